@@ -6,13 +6,14 @@ import (
 	_ "embed"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 
 	"github.com/BurntSushi/toml"
+	"github.com/rekby/lets-proxy2/internal/admin"
 	"github.com/rekby/lets-proxy2/internal/config"
+	"github.com/rekby/lets-proxy2/internal/dns01"
 	"github.com/rekby/lets-proxy2/internal/domain_checker"
 	"github.com/rekby/lets-proxy2/internal/log"
 	"github.com/rekby/lets-proxy2/internal/profiler"
@@ -20,6 +21,7 @@ import (
 	"github.com/rekby/lets-proxy2/internal/tlslistener"
 	zc "github.com/rekby/zapcontext"
 	"go.uber.org/zap"
+	"golang.org/x/xerrors"
 )
 
 //go:embed static/default-config.toml
@@ -30,14 +32,17 @@ type configType struct {
 	Log          logConfig
 	Proxy        proxy.Config
 	CheckDomains domain_checker.Config
+	DNSChallenge dns01.Config
 	Listen       tlslistener.Config
 
 	Profiler profiler.Config
 	Metrics  config.Config
+	Admin    admin.Config
 }
 
 type configGeneral struct {
 	IssueTimeout            int
+	ShutdownTimeout         int
 	StorageDir              string
 	Subdomains              []string
 	AcmeServer              string
@@ -48,6 +53,8 @@ type configGeneral struct {
 	AllowECDSACert          bool
 	AllowInsecureTLSChipers bool
 	MinTLSVersion           string
+	ChallengeTypes          []string
+	WildcardDomains         []string
 }
 
 //nolint:maligned
@@ -72,23 +79,37 @@ var (
 
 func getConfig(ctx context.Context) *configType {
 	if _config == nil {
-		logger := zc.LNop(ctx).With(zap.String("config_file", *configFileP))
-		logger.Info("Read config")
-		_config = &configType{}
-		mergeConfigBytes(ctx, _config, defaultConfig(ctx), "default")
-		mergeConfigByTemplate(ctx, _config, *configFileP)
-		applyMoveConfigDetails(_config)
-		applyFlags(ctx, _config)
-		logger.Info("Parse configs finished", zap.Int("readed_files", parsedConfigFiles),
-			zap.Int("max_read_files", _config.General.MaxConfigFilesRead))
-
-		if *debugLog {
-			_config.Log.LogLevel = "debug"
-		}
+		var err error
+		_config, err = readConfig(ctx)
+		log.InfoFatal(zc.L(ctx), err, "Read config")
 	}
 	return _config
 }
 
+// readConfig read and parse config files from scratch. It used for first start and for reload config.
+func readConfig(ctx context.Context) (*configType, error) {
+	logger := zc.LNop(ctx).With(zap.String("config_file", *configFileP))
+	logger.Info("Read config")
+
+	parsedConfigFiles = 0
+	cfg := &configType{}
+	if err := mergeConfigBytes(ctx, cfg, defaultConfig(ctx), "default"); err != nil {
+		return nil, err
+	}
+	if err := mergeConfigByTemplate(ctx, cfg, *configFileP); err != nil {
+		return nil, err
+	}
+	applyMoveConfigDetails(cfg)
+	applyFlags(ctx, cfg)
+	logger.Info("Parse configs finished", zap.Int("readed_files", parsedConfigFiles),
+		zap.Int("max_read_files", cfg.General.MaxConfigFilesRead))
+
+	if *debugLog {
+		cfg.Log.LogLevel = "debug"
+	}
+	return cfg, nil
+}
+
 // Apply command line flags to config
 func applyFlags(ctx context.Context, config *configType) {
 	if *testAcmeServerP {
@@ -111,25 +132,31 @@ func defaultConfig(ctx context.Context) []byte {
 	return configBytes
 }
 
-func mergeConfigByTemplate(ctx context.Context, c *configType, filepathTemplate string) {
+func mergeConfigByTemplate(ctx context.Context, c *configType, filepathTemplate string) error {
 	logger := zc.LNop(ctx).With(zap.String("config_file", filepathTemplate))
 	if !hasMeta(filepathTemplate) {
-		mergeConfigByFilepath(ctx, c, filepathTemplate)
-		return
+		return mergeConfigByFilepath(ctx, c, filepathTemplate)
 	}
 
 	filenames, err := filepath.Glob(filepathTemplate)
-	log.DebugFatal(logger, err, "Expand config file template",
+	log.DebugError(logger, err, "Expand config file template",
 		zap.String("filepathTemplate", filepathTemplate), zap.Strings("files", filenames))
+	if err != nil {
+		return xerrors.Errorf("expand config file template %q: %w", filepathTemplate, err)
+	}
 	for _, filename := range filenames {
-		mergeConfigByFilepath(ctx, c, filename)
+		if err = mergeConfigByFilepath(ctx, c, filename); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func mergeConfigByFilepath(ctx context.Context, c *configType, filename string) {
+func mergeConfigByFilepath(ctx context.Context, c *configType, filename string) error {
 	logger := zc.LNop(ctx).With(zap.String("config_file", filename))
 	if parsedConfigFiles > c.General.MaxConfigFilesRead {
-		logger.Fatal("Exceed max config files read count", zap.Int("MaxConfigFilesRead", c.General.MaxConfigFilesRead))
+		logger.Error("Exceed max config files read count", zap.Int("MaxConfigFilesRead", c.General.MaxConfigFilesRead))
+		return xerrors.Errorf("exceed max config files read count: %v", c.General.MaxConfigFilesRead)
 	}
 	parsedConfigFiles++
 
@@ -137,27 +164,21 @@ func mergeConfigByFilepath(ctx context.Context, c *configType, filename string)
 	if !filepath.IsAbs(filename) {
 		var filepathNew string
 		filepathNew, err = filepath.Abs(filename)
-		log.DebugFatal(logger, err, "Convert filepath to absolute",
+		log.DebugError(logger, err, "Convert filepath to absolute",
 			zap.String("old", filename), zap.String("new", filepathNew))
+		if err != nil {
+			return xerrors.Errorf("convert config filepath %q to absolute: %w", filename, err)
+		}
 		filename = filepathNew
 	}
 
 	content, err := ioutil.ReadFile(filename)
-	log.DebugFatal(logger, err, "Read filename")
-
-	dir, err := os.Getwd()
-	log.DebugFatal(logger, err, "Current workdir", zap.String("dir", dir))
-	fileDir := filepath.Dir(filename)
-	if dir != fileDir {
-		err = os.Chdir(fileDir)
-		log.DebugFatal(logger, err, "Chdir to config filename directory")
-		defer func() {
-			err = os.Chdir(dir)
-			log.DebugFatal(logger, err, "Restore workdir to", zap.String("dir", dir))
-		}()
+	log.DebugError(logger, err, "Read filename")
+	if err != nil {
+		return xerrors.Errorf("read config file: %w", err)
 	}
 
-	mergeConfigBytes(ctx, c, content, filename)
+	return mergeConfigBytes(ctx, c, content, filename)
 }
 
 // hasMeta reports whether path contains any of the magic characters
@@ -171,7 +192,8 @@ func hasMeta(path string) bool {
 	return strings.ContainsAny(path, magicChars)
 }
 
-func mergeConfigBytes(ctx context.Context, c *configType, content []byte, file string) {
+// mergeConfigBytes parse content over c. Relative paths of included configs resolve from directory of file.
+func mergeConfigBytes(ctx context.Context, c *configType, content []byte, file string) error {
 	// for prevent loop by existed included
 	c.General.IncludeConfigs = nil
 
@@ -179,12 +201,21 @@ func mergeConfigBytes(ctx context.Context, c *configType, content []byte, file s
 	if err == nil && len(meta.Undecoded()) > 0 {
 		err = fmt.Errorf("unknown fields: %v", meta.Undecoded())
 	}
-	log.InfoFatal(zc.L(ctx), err, "Parse config file", zap.String("config_file", file))
+	log.InfoError(zc.L(ctx), err, "Parse config file", zap.String("config_file", file))
+	if err != nil {
+		return xerrors.Errorf("parse config file %q: %w", file, err)
+	}
 
 	if len(c.General.IncludeConfigs) > 0 {
 		includeConfigs := c.General.IncludeConfigs // need save because it will reset while merging
-		for _, file := range includeConfigs {
-			mergeConfigByTemplate(ctx, c, file)
+		for _, includeFile := range includeConfigs {
+			if !filepath.IsAbs(includeFile) && filepath.IsAbs(file) {
+				includeFile = filepath.Join(filepath.Dir(file), includeFile)
+			}
+			if err = mergeConfigByTemplate(ctx, c, includeFile); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
@@ -8,8 +8,11 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/xerrors"
@@ -29,10 +32,13 @@ import (
 
 	_ "github.com/kardianos/minwinsvc"
 	"github.com/rekby/lets-proxy2/internal/acme_client_manager"
+	"github.com/rekby/lets-proxy2/internal/admin"
 	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain_checker"
 	"github.com/rekby/lets-proxy2/internal/log"
 	"github.com/rekby/lets-proxy2/internal/proxy"
 	"github.com/rekby/lets-proxy2/internal/tlslistener"
+	"github.com/rekby/lets-proxy2/internal/upgrade"
 	zc "github.com/rekby/zapcontext"
 	"go.uber.org/zap"
 )
@@ -41,6 +47,9 @@ var VERSION = "custom" // need be var because it redefine by --ldflags "-X main.
 
 const defaultDirMode = 0700
 
+// maintenanceFlagDir - dir in storage dir with maintenance flag files, file name is host in maintenance mode.
+const maintenanceFlagDir = "maintenance"
+
 func main() {
 	flag.Parse()
 
@@ -135,14 +144,25 @@ func startProgram(config *configType) {
 	certManager.AllowRSACert = config.General.AllowRSACert
 	certManager.AllowInsecureTLSChipers = config.General.AllowInsecureTLSChipers
 
+	certManager.DNSProvider, err = config.DNSChallenge.CreateProvider(ctx)
+	log.InfoFatal(logger, err, "Create dns-01 provider")
+
+	err = certManager.SetChallengeTypes(config.General.ChallengeTypes)
+	log.InfoFatal(logger, err, "Set challenge types", zap.Strings("challenge_types", config.General.ChallengeTypes))
+
+	err = certManager.SetWildcardDomains(config.General.WildcardDomains)
+	log.InfoFatal(logger, err, "Set wildcard domains", zap.Strings("wildcard_domains", config.General.WildcardDomains))
+
 	for _, subdomain := range config.General.Subdomains {
 		subdomain = strings.TrimSpace(subdomain)
 		subdomain = strings.TrimSuffix(subdomain, ".") + "." // must ends with dot
 		certManager.AutoSubdomains = append(certManager.AutoSubdomains, subdomain)
 	}
 
-	certManager.DomainChecker, err = config.CheckDomains.CreateDomainChecker(ctx)
+	domainChecker, err := config.CheckDomains.CreateDomainChecker(ctx)
 	log.DebugFatal(logger, err, "Config domain checkers.")
+	reloadableDomainChecker := domain_checker.NewReloadable(domainChecker)
+	certManager.DomainChecker = reloadableDomainChecker
 
 	err = startMetrics(ctx, registry, config.Metrics, certManager.GetCertificate)
 	log.InfoFatalCtx(ctx, err, "start metrics")
@@ -158,15 +178,55 @@ func startProgram(config *configType) {
 	log.DebugFatal(logger, err, "StartAutoRenew tls listener")
 
 	config.Proxy.EnableAccessLog = config.Log.EnableAccessLog
+	config.Proxy.MetricsRegisterer = registry
 	p := proxy.NewHTTPProxy(ctx, tlsListener)
+	p.HandleHTTPValidation = certManager.HandleHTTPValidation
+	p.HandleMisdirectedRequest = tlsListener.HandleClientAuthMismatch
 	p.GetContext = func(req *http.Request) (i context.Context, e error) {
 		localAddr := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
 		return tlsListener.GetConnectionContext(req.RemoteAddr, localAddr.String())
 	}
+	for _, listener := range tlsListener.QUICListeners() {
+		p.HTTP3Listeners = append(p.HTTP3Listeners, listener)
+	}
+
+	maintenance := proxy.NewMaintenance(filepath.Join(config.General.StorageDir, maintenanceFlagDir))
+	maintenance.Start(ctx)
+	p.Maintenance = maintenance
 
-	err = config.Proxy.Apply(ctx, p)
+	proxyConfigCtx, cancelProxyConfig := context.WithCancel(ctx)
+	err = config.Proxy.Apply(proxyConfigCtx, p)
 	log.InfoFatal(logger, err, "Apply proxy config")
 
+	reloader := &configReloader{
+		ctx:               ctx,
+		config:            config,
+		registry:          registry,
+		proxy:             p,
+		domainChecker:     reloadableDomainChecker,
+		cancelProxyConfig: cancelProxyConfig,
+		readConfig:        readConfig,
+	}
+	startReloadBySignal(ctx, reloader)
+	startAdmin(ctx, config.Admin, reloader, maintenance)
+
+	shutdown := &gracefulShutdown{
+		timeout:       time.Duration(config.General.ShutdownTimeout) * time.Second,
+		listener:      tlsListener,
+		proxy:         p,
+		certManager:   certManager,
+		clientManager: clientManager,
+	}
+	startShutdownBySignal(ctx, shutdown)
+	startUpgradeBySignal(ctx, shutdown)
+
+	unusedListeners := upgrade.CloseUnusedInherited()
+	if len(unusedListeners) > 0 {
+		logger.Info("Close unused inherited listeners", zap.Strings("listeners", unusedListeners))
+	}
+	err = upgrade.Ready()
+	log.InfoError(logger, err, "Report ready to parent process")
+
 	go func() {
 		defer log.HandlePanic(logger)
 
@@ -181,6 +241,68 @@ func startProgram(config *configType) {
 		effectiveError = nil
 	}
 	log.DebugErrorCtx(ctx, effectiveError, "Handle request stopped")
+
+	if err == http.ErrServerClosed || shutdown.Started() {
+		// wait shutdown, started by signal
+		shutdown.Shutdown(ctx)
+	}
+}
+
+func startReloadBySignal(ctx context.Context, reloader *configReloader) {
+	logger := zc.L(ctx)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		defer log.HandlePanic(logger)
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				logger.Info("Receive SIGHUP")
+				_, err := reloader.Reload(ctx)
+				log.InfoError(logger, err, "Reload config by signal")
+			}
+		}
+	}()
+}
+
+func startAdmin(ctx context.Context, config admin.Config, reloader *configReloader, maintenance *proxy.Maintenance) {
+	logger := zc.L(ctx)
+
+	if !config.Enable {
+		logger.Info("Admin endpoint disabled")
+		return
+	}
+
+	adminHandler := admin.New(logger.Named("admin"), config)
+	adminHandler.HandleReload(func(reqCtx context.Context) ([]string, error) {
+		return reloader.Reload(zc.WithLogger(reqCtx, logger.Named("admin_reload")))
+	})
+	adminHandler.HandleMaintenance(maintenance)
+
+	go func() {
+		defer log.HandlePanic(logger)
+
+		httpServer := http.Server{
+			Addr:    config.BindAddress,
+			Handler: adminHandler,
+		}
+
+		logger.Info("Start admin endpoint", zap.String("bind_address", httpServer.Addr))
+		err := listenAndServe(&httpServer)
+		var logLevel zapcore.Level
+		if err == http.ErrServerClosed {
+			logLevel = zapcore.InfoLevel
+		} else {
+			logLevel = zapcore.ErrorLevel
+		}
+		log.LevelParam(logger, logLevel, "Admin endpoint stopped", zap.Error(err))
+	}()
 }
 
 func startProfiler(ctx context.Context, config profiler.Config) {
@@ -200,7 +322,7 @@ func startProfiler(ctx context.Context, config profiler.Config) {
 		}
 
 		logger.Info("Start profiler", zap.String("bind_address", httpServer.Addr))
-		err := httpServer.ListenAndServe()
+		err := listenAndServe(&httpServer)
 		var logLevel zapcore.Level
 		if err == http.ErrServerClosed {
 			logLevel = zapcore.InfoLevel
@@ -210,3 +332,12 @@ func startProfiler(ctx context.Context, config profiler.Config) {
 		log.LevelParam(logger, logLevel, "Profiler stopped")
 	}()
 }
+
+// listenAndServe same as http.Server.ListenAndServe, but listener can be inherited from previous process on upgrade.
+func listenAndServe(server *http.Server) error {
+	listener, err := upgrade.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	return server.Serve(listener)
+}
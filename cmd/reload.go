@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/domain_checker"
+	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/proxy"
+)
+
+// configReloader re-read config and apply settings, which can change without restart:
+// proxy rules (directors, rate limiter, upstreams) and domain checkers.
+type configReloader struct {
+	mu sync.Mutex
+
+	// ctx is program context, it is parent for proxy config context.
+	ctx context.Context
+
+	// config is config from program start, it need for detect changes, which need restart.
+	config   *configType
+	registry prometheus.Registerer
+
+	proxy             *proxy.HTTPProxy
+	domainChecker     *domain_checker.Reloadable
+	cancelProxyConfig context.CancelFunc
+
+	// readConfig is readConfig function, can be replaced for tests
+	readConfig func(ctx context.Context) (*configType, error)
+}
+
+// Reload config. Old settings keep on any error.
+// Return list of changed settings, which need restart for apply.
+func (r *configReloader) Reload(ctx context.Context) (restartRequired []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	logger := zc.L(ctx)
+	logger.Info("Reload config")
+
+	newConfig, err := r.readConfig(ctx)
+	log.InfoError(logger, err, "Read config for reload")
+	if err != nil {
+		return nil, xerrors.Errorf("read config: %w", err)
+	}
+	newConfig.Proxy.EnableAccessLog = newConfig.Log.EnableAccessLog
+	newConfig.Proxy.MetricsRegisterer = r.registry
+	newConfig.Proxy.PreviousUpstreams = r.proxy.Upstreams()
+
+	domainChecker, err := newConfig.CheckDomains.CreateDomainChecker(ctx)
+	log.InfoError(logger, err, "Create domain checker for reload")
+	if err != nil {
+		return nil, xerrors.Errorf("create domain checker: %w", err)
+	}
+
+	proxyCtx, cancelProxyConfig := context.WithCancel(r.ctx)
+	var newProxy proxy.HTTPProxy
+	err = newConfig.Proxy.Apply(proxyCtx, &newProxy)
+	log.InfoError(logger, err, "Apply proxy config for reload")
+	if err != nil {
+		cancelProxyConfig()
+		return nil, xerrors.Errorf("apply proxy config: %w", err)
+	}
+
+	r.proxy.Update(&newProxy)
+	r.domainChecker.Set(domainChecker)
+	if r.cancelProxyConfig != nil {
+		r.cancelProxyConfig()
+	}
+	r.cancelProxyConfig = cancelProxyConfig
+
+	restartRequired = restartRequiredSettings(r.config, newConfig)
+	if len(restartRequired) > 0 {
+		logger.Warn("Some changed settings need restart for apply", zap.Strings("settings", restartRequired))
+	}
+	logger.Info("Config reloaded")
+	return restartRequired, nil
+}
+
+// restartRequiredSettings return names of changed settings, which can't apply without restart.
+func restartRequiredSettings(oldConfig, newConfig *configType) []string {
+	var res []string
+	check := func(name string, oldValue, newValue interface{}) {
+		if !reflect.DeepEqual(oldValue, newValue) {
+			res = append(res, name)
+		}
+	}
+
+	check("General", oldConfig.General, newConfig.General)
+	check("Log", oldConfig.Log, newConfig.Log)
+	check("DNSChallenge", oldConfig.DNSChallenge, newConfig.DNSChallenge)
+	check("Listen", oldConfig.Listen, newConfig.Listen)
+	check("Profiler", oldConfig.Profiler, newConfig.Profiler)
+	check("Metrics", oldConfig.Metrics, newConfig.Metrics)
+	check("Admin", oldConfig.Admin, newConfig.Admin)
+	check("Proxy.KeepAliveTimeoutSeconds", oldConfig.Proxy.KeepAliveTimeoutSeconds, newConfig.Proxy.KeepAliveTimeoutSeconds)
+	return res
+}
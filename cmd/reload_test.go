@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/domain_checker"
+	"github.com/rekby/lets-proxy2/internal/proxy"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestConfigReloader_Reload(t *testing.T) {
+	_, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+
+	newBackend := func(answer string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(answer))
+		}))
+		t.Cleanup(server.Close)
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+	backend1 := newBackend("backend1")
+	backend2 := newBackend("backend2")
+
+	newConfig := func(target string) *configType {
+		config, err := readConfig(ctx)
+		td.CmpNoError(err)
+		config.Proxy.DefaultTarget = target
+		config.CheckDomains.IPSelf = false
+		return config
+	}
+
+	startConfig := newConfig(backend1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	p := proxy.NewHTTPProxy(ctx, listener)
+	td.CmpNoError(startConfig.Proxy.Apply(ctx, p))
+	go func() { _ = p.Start() }()
+	defer func() { _ = p.Close() }()
+
+	get := func() string {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		td.CmpNoError(err)
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return string(body)
+	}
+
+	checker := domain_checker.NewReloadable(domain_checker.False{})
+
+	var nextConfig *configType
+	var nextErr error
+	reloader := &configReloader{
+		ctx:           ctx,
+		config:        startConfig,
+		proxy:         p,
+		domainChecker: checker,
+		readConfig: func(ctx context.Context) (*configType, error) {
+			return nextConfig, nextErr
+		},
+	}
+
+	td.Cmp(get(), "backend1")
+
+	// read error
+	nextErr = errors.New("test")
+	_, err = reloader.Reload(ctx)
+	td.CmpError(err)
+
+	// bad proxy config
+	nextErr = nil
+	nextConfig = newConfig("")
+	_, err = reloader.Reload(ctx)
+	td.CmpError(err)
+	td.Cmp(get(), "backend1")
+
+	allowed, err := checker.IsDomainAllowed(ctx, "example.com")
+	td.CmpNoError(err)
+	td.False(allowed, "checker must not changed after failed reload")
+
+	// ok
+	nextConfig = newConfig(backend2)
+	nextConfig.Listen.TCPAddresses = []string{"[::]:1"}
+	restartRequired, err := reloader.Reload(ctx)
+	td.CmpNoError(err)
+	td.Cmp(restartRequired, []string{"Listen"})
+	td.Cmp(get(), "backend2")
+
+	allowed, err = checker.IsDomainAllowed(ctx, "example.com")
+	td.CmpNoError(err)
+	td.True(allowed)
+}
+
+func TestRestartRequiredSettings(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	oldConfig := &configType{}
+	newConfig := &configType{}
+	td.Nil(restartRequiredSettings(oldConfig, newConfig))
+
+	newConfig.Proxy.DefaultTarget = "1.2.3.4"
+	newConfig.CheckDomains.WhiteList = "asd"
+	td.Nil(restartRequiredSettings(oldConfig, newConfig))
+
+	newConfig.General.StorageDir = "asd"
+	newConfig.Proxy.KeepAliveTimeoutSeconds = 1
+	td.Cmp(restartRequiredSettings(oldConfig, newConfig), []string{"General", "Proxy.KeepAliveTimeoutSeconds"})
+}
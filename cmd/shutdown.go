@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+type shutdownProxy interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+type shutdownCertManager interface {
+	Close(ctx context.Context) error
+}
+
+type shutdownCloser interface {
+	Close() error
+}
+
+// gracefulShutdown stop program components in order: finish or cancel in-progress certificate issues,
+// stop accept new connections, drain active requests, close acme client manager.
+// Listeners accept connections while certificates issue, because acme server validate domains through them.
+type gracefulShutdown struct {
+	// timeout for in-progress certificate issues and separate same timeout for drain active requests
+	timeout time.Duration
+
+	listener      shutdownCloser
+	proxy         shutdownProxy
+	certManager   shutdownCertManager
+	clientManager shutdownCloser
+
+	once    sync.Once
+	started int32
+}
+
+// Shutdown run once, next calls wait until first call finished.
+func (s *gracefulShutdown) Shutdown(ctx context.Context) {
+	atomic.StoreInt32(&s.started, 1)
+	s.once.Do(func() {
+		s.shutdown(ctx)
+	})
+}
+
+func (s *gracefulShutdown) shutdown(ctx context.Context) {
+	logger := zc.L(ctx)
+	logger.Info("Start graceful shutdown", zap.Duration("timeout", s.timeout))
+
+	issueCtx, issueCancel := context.WithTimeout(ctx, s.timeout)
+	err := s.certManager.Close(issueCtx)
+	issueCancel()
+	log.InfoError(logger, err, "Wait in-progress certificate issues")
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, s.timeout)
+	defer drainCancel()
+
+	// Proxy must start shutdown before its listener closed, else it stop handle requests with error without drain.
+	// Proxy close own listener itself, other listeners closed after it.
+	err = s.proxy.Shutdown(drainCtx)
+	log.InfoError(logger, err, "Drain active requests")
+	if err != nil {
+		err = s.proxy.Close()
+		log.DebugError(logger, err, "Close proxy connections")
+	}
+
+	err = s.listener.Close()
+	log.DebugError(logger, err, "Stop accept connections")
+
+	err = s.clientManager.Close()
+	log.DebugError(logger, err, "Close acme client manager")
+
+	logger.Info("Graceful shutdown finished")
+}
+
+// Started return true if Shutdown was called.
+func (s *gracefulShutdown) Started() bool {
+	return atomic.LoadInt32(&s.started) == 1
+}
+
+// startShutdownBySignal run graceful shutdown on SIGTERM or SIGINT.
+func startShutdownBySignal(ctx context.Context, s *gracefulShutdown) {
+	logger := zc.L(ctx)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		defer log.HandlePanic(logger)
+		defer signal.Stop(signals)
+
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			logger.Info("Receive signal", zap.Stringer("signal", sig))
+		}
+		s.Shutdown(ctx)
+	}()
+}
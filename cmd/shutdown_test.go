@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/proxy"
+	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/tlslistener"
+)
+
+type shutdownTestStep struct {
+	mu    *sync.Mutex
+	steps *[]string
+	name  string
+	err   error
+}
+
+func (s shutdownTestStep) add(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*s.steps = append(*s.steps, name)
+}
+
+func (s shutdownTestStep) Close() error {
+	s.add(s.name)
+	return s.err
+}
+
+type shutdownTestCertManager struct {
+	shutdownTestStep
+}
+
+func (s shutdownTestCertManager) Close(ctx context.Context) error {
+	s.add(s.name)
+	return ctx.Err()
+}
+
+func TestGracefulShutdown_Shutdown(t *testing.T) {
+	_, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+
+	requestStarted := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requestStarted)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	p := proxy.NewHTTPProxy(ctx, listener)
+	p.Director = proxy.NewDirectorChain(
+		proxy.NewDirectorHost(strings.TrimPrefix(backend.URL, "http://")),
+		proxy.NewSetSchemeDirector(proxy.ProtocolHTTP),
+	)
+	proxyStopped := make(chan error, 1)
+	go func() { proxyStopped <- p.Start() }()
+
+	var mu sync.Mutex
+	var steps []string
+	step := func(name string) shutdownTestStep {
+		return shutdownTestStep{mu: &mu, steps: &steps, name: name}
+	}
+
+	type response struct {
+		body string
+		err  error
+	}
+	responseCh := make(chan response, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			responseCh <- response{err: err}
+			return
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		responseCh <- response{body: string(body), err: err}
+	}()
+	<-requestStarted
+
+	s := &gracefulShutdown{
+		timeout:       time.Minute,
+		listener:      step("listener"),
+		proxy:         p,
+		certManager:   shutdownTestCertManager{step("cert_manager")},
+		clientManager: step("client_manager"),
+	}
+	s.Shutdown(ctx)
+
+	td.Cmp(<-proxyStopped, http.ErrServerClosed)
+
+	resp := <-responseCh
+	td.CmpNoError(resp.err)
+	td.Cmp(resp.body, "ok", "active request must finish")
+	td.Cmp(steps, []string{"cert_manager", "listener", "client_manager"})
+}
+
+type shutdownTestWaitCertManager struct {
+	shutdownTestStep
+}
+
+func (s shutdownTestWaitCertManager) Close(ctx context.Context) error {
+	<-ctx.Done()
+	s.add(s.name)
+	return ctx.Err()
+}
+
+type shutdownTestProxy struct {
+	shutdownTestStep
+}
+
+func (p shutdownTestProxy) Shutdown(ctx context.Context) error {
+	p.add(p.name)
+	return ctx.Err()
+}
+
+func TestGracefulShutdown_IssueTimeout(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	var mu sync.Mutex
+	var steps []string
+	step := func(name string) shutdownTestStep {
+		return shutdownTestStep{mu: &mu, steps: &steps, name: name}
+	}
+
+	s := &gracefulShutdown{
+		timeout:       10 * time.Millisecond,
+		listener:      step("listener"),
+		proxy:         shutdownTestProxy{step("proxy_shutdown")},
+		certManager:   shutdownTestWaitCertManager{step("cert_manager")},
+		clientManager: step("client_manager"),
+	}
+	s.Shutdown(ctx)
+
+	// proxy.Close called only if drain failed, expired issue timeout must not break drain.
+	td.Cmp(steps, []string{"cert_manager", "proxy_shutdown", "listener", "client_manager"})
+}
+
+// shutdownTestSlowCloser give time to proxy for handle closed listener before next shutdown step.
+type shutdownTestSlowCloser struct {
+	shutdownCloser
+}
+
+func (c shutdownTestSlowCloser) Close() error {
+	err := c.shutdownCloser.Close()
+	time.Sleep(50 * time.Millisecond)
+	return err
+}
+
+// TestGracefulShutdown_ListenersHandler check drain with listener and proxy as in program.
+func TestGracefulShutdown_ListenersHandler(t *testing.T) {
+	_, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+	td.FailureIsFatal()
+
+	requestStarted := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requestStarted)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	listener := &tlslistener.ListenersHandler{Listeners: []net.Listener{tcpListener}}
+	td.CmpNoError(listener.Start(ctx, nil))
+
+	p := proxy.NewHTTPProxy(ctx, listener)
+	p.GetContext = func(req *http.Request) (context.Context, error) {
+		localAddr := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		return listener.GetConnectionContext(req.RemoteAddr, localAddr.String())
+	}
+	p.Director = proxy.NewDirectorChain(
+		proxy.NewDirectorHost(strings.TrimPrefix(backend.URL, "http://")),
+		proxy.NewSetSchemeDirector(proxy.ProtocolHTTP),
+	)
+	proxyStopped := make(chan error, 1)
+	go func() { proxyStopped <- p.Start() }()
+
+	responseCh := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + tcpListener.Addr().String())
+		if err != nil {
+			responseCh <- err.Error()
+			return
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			responseCh <- err.Error()
+			return
+		}
+		responseCh <- string(body)
+	}()
+	<-requestStarted
+
+	var mu sync.Mutex
+	var steps []string
+	s := &gracefulShutdown{
+		timeout:       time.Minute,
+		listener:      shutdownTestSlowCloser{listener},
+		proxy:         p,
+		certManager:   shutdownTestCertManager{shutdownTestStep{mu: &mu, steps: &steps, name: "cert_manager"}},
+		clientManager: shutdownTestStep{mu: &mu, steps: &steps, name: "client_manager"},
+	}
+	go s.Shutdown(ctx)
+
+	td.Cmp(<-proxyStopped, http.ErrServerClosed, "proxy stopped by shutdown, not by closed listener")
+	td.True(s.Started())
+	td.Cmp(<-responseCh, "ok", "active request must finish")
+	s.Shutdown(ctx)
+	td.Cmp(steps, []string{"cert_manager", "client_manager"})
+}
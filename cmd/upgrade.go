@@ -0,0 +1,55 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/upgrade"
+)
+
+// upgradeReadyTimeout is time for new process start serve, include get acme account.
+const upgradeReadyTimeout = time.Minute
+
+// startUpgradeBySignal start new binary on SIGUSR2 with inherited listeners.
+// Graceful shutdown current process after new process ready.
+func startUpgradeBySignal(ctx context.Context, s *gracefulShutdown) {
+	logger := zc.L(ctx)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	go func() {
+		defer log.HandlePanic(logger)
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				logger.Info("Receive SIGUSR2, start upgrade")
+			}
+
+			startCtx, cancel := context.WithTimeout(ctx, upgradeReadyTimeout)
+			process, err := upgrade.StartProcess(startCtx)
+			cancel()
+			log.InfoError(logger, err, "Start new process for upgrade")
+			if err != nil {
+				continue
+			}
+
+			logger.Info("New process ready, stop old process", zap.Int("new_pid", process.Pid))
+			s.Shutdown(ctx)
+			return
+		}
+	}()
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"context"
+
+	zc "github.com/rekby/zapcontext"
+)
+
+// startUpgradeBySignal do nothing: windows doesn't support listeners inheritance.
+func startUpgradeBySignal(ctx context.Context, _ *gracefulShutdown) {
+	zc.L(ctx).Debug("Upgrade by signal doesn't support on windows")
+}
@@ -0,0 +1,123 @@
+// Package admin contains local http endpoint for manage running lets-proxy.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/secrethandler"
+)
+
+type Config struct {
+	secrethandler.Config
+
+	Enable      bool
+	BindAddress string
+}
+
+// ReloadFunc reload config and return list of changed settings, which need restart for apply.
+type ReloadFunc func(ctx context.Context) (restartRequired []string, err error)
+
+// Maintenance switch maintenance mode of hosts.
+type Maintenance interface {
+	Set(host string, enable bool)
+	Hosts() []string
+}
+
+type Admin struct {
+	logger        *zap.Logger
+	mux           *http.ServeMux
+	secretHandler secrethandler.SecretHandler
+}
+
+func New(logger *zap.Logger, config Config) *Admin {
+	mux := http.NewServeMux()
+	config.Config.AllowPost = true // state changed by POST requests
+	return &Admin{
+		logger:        logger,
+		mux:           mux,
+		secretHandler: secrethandler.New(logger, config.Config, mux),
+	}
+}
+
+// Handle register handler for pattern. Access to all handlers checked by secret handler.
+func (a *Admin) Handle(pattern string, handler http.Handler) {
+	a.mux.Handle(pattern, handler)
+}
+
+// HandleReload register /reload endpoint
+func (a *Admin) HandleReload(reload ReloadFunc) {
+	a.Handle("/reload", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		restartRequired, err := reload(r.Context())
+
+		type result struct {
+			OK              bool     `json:"ok"`
+			Error           string   `json:"error,omitempty"`
+			RestartRequired []string `json:"restart_required"`
+		}
+
+		res := result{OK: err == nil, RestartRequired: restartRequired}
+		if res.RestartRequired == nil {
+			res.RestartRequired = []string{}
+		}
+		status := http.StatusOK
+		if err != nil {
+			res.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if encodeErr := json.NewEncoder(w).Encode(res); encodeErr != nil {
+			a.logger.Debug("Write reload result", zap.Error(encodeErr))
+		}
+	}))
+}
+
+// HandleMaintenance register /maintenance endpoint.
+// Without params it return hosts in maintenance mode, POST with host and enable=true|false params switch the host.
+// Other methods can't switch mode: link or prefetch must not take host offline.
+func (a *Admin) HandleMaintenance(maintenance Maintenance) {
+	a.Handle("/maintenance", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type result struct {
+			OK    bool     `json:"ok"`
+			Error string   `json:"error,omitempty"`
+			Hosts []string `json:"hosts"`
+		}
+
+		res := result{OK: true}
+		status := http.StatusOK
+		if host := r.FormValue("host"); host != "" {
+			enable, err := strconv.ParseBool(r.FormValue("enable"))
+			switch {
+			case r.Method != http.MethodPost:
+				res.OK = false
+				res.Error = "maintenance mode switch require POST method"
+				status = http.StatusMethodNotAllowed
+				w.Header().Set("Allow", http.MethodPost)
+			case err == nil:
+				a.logger.Info("Switch maintenance mode", zap.String("host", host), zap.Bool("enable", enable))
+				maintenance.Set(host, enable)
+			default:
+				res.OK = false
+				res.Error = "enable must be true or false"
+				status = http.StatusBadRequest
+			}
+		}
+		res.Hosts = maintenance.Hosts()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if encodeErr := json.NewEncoder(w).Encode(res); encodeErr != nil {
+			a.logger.Debug("Write maintenance result", zap.Error(encodeErr))
+		}
+	}))
+}
+
+func (a *Admin) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	a.secretHandler.ServeHTTP(resp, req)
+}
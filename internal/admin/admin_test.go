@@ -0,0 +1,120 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/secrethandler"
+)
+
+func TestAdmin_HandleReload(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	var reloadErr error
+	var restartRequired []string
+	admin := New(zap.NewNop(), Config{Config: secrethandler.Config{Password: "pass"}})
+	admin.HandleReload(func(ctx context.Context) ([]string, error) {
+		return restartRequired, reloadErr
+	})
+
+	request := func(url string) (int, string) {
+		respWriter := httptest.NewRecorder()
+		admin.ServeHTTP(respWriter, httptest.NewRequest(http.MethodGet, url, nil))
+		resp := respWriter.Result()
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+
+	status, _ := request("http://test/reload")
+	td.Cmp(status, http.StatusForbidden)
+
+	status, body := request("http://test/reload?password=pass")
+	td.Cmp(status, http.StatusOK)
+	td.Cmp(body, `{"ok":true,"restart_required":[]}`+"\n")
+
+	restartRequired = []string{"Listen"}
+	status, body = request("http://test/reload?password=pass")
+	td.Cmp(status, http.StatusOK)
+	td.Cmp(body, `{"ok":true,"restart_required":["Listen"]}`+"\n")
+
+	reloadErr = errors.New("test")
+	restartRequired = nil
+	status, body = request("http://test/reload?password=pass")
+	td.Cmp(status, http.StatusInternalServerError)
+	td.Cmp(body, `{"ok":false,"error":"test","restart_required":[]}`+"\n")
+}
+
+type testMaintenance map[string]bool
+
+func (m testMaintenance) Set(host string, enable bool) {
+	if enable {
+		m[host] = true
+	} else {
+		delete(m, host)
+	}
+}
+
+func (m testMaintenance) Hosts() []string {
+	res := make([]string, 0, len(m))
+	for host := range m {
+		res = append(res, host)
+	}
+	return res
+}
+
+func TestAdmin_HandleMaintenance(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	maintenance := testMaintenance{}
+	admin := New(zap.NewNop(), Config{Config: secrethandler.Config{Password: "pass"}})
+	admin.HandleMaintenance(maintenance)
+
+	requestMethod := func(method, url string) (int, string) {
+		respWriter := httptest.NewRecorder()
+		admin.ServeHTTP(respWriter, httptest.NewRequest(method, url, nil))
+		resp := respWriter.Result()
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+	request := func(url string) (int, string) {
+		return requestMethod(http.MethodPost, url)
+	}
+
+	status, _ := request("http://test/maintenance?host=example.com&enable=true")
+	td.Cmp(status, http.StatusForbidden)
+	td.Empty(maintenance)
+
+	status, body := requestMethod(http.MethodGet, "http://test/maintenance?password=pass")
+	td.Cmp(status, http.StatusOK)
+	td.Cmp(body, `{"ok":true,"hosts":[]}`+"\n")
+
+	status, body = requestMethod(http.MethodGet, "http://test/maintenance?password=pass&host=example.com&enable=true")
+	td.Cmp(status, http.StatusMethodNotAllowed)
+	td.Cmp(body, `{"ok":false,"error":"maintenance mode switch require POST method","hosts":[]}`+"\n")
+	td.Empty(maintenance)
+
+	status, body = request("http://test/maintenance?password=pass&host=example.com&enable=true")
+	td.Cmp(status, http.StatusOK)
+	td.Cmp(body, `{"ok":true,"hosts":["example.com"]}`+"\n")
+
+	status, body = requestMethod(http.MethodGet, "http://test/maintenance?password=pass")
+	td.Cmp(status, http.StatusOK)
+	td.Cmp(body, `{"ok":true,"hosts":["example.com"]}`+"\n")
+
+	status, body = request("http://test/maintenance?password=pass&host=example.com&enable=asd")
+	td.Cmp(status, http.StatusBadRequest)
+	td.Cmp(body, `{"ok":false,"error":"enable must be true or false","hosts":["example.com"]}`+"\n")
+
+	status, body = request("http://test/maintenance?password=pass&host=example.com&enable=false")
+	td.Cmp(status, http.StatusOK)
+	td.Cmp(body, `{"ok":true,"hosts":[]}`+"\n")
+}
@@ -37,6 +37,12 @@ type AcmeClientMock struct {
 	beforeCreateOrderCertCounter uint64
 	CreateOrderCertMock          mAcmeClientMockCreateOrderCert
 
+	funcDNS01ChallengeRecord          func(token string) (s1 string, err error)
+	inspectFuncDNS01ChallengeRecord   func(token string)
+	afterDNS01ChallengeRecordCounter  uint64
+	beforeDNS01ChallengeRecordCounter uint64
+	DNS01ChallengeRecordMock          mAcmeClientMockDNS01ChallengeRecord
+
 	funcGetAuthorization          func(ctx context.Context, url string) (ap1 *acme.Authorization, err error)
 	inspectFuncGetAuthorization   func(ctx context.Context, url string)
 	afterGetAuthorizationCounter  uint64
@@ -90,6 +96,9 @@ func NewAcmeClientMock(t minimock.Tester) *AcmeClientMock {
 	m.CreateOrderCertMock = mAcmeClientMockCreateOrderCert{mock: m}
 	m.CreateOrderCertMock.callArgs = []*AcmeClientMockCreateOrderCertParams{}
 
+	m.DNS01ChallengeRecordMock = mAcmeClientMockDNS01ChallengeRecord{mock: m}
+	m.DNS01ChallengeRecordMock.callArgs = []*AcmeClientMockDNS01ChallengeRecordParams{}
+
 	m.GetAuthorizationMock = mAcmeClientMockGetAuthorization{mock: m}
 	m.GetAuthorizationMock.callArgs = []*AcmeClientMockGetAuthorizationParams{}
 
@@ -766,6 +775,222 @@ func (m *AcmeClientMock) MinimockCreateOrderCertInspect() {
 	}
 }
 
+type mAcmeClientMockDNS01ChallengeRecord struct {
+	mock               *AcmeClientMock
+	defaultExpectation *AcmeClientMockDNS01ChallengeRecordExpectation
+	expectations       []*AcmeClientMockDNS01ChallengeRecordExpectation
+
+	callArgs []*AcmeClientMockDNS01ChallengeRecordParams
+	mutex    sync.RWMutex
+}
+
+// AcmeClientMockDNS01ChallengeRecordExpectation specifies expectation struct of the AcmeClient.DNS01ChallengeRecord
+type AcmeClientMockDNS01ChallengeRecordExpectation struct {
+	mock    *AcmeClientMock
+	params  *AcmeClientMockDNS01ChallengeRecordParams
+	results *AcmeClientMockDNS01ChallengeRecordResults
+	Counter uint64
+}
+
+// AcmeClientMockDNS01ChallengeRecordParams contains parameters of the AcmeClient.DNS01ChallengeRecord
+type AcmeClientMockDNS01ChallengeRecordParams struct {
+	token string
+}
+
+// AcmeClientMockDNS01ChallengeRecordResults contains results of the AcmeClient.DNS01ChallengeRecord
+type AcmeClientMockDNS01ChallengeRecordResults struct {
+	s1  string
+	err error
+}
+
+// Expect sets up expected params for AcmeClient.DNS01ChallengeRecord
+func (mmDNS01ChallengeRecord *mAcmeClientMockDNS01ChallengeRecord) Expect(token string) *mAcmeClientMockDNS01ChallengeRecord {
+	if mmDNS01ChallengeRecord.mock.funcDNS01ChallengeRecord != nil {
+		mmDNS01ChallengeRecord.mock.t.Fatalf("AcmeClientMock.DNS01ChallengeRecord mock is already set by Set")
+	}
+
+	if mmDNS01ChallengeRecord.defaultExpectation == nil {
+		mmDNS01ChallengeRecord.defaultExpectation = &AcmeClientMockDNS01ChallengeRecordExpectation{}
+	}
+
+	mmDNS01ChallengeRecord.defaultExpectation.params = &AcmeClientMockDNS01ChallengeRecordParams{token}
+	for _, e := range mmDNS01ChallengeRecord.expectations {
+		if minimock.Equal(e.params, mmDNS01ChallengeRecord.defaultExpectation.params) {
+			mmDNS01ChallengeRecord.mock.t.Fatalf("Expectation set by When has same params: %#v", *mmDNS01ChallengeRecord.defaultExpectation.params)
+		}
+	}
+
+	return mmDNS01ChallengeRecord
+}
+
+// Inspect accepts an inspector function that has same arguments as the AcmeClient.DNS01ChallengeRecord
+func (mmDNS01ChallengeRecord *mAcmeClientMockDNS01ChallengeRecord) Inspect(f func(token string)) *mAcmeClientMockDNS01ChallengeRecord {
+	if mmDNS01ChallengeRecord.mock.inspectFuncDNS01ChallengeRecord != nil {
+		mmDNS01ChallengeRecord.mock.t.Fatalf("Inspect function is already set for AcmeClientMock.DNS01ChallengeRecord")
+	}
+
+	mmDNS01ChallengeRecord.mock.inspectFuncDNS01ChallengeRecord = f
+
+	return mmDNS01ChallengeRecord
+}
+
+// Return sets up results that will be returned by AcmeClient.DNS01ChallengeRecord
+func (mmDNS01ChallengeRecord *mAcmeClientMockDNS01ChallengeRecord) Return(s1 string, err error) *AcmeClientMock {
+	if mmDNS01ChallengeRecord.mock.funcDNS01ChallengeRecord != nil {
+		mmDNS01ChallengeRecord.mock.t.Fatalf("AcmeClientMock.DNS01ChallengeRecord mock is already set by Set")
+	}
+
+	if mmDNS01ChallengeRecord.defaultExpectation == nil {
+		mmDNS01ChallengeRecord.defaultExpectation = &AcmeClientMockDNS01ChallengeRecordExpectation{mock: mmDNS01ChallengeRecord.mock}
+	}
+	mmDNS01ChallengeRecord.defaultExpectation.results = &AcmeClientMockDNS01ChallengeRecordResults{s1, err}
+	return mmDNS01ChallengeRecord.mock
+}
+
+//Set uses given function f to mock the AcmeClient.DNS01ChallengeRecord method
+func (mmDNS01ChallengeRecord *mAcmeClientMockDNS01ChallengeRecord) Set(f func(token string) (s1 string, err error)) *AcmeClientMock {
+	if mmDNS01ChallengeRecord.defaultExpectation != nil {
+		mmDNS01ChallengeRecord.mock.t.Fatalf("Default expectation is already set for the AcmeClient.DNS01ChallengeRecord method")
+	}
+
+	if len(mmDNS01ChallengeRecord.expectations) > 0 {
+		mmDNS01ChallengeRecord.mock.t.Fatalf("Some expectations are already set for the AcmeClient.DNS01ChallengeRecord method")
+	}
+
+	mmDNS01ChallengeRecord.mock.funcDNS01ChallengeRecord = f
+	return mmDNS01ChallengeRecord.mock
+}
+
+// When sets expectation for the AcmeClient.DNS01ChallengeRecord which will trigger the result defined by the following
+// Then helper
+func (mmDNS01ChallengeRecord *mAcmeClientMockDNS01ChallengeRecord) When(token string) *AcmeClientMockDNS01ChallengeRecordExpectation {
+	if mmDNS01ChallengeRecord.mock.funcDNS01ChallengeRecord != nil {
+		mmDNS01ChallengeRecord.mock.t.Fatalf("AcmeClientMock.DNS01ChallengeRecord mock is already set by Set")
+	}
+
+	expectation := &AcmeClientMockDNS01ChallengeRecordExpectation{
+		mock:   mmDNS01ChallengeRecord.mock,
+		params: &AcmeClientMockDNS01ChallengeRecordParams{token},
+	}
+	mmDNS01ChallengeRecord.expectations = append(mmDNS01ChallengeRecord.expectations, expectation)
+	return expectation
+}
+
+// Then sets up AcmeClient.DNS01ChallengeRecord return parameters for the expectation previously defined by the When method
+func (e *AcmeClientMockDNS01ChallengeRecordExpectation) Then(s1 string, err error) *AcmeClientMock {
+	e.results = &AcmeClientMockDNS01ChallengeRecordResults{s1, err}
+	return e.mock
+}
+
+// DNS01ChallengeRecord implements AcmeClient
+func (mmDNS01ChallengeRecord *AcmeClientMock) DNS01ChallengeRecord(token string) (s1 string, err error) {
+	mm_atomic.AddUint64(&mmDNS01ChallengeRecord.beforeDNS01ChallengeRecordCounter, 1)
+	defer mm_atomic.AddUint64(&mmDNS01ChallengeRecord.afterDNS01ChallengeRecordCounter, 1)
+
+	if mmDNS01ChallengeRecord.inspectFuncDNS01ChallengeRecord != nil {
+		mmDNS01ChallengeRecord.inspectFuncDNS01ChallengeRecord(token)
+	}
+
+	mm_params := &AcmeClientMockDNS01ChallengeRecordParams{token}
+
+	// Record call args
+	mmDNS01ChallengeRecord.DNS01ChallengeRecordMock.mutex.Lock()
+	mmDNS01ChallengeRecord.DNS01ChallengeRecordMock.callArgs = append(mmDNS01ChallengeRecord.DNS01ChallengeRecordMock.callArgs, mm_params)
+	mmDNS01ChallengeRecord.DNS01ChallengeRecordMock.mutex.Unlock()
+
+	for _, e := range mmDNS01ChallengeRecord.DNS01ChallengeRecordMock.expectations {
+		if minimock.Equal(e.params, mm_params) {
+			mm_atomic.AddUint64(&e.Counter, 1)
+			return e.results.s1, e.results.err
+		}
+	}
+
+	if mmDNS01ChallengeRecord.DNS01ChallengeRecordMock.defaultExpectation != nil {
+		mm_atomic.AddUint64(&mmDNS01ChallengeRecord.DNS01ChallengeRecordMock.defaultExpectation.Counter, 1)
+		mm_want := mmDNS01ChallengeRecord.DNS01ChallengeRecordMock.defaultExpectation.params
+		mm_got := AcmeClientMockDNS01ChallengeRecordParams{token}
+		if mm_want != nil && !minimock.Equal(*mm_want, mm_got) {
+			mmDNS01ChallengeRecord.t.Errorf("AcmeClientMock.DNS01ChallengeRecord got unexpected parameters, want: %#v, got: %#v%s\n", *mm_want, mm_got, minimock.Diff(*mm_want, mm_got))
+		}
+
+		mm_results := mmDNS01ChallengeRecord.DNS01ChallengeRecordMock.defaultExpectation.results
+		if mm_results == nil {
+			mmDNS01ChallengeRecord.t.Fatal("No results are set for the AcmeClientMock.DNS01ChallengeRecord")
+		}
+		return (*mm_results).s1, (*mm_results).err
+	}
+	if mmDNS01ChallengeRecord.funcDNS01ChallengeRecord != nil {
+		return mmDNS01ChallengeRecord.funcDNS01ChallengeRecord(token)
+	}
+	mmDNS01ChallengeRecord.t.Fatalf("Unexpected call to AcmeClientMock.DNS01ChallengeRecord. %v", token)
+	return
+}
+
+// DNS01ChallengeRecordAfterCounter returns a count of finished AcmeClientMock.DNS01ChallengeRecord invocations
+func (mmDNS01ChallengeRecord *AcmeClientMock) DNS01ChallengeRecordAfterCounter() uint64 {
+	return mm_atomic.LoadUint64(&mmDNS01ChallengeRecord.afterDNS01ChallengeRecordCounter)
+}
+
+// DNS01ChallengeRecordBeforeCounter returns a count of AcmeClientMock.DNS01ChallengeRecord invocations
+func (mmDNS01ChallengeRecord *AcmeClientMock) DNS01ChallengeRecordBeforeCounter() uint64 {
+	return mm_atomic.LoadUint64(&mmDNS01ChallengeRecord.beforeDNS01ChallengeRecordCounter)
+}
+
+// Calls returns a list of arguments used in each call to AcmeClientMock.DNS01ChallengeRecord.
+// The list is in the same order as the calls were made (i.e. recent calls have a higher index)
+func (mmDNS01ChallengeRecord *mAcmeClientMockDNS01ChallengeRecord) Calls() []*AcmeClientMockDNS01ChallengeRecordParams {
+	mmDNS01ChallengeRecord.mutex.RLock()
+
+	argCopy := make([]*AcmeClientMockDNS01ChallengeRecordParams, len(mmDNS01ChallengeRecord.callArgs))
+	copy(argCopy, mmDNS01ChallengeRecord.callArgs)
+
+	mmDNS01ChallengeRecord.mutex.RUnlock()
+
+	return argCopy
+}
+
+// MinimockDNS01ChallengeRecordDone returns true if the count of the DNS01ChallengeRecord invocations corresponds
+// the number of defined expectations
+func (m *AcmeClientMock) MinimockDNS01ChallengeRecordDone() bool {
+	for _, e := range m.DNS01ChallengeRecordMock.expectations {
+		if mm_atomic.LoadUint64(&e.Counter) < 1 {
+			return false
+		}
+	}
+
+	// if default expectation was set then invocations count should be greater than zero
+	if m.DNS01ChallengeRecordMock.defaultExpectation != nil && mm_atomic.LoadUint64(&m.afterDNS01ChallengeRecordCounter) < 1 {
+		return false
+	}
+	// if func was set then invocations count should be greater than zero
+	if m.funcDNS01ChallengeRecord != nil && mm_atomic.LoadUint64(&m.afterDNS01ChallengeRecordCounter) < 1 {
+		return false
+	}
+	return true
+}
+
+// MinimockDNS01ChallengeRecordInspect logs each unmet expectation
+func (m *AcmeClientMock) MinimockDNS01ChallengeRecordInspect() {
+	for _, e := range m.DNS01ChallengeRecordMock.expectations {
+		if mm_atomic.LoadUint64(&e.Counter) < 1 {
+			m.t.Errorf("Expected call to AcmeClientMock.DNS01ChallengeRecord with params: %#v", *e.params)
+		}
+	}
+
+	// if default expectation was set then invocations count should be greater than zero
+	if m.DNS01ChallengeRecordMock.defaultExpectation != nil && mm_atomic.LoadUint64(&m.afterDNS01ChallengeRecordCounter) < 1 {
+		if m.DNS01ChallengeRecordMock.defaultExpectation.params == nil {
+			m.t.Error("Expected call to AcmeClientMock.DNS01ChallengeRecord")
+		} else {
+			m.t.Errorf("Expected call to AcmeClientMock.DNS01ChallengeRecord with params: %#v", *m.DNS01ChallengeRecordMock.defaultExpectation.params)
+		}
+	}
+	// if func was set then invocations count should be greater than zero
+	if m.funcDNS01ChallengeRecord != nil && mm_atomic.LoadUint64(&m.afterDNS01ChallengeRecordCounter) < 1 {
+		m.t.Error("Expected call to AcmeClientMock.DNS01ChallengeRecord")
+	}
+}
+
 type mAcmeClientMockGetAuthorization struct {
 	mock               *AcmeClientMock
 	defaultExpectation *AcmeClientMockGetAuthorizationExpectation
@@ -2076,6 +2301,8 @@ func (m *AcmeClientMock) MinimockFinish() {
 
 		m.MinimockCreateOrderCertInspect()
 
+		m.MinimockDNS01ChallengeRecordInspect()
+
 		m.MinimockGetAuthorizationInspect()
 
 		m.MinimockHTTP01ChallengeResponseInspect()
@@ -2113,6 +2340,7 @@ func (m *AcmeClientMock) minimockDone() bool {
 		m.MinimockAcceptDone() &&
 		m.MinimockAuthorizeOrderDone() &&
 		m.MinimockCreateOrderCertDone() &&
+		m.MinimockDNS01ChallengeRecordDone() &&
 		m.MinimockGetAuthorizationDone() &&
 		m.MinimockHTTP01ChallengeResponseDone() &&
 		m.MinimockRevokeAuthorizationDone() &&
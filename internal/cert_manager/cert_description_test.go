@@ -13,31 +13,37 @@ import (
 func TestCertDescription_CertStoreName(t *testing.T) {
 	td := testdeep.NewT(t)
 	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA}.CertStoreName(), "asd.ru.rsa.cer")
+	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA, Wildcard: true}.CertStoreName(), "_wildcard.asd.ru.rsa.cer")
 }
 
 func TestCertDescription_DomainNames(t *testing.T) {
 	td := testdeep.NewT(t)
 	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA, Subdomains: []string{"www."}}.DomainNames(), []domain.DomainName{"asd.ru", "www.asd.ru"})
+	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA, Subdomains: []string{"www."}, Wildcard: true}.DomainNames(), []domain.DomainName{"*.asd.ru"})
 }
 
 func TestCertDescription_KeyStoreName(t *testing.T) {
 	td := testdeep.NewT(t)
 	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA}.KeyStoreName(), "asd.ru.rsa.key")
+	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA, Wildcard: true}.KeyStoreName(), "_wildcard.asd.ru.rsa.key")
 }
 
 func TestCertDescription_LockName(t *testing.T) {
 	td := testdeep.NewT(t)
 	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA}.LockName(), "asd.ru.lock")
+	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA, Wildcard: true}.LockName(), "_wildcard.asd.ru.lock")
 }
 
 func TestCertDescription_MetaStoreName(t *testing.T) {
 	td := testdeep.NewT(t)
 	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA}.MetaStoreName(), "asd.ru.rsa.json")
+	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA, Wildcard: true}.MetaStoreName(), "_wildcard.asd.ru.rsa.json")
 }
 
 func TestCertDescription_String(t *testing.T) {
 	td := testdeep.NewT(t)
 	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA}.String(), "asd.ru.rsa")
+	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA, Wildcard: true}.String(), "_wildcard.asd.ru.rsa")
 }
 
 func TestCertDescription_ZapField(t *testing.T) {
@@ -45,3 +51,24 @@ func TestCertDescription_ZapField(t *testing.T) {
 	cd := CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA}
 	td.Cmp(cd.ZapField(), zap.Stringer("cert_name", cd))
 }
+
+func TestWildcardCertDescriptionFromDomain(t *testing.T) {
+	td := testdeep.NewT(t)
+	zones := []domain.DomainName{"apps.example.com", "example.org"}
+
+	cd, ok := WildcardCertDescriptionFromDomain("test.apps.example.com", KeyECDSA, zones)
+	td.True(ok)
+	td.Cmp(cd, CertDescription{MainDomain: "apps.example.com", KeyType: KeyECDSA, Wildcard: true})
+
+	cd, ok = WildcardCertDescriptionFromDomain("www.example.org", KeyRSA, zones)
+	td.True(ok)
+	td.Cmp(cd, CertDescription{MainDomain: "example.org", KeyType: KeyRSA, Wildcard: true})
+
+	for _, d := range []domain.DomainName{"apps.example.com", "www.test.apps.example.com", "test.example.com", "example.org", "testexample.org"} {
+		_, ok = WildcardCertDescriptionFromDomain(d, KeyRSA, zones)
+		td.False(ok, d)
+	}
+
+	_, ok = WildcardCertDescriptionFromDomain("test.example.org", KeyRSA, nil)
+	td.False(ok)
+}
@@ -9,17 +9,28 @@ import (
 	"go.uber.org/zap"
 )
 
+// wildcardStorePrefix is prefix for store names of wildcard certificates.
+// Underscore is invalid symbol for certificate domain names, so it can't conflict with usual domain certificates.
+const wildcardStorePrefix = "_wildcard."
+
 type CertDescription struct {
 	MainDomain string
 	KeyType    KeyType
 	Subdomains []string
+
+	// Wildcard certificate issued for "*." + MainDomain only, Subdomains ignored.
+	Wildcard bool
 }
 
 func (n CertDescription) CertStoreName() string {
-	return n.MainDomain + "." + n.KeyType.String() + ".cer"
+	return n.storeName() + "." + n.KeyType.String() + ".cer"
 }
 
 func (n CertDescription) DomainNames() []domain.DomainName {
+	if n.Wildcard {
+		return []domain.DomainName{domain.DomainName("*." + n.MainDomain)}
+	}
+
 	domains := make([]domain.DomainName, 1, len(n.Subdomains)+1)
 	domains[0] = domain.DomainName(n.MainDomain)
 	for _, subdomain := range n.Subdomains {
@@ -29,19 +40,26 @@ func (n CertDescription) DomainNames() []domain.DomainName {
 }
 
 func (n CertDescription) KeyStoreName() string {
-	return n.MainDomain + "." + n.KeyType.String() + ".key"
+	return n.storeName() + "." + n.KeyType.String() + ".key"
 }
 
 func (n CertDescription) LockName() string {
-	return n.MainDomain + ".lock"
+	return n.storeName() + ".lock"
 }
 
 func (n CertDescription) MetaStoreName() string {
-	return n.MainDomain + "." + n.KeyType.String() + ".json"
+	return n.storeName() + "." + n.KeyType.String() + ".json"
 }
 
 func (n CertDescription) String() string {
-	return n.MainDomain + "." + n.KeyType.String()
+	return n.storeName() + "." + n.KeyType.String()
+}
+
+func (n CertDescription) storeName() string {
+	if n.Wildcard {
+		return wildcardStorePrefix + n.MainDomain
+	}
+	return n.MainDomain
 }
 
 func (n CertDescription) ZapField() zap.Field {
@@ -62,3 +80,20 @@ func CertDescriptionFromDomain(domain domain.DomainName, keyType KeyType, autoSu
 		Subdomains: autoSubDomains,
 	}
 }
+
+// WildcardCertDescriptionFromDomain return description of wildcard certificate for domain
+// if domain is direct subdomain of one of zones.
+func WildcardCertDescriptionFromDomain(domain domain.DomainName, keyType KeyType, zones []domain.DomainName) (CertDescription, bool) {
+	for _, zone := range zones {
+		label := strings.TrimSuffix(domain.String(), "."+zone.String())
+		if label == domain.String() || label == "" || strings.Contains(label, ".") {
+			continue
+		}
+		return CertDescription{
+			MainDomain: zone.String(),
+			KeyType:    keyType,
+			Wildcard:   true,
+		}, true
+	}
+	return CertDescription{}, false
+}
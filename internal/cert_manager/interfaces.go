@@ -19,6 +19,7 @@ type AcmeClient interface {
 	Accept(ctx context.Context, chal *acme.Challenge) (*acme.Challenge, error)
 	AuthorizeOrder(ctx context.Context, id []acme.AuthzID, opt ...acme.OrderOption) (*acme.Order, error)
 	CreateOrderCert(ctx context.Context, url string, csr []byte, bundle bool) (der [][]byte, certURL string, err error)
+	DNS01ChallengeRecord(token string) (string, error)
 	GetAuthorization(ctx context.Context, url string) (*acme.Authorization, error)
 	HTTP01ChallengeResponse(token string) (string, error)
 	RevokeAuthorization(ctx context.Context, url string) error
@@ -32,6 +33,16 @@ type AcmeClientManager interface {
 	GetClient(ctx context.Context) (client *acme.Client, clientDisableFunc func(), err error)
 }
 
+// DNS01Provider publish and remove TXT records for dns-01 challenge.
+type DNS01Provider interface {
+	// Present create TXT record with value for fqdn.
+	// Record must be visible for acme server after Present return.
+	Present(ctx context.Context, fqdn, value string) error
+
+	// CleanUp remove TXT record, created by Present.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
 type managerDefaults struct{}
 
 func (managerDefaults) IsDomainAllowed(ctx context.Context, domain string) (bool, error) {
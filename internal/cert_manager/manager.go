@@ -47,6 +47,8 @@ import (
 const (
 	tlsAlpn01     = "tls-alpn-01"
 	http01        = "http-01"
+	dns01         = "dns-01"
+	dns01Label    = "_acme-challenge."
 	httpWellKnown = "/.well-known/acme-challenge/"
 )
 
@@ -71,6 +73,7 @@ var errHaveNoCert = errors.New("have no certificate for domain") // may return f
 var errRSADenied = xerrors.New("RSA certificate denied by config")
 var errECDSADenied = xerrors.New("ECDSA certificate denied by config")
 var errCertTypeUnknown = xerrors.New("unknown cert type")
+var errManagerClosed = xerrors.New("manager closed")
 
 type GetContext interface {
 	GetContext() context.Context
@@ -105,21 +108,34 @@ type Manager struct {
 	// Every subdomain must have suffix dot. For example: "www."
 	AutoSubdomains []string
 
+	// Zones, which direct subdomains served by one wildcard certificate. Set by SetWildcardDomains.
+	WildcardZones []domain.DomainName
+
 	acmeClientManager       AcmeClientManager
 	DomainChecker           DomainChecker
 	EnableHTTPValidation    bool
 	EnableTLSValidation     bool
+	EnableDNSValidation     bool
 	SaveJSONMeta            bool
 	AllowECDSACert          bool
 	AllowRSACert            bool
 	AllowInsecureTLSChipers bool
 
+	// DNSProvider publish TXT records for dns-01 challenges. Required for EnableDNSValidation.
+	DNSProvider DNS01Provider
+
 	certForDomainAuthorize cache.Value
 
 	certStateMu safemutex.MutexWithPointers[cache.Value]
 
 	httpTokens cache.Bytes
 
+	// in-progress certificate issues, for wait it on Close
+	issuesMu     sync.Mutex
+	issuesWG     sync.WaitGroup
+	issuesClosed bool
+	issuesCancel chan struct{}
+
 	// metrics
 	handleCertStart, certRequestStart   metrics.ProcessStartFunc
 	handleCertFinish, certRequestFinish metrics.ProcessFinishFunc
@@ -199,7 +215,7 @@ func (m *Manager) getCertificate(ctx context.Context, needDomain domain.DomainNa
 		return nil, errCertTypeUnknown
 	}
 
-	certDescription := CertDescriptionFromDomain(needDomain, certType, m.AutoSubdomains)
+	certDescription := m.certDescription(needDomain, certType)
 
 	logger := zc.L(ctx).With(certDescription.ZapField())
 	ctx = zc.WithLogger(ctx, zc.L(ctx).With(certDescription.ZapField()))
@@ -287,6 +303,13 @@ func (m *Manager) issueNewCert(ctx context.Context, needDomain domain.DomainName
 	}()
 	logger := zc.L(ctx)
 
+	ctx, issueFinished, err := m.issueStart(ctx)
+	if err != nil {
+		logger.Info("Deny certificate issue", zap.Error(err))
+		return nil, errHaveNoCert
+	}
+	defer issueFinished()
+
 	allowed, err := m.DomainChecker.IsDomainAllowed(ctx, needDomain.ASCII())
 	log.DebugError(logger, err, "Check if domain allowed for certificate", zap.Bool("allowed", allowed))
 	if err != nil {
@@ -300,8 +323,11 @@ func (m *Manager) issueNewCert(ctx context.Context, needDomain domain.DomainName
 	defer cancelFunc()
 
 	domains := cd.DomainNames()
-	domains, err = filterDomains(ctx, m.DomainChecker, domains, needDomain)
-	log.DebugError(logger, err, "Filter domains", domain.LogDomains(domains))
+	if !cd.Wildcard {
+		// wildcard name can't be checked as usual domain and allowed by need domain check
+		domains, err = filterDomains(ctx, m.DomainChecker, domains, needDomain)
+		log.DebugError(logger, err, "Filter domains", domain.LogDomains(domains))
+	}
 
 	res, err := m.createCertificateForDomains(certIssueContext, cd, domains)
 	if err == nil {
@@ -313,6 +339,69 @@ func (m *Manager) issueNewCert(ctx context.Context, needDomain domain.DomainName
 	return nil, errHaveNoCert
 }
 
+// issueStart register in-progress certificate issue.
+// Returned context cancelled if Close can't wait the issue finish.
+// Caller must call finish func after issue finished.
+func (m *Manager) issueStart(ctx context.Context) (_ context.Context, finish func(), _ error) {
+	m.issuesMu.Lock()
+	defer m.issuesMu.Unlock()
+
+	if m.issuesClosed {
+		return nil, nil, errManagerClosed
+	}
+	if m.issuesCancel == nil {
+		m.issuesCancel = make(chan struct{})
+	}
+	m.issuesWG.Add(1)
+
+	cancelIssues := m.issuesCancel
+	ctx, ctxCancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-cancelIssues:
+			ctxCancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		ctxCancel()
+		m.issuesWG.Done()
+	}, nil
+}
+
+// Close deny new certificate issues and wait until in-progress issues finished.
+// If ctx done before - cancel in-progress issues, wait it stopped and return error.
+// Certificates from local state and cache still can be used after Close.
+func (m *Manager) Close(ctx context.Context) error {
+	m.issuesMu.Lock()
+	if m.issuesClosed {
+		m.issuesMu.Unlock()
+		return errManagerClosed
+	}
+	m.issuesClosed = true
+	if m.issuesCancel == nil {
+		m.issuesCancel = make(chan struct{})
+	}
+	cancelIssues := m.issuesCancel
+	m.issuesMu.Unlock()
+
+	issuesFinished := make(chan struct{})
+	go func() {
+		m.issuesWG.Wait()
+		close(issuesFinished)
+	}()
+
+	select {
+	case <-issuesFinished:
+		return nil
+	case <-ctx.Done():
+		close(cancelIssues)
+		<-issuesFinished
+		return xerrors.Errorf("in-progress certificate issues cancelled: %w", ctx.Err())
+	}
+}
+
 func (m *Manager) handleTLSALPN(ctx context.Context, needDomain domain.DomainName) (*tls.Certificate, error) {
 	logger := zc.L(ctx)
 	logger.Debug("It is tls-alpn-01 token request.")
@@ -444,6 +533,64 @@ func (m *Manager) createOrderAndCertificate(ctx context.Context, acmeClient Acme
 	return res, err
 }
 
+// SetChallengeTypes enable only listed challenge types for authorize domains.
+// DNSProvider must be set before enable dns-01.
+func (m *Manager) SetChallengeTypes(types []string) error {
+	if len(types) == 0 {
+		return xerrors.New("empty challenge types list")
+	}
+
+	var enableTLS, enableHTTP, enableDNS bool
+	for _, challengeType := range types {
+		switch strings.TrimSpace(challengeType) {
+		case tlsAlpn01:
+			enableTLS = true
+		case http01:
+			enableHTTP = true
+		case dns01:
+			if m.DNSProvider == nil {
+				return xerrors.New("dns-01 challenge need dns provider")
+			}
+			enableDNS = true
+		default:
+			return xerrors.Errorf("unknown challenge type: '%v'", challengeType)
+		}
+	}
+	m.EnableTLSValidation = enableTLS
+	m.EnableHTTPValidation = enableHTTP
+	m.EnableDNSValidation = enableDNS
+	return nil
+}
+
+// SetWildcardDomains set zones for wildcard certificates from list of wildcard names like "*.example.com".
+// Wildcard certificates can be validated by dns-01 challenge only, so it must be enabled before.
+func (m *Manager) SetWildcardDomains(wildcards []string) error {
+	zones := make([]domain.DomainName, 0, len(wildcards))
+	for _, wildcard := range wildcards {
+		wildcard = strings.TrimSpace(wildcard)
+		if !strings.HasPrefix(wildcard, "*.") {
+			return xerrors.Errorf("wildcard domain must start with '*.': '%v'", wildcard)
+		}
+		zone, err := domain.NormalizeDomain(strings.TrimPrefix(wildcard, "*."))
+		if err != nil {
+			return xerrors.Errorf("normalize wildcard domain '%v': %w", wildcard, err)
+		}
+		zones = append(zones, zone)
+	}
+	if len(zones) > 0 && !m.EnableDNSValidation {
+		return xerrors.New("wildcard certificates need enabled dns-01 challenge")
+	}
+	m.WildcardZones = zones
+	return nil
+}
+
+func (m *Manager) certDescription(needDomain domain.DomainName, certType KeyType) CertDescription {
+	if cd, ok := WildcardCertDescriptionFromDomain(needDomain, certType, m.WildcardZones); ok {
+		return cd
+	}
+	return CertDescriptionFromDomain(needDomain, certType, m.AutoSubdomains)
+}
+
 func (m *Manager) supportedChallenges() []string {
 	var allowedChallenges []string
 	if m.EnableTLSValidation {
@@ -452,6 +599,9 @@ func (m *Manager) supportedChallenges() []string {
 	if m.EnableHTTPValidation {
 		allowedChallenges = append(allowedChallenges, http01)
 	}
+	if m.EnableDNSValidation {
+		allowedChallenges = append(allowedChallenges, dns01)
+	}
 	return allowedChallenges
 }
 
@@ -568,6 +718,7 @@ authorizeOrderLoop:
 				if err != nil {
 					continue authorizeOrderLoop
 				}
+				continue authDomainLoop
 			}
 			if !hasCompatibleChallenge {
 				logger.Error("No compatible challenges")
@@ -730,6 +881,25 @@ func (m *Manager) fulfill(ctx context.Context, acmeClient AcmeClient, challenge
 		} else {
 			return nil, err
 		}
+	case dns01:
+		if m.DNSProvider == nil {
+			return nil, errors.New("dns provider doesn't set")
+		}
+		value, err := acmeClient.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return nil, err
+		}
+		// authorization for wildcard certificate has domain without "*." prefix, but trim it for sure
+		fqdn := dns01Label + strings.TrimPrefix(domain.ASCII(), "*.") + "."
+		err = m.DNSProvider.Present(ctx, fqdn, value)
+		log.DebugError(logger, err, "Present dns-01 record", zap.String("fqdn", fqdn))
+		if err != nil {
+			return nil, err
+		}
+		return func(localContext context.Context) {
+			err := m.DNSProvider.CleanUp(localContext, fqdn, value)
+			log.DebugError(zc.L(localContext), err, "Clean up dns-01 record", zap.String("fqdn", fqdn))
+		}, nil
 	default:
 		logger.Error("Unknow challenge type", zap.Reflect("challenge", challenge))
 		return nil, errors.New("unknown challenge type")
@@ -752,8 +922,10 @@ func (m *Manager) isHTTPValidationRequest(r *http.Request) bool {
 	return strings.HasPrefix(r.URL.Path, httpWellKnown)
 }
 
+// HandleHTTPValidation answer to http-01 validation requests.
+// It return false if request isn't validation request and must be handled by caller.
 func (m *Manager) HandleHTTPValidation(w http.ResponseWriter, r *http.Request) bool {
-	if !m.isHTTPValidationRequest(r) {
+	if !m.EnableHTTPValidation || !m.isHTTPValidationRequest(r) {
 		return false
 	}
 
@@ -775,6 +947,7 @@ func (m *Manager) HandleHTTPValidation(w http.ResponseWriter, r *http.Request) b
 		log.DebugInfo(logger, err, "Error write http token answer to response", domain.LogDomain(d), zap.String("token", token))
 	} else {
 		logger.Warn("Have no validation token", domain.LogDomain(d), zap.String("token", token), zap.Error(err))
+		w.WriteHeader(http.StatusNotFound)
 	}
 	return true
 }
@@ -22,7 +22,9 @@ import (
 
 	"github.com/gojuno/minimock/v3"
 	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/proxy"
 	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/tlslistener"
 	zc "github.com/rekby/zapcontext"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/acme"
@@ -88,6 +90,58 @@ func TestManager_GetCertificateHttp01(t *testing.T) {
 	getCertificatesTests(t, manager, ctx, logger)
 }
 
+func TestManager_GetCertificateHttp01ThroughProxy(t *testing.T) {
+	env, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	th.Pebble(env)
+
+	t.Parallel()
+
+	logger := zc.L(ctx)
+
+	mc := minimock.NewController(t)
+	defer mc.Finish()
+
+	manager := New(createTestClientManager(env, t), newCacheMock(mc), nil)
+	manager.CertificateIssueTimeout = testCertIssueTimeout
+	manager.AutoSubdomains = []string{"www."}
+	err := manager.SetChallengeTypes([]string{http01})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same wiring as in main: plain tcp listener -> listeners handler -> http proxy
+	listenConfig := tlslistener.Config{
+		TCPAddresses: []string{(&net.TCPAddr{Port: th.PebbleHTTPValidationPort(env)}).String()},
+	}
+	listener := &tlslistener.ListenersHandler{GetCertificate: manager.GetCertificate}
+	err = listenConfig.Apply(ctx, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = listener.Start(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := proxy.NewHTTPProxy(ctx, listener)
+	p.HandleHTTPValidation = manager.HandleHTTPValidation
+	p.GetContext = func(req *http.Request) (context.Context, error) {
+		localAddr := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		return listener.GetConnectionContext(req.RemoteAddr, localAddr.String())
+	}
+	go func() {
+		err := p.Start()
+		logger.Info("http proxy stopped", zap.Error(err))
+	}()
+	defer func() {
+		_ = p.Close()
+	}()
+
+	getCertificatesTests(t, manager, ctx, logger)
+}
+
 func TestManager_GetCertificateTls(t *testing.T) {
 	env, ctx, cancel := th.NewEnv(t)
 	defer cancel()
@@ -154,11 +208,16 @@ func TestManager_GetCertificateTls(t *testing.T) {
 }
 
 func fastCreateTestCert(domains []string, now time.Time) (certBytes, keyBytes []byte) {
+	return fastCreateTestCertPeriod(domains, now.Add(-time.Hour), now.Add(time.Hour))
+}
+
+// fastCreateTestCertPeriod create self-signed certificate, valid between notBefore and notAfter.
+func fastCreateTestCertPeriod(domains []string, notBefore, notAfter time.Time) (certBytes, keyBytes []byte) {
 	template := x509.Certificate{
 		SerialNumber: big.NewInt(123),
 		Subject:      pkix.Name{CommonName: domains[0]},
-		NotBefore:    now.Add(-time.Hour),
-		NotAfter:     now.Add(time.Hour),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
 		DNSNames:     domains,
 	}
 	priv, err := rsa.GenerateKey(rand.Reader, 512)
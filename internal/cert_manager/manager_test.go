@@ -13,11 +13,13 @@ import (
 	"github.com/rekby/safemutex"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/rekby/fixenv"
 	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
 
 	"go.uber.org/zap"
 
@@ -287,3 +289,211 @@ func createManager(t *testing.T) (res testManagerContext, cancel func()) {
 		ctxCancel()
 	}
 }
+
+func TestManager_SetChallengeTypes(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := Manager{}
+	td.CmpNoError(m.SetChallengeTypes([]string{"tls-alpn-01"}))
+	td.Cmp(m.supportedChallenges(), []string{tlsAlpn01})
+
+	td.CmpNoError(m.SetChallengeTypes([]string{"http-01"}))
+	td.Cmp(m.supportedChallenges(), []string{http01})
+
+	td.CmpNoError(m.SetChallengeTypes([]string{" http-01", "tls-alpn-01 "}))
+	td.Cmp(m.supportedChallenges(), []string{tlsAlpn01, http01})
+
+	td.CmpError(m.SetChallengeTypes([]string{"dns-01"}))
+	m.DNSProvider = &testDNSProvider{}
+	td.CmpNoError(m.SetChallengeTypes([]string{"dns-01", "http-01"}))
+	td.Cmp(m.supportedChallenges(), []string{http01, dns01})
+
+	td.CmpNoError(m.SetChallengeTypes([]string{" http-01", "tls-alpn-01 "}))
+	td.CmpError(m.SetChallengeTypes(nil))
+	td.CmpError(m.SetChallengeTypes([]string{"http-01", "unknown"}))
+	td.Cmp(m.supportedChallenges(), []string{tlsAlpn01, http01})
+}
+
+func TestManager_HandleHTTPValidation(t *testing.T) {
+	td := testdeep.NewT(t)
+	c, cancel := createManager(t)
+	defer cancel()
+
+	c.httpTokens.GetMock.Set(func(ctx context.Context, key string) (ba1 []byte, err error) {
+		if key == "test.ru/token" {
+			return []byte("response"), nil
+		}
+		return nil, cache.ErrCacheMiss
+	})
+
+	resp := httptest.NewRecorder()
+	td.False(c.manager.HandleHTTPValidation(resp, httptest.NewRequest(http.MethodGet, "http://test.ru/", nil)))
+
+	resp = httptest.NewRecorder()
+	td.True(c.manager.HandleHTTPValidation(resp, httptest.NewRequest(http.MethodGet, "http://test.ru/.well-known/acme-challenge/token", nil)))
+	td.Cmp(resp.Code, http.StatusOK)
+	td.Cmp(resp.Body.String(), "response")
+
+	resp = httptest.NewRecorder()
+	td.True(c.manager.HandleHTTPValidation(resp, httptest.NewRequest(http.MethodGet, "http://test.ru:80/.well-known/acme-challenge/token", nil)))
+	td.Cmp(resp.Code, http.StatusOK)
+	td.Cmp(resp.Body.String(), "response")
+
+	resp = httptest.NewRecorder()
+	td.True(c.manager.HandleHTTPValidation(resp, httptest.NewRequest(http.MethodGet, "http://test.ru/.well-known/acme-challenge/other", nil)))
+	td.Cmp(resp.Code, http.StatusNotFound)
+
+	c.manager.EnableHTTPValidation = false
+	resp = httptest.NewRecorder()
+	td.False(c.manager.HandleHTTPValidation(resp, httptest.NewRequest(http.MethodGet, "http://test.ru/.well-known/acme-challenge/token", nil)))
+}
+
+type testDNSProvider struct {
+	records map[string]string
+}
+
+func (p *testDNSProvider) Present(_ context.Context, fqdn, value string) error {
+	if p.records == nil {
+		p.records = make(map[string]string)
+	}
+	p.records[fqdn] = value
+	return nil
+}
+
+func (p *testDNSProvider) CleanUp(_ context.Context, fqdn, value string) error {
+	if p.records[fqdn] == value {
+		delete(p.records, fqdn)
+	}
+	return nil
+}
+
+func TestManager_FulfillDNS01(t *testing.T) {
+	td := testdeep.NewT(t)
+	c, cancel := createManager(t)
+	defer cancel()
+
+	mc := minimock.NewController(t)
+	defer mc.Finish()
+
+	client := NewAcmeClientMock(mc)
+	client.DNS01ChallengeRecordMock.Expect("token").Return("record-value", nil)
+
+	_, err := c.manager.fulfill(c.ctx, client, &acme.Challenge{Type: dns01, Token: "token"}, "test.ru")
+	td.CmpError(err)
+
+	provider := &testDNSProvider{}
+	c.manager.DNSProvider = provider
+	cleanup, err := c.manager.fulfill(c.ctx, client, &acme.Challenge{Type: dns01, Token: "token"}, "test.ru")
+	td.CmpNoError(err)
+	td.Cmp(provider.records, map[string]string{"_acme-challenge.test.ru.": "record-value"})
+
+	cleanup(c.ctx)
+	td.Len(provider.records, 0)
+}
+
+func TestManager_SetWildcardDomains(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := Manager{}
+	td.CmpNoError(m.SetWildcardDomains(nil))
+	td.Len(m.WildcardZones, 0)
+
+	td.CmpError(m.SetWildcardDomains([]string{"*.example.com"}))
+
+	m.EnableDNSValidation = true
+	td.CmpNoError(m.SetWildcardDomains([]string{"*.Apps.Example.com", " *.example.org. "}))
+	td.Cmp(m.WildcardZones, []domain.DomainName{"apps.example.com", "example.org"})
+
+	td.CmpError(m.SetWildcardDomains([]string{"example.com"}))
+	td.CmpError(m.SetWildcardDomains([]string{"*.*.example.com"}))
+}
+
+func TestManager_GetWildcardCertificate(t *testing.T) {
+	td := testdeep.NewT(t)
+	c, cancel := createManager(t)
+	defer cancel()
+
+	// certificate valid long after renew time for prevent background renew
+	now := time.Now()
+	certBytes, keyBytes := fastCreateTestCertPeriod([]string{"*.test.ru"}, now.Add(-time.Hour), now.Add(2*renewBeforeExpire))
+
+	c.manager.WildcardZones = []domain.DomainName{"test.ru"}
+	c.certState.GetMock.Return(&certState{}, nil)
+	c.cache.GetMock.Set(func(ctx context.Context, key string) (ba1 []byte, err error) {
+		switch key {
+		case "_wildcard.test.ru.rsa.cer":
+			return certBytes, nil
+		case "_wildcard.test.ru.rsa.key":
+			return keyBytes, nil
+		default:
+			return nil, cache.ErrCacheMiss
+		}
+	})
+
+	res, err := c.manager.GetCertificate(&tls.ClientHelloInfo{Conn: c.connContext, ServerName: "sub.test.ru"})
+	td.CmpNoError(err)
+	td.Cmp(res.Leaf.DNSNames, []string{"*.test.ru"})
+
+	res, err = c.manager.GetCertificate(&tls.ClientHelloInfo{Conn: c.connContext, ServerName: "other.Test.ru"})
+	td.CmpNoError(err)
+	td.Cmp(res.Leaf.DNSNames, []string{"*.test.ru"})
+}
+
+func TestManager_Close(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	t.Run("WaitIssue", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		m := Manager{}
+
+		issueCtx, finish, err := m.issueStart(ctx)
+		td.CmpNoError(err)
+
+		closed := make(chan error, 1)
+		go func() { closed <- m.Close(ctx) }()
+
+		select {
+		case <-closed:
+			t.Fatal("close must wait in-progress issue")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		td.CmpNoError(issueCtx.Err())
+		finish()
+		td.CmpNoError(<-closed)
+
+		_, _, err = m.issueStart(ctx)
+		td.Cmp(err, errManagerClosed)
+		td.Cmp(m.Close(ctx), errManagerClosed)
+	})
+
+	t.Run("CancelIssue", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		m := Manager{}
+
+		issueCtx, finish, err := m.issueStart(ctx)
+		td.CmpNoError(err)
+		go func() {
+			<-issueCtx.Done()
+			finish()
+		}()
+
+		closeCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		td.CmpError(m.Close(closeCtx))
+		td.CmpError(issueCtx.Err())
+	})
+
+	t.Run("DenyIssueAfterClose", func(t *testing.T) {
+		m := Manager{}
+		m.initMetrics(nil)
+		td.CmpNoError(m.Close(ctx))
+
+		_, err := m.issueNewCert(ctx, "example.com", CertDescription{})
+		td.Cmp(err, errHaveNoCert)
+	})
+}
@@ -5,4 +5,31 @@ type Label string
 const (
 	ConnectionID  Label = "connection_id"
 	TLSConnection Label = "tls"
+
+	// HTTPSRedirect - true if requests of connection must be redirected to https
+	HTTPSRedirect Label = "https_redirect"
+
+	// RequestID - id of http request, generated by proxy
+	RequestID Label = "request_id"
+
+	// RequestPath - path of client request, before rewrite by directors
+	RequestPath Label = "request_path"
+
+	// RemoteAddr - net.Addr of client, from PROXY protocol header if listener receive it
+	RemoteAddr Label = "remote_addr"
+
+	// LocalAddr - net.Addr of listener, which accept client connection
+	LocalAddr Label = "local_addr"
+
+	// ProxyProtocol - version of PROXY protocol header for send to backend
+	ProxyProtocol Label = "proxy_protocol"
+
+	// BackendTLS - TLS options for connect to https backend
+	BackendTLS Label = "backend_tls"
+
+	// StaticDir - directory for serve files instead of send request to backend
+	StaticDir Label = "static_dir"
+
+	// UpstreamAttempt - number of attempt (from 1) for send request to upstream pool
+	UpstreamAttempt Label = "upstream_attempt"
 )
@@ -0,0 +1,103 @@
+// Package dns01 contains providers for publish TXT records, need for dns-01 acme challenges.
+package dns01
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/cert_manager"
+)
+
+const (
+	ProviderNone    = ""
+	ProviderRFC2136 = "rfc2136"
+	ProviderExec    = "exec"
+)
+
+//nolint:maligned
+type Config struct {
+	Provider string
+
+	// Seconds for wait after publish record, before ask acme server for validate it.
+	// It need for wait sync dns secondary servers.
+	PropagationWaitSeconds int
+
+	RFC2136Server         string
+	RFC2136Zone           string
+	RFC2136TTL            int
+	RFC2136TimeoutSeconds int
+	RFC2136TSIGKey        string
+	RFC2136TSIGSecret     string
+	RFC2136TSIGAlgorithm  string
+
+	ExecCommand string
+}
+
+// CreateProvider return configured provider.
+// can return nil, nil if no provider configured
+func (c *Config) CreateProvider(ctx context.Context) (cert_manager.DNS01Provider, error) {
+	logger := zc.L(ctx)
+
+	var provider cert_manager.DNS01Provider
+	var err error
+
+	providerName := strings.ToLower(strings.TrimSpace(c.Provider))
+	switch providerName {
+	case ProviderNone:
+		logger.Info("Dns-01 provider doesn't configured")
+		return nil, nil
+	case ProviderRFC2136:
+		provider, err = NewRFC2136(RFC2136Params{
+			Server:        c.RFC2136Server,
+			Zone:          c.RFC2136Zone,
+			TTL:           uint32(c.RFC2136TTL),
+			Timeout:       time.Duration(c.RFC2136TimeoutSeconds) * time.Second,
+			TSIGKey:       c.RFC2136TSIGKey,
+			TSIGSecret:    c.RFC2136TSIGSecret,
+			TSIGAlgorithm: c.RFC2136TSIGAlgorithm,
+		})
+	case ProviderExec:
+		provider, err = NewExec(c.ExecCommand)
+	default:
+		return nil, xerrors.Errorf("unknown dns01 provider: '%v'", c.Provider)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("create dns01 provider %q: %w", providerName, err)
+	}
+
+	logger.Info("Create dns-01 provider", zap.String("provider", providerName),
+		zap.Int("propagation_wait_seconds", c.PropagationWaitSeconds))
+
+	if c.PropagationWaitSeconds > 0 {
+		provider = propagationWaiter{DNS01Provider: provider, wait: time.Duration(c.PropagationWaitSeconds) * time.Second}
+	}
+	return provider, nil
+}
+
+// propagationWaiter wait some time after present record
+type propagationWaiter struct {
+	cert_manager.DNS01Provider
+	wait time.Duration
+}
+
+func (p propagationWaiter) Present(ctx context.Context, fqdn, value string) error {
+	err := p.DNS01Provider.Present(ctx, fqdn, value)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(p.wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
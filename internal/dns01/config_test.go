@@ -0,0 +1,78 @@
+package dns01
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestConfig_CreateProvider(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	c := Config{}
+	p, err := c.CreateProvider(ctx)
+	td.CmpNoError(err)
+	td.Nil(p)
+
+	c = Config{Provider: "unknown"}
+	_, err = c.CreateProvider(ctx)
+	td.CmpError(err)
+
+	c = Config{Provider: "RFC2136"}
+	_, err = c.CreateProvider(ctx)
+	td.CmpError(err)
+
+	c = Config{Provider: "rfc2136", RFC2136Server: "127.0.0.1:53", RFC2136TTL: 30, RFC2136TSIGKey: "key", RFC2136TSIGSecret: "secret"}
+	p, err = c.CreateProvider(ctx)
+	td.CmpNoError(err)
+	td.Cmp(p, testdeep.Isa(&RFC2136{}))
+	td.Cmp(p.(*RFC2136).ttl, uint32(30))
+
+	c = Config{Provider: "exec"}
+	_, err = c.CreateProvider(ctx)
+	td.CmpError(err)
+
+	c = Config{Provider: "exec", ExecCommand: "/bin/true", PropagationWaitSeconds: 2}
+	p, err = c.CreateProvider(ctx)
+	td.CmpNoError(err)
+	td.Cmp(p, propagationWaiter{DNS01Provider: &Exec{command: "/bin/true"}, wait: 2 * time.Second})
+}
+
+type testProvider struct {
+	presented bool
+}
+
+func (p *testProvider) Present(ctx context.Context, fqdn, value string) error {
+	p.presented = true
+	return nil
+}
+
+func (p *testProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return nil
+}
+
+func TestPropagationWaiter(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	inner := &testProvider{}
+	p := propagationWaiter{DNS01Provider: inner, wait: 50 * time.Millisecond}
+	start := time.Now()
+	td.CmpNoError(p.Present(ctx, "fqdn", "value"))
+	td.True(inner.presented)
+	td.Gte(time.Since(start), 50*time.Millisecond)
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	p = propagationWaiter{DNS01Provider: &testProvider{}, wait: time.Hour}
+	td.CmpError(p.Present(canceledCtx, "fqdn", "value"))
+}
@@ -0,0 +1,68 @@
+package dns01
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const (
+	ExecActionPresent = "present"
+	ExecActionCleanUp = "cleanup"
+)
+
+// Exec publish TXT records by run external command.
+// Command called with args: <action> <fqdn> <value>, where action is "present" or "cleanup".
+// Same values passed by environment variables LETS_PROXY_DNS01_ACTION, LETS_PROXY_DNS01_FQDN
+// and LETS_PROXY_DNS01_VALUE.
+// Non zero exit code mean error.
+type Exec struct {
+	command string
+}
+
+func NewExec(command string) (*Exec, error) {
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return nil, xerrors.New("empty dns01 exec command")
+	}
+	return &Exec{command: command}, nil
+}
+
+func (e *Exec) Present(ctx context.Context, fqdn, value string) error {
+	return e.run(ctx, ExecActionPresent, fqdn, value)
+}
+
+func (e *Exec) CleanUp(ctx context.Context, fqdn, value string) error {
+	return e.run(ctx, ExecActionCleanUp, fqdn, value)
+}
+
+func (e *Exec) run(ctx context.Context, action, fqdn, value string) error {
+	logger := zc.L(ctx).With(zap.String("command", e.command), zap.String("action", action), zap.String("fqdn", fqdn))
+
+	var output bytes.Buffer
+
+	//nolint:gosec
+	cmd := exec.CommandContext(ctx, e.command, action, fqdn, value)
+	cmd.Env = append(os.Environ(),
+		"LETS_PROXY_DNS01_ACTION="+action,
+		"LETS_PROXY_DNS01_FQDN="+fqdn,
+		"LETS_PROXY_DNS01_VALUE="+value,
+	)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	log.DebugInfo(logger, err, "Run dns01 exec command", zap.String("output", output.String()))
+	if err != nil {
+		return xerrors.Errorf("run dns01 command %q %v: %w", e.command, action, err)
+	}
+	return nil
+}
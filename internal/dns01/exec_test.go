@@ -0,0 +1,59 @@
+package dns01
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestNewExec(t *testing.T) {
+	e, _, cancel := th.NewEnv(t)
+	defer cancel()
+
+	_, err := NewExec(" ")
+	e.CmpError(err)
+
+	p, err := NewExec(" /bin/true ")
+	e.CmpNoError(err)
+	e.Cmp(p.command, "/bin/true")
+}
+
+func TestExec_PresentCleanUp(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test use shell script")
+	}
+
+	e, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	dir := th.TmpDir(e)
+	outFile := filepath.Join(dir, "out.txt")
+	script := filepath.Join(dir, "hook.sh")
+	e.CmpNoError(ioutil.WriteFile(script, []byte(`#!/bin/sh
+echo "$1 $2 $3 $LETS_PROXY_DNS01_ACTION $LETS_PROXY_DNS01_FQDN $LETS_PROXY_DNS01_VALUE" >> `+outFile+`
+if [ "$3" = "fail" ]; then
+	exit 1
+fi
+`), 0700))
+
+	p, err := NewExec(script)
+	e.CmpNoError(err)
+
+	e.CmpNoError(p.Present(ctx, "_acme-challenge.example.com.", "value"))
+	e.CmpNoError(p.CleanUp(ctx, "_acme-challenge.example.com.", "value"))
+	e.CmpError(p.Present(ctx, "_acme-challenge.example.com.", "fail"))
+
+	out, err := ioutil.ReadFile(outFile)
+	e.CmpNoError(err)
+	e.Cmp(string(out), `present _acme-challenge.example.com. value present _acme-challenge.example.com. value
+cleanup _acme-challenge.example.com. value cleanup _acme-challenge.example.com. value
+present _acme-challenge.example.com. fail present _acme-challenge.example.com. fail
+`)
+
+	p, err = NewExec(filepath.Join(dir, "not-exist.sh"))
+	e.CmpNoError(err)
+	e.CmpError(p.Present(ctx, "_acme-challenge.example.com.", "value"))
+}
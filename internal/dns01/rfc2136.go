@@ -0,0 +1,175 @@
+package dns01
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const (
+	defaultRFC2136TTL       = 60
+	defaultRFC2136Timeout   = 10 * time.Second
+	defaultTSIGAlgorithm    = mdns.HmacSHA256
+	tsigFudgeSeconds        = 300
+	maxZoneDetectionQueries = 10
+)
+
+type dnsExchanger interface {
+	ExchangeContext(ctx context.Context, msg *mdns.Msg, address string) (r *mdns.Msg, rtt time.Duration, err error)
+}
+
+// RFC2136 publish TXT records by dynamic dns update (RFC 2136), signed by TSIG key (RFC 2845)
+type RFC2136 struct {
+	server string
+	zone   string
+	ttl    uint32
+
+	tsigKey       string
+	tsigAlgorithm string
+
+	client dnsExchanger
+}
+
+type RFC2136Params struct {
+	// Server - ip:port of primary dns server, which accept updates
+	Server string
+
+	// Zone for update. Detect by SOA query to Server if empty.
+	Zone string
+
+	TTL     uint32
+	Timeout time.Duration
+
+	// TSIGKey - name of TSIG key. Updates send without signature if empty.
+	TSIGKey string
+
+	// TSIGSecret - base64 encoded secret of TSIG key.
+	TSIGSecret string
+
+	// TSIGAlgorithm in form of miekg/dns constants, for example "hmac-sha256.". Default hmac-sha256.
+	TSIGAlgorithm string
+}
+
+func NewRFC2136(params RFC2136Params) (*RFC2136, error) {
+	if params.Server == "" {
+		return nil, xerrors.New("empty rfc2136 dns server")
+	}
+	if params.TSIGKey != "" && params.TSIGSecret == "" {
+		return nil, xerrors.New("empty rfc2136 tsig secret")
+	}
+
+	res := &RFC2136{
+		server:        params.Server,
+		ttl:           params.TTL,
+		tsigAlgorithm: params.TSIGAlgorithm,
+	}
+	if params.Zone != "" {
+		res.zone = mdns.Fqdn(params.Zone)
+	}
+	if res.ttl == 0 {
+		res.ttl = defaultRFC2136TTL
+	}
+	if res.tsigAlgorithm == "" {
+		res.tsigAlgorithm = defaultTSIGAlgorithm
+	}
+	res.tsigAlgorithm = mdns.Fqdn(res.tsigAlgorithm)
+
+	timeout := params.Timeout
+	if timeout == 0 {
+		timeout = defaultRFC2136Timeout
+	}
+	client := &mdns.Client{Net: "udp", Timeout: timeout}
+	if params.TSIGKey != "" {
+		res.tsigKey = mdns.Fqdn(params.TSIGKey)
+		client.TsigSecret = map[string]string{res.tsigKey: params.TSIGSecret}
+	}
+	res.client = client
+
+	return res, nil
+}
+
+func (p *RFC2136) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, true)
+}
+
+func (p *RFC2136) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, false)
+}
+
+func (p *RFC2136) update(ctx context.Context, fqdn, value string, insert bool) error {
+	logger := zc.L(ctx).With(zap.String("fqdn", fqdn), zap.String("dns_server", p.server), zap.Bool("insert", insert))
+	fqdn = mdns.Fqdn(fqdn)
+
+	zone, err := p.getZone(ctx, fqdn)
+	log.DebugError(logger, err, "Get zone for update", zap.String("zone", zone))
+	if err != nil {
+		return err
+	}
+
+	rr := &mdns.TXT{
+		Hdr: mdns.RR_Header{Name: fqdn, Rrtype: mdns.TypeTXT, Class: mdns.ClassINET, Ttl: p.ttl},
+		Txt: []string{value},
+	}
+
+	msg := new(mdns.Msg)
+	msg.SetUpdate(zone)
+	if insert {
+		msg.Insert([]mdns.RR{rr})
+	} else {
+		msg.Remove([]mdns.RR{rr})
+	}
+
+	resp, err := p.exchange(ctx, msg)
+	if err == nil && resp.Rcode != mdns.RcodeSuccess {
+		err = xerrors.Errorf("dns server answer with code: %v", mdns.RcodeToString[resp.Rcode])
+	}
+	log.DebugInfo(logger, err, "Send dns update", zap.String("zone", zone))
+	return err
+}
+
+func (p *RFC2136) getZone(ctx context.Context, fqdn string) (string, error) {
+	if p.zone != "" {
+		if !mdns.IsSubDomain(p.zone, fqdn) {
+			return "", xerrors.Errorf("record %q out of zone %q", fqdn, p.zone)
+		}
+		return p.zone, nil
+	}
+
+	labels := mdns.SplitDomainName(fqdn)
+	for i := 0; i < len(labels) && i < maxZoneDetectionQueries; i++ {
+		candidate := mdns.Fqdn(strings.Join(labels[i:], "."))
+
+		msg := new(mdns.Msg)
+		msg.SetQuestion(candidate, mdns.TypeSOA)
+		resp, err := p.exchange(ctx, msg)
+		if err != nil {
+			return "", xerrors.Errorf("query soa for %q: %w", candidate, err)
+		}
+		// NXDOMAIN and other errors mean candidate is not a zone, go to parent
+		if resp.Rcode != mdns.RcodeSuccess {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			if soa, ok := rr.(*mdns.SOA); ok && strings.EqualFold(soa.Hdr.Name, candidate) {
+				return candidate, nil
+			}
+		}
+	}
+	return "", xerrors.Errorf("can't detect zone for %q", fqdn)
+}
+
+func (p *RFC2136) exchange(ctx context.Context, msg *mdns.Msg) (*mdns.Msg, error) {
+	if p.tsigKey != "" {
+		msg.SetTsig(p.tsigKey, p.tsigAlgorithm, tsigFudgeSeconds, time.Now().Unix())
+	}
+
+	resp, _, err := p.client.ExchangeContext(ctx, msg, p.server)
+	return resp, err
+}
@@ -0,0 +1,186 @@
+package dns01
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	mdns "github.com/miekg/dns"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+const (
+	testZone       = "example.com."
+	testTSIGKey    = "lets-proxy."
+	testTSIGSecret = "c2VjcmV0LWtleS1mb3ItdGVzdHM="
+)
+
+type testDNSServer struct {
+	addr string
+
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func (s *testDNSServer) txt(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.records[strings.ToLower(name)]...)
+}
+
+func (s *testDNSServer) ServeDNS(w mdns.ResponseWriter, req *mdns.Msg) {
+	resp := new(mdns.Msg)
+	resp.SetReply(req)
+
+	switch req.Opcode {
+	case mdns.OpcodeQuery:
+		q := req.Question[0]
+		switch {
+		case q.Qtype == mdns.TypeSOA && strings.EqualFold(q.Name, testZone):
+			resp.Answer = append(resp.Answer, &mdns.SOA{
+				Hdr: mdns.RR_Header{Name: testZone, Rrtype: mdns.TypeSOA, Class: mdns.ClassINET, Ttl: 60},
+				Ns:  "ns." + testZone, Mbox: "admin." + testZone, Serial: 1,
+			})
+		case mdns.IsSubDomain(testZone, q.Name):
+			// exist zone, but no records
+		default:
+			resp.Rcode = mdns.RcodeNameError
+		}
+	case mdns.OpcodeUpdate:
+		if req.IsTsig() == nil || w.TsigStatus() != nil {
+			resp.Rcode = mdns.RcodeNotAuth
+			break
+		}
+		if !strings.EqualFold(req.Question[0].Name, testZone) {
+			resp.Rcode = mdns.RcodeNotZone
+			break
+		}
+		s.mu.Lock()
+		for _, rr := range req.Ns {
+			txt, ok := rr.(*mdns.TXT)
+			if !ok {
+				continue
+			}
+			name := strings.ToLower(txt.Hdr.Name)
+			switch txt.Hdr.Class {
+			case mdns.ClassINET:
+				s.records[name] = append(s.records[name], txt.Txt...)
+			case mdns.ClassNONE:
+				var newValues []string
+				for _, v := range s.records[name] {
+					if v != strings.Join(txt.Txt, "") {
+						newValues = append(newValues, v)
+					}
+				}
+				s.records[name] = newValues
+			}
+		}
+		s.mu.Unlock()
+	default:
+		resp.Rcode = mdns.RcodeNotImplemented
+	}
+
+	if req.IsTsig() != nil {
+		resp.SetTsig(testTSIGKey, mdns.HmacSHA256, tsigFudgeSeconds, time.Now().Unix())
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func newTestDNSServer(t *testing.T) *testDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := &testDNSServer{addr: conn.LocalAddr().String(), records: map[string][]string{}}
+	started := make(chan struct{})
+	server := &mdns.Server{
+		PacketConn:        conn,
+		Handler:           res,
+		TsigSecret:        map[string]string{testTSIGKey: testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc: func(dh mdns.Header) mdns.MsgAcceptAction {
+			return mdns.MsgAccept
+		},
+	}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	return res
+}
+
+func TestNewRFC2136(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	_, err := NewRFC2136(RFC2136Params{})
+	td.CmpError(err)
+
+	_, err = NewRFC2136(RFC2136Params{Server: "127.0.0.1:53", TSIGKey: "key"})
+	td.CmpError(err)
+
+	p, err := NewRFC2136(RFC2136Params{Server: "127.0.0.1:53", Zone: "example.com", TSIGKey: "key", TSIGSecret: "secret"})
+	td.CmpNoError(err)
+	td.Cmp(p.zone, "example.com.")
+	td.Cmp(p.tsigKey, "key.")
+	td.Cmp(p.tsigAlgorithm, mdns.HmacSHA256)
+	td.Cmp(p.ttl, uint32(defaultRFC2136TTL))
+}
+
+func TestRFC2136_PresentCleanUp(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	server := newTestDNSServer(t)
+	const fqdn = "_acme-challenge.www.example.com."
+
+	t.Run("DetectZone", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		p, err := NewRFC2136(RFC2136Params{Server: server.addr, TSIGKey: testTSIGKey, TSIGSecret: testTSIGSecret})
+		td.CmpNoError(err)
+
+		td.CmpNoError(p.Present(ctx, fqdn, "value1"))
+		td.Cmp(server.txt(fqdn), []string{"value1"})
+
+		td.CmpNoError(p.CleanUp(ctx, fqdn, "value1"))
+		td.Len(server.txt(fqdn), 0)
+	})
+
+	t.Run("StaticZone", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		p, err := NewRFC2136(RFC2136Params{Server: server.addr, Zone: "example.com", TSIGKey: testTSIGKey, TSIGSecret: testTSIGSecret})
+		td.CmpNoError(err)
+
+		td.CmpNoError(p.Present(ctx, fqdn, "value2"))
+		td.Cmp(server.txt(fqdn), []string{"value2"})
+		td.CmpNoError(p.CleanUp(ctx, fqdn, "value2"))
+		td.Len(server.txt(fqdn), 0)
+
+		td.CmpError(p.Present(ctx, "_acme-challenge.other.org.", "value"))
+	})
+
+	t.Run("UnknownZone", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		p, err := NewRFC2136(RFC2136Params{Server: server.addr, TSIGKey: testTSIGKey, TSIGSecret: testTSIGSecret})
+		td.CmpNoError(err)
+
+		td.CmpError(p.Present(ctx, "_acme-challenge.other.org.", "value"))
+	})
+
+	t.Run("BadKey", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		p, err := NewRFC2136(RFC2136Params{Server: server.addr, Zone: testZone, TSIGKey: testTSIGKey, TSIGSecret: "YmFkLWtleQ=="})
+		td.CmpNoError(err)
+
+		td.CmpError(p.Present(ctx, fqdn, "value3"))
+		td.Len(server.txt(fqdn), 0)
+	})
+}
@@ -0,0 +1,32 @@
+//nolint:golint
+package domain_checker
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Reloadable is checker, which can be replaced while it used concurrently,
+// for example after reload config.
+type Reloadable struct {
+	checker atomic.Value
+}
+
+type reloadableValue struct {
+	DomainChecker
+}
+
+func NewReloadable(checker DomainChecker) *Reloadable {
+	res := &Reloadable{}
+	res.Set(checker)
+	return res
+}
+
+// Set replace checker for next checks
+func (r *Reloadable) Set(checker DomainChecker) {
+	r.checker.Store(reloadableValue{DomainChecker: checker})
+}
+
+func (r *Reloadable) IsDomainAllowed(ctx context.Context, domain string) (bool, error) {
+	return r.checker.Load().(reloadableValue).IsDomainAllowed(ctx, domain)
+}
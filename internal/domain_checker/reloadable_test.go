@@ -0,0 +1,29 @@
+//nolint:golint
+package domain_checker
+
+import (
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestReloadable(t *testing.T) {
+	var _ DomainChecker = &Reloadable{}
+
+	ctx, cancel := th.TestContext(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+
+	r := NewReloadable(True{})
+	res, err := r.IsDomainAllowed(ctx, "aaa")
+	td.True(res)
+	td.CmpNoError(err)
+
+	r.Set(False{})
+	res, err = r.IsDomainAllowed(ctx, "aaa")
+	td.False(res)
+	td.CmpNoError(err)
+}
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"errors"
 	"net/http"
 	"reflect"
 
@@ -71,3 +72,19 @@ func ToefCounters(r prometheus.Registerer, name, description string) (start Proc
 	}
 	return start, finish
 }
+
+// RegisterOrExisting register collector and return it or return same collector, registered early
+// (for example by previous config or listeners). Return false on other errors.
+func RegisterOrExisting[T prometheus.Collector](r prometheus.Registerer, c T) (T, bool) {
+	err := r.Register(c)
+	if err == nil {
+		return c, true
+	}
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if errors.As(err, &alreadyRegistered) {
+		existed, ok := alreadyRegistered.ExistingCollector.(T)
+		return existed, ok
+	}
+	var empty T
+	return empty, false
+}
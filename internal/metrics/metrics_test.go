@@ -123,6 +123,27 @@ func TestToefCounters(t *testing.T) {
 	td.Cmp(getCount(cntInFly), 0)
 }
 
+func TestRegisterOrExisting(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	r := prometheus.NewRegistry()
+	newCounter := func() *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test", Help: "test"}, []string{"label"})
+	}
+
+	first := newCounter()
+	res, ok := RegisterOrExisting(r, first)
+	td.True(ok)
+	td.Shallow(res, first)
+
+	res, ok = RegisterOrExisting(r, newCounter())
+	td.True(ok)
+	td.Shallow(res, first, "existed")
+
+	_, ok = RegisterOrExisting(r, prometheus.NewGauge(prometheus.GaugeOpts{Name: "test", Help: "test"}))
+	td.False(ok, "other collector with same name")
+}
+
 func TestErrorLoggger_Println(t *testing.T) {
 	loggerMock := NewLoggerErrorMock(t)
 	defer loggerMock.MinimockFinish()
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// BackendTLS - TLS options for connections to https backend.
+type BackendTLS struct {
+	// ServerName for SNI and certificate verification, host of request used if empty.
+	ServerName string
+
+	// RootCAs for verify backend certificate, system pool used if nil.
+	RootCAs *x509.CertPool
+
+	// PinnedSHA256 - allowed SHA-256 fingerprints of backend certificate. If set, certificate chain
+	// verified only if RootCAs set.
+	PinnedSHA256 [][sha256.Size]byte
+
+	// MinVersion of TLS, go default used if 0.
+	MinVersion uint16
+
+	// Certificates - client certificates for mTLS.
+	Certificates []tls.Certificate
+}
+
+// BackendTLSConfig - TLS options of backend from config file.
+type BackendTLSConfig struct {
+	// CAFile - PEM file with CA certificates for verify backend certificate instead of system pool.
+	CAFile string
+
+	// PinnedSHA256 - SHA-256 fingerprints of backend certificate in hex, colons allowed.
+	PinnedSHA256 []string
+
+	// ServerName for SNI and certificate verification instead of request host.
+	ServerName string
+
+	// MinVersion of TLS: 1.0, 1.1, 1.2 or 1.3.
+	MinVersion string
+
+	// CertFile and KeyFile - PEM files of client certificate and its key for mTLS.
+	CertFile string
+	KeyFile  string
+}
+
+// NewBackendTLS read files and parse options from config.
+func NewBackendTLS(c BackendTLSConfig) (*BackendTLS, error) {
+	res := &BackendTLS{ServerName: strings.TrimSpace(c.ServerName)}
+
+	if c.CAFile != "" {
+		content, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read backend CA file %q: %w", c.CAFile, err)
+		}
+		res.RootCAs = x509.NewCertPool()
+		if !res.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates in backend CA file %q", c.CAFile)
+		}
+	}
+
+	for _, pin := range c.PinnedSHA256 {
+		fingerprint, err := parseSHA256Fingerprint(pin)
+		if err != nil {
+			return nil, err
+		}
+		res.PinnedSHA256 = append(res.PinnedSHA256, fingerprint)
+	}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[strings.TrimSpace(c.MinVersion)]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version: %q", c.MinVersion)
+		}
+		res.MinVersion = version
+	}
+
+	switch {
+	case c.CertFile == "" && c.KeyFile == "":
+		// pass
+	case c.CertFile == "" || c.KeyFile == "":
+		return nil, errors.New("backend client certificate need both CertFile and KeyFile")
+	default:
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load backend client certificate: %w", err)
+		}
+		res.Certificates = []tls.Certificate{cert}
+	}
+	return res, nil
+}
+
+func parseSHA256Fingerprint(s string) (res [sha256.Size]byte, err error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ":", "")
+	decoded, err := hex.DecodeString(s)
+	if err != nil || len(decoded) != sha256.Size {
+		return res, fmt.Errorf("bad sha256 fingerprint: %q", s)
+	}
+	copy(res[:], decoded)
+	return res, nil
+}
+
+// tlsConfig for connect to backend with the server name.
+func (b *BackendTLS) tlsConfig(serverName string) *tls.Config {
+	res := &tls.Config{
+		ServerName:   serverName,
+		RootCAs:      b.RootCAs,
+		MinVersion:   b.MinVersion,
+		Certificates: b.Certificates,
+	}
+	if len(b.PinnedSHA256) > 0 {
+		// standard verification can't be partially disabled, so chain verified by VerifyConnection
+		res.InsecureSkipVerify = true //nolint:gosec
+		res.VerifyConnection = b.verifyConnection
+	}
+	return res
+}
+
+func (b *BackendTLS) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("backend has no certificate")
+	}
+	leaf := state.PeerCertificates[0]
+	fingerprint := sha256.Sum256(leaf.Raw)
+
+	pinned := false
+	for _, pin := range b.PinnedSHA256 {
+		if bytes.Equal(pin[:], fingerprint[:]) {
+			pinned = true
+			break
+		}
+	}
+	if !pinned {
+		return fmt.Errorf("backend certificate fingerprint %x doesn't match pinned", fingerprint)
+	}
+
+	if b.RootCAs == nil {
+		return nil
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         b.RootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(opts)
+	return err
+}
+
+// withBackendTLS set TLS options for connect to backend of the request.
+func withBackendTLS(ctx context.Context, backendTLS *BackendTLS) context.Context {
+	return context.WithValue(ctx, contextlabel.BackendTLS, backendTLS)
+}
+
+func getBackendTLS(ctx context.Context) *BackendTLS {
+	res, _ := ctx.Value(contextlabel.BackendTLS).(*BackendTLS)
+	return res
+}
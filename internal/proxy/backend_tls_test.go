@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	stdlog "log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestNewBackendTLS(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir)
+
+	_, err := NewBackendTLS(BackendTLSConfig{CAFile: filepath.Join(dir, "not-exist.pem")})
+	td.CmpError(err)
+
+	_, err = NewBackendTLS(BackendTLSConfig{CAFile: keyFile})
+	td.CmpError(err, "no certificates")
+
+	_, err = NewBackendTLS(BackendTLSConfig{PinnedSHA256: []string{"0102"}})
+	td.CmpError(err)
+
+	_, err = NewBackendTLS(BackendTLSConfig{MinVersion: "1.4"})
+	td.CmpError(err)
+
+	_, err = NewBackendTLS(BackendTLSConfig{CertFile: certFile})
+	td.CmpError(err)
+
+	pin := strings.Repeat("ab:", sha256.Size-1) + "AB"
+	res, err := NewBackendTLS(BackendTLSConfig{
+		CAFile:       certFile,
+		PinnedSHA256: []string{pin},
+		ServerName:   " backend.internal ",
+		MinVersion:   "1.3",
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+	})
+	td.CmpNoError(err)
+	td.Cmp(res.ServerName, "backend.internal")
+	td.NotNil(res.RootCAs)
+	td.Cmp(hex.EncodeToString(res.PinnedSHA256[0][:]), strings.Repeat("ab", sha256.Size))
+	td.Cmp(res.MinVersion, uint16(tls.VersionTLS13))
+	td.Len(res.Certificates, 1)
+}
+
+func TestTransport_BackendTLS(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir)
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	td.CmpNoError(err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(parseTestCert(t, clientCert))
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.ServerName))
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	backend.Config.ErrorLog = stdlog.New(io.Discard, "", 0) // expected handshake errors
+	backend.StartTLS()
+	defer backend.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	td.CmpNoError(os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0600))
+	fingerprint := sha256.Sum256(backend.Certificate().Raw)
+
+	target := backend.Listener.Addr().String()
+	request := func(backendTLS BackendTLSConfig) (string, error) {
+		options, err := NewBackendTLS(backendTLS)
+		td.CmpNoError(err)
+		tr := Transport{
+			RateLimiter: &RateLimiter{},
+			BackendTLS:  map[string]*BackendTLS{target: options},
+			Cache:       NewTransportCache(TransportParams{}),
+		}
+		defer tr.Cache.CloseIdleConnections()
+
+		req, _ := http.NewRequest(http.MethodGet, "https://"+target+"/", nil)
+		req.Host = "public.example.org"
+		resp, err := tr.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	serverName, err := request(BackendTLSConfig{
+		CAFile: caFile, ServerName: "example.com", MinVersion: "1.2", CertFile: certFile, KeyFile: keyFile,
+	})
+	td.CmpNoError(err)
+	td.Cmp(serverName, "example.com", "sni override")
+
+	_, err = request(BackendTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	td.CmpError(err, "request host isn't in backend certificate")
+
+	_, err = request(BackendTLSConfig{ServerName: "example.com", CertFile: certFile, KeyFile: keyFile})
+	td.CmpError(err, "unknown CA")
+
+	_, err = request(BackendTLSConfig{CAFile: caFile, ServerName: "example.com"})
+	td.CmpError(err, "without client certificate")
+
+	_, err = request(BackendTLSConfig{
+		PinnedSHA256: []string{hex.EncodeToString(fingerprint[:])}, CertFile: certFile, KeyFile: keyFile,
+	})
+	td.CmpNoError(err, "pinned certificate without CA")
+
+	_, err = request(BackendTLSConfig{
+		PinnedSHA256: []string{strings.Repeat("00", sha256.Size)}, CertFile: certFile, KeyFile: keyFile,
+	})
+	td.CmpError(err, "other pinned certificate")
+
+	_, err = request(BackendTLSConfig{
+		CAFile: caFile, ServerName: "other.com", PinnedSHA256: []string{hex.EncodeToString(fingerprint[:])},
+		CertFile: certFile, KeyFile: keyFile,
+	})
+	td.CmpError(err, "pinned certificate verified by CA if set")
+}
+
+// writeTestCert write self-signed certificate for client and server auth and its key to dir
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "lets-proxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client.key")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func parseTestCert(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	t.Helper()
+	res, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/metrics"
+)
+
+const (
+	EncodingGzip   = "gzip"
+	EncodingBrotli = "br"
+	EncodingZstd   = "zstd"
+)
+
+const (
+	defaultCompressionMinSize = 1024
+	brotliCompressionLevel    = 5
+)
+
+// DefaultCompressionEncodings in order of preference for same client weight.
+var DefaultCompressionEncodings = []string{EncodingZstd, EncodingBrotli, EncodingGzip}
+
+// DefaultCompressionContentTypes - media types for compress. Type with "/" or "*" in the end is prefix.
+var DefaultCompressionContentTypes = []string{
+	"text/html", "text/plain", "text/css", "text/javascript", "text/xml", "text/csv",
+	"application/javascript", "application/json", "application/xml", "application/rss+xml",
+	"application/atom+xml", "application/manifest+json", "application/wasm", "image/svg+xml",
+}
+
+// ResponseModifierCompression compress responses by encoding, negotiated by Accept-Encoding of request.
+// It skip responses with Content-Encoding, Content-Range, Cache-Control: no-transform, responses with content type
+// not from ContentTypes and with known length less then MinSize. Vary: Accept-Encoding set for all eligible responses.
+// Compression disabled if Encodings is empty.
+type ResponseModifierCompression struct {
+	Encodings    []string
+	ContentTypes []string
+	MinSize      int64
+
+	metrics *compressionMetrics
+}
+
+// NewResponseModifierCompression check encodings and create compression modifier.
+// r - registerer for compression metrics, can be nil.
+func NewResponseModifierCompression(encodings, contentTypes []string, minSize int64, r prometheus.Registerer) (ResponseModifierCompression, error) {
+	for _, encoding := range encodings {
+		if _, ok := compressorPools[encoding]; !ok {
+			return ResponseModifierCompression{}, errors.New("unknown compression encoding: " + strconv.Quote(encoding))
+		}
+	}
+	return ResponseModifierCompression{
+		Encodings:    encodings,
+		ContentTypes: contentTypes,
+		MinSize:      minSize,
+		metrics:      newCompressionMetrics(r),
+	}, nil
+}
+
+func (m ResponseModifierCompression) ModifyResponse(resp *http.Response) error {
+	if len(m.Encodings) == 0 || resp.Request == nil || !m.eligible(resp) {
+		return nil
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	addVary(resp.Header, "Accept-Encoding")
+
+	encoding := negotiateEncoding(resp.Request.Header.Get("Accept-Encoding"), m.Encodings)
+	if encoding == "" {
+		return nil
+	}
+
+	zc.L(resp.Request.Context()).Debug("Compress response", zap.String("encoding", encoding))
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	if etag := resp.Header.Get("Etag"); strings.HasPrefix(etag, `"`) {
+		resp.Header.Set("Etag", "W/"+etag)
+	}
+	resp.ContentLength = -1
+	resp.Body = m.compressBody(resp, encoding)
+	return nil
+}
+
+func (m ResponseModifierCompression) eligible(resp *http.Response) bool {
+	switch {
+	case resp.Request.Method == http.MethodHead,
+		resp.StatusCode < http.StatusOK,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusPartialContent,
+		resp.StatusCode == http.StatusNotModified:
+		return false
+	case resp.Header.Get("Content-Range") != "":
+		return false
+	case resp.Header.Get("Content-Encoding") != "" && !strings.EqualFold(resp.Header.Get("Content-Encoding"), "identity"):
+		return false
+	case strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform"):
+		return false
+	case resp.ContentLength >= 0 && resp.ContentLength < m.MinSize:
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, contentType := range m.ContentTypes {
+		if prefix := strings.TrimSuffix(contentType, "*"); strings.HasSuffix(prefix, "/") {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if mediaType == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+func (m ResponseModifierCompression) compressBody(resp *http.Response, encoding string) io.ReadCloser {
+	logger := zc.L(resp.Request.Context())
+	body := resp.Body
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		defer log.HandlePanic(logger)
+		defer func() { _ = body.Close() }()
+
+		output := &countingWriter{w: pipeWriter}
+		compressor := getCompressor(encoding, output)
+		input, err := io.Copy(compressor, body)
+		if err == nil {
+			err = compressor.Close()
+		}
+		if err == nil {
+			putCompressor(encoding, compressor)
+			m.metrics.observe(encoding, input, output.n)
+		}
+		log.DebugError(logger, err, "Compress response body", zap.String("encoding", encoding),
+			zap.Int64("input_bytes", input), zap.Int64("output_bytes", output.n))
+		_ = pipeWriter.CloseWithError(err)
+	}()
+	return pipeReader
+}
+
+// negotiateEncoding return encoding with max weight from Accept-Encoding header, encodings order used for same
+// weight. Return empty string if no acceptable encodings.
+func negotiateEncoding(acceptEncoding string, encodings []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		weight := 1.0
+		params = strings.TrimSpace(params)
+		if strings.HasPrefix(params, "q=") {
+			if q, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil {
+				weight = q
+			}
+		}
+		weights[name] = weight
+	}
+
+	var best string
+	var bestWeight float64
+	for _, encoding := range encodings {
+		weight, ok := weights[encoding]
+		if !ok {
+			weight = weights["*"]
+		}
+		if weight > bestWeight {
+			best = encoding
+			bestWeight = weight
+		}
+	}
+	return best
+}
+
+// addVary add value to Vary header if it absent.
+func addVary(header http.Header, value string) {
+	for _, line := range header.Values("Vary") {
+		for _, item := range strings.Split(line, ",") {
+			item = strings.TrimSpace(item)
+			if item == "*" || strings.EqualFold(item, value) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", value)
+}
+
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+var compressorPools = map[string]*sync.Pool{
+	EncodingGzip: {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+	EncodingBrotli: {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotliCompressionLevel)
+	}},
+	EncodingZstd: {New: func() interface{} {
+		encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return encoder
+	}},
+}
+
+func getCompressor(encoding string, w io.Writer) compressor {
+	res := compressorPools[encoding].Get().(compressor)
+	res.Reset(w)
+	return res
+}
+
+func putCompressor(encoding string, c compressor) {
+	c.Reset(nil)
+	compressorPools[encoding].Put(c)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+type compressionMetrics struct {
+	inputBytes  *prometheus.CounterVec
+	outputBytes *prometheus.CounterVec
+	ratio       *prometheus.HistogramVec
+}
+
+// newCompressionMetrics register metrics or use registered early (for example by previous config).
+// can return nil
+func newCompressionMetrics(r prometheus.Registerer) *compressionMetrics {
+	if r == nil || reflect.ValueOf(r).IsNil() {
+		return nil
+	}
+
+	inputBytes, ok := metrics.RegisterOrExisting(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "compression_input_bytes",
+		Help: "Bytes of responses before compression",
+	}, []string{"encoding"}))
+	if !ok {
+		return nil
+	}
+	outputBytes, ok := metrics.RegisterOrExisting(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "compression_output_bytes",
+		Help: "Bytes of compressed responses",
+	}, []string{"encoding"}))
+	if !ok {
+		return nil
+	}
+	ratio, ok := metrics.RegisterOrExisting(r, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "compression_ratio",
+		Help:    "Size of compressed response divided by size of original response",
+		Buckets: []float64{0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1},
+	}, []string{"encoding"}))
+	if !ok {
+		return nil
+	}
+	return &compressionMetrics{inputBytes: inputBytes, outputBytes: outputBytes, ratio: ratio}
+}
+
+func (m *compressionMetrics) observe(encoding string, input, output int64) {
+	if m == nil {
+		return
+	}
+	m.inputBytes.WithLabelValues(encoding).Add(float64(input))
+	m.outputBytes.WithLabelValues(encoding).Add(float64(output))
+	if input > 0 {
+		m.ratio.WithLabelValues(encoding).Observe(float64(output) / float64(input))
+	}
+}
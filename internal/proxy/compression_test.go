@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/maxatome/go-testdeep"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	encodings := []string{EncodingZstd, EncodingBrotli, EncodingGzip}
+	td.Cmp(negotiateEncoding("", encodings), "")
+	td.Cmp(negotiateEncoding("gzip", encodings), "gzip")
+	td.Cmp(negotiateEncoding("gzip, deflate, br", encodings), "br")
+	td.Cmp(negotiateEncoding("gzip, br, zstd", encodings), "zstd")
+	td.Cmp(negotiateEncoding("gzip;q=1.0, br;q=0.5", encodings), "gzip")
+	td.Cmp(negotiateEncoding("GZIP", encodings), "gzip")
+	td.Cmp(negotiateEncoding("deflate", encodings), "")
+	td.Cmp(negotiateEncoding("gzip;q=0", encodings), "")
+	td.Cmp(negotiateEncoding("*", encodings), "zstd")
+	td.Cmp(negotiateEncoding("*;q=0.5, zstd;q=0", encodings), "br")
+	td.Cmp(negotiateEncoding("br", []string{EncodingGzip}), "")
+}
+
+func TestAddVary(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	header := http.Header{}
+	addVary(header, "Accept-Encoding")
+	td.Cmp(header.Values("Vary"), []string{"Accept-Encoding"})
+
+	header = http.Header{"Vary": {"Origin, accept-encoding"}}
+	addVary(header, "Accept-Encoding")
+	td.Cmp(header.Values("Vary"), []string{"Origin, accept-encoding"})
+
+	header = http.Header{"Vary": {"Origin"}}
+	addVary(header, "Accept-Encoding")
+	td.Cmp(header.Values("Vary"), []string{"Origin", "Accept-Encoding"})
+}
+
+func TestResponseModifierCompression(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	_, err := NewResponseModifierCompression([]string{"deflate"}, nil, 0, nil)
+	td.CmpError(err)
+
+	registry := prometheus.NewRegistry()
+	m, err := NewResponseModifierCompression(DefaultCompressionEncodings, []string{"text/", "application/json"}, 10, registry)
+	td.CmpNoError(err)
+
+	content := strings.Repeat("compressible content ", 100)
+	newResponse := func(acceptEncoding string, header http.Header) *http.Response {
+		request, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		request = request.WithContext(ctx)
+		if acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if header == nil {
+			header = http.Header{}
+		}
+		if header.Get("Content-Type") == "" {
+			header.Set("Content-Type", "text/html; charset=utf-8")
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        header,
+			Body:          io.NopCloser(strings.NewReader(content)),
+			ContentLength: int64(len(content)),
+			Request:       request,
+		}
+	}
+	readBody := func(resp *http.Response) []byte {
+		body, err := io.ReadAll(resp.Body)
+		td.CmpNoError(err)
+		td.CmpNoError(resp.Body.Close())
+		return body
+	}
+
+	decoders := map[string]func(r io.Reader) io.Reader{
+		EncodingGzip: func(r io.Reader) io.Reader {
+			res, err := gzip.NewReader(r)
+			td.CmpNoError(err)
+			return res
+		},
+		EncodingBrotli: func(r io.Reader) io.Reader {
+			return brotli.NewReader(r)
+		},
+		EncodingZstd: func(r io.Reader) io.Reader {
+			res, err := zstd.NewReader(r)
+			td.CmpNoError(err)
+			return res
+		},
+	}
+	for encoding, decoder := range decoders {
+		// twice for check compressor from pool
+		for i := 0; i < 2; i++ {
+			resp := newResponse(encoding, http.Header{"Etag": {`"123"`}, "Content-Length": {"2100"}})
+			td.CmpNoError(m.ModifyResponse(resp))
+			td.Cmp(resp.Header.Get("Content-Encoding"), encoding)
+			td.Cmp(resp.Header.Get("Vary"), "Accept-Encoding")
+			td.Cmp(resp.Header.Get("Etag"), `W/"123"`)
+			td.Cmp(resp.Header.Get("Content-Length"), "")
+			td.Cmp(resp.ContentLength, int64(-1))
+
+			compressed := readBody(resp)
+			td.Lt(len(compressed), len(content)/5, encoding)
+			decompressed, err := io.ReadAll(decoder(bytes.NewReader(compressed)))
+			td.CmpNoError(err, encoding)
+			td.Cmp(string(decompressed), content, encoding)
+		}
+	}
+
+	resp := newResponse("", nil)
+	td.CmpNoError(m.ModifyResponse(resp))
+	td.Cmp(resp.Header.Get("Content-Encoding"), "")
+	td.Cmp(resp.Header.Get("Vary"), "Accept-Encoding", "vary for response without client encodings")
+	td.Cmp(string(readBody(resp)), content)
+
+	skip := func(name string, resp *http.Response) {
+		t.Helper()
+		td.CmpNoError(m.ModifyResponse(resp))
+		td.Cmp(resp.Header.Get("Vary"), "", name)
+		td.Cmp(resp.Header.Get("Content-Encoding"), resp.Header.Get("X-Original-Encoding"), name)
+	}
+	skip("image", newResponse("gzip", http.Header{"Content-Type": {"image/png"}}))
+	skip("encoded", newResponse("gzip", http.Header{"Content-Encoding": {"br"}, "X-Original-Encoding": {"br"}}))
+	skip("range", newResponse("gzip", http.Header{"Content-Range": {"bytes 0-10/2100"}}))
+	skip("no-transform", newResponse("gzip", http.Header{"Cache-Control": {"public, no-transform"}}))
+
+	resp = newResponse("gzip", nil)
+	resp.StatusCode = http.StatusPartialContent
+	skip("partial", resp)
+
+	resp = newResponse("gzip", nil)
+	resp.ContentLength = 5
+	skip("small", resp)
+
+	resp = newResponse("gzip", nil)
+	resp.Request.Method = http.MethodHead
+	skip("head", resp)
+
+	resp = newResponse("gzip", http.Header{"Content-Type": {"application/json"}})
+	resp.ContentLength = -1
+	td.CmpNoError(m.ModifyResponse(resp))
+	td.Cmp(resp.Header.Get("Content-Encoding"), "gzip", "unknown length")
+	readBody(resp)
+
+	families, err := registry.Gather()
+	td.CmpNoError(err)
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			values[family.GetName()+"/"+labelValue(metric, "encoding")] = metric.GetCounter().GetValue() +
+				float64(metric.GetHistogram().GetSampleCount())
+		}
+	}
+	td.Cmp(values["compression_input_bytes/gzip"], float64(len(content)*3))
+	td.Gt(values["compression_output_bytes/gzip"], float64(0))
+	td.Cmp(values["compression_ratio/gzip"], float64(3))
+	td.Cmp(values["compression_ratio/zstd"], float64(2))
+
+	// second registration use same metrics
+	_, err = NewResponseModifierCompression(DefaultCompressionEncodings, nil, 0, registry)
+	td.CmpNoError(err)
+}
+
+func labelValue(metric *dto.Metric, name string) string {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestResponseModifierFirstRoute(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	newRoute := func(host, prefix, value string) ResponseModifierRoute {
+		template, err := ParseHeaderTemplate(value)
+		td.CmpNoError(err)
+		route, err := NewResponseModifierRoute(host, prefix, ResponseModifierHeaders{Set: map[string]*HeaderTemplate{"X-Test": template}})
+		td.CmpNoError(err)
+		return route
+	}
+	modifier := NewResponseModifierFirstRoute([]ResponseModifierRoute{
+		newRoute("", "", "global"),
+		newRoute("", "/api", "api"),
+		newRoute("example.com", "", "host"),
+	})
+
+	check := func(host, path string) http.Header {
+		request, _ := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		resp := &http.Response{Request: request}
+		td.CmpNoError(modifier.ModifyResponse(resp))
+		return resp.Header
+	}
+	td.Cmp(check("other.com", "/"), http.Header{"X-Test": {"global"}})
+	td.Cmp(check("example.com", "/"), http.Header{"X-Test": {"host"}})
+	td.Cmp(check("example.com", "/api/v1"), http.Header{"X-Test": {"api"}})
+}
+
+func TestConfig_getCompression(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	c := Config{}
+	modifier, err := c.getCompression(ctx)
+	td.CmpNoError(err)
+	td.Nil(modifier)
+
+	c.Compression = []CompressionConfig{{Encodings: []string{"deflate"}}}
+	_, err = c.getCompression(ctx)
+	td.CmpError(err)
+
+	c.Compression = []CompressionConfig{{Prefix: "asd"}}
+	_, err = c.getCompression(ctx)
+	td.CmpError(err)
+
+	c.Compression = []CompressionConfig{
+		{Encodings: []string{" GZIP "}},
+		{Prefix: "/download/", Disable: true},
+	}
+	modifier, err = c.getCompression(ctx)
+	td.CmpNoError(err)
+	routes := modifier.(ResponseModifierFirstRoute)
+	td.Len(routes, 2)
+	td.Cmp(routes[0].prefix, "/download/")
+	td.Cmp(routes[0].modifier, ResponseModifierCompression{})
+	td.Cmp(routes[1].modifier, ResponseModifierCompression{
+		Encodings:    []string{EncodingGzip},
+		ContentTypes: DefaultCompressionContentTypes,
+		MinSize:      defaultCompressionMinSize,
+	})
+}
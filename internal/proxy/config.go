@@ -5,9 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+
 	"github.com/rekby/lets-proxy2/internal/log"
 
 	"go.uber.org/zap"
@@ -17,6 +21,50 @@ import (
 
 const defaultHTTPPort = 80
 
+// ResponseHeadersConfig describe modification of responses headers for requests, which match Host and Prefix.
+// Rules applied from common to specific, so specific rule can override header, set by common rule.
+type ResponseHeadersConfig struct {
+	// Host pattern in same format as for HostRoutes. Rule match any host if empty.
+	Host string
+
+	// Prefix of client request path. Rule match any path if empty.
+	Prefix string
+
+	// Set - colon separated HeaderName:HeaderValue, value is template same as for Headers.
+	Set []string
+
+	// Remove - names of headers for remove from response.
+	Remove []string
+
+	// HSTSMaxAge - max-age in seconds for Strict-Transport-Security header. It set for TLS connections only.
+	// Disabled if 0.
+	HSTSMaxAge            int
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+}
+
+// CompressionConfig describe compression of responses for requests, which match Host and Prefix.
+// Most specific matched rule used.
+type CompressionConfig struct {
+	// Host pattern in same format as for HostRoutes. Rule match any host if empty.
+	Host string
+
+	// Prefix of client request path. Rule match any path if empty.
+	Prefix string
+
+	// Disable compression for matched requests.
+	Disable bool
+
+	// Encodings in order of preference: zstd, br, gzip. Default - all.
+	Encodings []string
+
+	// ContentTypes - media types for compress, type with "/" or "*" in the end is prefix. Default - text types.
+	ContentTypes []string
+
+	// MinSize - responses with known length less then MinSize doesn't compress. 0 - default 1024 bytes.
+	MinSize int64
+}
+
 type IPHeaders struct {
 	Headers map[string]string
 	IP      string
@@ -26,16 +74,76 @@ type IPHeaders struct {
 type Config struct {
 	DefaultTarget           string
 	TargetMap               []string
+	HostRoutes              map[string]string
+	PathRoutes              []PathRoute
 	Headers                 []string
 	HeadersByIP             map[string][]string
 	KeepAliveTimeoutSeconds int
 	HTTPSBackend            bool
+	H2CBackend              bool
 	HTTPSBackendIgnoreCert  bool
 	EnableAccessLog         bool
 	RateLimit               int
 	RateLimitTimeWindowMs   int
 	RateLimitBurst          int
 	RateLimitCacheSize      int
+	Upstreams               map[string]UpstreamConfig
+	ProxyProtocolTargets    map[string]string
+	ResponseHeaders         []ResponseHeadersConfig
+
+	// HTTPSRedirectCode - 301 (default) or 308, for listeners from Listen.HTTPSRedirectAddresses.
+	HTTPSRedirectCode int
+
+	// HTTPSRedirectExceptHosts - host patterns, which stay on http.
+	HTTPSRedirectExceptHosts []string
+
+	// HTTPSRedirectExceptPaths - path prefixes, which stay on http.
+	HTTPSRedirectExceptPaths []string
+
+	// ErrorPages - html files for replace backend responses by status code ("502") or for all 5xx codes ("5xx").
+	ErrorPages map[string]string
+
+	// MaintenancePageFile - html file for answer to hosts in maintenance mode. Builtin page used if empty.
+	MaintenancePageFile string
+
+	// MaintenanceRetryAfterSeconds - value of Retry-After header for maintenance answer. Header doesn't send if 0.
+	MaintenanceRetryAfterSeconds int
+
+	Compression []CompressionConfig
+
+	// BackendMaxIdleConns - max idle connections of every cached backend transport. 0 - default 100.
+	BackendMaxIdleConns int
+
+	// BackendMaxIdleConnsPerHost - max idle connections to one backend. 0 - default 16.
+	BackendMaxIdleConnsPerHost int
+
+	// BackendIdleConnTimeoutSeconds - idle backend connections closed after the timeout. 0 - default 90.
+	BackendIdleConnTimeoutSeconds int
+
+	// BackendDialTimeoutSeconds - timeout of connect to backend. 0 - default 30.
+	BackendDialTimeoutSeconds int
+
+	// BackendTLSHandshakeTimeoutSeconds - timeout of TLS handshake with https backend. 0 - default 10.
+	BackendTLSHandshakeTimeoutSeconds int
+
+	// BackendResponseHeaderTimeoutSeconds - timeout of wait response headers from backend. 0 - without timeout.
+	BackendResponseHeaderTimeoutSeconds int
+
+	// BackendHTTP2 enable HTTP/2 to https backends, which support it.
+	BackendHTTP2 bool
+
+	// BackendTLS - TLS options for https connections to targets (IP:Port or upstream:<name>).
+	BackendTLS map[string]BackendTLSConfig
+
+	// BackendTransportCacheSize - max count of transports, cached by server name and TLS options. 0 - default 1000.
+	BackendTransportCacheSize int
+
+	// MetricsRegisterer for proxy metrics, set from code. Metrics disabled if nil.
+	MetricsRegisterer prometheus.Registerer `toml:"-"`
+
+	// PreviousUpstreams - upstream pools of running config on reload, set from code. Can be nil.
+	// New pools keep health state of same upstreams.
+	PreviousUpstreams Upstreams `toml:"-"`
 }
 
 func (c *Config) Apply(ctx context.Context, p *HTTPProxy) error {
@@ -59,24 +167,98 @@ func (c *Config) Apply(ctx context.Context, p *HTTPProxy) error {
 		CacheSize:  c.RateLimitCacheSize,
 	})
 
+	proxyProtocolTargets, err := c.getProxyProtocolTargets(ctx)
+	if resErr == nil {
+		resErr = err
+	}
+
+	upstreams, err := c.getUpstreams(ctx)
+	if resErr == nil {
+		resErr = err
+	}
+
+	transportCache, err := c.getTransportCache(ctx)
+	if resErr == nil {
+		resErr = err
+	}
+
+	backendTLS, err := c.getBackendTLSTargets(ctx)
+	if resErr == nil {
+		resErr = err
+	}
+
 	appendDirector(c.getDefaultTargetDirector)
 	appendDirector(c.getMapDirector)
+	appendDirector(c.getHostRoutesDirector)
 	appendDirector(c.getHeadersDirector)
 	appendDirector(c.getSchemaDirector)
 	appendDirector(c.getHeadersByIPDirector)
+	appendDirector(c.getPathRoutesDirector)
 	p.HTTPTransport = Transport{
 		IgnoreHTTPSCertificate: c.HTTPSBackendIgnoreCert,
 		RateLimiter:            rateLimiter,
+		Upstreams:              upstreams,
+		LogAttempts:            c.EnableAccessLog,
+		ProxyProtocolTargets:   proxyProtocolTargets,
+		BackendTLS:             backendTLS,
+		Cache:                  transportCache,
 	}
 	p.EnableAccessLog = c.EnableAccessLog
 
+	responseModifier, err := c.getResponseModifier(ctx)
+	if resErr == nil {
+		resErr = err
+	}
+
+	httpsRedirect, err := NewHTTPSRedirect(c.HTTPSRedirectCode, c.HTTPSRedirectExceptHosts, c.HTTPSRedirectExceptPaths)
+	if resErr == nil {
+		resErr = err
+	}
+
+	errorPages, err := c.getErrorPages(ctx)
+	if resErr == nil {
+		resErr = err
+	}
+
+	maintenancePage, err := c.getMaintenancePage(ctx)
+	if resErr == nil {
+		resErr = err
+	}
+
+	compression, err := c.getCompression(ctx)
+	if resErr == nil {
+		resErr = err
+	}
+
 	if resErr != nil {
 		zc.L(ctx).Error("Can't parse proxy config", zap.Error(resErr))
 		return resErr
 	}
 
+	for name, pool := range upstreams {
+		pool.params.ProxyProtocol = proxyProtocolTargets[UpstreamTargetPrefix+name]
+		pool.params.BackendTLS = backendTLS[UpstreamTargetPrefix+name]
+	}
+
+	// health checks bypass rate limiter and upstream pools
+	upstreams.StartHealthCheck(ctx, Transport{
+		IgnoreHTTPSCertificate: c.HTTPSBackendIgnoreCert,
+		RateLimiter:            &RateLimiter{},
+		BackendTLS:             backendTLS,
+		Cache:                  transportCache,
+	})
+
+	// config ctx cancelled on reload, connections of new config use new cache
+	go func() {
+		<-ctx.Done()
+		transportCache.CloseIdleConnections()
+	}()
+
 	chainDirector := NewDirectorChain(chain...)
 	p.Director = chainDirector
+	p.ResponseModifier = NewResponseModifierChain(errorPages, responseModifier, compression)
+	p.MaintenancePage = maintenancePage
+	p.HTTPSRedirect = httpsRedirect
 	p.IdleTimeout = time.Duration(c.KeepAliveTimeoutSeconds) * time.Second
 	return nil
 }
@@ -89,6 +271,14 @@ func (c *Config) getDefaultTargetDirector(ctx context.Context) (Director, error)
 	if s == "" {
 		return nil, errors.New("empty default target")
 	}
+	if strings.HasPrefix(s, UpstreamTargetPrefix) || strings.HasPrefix(s, UnixTargetPrefix) {
+		target, err := c.parseTarget(s)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Create upstream pool or unix socket director", zap.String("target", target))
+		return NewDirectorHost(target), nil
+	}
 	defaultTarget, err := net.ResolveTCPAddr("tcp", c.DefaultTarget)
 	logger.Debug("Parse default target as tcp address", zap.Stringer("default_target", defaultTarget), zap.Error(err))
 
@@ -131,8 +321,16 @@ func (c *Config) getHeadersDirector(ctx context.Context) (Director, error) {
 		m[lineParts[0]] = lineParts[1]
 	}
 
+	director, err := NewDirectorSetHeaders(m)
+	log.DebugError(logger, err, "Parse headers templates")
+	if err != nil {
+		return nil, err
+	}
+	for name, template := range director {
+		logHeaderTemplateWarnings(logger, name, template)
+	}
 	logger.Info("Create headers director", zap.Any("headers", m))
-	return NewDirectorSetHeaders(m), nil
+	return director, nil
 }
 
 // can return nil, nil
@@ -144,7 +342,7 @@ func (c *Config) getMapDirector(ctx context.Context) (Director, error) {
 
 	m := make(map[string]string)
 	for _, line := range c.TargetMap {
-		from, to, err := parseTCPMapPair(line)
+		from, to, err := c.parseTargetMapLine(line)
 		log.DebugError(logger, err, "Parse target map", zap.String("line", line),
 			zap.String("from", from), zap.String("to", to))
 		if err != nil {
@@ -157,10 +355,256 @@ func (c *Config) getMapDirector(ctx context.Context) (Director, error) {
 	return NewDirectorDestMap(m), nil
 }
 
+// getHostRoutesDirector create director for route requests by host.
+// can return nil, nil
+// example:
+//
+// [Proxy.HostRoutes]
+// "api.example.com" = "10.0.0.5:8080"
+// "*.static.example.com" = "10.0.0.9"
+// "~^img[0-9]+\\.example\\.com$" = "10.0.0.10:80"
+func (c *Config) getHostRoutesDirector(ctx context.Context) (Director, error) {
+	logger := zc.L(ctx)
+	if len(c.HostRoutes) == 0 {
+		return nil, nil
+	}
+
+	m := make(map[string]string, len(c.HostRoutes))
+	for pattern, target := range c.HostRoutes {
+		to, err := c.parseTarget(target)
+		log.DebugError(logger, err, "Parse host route target", zap.String("pattern", pattern),
+			zap.String("target", target), zap.String("to", to))
+		if err != nil {
+			return nil, err
+		}
+		m[strings.TrimSpace(pattern)] = to
+	}
+
+	director, err := NewDirectorHostRoutes(m)
+	if err != nil {
+		logger.Error("Can't create host routes director", zap.Error(err))
+		return nil, err
+	}
+
+	logger.Info("Add host routes director", zap.Any("routes", m))
+	return director, nil
+}
+
+// getPathRoutesDirector create director for route requests by path prefix.
+// It must be after schema director, because route can override backend scheme.
+// can return nil, nil
+// example:
+//
+// [[Proxy.PathRoutes]]
+// Host = "example.com"
+// Prefix = "/api/"
+// Target = "10.0.0.5:8080"
+// StripPrefix = true
+func (c *Config) getPathRoutesDirector(ctx context.Context) (Director, error) {
+	logger := zc.L(ctx)
+	if len(c.PathRoutes) == 0 {
+		return nil, nil
+	}
+
+	routes := make([]PathRoute, 0, len(c.PathRoutes))
+	for _, route := range c.PathRoutes {
+		route.Scheme = strings.ToLower(strings.TrimSpace(route.Scheme))
+		route.ProxyProtocol = strings.ToLower(strings.TrimSpace(route.ProxyProtocol))
+		if route.StaticDir != "" {
+			stat, err := os.Stat(route.StaticDir)
+			if err == nil && !stat.IsDir() {
+				err = fmt.Errorf("%q isn't directory", route.StaticDir)
+			}
+			log.DebugError(logger, err, "Check path route static dir", zap.String("prefix", route.Prefix),
+				zap.String("static_dir", route.StaticDir))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if route.Target != "" {
+			to, err := c.parseTarget(route.Target)
+			log.DebugError(logger, err, "Parse path route target", zap.String("prefix", route.Prefix),
+				zap.String("target", route.Target), zap.String("to", to))
+			if err != nil {
+				return nil, err
+			}
+			route.Target = to
+		}
+		routes = append(routes, route)
+	}
+
+	director, err := NewDirectorPathRoutes(routes)
+	if err != nil {
+		logger.Error("Can't create path routes director", zap.Error(err))
+		return nil, err
+	}
+
+	logger.Info("Add path routes director", zap.Any("routes", routes))
+	return director, nil
+}
+
+// getUpstreams create upstream pools from config
+// example:
+//
+// [Proxy.Upstreams.backend]
+// Strategy = "least-conn"
+// Targets = ["10.0.0.5:8080", "10.0.0.6:8080"]
+// HealthCheckPath = "/health"
+func (c *Config) getUpstreams(ctx context.Context) (Upstreams, error) {
+	logger := zc.L(ctx)
+
+	res := make(Upstreams, len(c.Upstreams))
+	for name, upstreamConfig := range c.Upstreams {
+		targets := make([]string, 0, len(upstreamConfig.Targets))
+		for _, target := range upstreamConfig.Targets {
+			if strings.HasPrefix(strings.TrimSpace(target), UpstreamTargetPrefix) {
+				return nil, fmt.Errorf("upstream pool %q can't contain other pool: %q", name, target)
+			}
+			to, err := c.parseTarget(target)
+			log.DebugError(logger, err, "Parse upstream target", zap.String("pool", name),
+				zap.String("target", target), zap.String("to", to))
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, to)
+		}
+
+		pool, err := NewUpstreamPool(UpstreamPoolParams{
+			Name:                name,
+			Strategy:            strings.ToLower(strings.TrimSpace(upstreamConfig.Strategy)),
+			Targets:             targets,
+			HealthCheckPath:     upstreamConfig.HealthCheckPath,
+			HealthCheckScheme:   strings.ToLower(strings.TrimSpace(upstreamConfig.HealthCheckScheme)),
+			HealthCheckInterval: time.Duration(upstreamConfig.HealthCheckIntervalSeconds) * time.Second,
+			HealthCheckTimeout:  time.Duration(upstreamConfig.HealthCheckTimeoutSeconds) * time.Second,
+			HealthyThreshold:    upstreamConfig.HealthyThreshold,
+			UnhealthyThreshold:  upstreamConfig.UnhealthyThreshold,
+			MaxFails:            upstreamConfig.MaxFails,
+			FailTimeout:         time.Duration(upstreamConfig.FailTimeoutSeconds) * time.Second,
+			Retries:             upstreamConfig.Retries,
+			RetryReplayableBody: upstreamConfig.RetryReplayableBody,
+			TryTimeout:          time.Duration(upstreamConfig.TryTimeoutMs) * time.Millisecond,
+			RetryStatusCodes:    upstreamConfig.RetryStatusCodes,
+			Registerer:          c.MetricsRegisterer,
+			Previous:            c.PreviousUpstreams[name],
+		})
+		if err != nil {
+			logger.Error("Can't create upstream pool", zap.String("pool", name), zap.Error(err))
+			return nil, err
+		}
+		logger.Info("Create upstream pool", zap.String("pool", name), zap.Strings("targets", targets),
+			zap.String("strategy", pool.params.Strategy))
+		res[name] = pool
+	}
+	return res, nil
+}
+
+// getProxyProtocolTargets return map from normalized target to PROXY protocol version
+// example:
+//
+// [Proxy.ProxyProtocolTargets]
+// "10.0.0.5:25" = "v1"
+// "upstream:nginx" = "v2"
+func (c *Config) getProxyProtocolTargets(ctx context.Context) (map[string]string, error) {
+	logger := zc.L(ctx)
+	if len(c.ProxyProtocolTargets) == 0 {
+		return nil, nil
+	}
+
+	res := make(map[string]string, len(c.ProxyProtocolTargets))
+	for target, version := range c.ProxyProtocolTargets {
+		to, err := c.parseTarget(target)
+		log.DebugError(logger, err, "Parse PROXY protocol target", zap.String("target", target), zap.String("to", to))
+		if err != nil {
+			return nil, err
+		}
+		version, err = parseProxyProtocolVersion(version)
+		if err != nil {
+			logger.Error("Bad PROXY protocol version", zap.String("target", target), zap.Error(err))
+			return nil, err
+		}
+		if version != "" {
+			res[to] = version
+		}
+	}
+	logger.Info("PROXY protocol targets", zap.Any("targets", res))
+	return res, nil
+}
+
+func (c *Config) getTransportCache(ctx context.Context) (*TransportCache, error) {
+	logger := zc.L(ctx)
+
+	values := map[string]int{
+		"BackendMaxIdleConns":                 c.BackendMaxIdleConns,
+		"BackendMaxIdleConnsPerHost":          c.BackendMaxIdleConnsPerHost,
+		"BackendIdleConnTimeoutSeconds":       c.BackendIdleConnTimeoutSeconds,
+		"BackendDialTimeoutSeconds":           c.BackendDialTimeoutSeconds,
+		"BackendTLSHandshakeTimeoutSeconds":   c.BackendTLSHandshakeTimeoutSeconds,
+		"BackendResponseHeaderTimeoutSeconds": c.BackendResponseHeaderTimeoutSeconds,
+		"BackendTransportCacheSize":           c.BackendTransportCacheSize,
+	}
+	for name, value := range values {
+		if value < 0 {
+			logger.Error("Negative backend transport option", zap.String("option", name), zap.Int("value", value))
+			return nil, fmt.Errorf("%v must not be negative: %v", name, value)
+		}
+	}
+
+	params := TransportParams{
+		CacheSize:             c.BackendTransportCacheSize,
+		MaxIdleConns:          c.BackendMaxIdleConns,
+		MaxIdleConnsPerHost:   c.BackendMaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(c.BackendIdleConnTimeoutSeconds) * time.Second,
+		DialTimeout:           time.Duration(c.BackendDialTimeoutSeconds) * time.Second,
+		TLSHandshakeTimeout:   time.Duration(c.BackendTLSHandshakeTimeoutSeconds) * time.Second,
+		ResponseHeaderTimeout: time.Duration(c.BackendResponseHeaderTimeoutSeconds) * time.Second,
+		HTTP2:                 c.BackendHTTP2,
+	}
+	cache := NewTransportCache(params)
+	logger.Info("Backend transport", zap.Reflect("params", cache.params))
+	return cache, nil
+}
+
+// getBackendTLSTargets return map from normalized target to TLS options
+// example:
+//
+// [Proxy.BackendTLS."upstream:backend"]
+// CAFile = "/etc/lets-proxy/backend-ca.pem"
+// ServerName = "backend.internal"
+func (c *Config) getBackendTLSTargets(ctx context.Context) (map[string]*BackendTLS, error) {
+	logger := zc.L(ctx)
+	if len(c.BackendTLS) == 0 {
+		return nil, nil
+	}
+
+	res := make(map[string]*BackendTLS, len(c.BackendTLS))
+	for target, tlsConfig := range c.BackendTLS {
+		to, err := c.parseTarget(target)
+		log.DebugError(logger, err, "Parse backend TLS target", zap.String("target", target), zap.String("to", to))
+		if err != nil {
+			return nil, err
+		}
+		backendTLS, err := NewBackendTLS(tlsConfig)
+		if err != nil {
+			logger.Error("Bad backend TLS options", zap.String("target", target), zap.Error(err))
+			return nil, err
+		}
+		res[to] = backendTLS
+	}
+	logger.Info("Backend TLS targets", zap.Int("count", len(res)))
+	return res, nil
+}
+
 func (c *Config) getSchemaDirector(ctx context.Context) (Director, error) {
+	if c.HTTPSBackend && c.H2CBackend {
+		return nil, errors.New("HTTPSBackend and H2CBackend can't be enabled together")
+	}
 	if c.HTTPSBackend {
 		return NewSetSchemeDirector(ProtocolHTTPS), nil
 	}
+	if c.H2CBackend {
+		return NewSetSchemeDirector(ProtocolH2C), nil
+	}
 	return NewSetSchemeDirector(ProtocolHTTP), nil
 }
 
@@ -238,7 +682,214 @@ func (c *Config) getHeadersByIPDirector(ctx context.Context) (Director, error) {
 	}
 
 	logger.Info("Create headers by ip director", zap.Any("headers", m))
-	return NewDirectorSetHeadersByIP(m)
+	director, err := NewDirectorSetHeadersByIP(m)
+	if err != nil {
+		return nil, err
+	}
+	for value, template := range director.templates {
+		logHeaderTemplateWarnings(logger, value, template)
+	}
+	return director, nil
+}
+
+// logHeaderTemplateWarnings log text in {{...}}, which kept in header value as is.
+func logHeaderTemplateWarnings(logger *zap.Logger, header string, template *HeaderTemplate) {
+	for _, warning := range template.Warnings() {
+		logger.Warn("Header template contains unknown expression", zap.String("header", header), zap.Error(warning))
+	}
+}
+
+// getResponseModifier create modifiers chain from ResponseHeaders rules. Can return nil, nil.
+func (c *Config) getResponseModifier(ctx context.Context) (ResponseModifier, error) {
+	logger := zc.L(ctx)
+	if len(c.ResponseHeaders) == 0 {
+		return nil, nil
+	}
+
+	routes := make([]ResponseModifierRoute, 0, len(c.ResponseHeaders))
+	for _, rule := range c.ResponseHeaders {
+		headers := ResponseModifierHeaders{Set: make(map[string]*HeaderTemplate, len(rule.Set)), Remove: rule.Remove}
+		for _, line := range rule.Set {
+			lineParts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+			if len(lineParts) != 2 {
+				logger.Error("Can't split response header line to parts", zap.String("line", line))
+				return nil, errors.New("can't parse response headers proxy config")
+			}
+			template, err := ParseHeaderTemplate(lineParts[1])
+			if err != nil {
+				return nil, fmt.Errorf("parse response header %q: %w", line, err)
+			}
+			logHeaderTemplateWarnings(logger, lineParts[0], template)
+			headers.Set[lineParts[0]] = template
+		}
+
+		var modifier ResponseModifier = headers
+		if rule.HSTSMaxAge > 0 {
+			modifier = NewResponseModifierChain(headers,
+				NewResponseModifierHSTS(rule.HSTSMaxAge, rule.HSTSIncludeSubdomains, rule.HSTSPreload))
+		}
+
+		route, err := NewResponseModifierRoute(rule.Host, rule.Prefix, modifier)
+		log.DebugError(logger, err, "Create response headers rule", zap.String("host", rule.Host),
+			zap.String("prefix", rule.Prefix))
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	sortResponseModifierRoutes(routes)
+
+	chain := make([]ResponseModifier, 0, len(routes))
+	for _, route := range routes {
+		chain = append(chain, route)
+	}
+
+	logger.Info("Add response headers modifier", zap.Any("rules", c.ResponseHeaders))
+	return NewResponseModifierChain(chain...), nil
+}
+
+// getErrorPages read error pages files. Can return nil, nil.
+func (c *Config) getErrorPages(ctx context.Context) (ResponseModifier, error) {
+	logger := zc.L(ctx)
+	if len(c.ErrorPages) == 0 {
+		return nil, nil
+	}
+
+	res := ResponseModifierErrorPages{Pages: make(map[int][]byte, len(c.ErrorPages))}
+	for code, file := range c.ErrorPages {
+		page, err := os.ReadFile(file)
+		log.DebugError(logger, err, "Read error page", zap.String("code", code), zap.String("file", file))
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.EqualFold(code, "5xx") {
+			res.Default = page
+			continue
+		}
+		statusCode, err := strconv.Atoi(code)
+		if err != nil || statusCode < 500 || statusCode > 599 {
+			return nil, fmt.Errorf("error page code must be 5xx or number from 500 to 599: %q", code)
+		}
+		res.Pages[statusCode] = page
+	}
+
+	logger.Info("Add error pages", zap.Any("pages", c.ErrorPages))
+	return res, nil
+}
+
+// getCompression create compression modifier from Compression rules. Can return nil, nil.
+func (c *Config) getCompression(ctx context.Context) (ResponseModifier, error) {
+	logger := zc.L(ctx)
+	if len(c.Compression) == 0 {
+		return nil, nil
+	}
+
+	routes := make([]ResponseModifierRoute, 0, len(c.Compression))
+	for _, rule := range c.Compression {
+		var modifier ResponseModifierCompression
+		if !rule.Disable {
+			encodings := DefaultCompressionEncodings
+			if len(rule.Encodings) > 0 {
+				encodings = make([]string, 0, len(rule.Encodings))
+				for _, encoding := range rule.Encodings {
+					encodings = append(encodings, strings.ToLower(strings.TrimSpace(encoding)))
+				}
+			}
+			contentTypes := rule.ContentTypes
+			if len(contentTypes) == 0 {
+				contentTypes = DefaultCompressionContentTypes
+			}
+			minSize := rule.MinSize
+			if minSize == 0 {
+				minSize = defaultCompressionMinSize
+			}
+
+			var err error
+			modifier, err = NewResponseModifierCompression(encodings, contentTypes, minSize, c.MetricsRegisterer)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		route, err := NewResponseModifierRoute(rule.Host, rule.Prefix, modifier)
+		log.DebugError(logger, err, "Create compression rule", zap.String("host", rule.Host),
+			zap.String("prefix", rule.Prefix))
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+
+	logger.Info("Add compression", zap.Any("rules", c.Compression))
+	return NewResponseModifierFirstRoute(routes), nil
+}
+
+func (c *Config) getMaintenancePage(ctx context.Context) (MaintenancePage, error) {
+	res := MaintenancePage{RetryAfter: time.Duration(c.MaintenanceRetryAfterSeconds) * time.Second}
+	if c.MaintenancePageFile == "" {
+		return res, nil
+	}
+
+	var err error
+	res.Body, err = os.ReadFile(c.MaintenancePageFile)
+	log.DebugError(zc.L(ctx), err, "Read maintenance page", zap.String("file", c.MaintenancePageFile))
+	return res, err
+}
+
+// parseTarget parse IP or IP:Port target address, unix socket "unix:/path.sock" or reference to upstream pool
+// "upstream:<name>".
+// Port 80 used if it absent.
+func (c *Config) parseTarget(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, UpstreamTargetPrefix) {
+		name := strings.TrimPrefix(s, UpstreamTargetPrefix)
+		if _, ok := c.Upstreams[name]; !ok {
+			return "", fmt.Errorf("unknown upstream pool: %q", name)
+		}
+		return s, nil
+	}
+	if strings.HasPrefix(s, UnixTargetPrefix) {
+		return parseUnixTarget(s)
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		ipAddr, ipErr := net.ResolveIPAddr("ip", s)
+		if ipErr != nil {
+			return "", fmt.Errorf("can't resolve target addr %q: %v", s, err.Error())
+		}
+		addr = &net.TCPAddr{IP: ipAddr.IP, Port: defaultHTTPPort}
+	}
+	if len(addr.IP) == 0 {
+		return "", fmt.Errorf("target addr has no ip: %q", s)
+	}
+	return addr.String(), nil
+}
+
+// parseTargetMapLine parse TargetMap line. Target can be reference to upstream pool or unix socket.
+func (c *Config) parseTargetMapLine(line string) (from, to string, err error) {
+	line = strings.TrimSpace(line)
+	pos := strings.Index(line, "-"+UpstreamTargetPrefix)
+	if pos == -1 {
+		pos = strings.Index(line, "-"+UnixTargetPrefix)
+	}
+	if pos == -1 {
+		return parseTCPMapPair(line)
+	}
+
+	fromTCP, err := net.ResolveTCPAddr("tcp", line[:pos])
+	if err != nil {
+		return "", "", fmt.Errorf("from addr can't resolve: %v", err.Error())
+	}
+	if len(fromTCP.IP) == 0 {
+		return "", "", errors.New("from addr has no ip")
+	}
+	to, err = c.parseTarget(line[pos+1:])
+	if err != nil {
+		return "", "", err
+	}
+	return fromTCP.String(), to, nil
 }
 
 func parseTCPMapPair(line string) (from, to string, err error) {
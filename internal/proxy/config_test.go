@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/rekby/lets-proxy2/internal/th"
 
@@ -147,15 +148,41 @@ func TestConfig_getHeadersDirector(t *testing.T) {
 	td.CmpError(err)
 
 	c = Config{
-		Headers: []string{"asd:aaa", "bbb:ccc:hhh", "Ajd:{{qwe}}"},
+		Headers: []string{"asd:aaa", "bbb:ccc:hhh", "Ajd:{{SOURCE_IP | sha256}}"},
 	}
 	director, err = c.getHeadersDirector(ctx)
-	td.CmpDeeply(director, NewDirectorSetHeaders(map[string]string{
+	td.CmpDeeply(director, newTestDirectorSetHeaders(t, map[string]string{
 		"asd": "aaa",
 		"bbb": "ccc:hhh",
-		"Ajd": "{{qwe}}",
+		"Ajd": "{{SOURCE_IP | sha256}}",
 	}))
 	td.CmpNoError(err)
+
+	c = Config{
+		Headers: []string{"asd:aaa", "Ajd:{{qwe}}"},
+	}
+	director, err = c.getHeadersDirector(ctx)
+	td.CmpNoError(err, "unknown expression kept as text")
+	td.CmpDeeply(director, newTestDirectorSetHeaders(t, map[string]string{
+		"asd": "aaa",
+		"Ajd": "{{qwe}}",
+	}))
+
+	c = Config{
+		Headers: []string{"asd:aaa", "Ajd:{{sha256 qwe}}"},
+	}
+	director, err = c.getHeadersDirector(ctx)
+	td.Nil(director)
+	td.CmpError(err, "unknown variable")
+}
+
+func newTestDirectorSetHeaders(t *testing.T, m map[string]string) DirectorSetHeaders {
+	t.Helper()
+	director, err := NewDirectorSetHeaders(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return director
 }
 
 func TestConfig_getMapDirector(t *testing.T) {
@@ -206,6 +233,186 @@ func TestConfig_getMapDirector(t *testing.T) {
 	td.CmpNoError(err)
 }
 
+func TestConfig_getHostRoutesDirector(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	var director Director
+	var err error
+
+	c := Config{}
+	director, err = c.getHostRoutesDirector(ctx)
+	td.Nil(director)
+	td.CmpNoError(err)
+
+	c = Config{
+		HostRoutes: map[string]string{"api.example.com": "asd:asd"},
+	}
+	director, err = c.getHostRoutesDirector(ctx)
+	td.Nil(director)
+	td.CmpError(err)
+
+	c = Config{
+		HostRoutes: map[string]string{"~[": "1.2.3.4"},
+	}
+	director, err = c.getHostRoutesDirector(ctx)
+	td.Nil(director)
+	td.CmpError(err)
+
+	c = Config{
+		HostRoutes: map[string]string{
+			"api.example.com":      "10.0.0.5:8080",
+			"*.static.example.com": "10.0.0.9",
+			"ipv6.example.com":     "[::1]:91",
+		},
+	}
+	director, err = c.getHostRoutesDirector(ctx)
+	td.CmpNoError(err)
+	expected, _ := NewDirectorHostRoutes(map[string]string{
+		"api.example.com":      "10.0.0.5:8080",
+		"*.static.example.com": "10.0.0.9:80",
+		"ipv6.example.com":     "[::1]:91",
+	})
+	td.CmpDeeply(director, expected)
+}
+
+func TestConfig_getPathRoutesDirector(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	var director Director
+	var err error
+
+	c := Config{}
+	director, err = c.getPathRoutesDirector(ctx)
+	td.Nil(director)
+	td.CmpNoError(err)
+
+	c = Config{
+		PathRoutes: []PathRoute{{Prefix: "/api/", Target: "asd:asd"}},
+	}
+	director, err = c.getPathRoutesDirector(ctx)
+	td.Nil(director)
+	td.CmpError(err)
+
+	c = Config{
+		PathRoutes: []PathRoute{{Prefix: "api"}},
+	}
+	director, err = c.getPathRoutesDirector(ctx)
+	td.Nil(director)
+	td.CmpError(err)
+
+	c = Config{
+		PathRoutes: []PathRoute{
+			{Prefix: "/", Target: "10.0.0.1"},
+			{Host: "example.com", Prefix: "/api/", Target: "10.0.0.2:8080", StripPrefix: true, Scheme: " HTTPS "},
+		},
+	}
+	director, err = c.getPathRoutesDirector(ctx)
+	td.CmpNoError(err)
+	expected, _ := NewDirectorPathRoutes([]PathRoute{
+		{Prefix: "/", Target: "10.0.0.1:80"},
+		{Host: "example.com", Prefix: "/api/", Target: "10.0.0.2:8080", StripPrefix: true, Scheme: ProtocolHTTPS},
+	})
+	td.CmpDeeply(director, expected)
+}
+
+func TestConfig_getUpstreams(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	c := Config{}
+	upstreams, err := c.getUpstreams(ctx)
+	td.CmpNoError(err)
+	td.Len(upstreams, 0)
+
+	c = Config{Upstreams: map[string]UpstreamConfig{"backend": {}}}
+	_, err = c.getUpstreams(ctx)
+	td.CmpError(err)
+
+	c = Config{Upstreams: map[string]UpstreamConfig{"backend": {Targets: []string{"asd:asd"}}}}
+	_, err = c.getUpstreams(ctx)
+	td.CmpError(err)
+
+	c = Config{Upstreams: map[string]UpstreamConfig{
+		"backend": {Targets: []string{"upstream:backend"}},
+	}}
+	_, err = c.getUpstreams(ctx)
+	td.CmpError(err)
+
+	c = Config{Upstreams: map[string]UpstreamConfig{
+		"backend": {
+			Targets: []string{"1.2.3.4", "[::1]:81"}, Strategy: " Least-Conn ", MaxFails: 3,
+			Retries: 2, TryTimeoutMs: 1500, RetryStatusCodes: []int{502},
+		},
+	}}
+	upstreams, err = c.getUpstreams(ctx)
+	td.CmpNoError(err)
+	td.Cmp(upstreams["backend"].params.Targets, []string{"1.2.3.4:80", "[::1]:81"})
+	td.Cmp(upstreams["backend"].params.Strategy, StrategyLeastConn)
+	td.Cmp(upstreams["backend"].params.MaxFails, 3)
+	td.Cmp(upstreams["backend"].params.Retries, 2)
+	td.Cmp(upstreams["backend"].params.TryTimeout, 1500*time.Millisecond)
+	td.Cmp(upstreams["backend"].params.RetryStatusCodes, []int{502})
+
+	c = Config{Upstreams: map[string]UpstreamConfig{
+		"backend": {Targets: []string{"1.2.3.4"}, RetryStatusCodes: []int{1000}},
+	}}
+	_, err = c.getUpstreams(ctx)
+	td.CmpError(err)
+}
+
+func TestConfig_parseTarget(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	c := Config{Upstreams: map[string]UpstreamConfig{"backend": {Targets: []string{"1.2.3.4"}}}}
+
+	target, err := c.parseTarget(" upstream:backend ")
+	td.CmpNoError(err)
+	td.Cmp(target, "upstream:backend")
+
+	_, err = c.parseTarget("upstream:unknown")
+	td.CmpError(err)
+
+	target, err = c.parseTarget("1.2.3.4")
+	td.CmpNoError(err)
+	td.Cmp(target, "1.2.3.4:80")
+
+	_, err = c.parseTarget(":80")
+	td.CmpError(err)
+
+	from, to, err := c.parseTargetMapLine("1.2.3.4:443-upstream:backend")
+	td.CmpNoError(err)
+	td.Cmp(from, "1.2.3.4:443")
+	td.Cmp(to, "upstream:backend")
+
+	_, _, err = c.parseTargetMapLine("1.2.3.4:443-upstream:unknown")
+	td.CmpError(err)
+
+	from, to, err = c.parseTargetMapLine("1.2.3.4:443-2.3.4.5:80")
+	td.CmpNoError(err)
+	td.Cmp(from, "1.2.3.4:443")
+	td.Cmp(to, "2.3.4.5:80")
+
+	target, err = c.parseTarget("unix:/run/app.sock")
+	td.CmpNoError(err)
+	td.Cmp(target, "unix:/run/app.sock")
+
+	_, err = c.parseTarget("unix:run/app.sock")
+	td.CmpError(err)
+
+	from, to, err = c.parseTargetMapLine("1.2.3.4:443-unix:/run/my-app.sock")
+	td.CmpNoError(err)
+	td.Cmp(from, "1.2.3.4:443")
+	td.Cmp(to, "unix:/run/my-app.sock")
+}
+
 func TestConfig_getSchemeDirector(t *testing.T) {
 	ctx, flush := th.TestContext(t)
 	defer flush()
@@ -228,6 +435,20 @@ func TestConfig_getSchemeDirector(t *testing.T) {
 	director, err = c.getSchemaDirector(ctx)
 	td.CmpNoError(err)
 	td.CmpDeeply(director, NewSetSchemeDirector(ProtocolHTTPS))
+
+	c = &Config{
+		H2CBackend: true,
+	}
+	director, err = c.getSchemaDirector(ctx)
+	td.CmpNoError(err)
+	td.CmpDeeply(director, NewSetSchemeDirector(ProtocolH2C))
+
+	c = &Config{
+		HTTPSBackend: true,
+		H2CBackend:   true,
+	}
+	_, err = c.getSchemaDirector(ctx)
+	td.CmpError(err)
 }
 
 func TestConfig_Apply(t *testing.T) {
@@ -260,7 +481,7 @@ func TestConfig_Apply(t *testing.T) {
 	td.CmpDeeply(p.Director,
 		NewDirectorChain(
 			NewDirectorSameIP(94),
-			NewDirectorSetHeaders(map[string]string{"aaa": "bbb"}),
+			newTestDirectorSetHeaders(t, map[string]string{"aaa": "bbb"}),
 			NewSetSchemeDirector(ProtocolHTTP),
 		),
 	)
@@ -277,10 +498,37 @@ func TestConfig_Apply(t *testing.T) {
 	td.CmpDeeply(p.Director, NewDirectorChain(
 		NewDirectorHost("1.2.3.4:94"),
 		NewDirectorDestMap(map[string]string{"1.2.3.4:33": "4.5.6.7:88"}),
-		NewDirectorSetHeaders(map[string]string{"aaa": "bbb"}),
+		newTestDirectorSetHeaders(t, map[string]string{"aaa": "bbb"}),
 		NewSetSchemeDirector(ProtocolHTTPS),
 	))
 
+	c = Config{
+		DefaultTarget: "upstream:backend",
+		Upstreams:     map[string]UpstreamConfig{"backend": {Targets: []string{"1.2.3.4:80"}}},
+	}
+	p = &HTTPProxy{}
+	err = c.Apply(ctx, p)
+	td.CmpNoError(err)
+	td.CmpDeeply(p.Director, NewDirectorChain(
+		NewDirectorHost("upstream:backend"),
+		NewSetSchemeDirector(ProtocolHTTP),
+	))
+	td.Len(p.HTTPTransport.(Transport).Upstreams, 1)
+
+	c = Config{DefaultTarget: "unix:/run/app.sock"}
+	p = &HTTPProxy{}
+	err = c.Apply(ctx, p)
+	td.CmpNoError(err)
+	td.CmpDeeply(p.Director, NewDirectorChain(
+		NewDirectorHost("unix:/run/app.sock"),
+		NewSetSchemeDirector(ProtocolHTTP),
+	))
+
+	c = Config{DefaultTarget: "upstream:unknown"}
+	p = &HTTPProxy{}
+	err = c.Apply(ctx, p)
+	td.CmpError(err)
+
 	// Test backendSchemas
 
 	c = Config{HTTPSBackendIgnoreCert: false}
@@ -334,6 +582,15 @@ func TestConfig_getHeadersByIPDirector(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "templateError",
+			c: Config{
+				HeadersByIP: map[string][]string{
+					"192.168.1.0/24": {"X-Client:{{SOURCE_IP | unknown}}"},
+				},
+			},
+			wantErr: true,
+		},
 		{
 			name: "5Networks",
 			c: Config{
@@ -462,3 +719,54 @@ func netToIP(ipnet *net.IPNet) (net.IP, error) {
 
 	return net.ParseIP(strings.Join(split, sep)), nil
 }
+
+func TestConfig_getTransportCache(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	c := Config{BackendDialTimeoutSeconds: -1}
+	_, err := c.getTransportCache(ctx)
+	td.CmpError(err)
+
+	c = Config{
+		BackendMaxIdleConnsPerHost:          4,
+		BackendDialTimeoutSeconds:           5,
+		BackendResponseHeaderTimeoutSeconds: 60,
+		BackendHTTP2:                        true,
+	}
+	cache, err := c.getTransportCache(ctx)
+	td.CmpNoError(err)
+	td.Cmp(cache.params, TransportParams{
+		CacheSize:             defaultTransportCacheSize,
+		MaxIdleConns:          defaultMaxIdleConns,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       defaultIdleConnTimeout,
+		DialTimeout:           5 * time.Second,
+		TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+		ResponseHeaderTimeout: time.Minute,
+		HTTP2:                 true,
+	})
+}
+
+func TestConfig_getBackendTLSTargets(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	c := Config{}
+	res, err := c.getBackendTLSTargets(ctx)
+	td.CmpNoError(err)
+	td.Nil(res)
+
+	c.BackendTLS = map[string]BackendTLSConfig{"1.2.3.4:443": {MinVersion: "2.0"}}
+	_, err = c.getBackendTLSTargets(ctx)
+	td.CmpError(err)
+
+	c.BackendTLS = map[string]BackendTLSConfig{"1.2.3.4": {ServerName: "backend.internal"}}
+	res, err = c.getBackendTLSTargets(ctx)
+	td.CmpNoError(err)
+	td.Cmp(res, map[string]*BackendTLS{"1.2.3.4:80": {ServerName: "backend.internal"}})
+}
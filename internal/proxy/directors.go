@@ -1,14 +1,15 @@
 package proxy
 
 import (
+	"crypto/x509"
 	"fmt"
-	"github.com/rekby/lets-proxy2/internal/contextlabel"
 	"net"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
-
-	"github.com/rekby/lets-proxy2/internal/log"
+	"strings"
 
 	zc "github.com/rekby/zapcontext"
 
@@ -17,17 +18,12 @@ import (
 	"github.com/egorgasay/cidranger"
 )
 
-const (
-	ConnectionID = "{{CONNECTION_ID}}"
-	HTTPProto    = "{{HTTP_PROTO}}"
-	SourceIP     = "{{SOURCE_IP}}"
-	SourcePort   = "{{SOURCE_PORT}}"
-	SourceIPPort = "{{SOURCE_IP}}:{{SOURCE_PORT}}"
-)
-
 const (
 	ProtocolHTTP  = "http"
 	ProtocolHTTPS = "https"
+
+	// ProtocolH2C - HTTP/2 without TLS, for example for gRPC backends.
+	ProtocolH2C = "h2c"
 )
 
 type DirectorChain []Director
@@ -72,13 +68,27 @@ func NewDirectorSameIP(port int) DirectorSameIP {
 }
 
 func (s DirectorSameIP) Director(request *http.Request) error {
-	localAddr := request.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	localAddr, _ := request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	var localIP net.IP
+	switch addr := localAddr.(type) {
+	case *net.TCPAddr:
+		localIP = addr.IP
+	case *net.UDPAddr:
+		// HTTP/3 listener, usually listen all interfaces
+		localIP = addr.IP
+		if localIP.IsUnspecified() {
+			localIP = net.IPv4(127, 0, 0, 1)
+		}
+	default:
+		// unix socket listener
+		localIP = net.IPv4(127, 0, 0, 1)
+	}
 	if request.URL == nil {
 		request.URL = &url.URL{}
 	}
-	request.URL.Host = localAddr.IP.String() + ":" + s.Port
+	request.URL.Host = localIP.String() + ":" + s.Port
 	zc.L(request.Context()).Debug("Set target as same ip",
-		zap.Stringer("local_addr", localAddr), zap.String("dest_host", request.Host))
+		zap.Any("local_addr", localAddr), zap.String("dest_host", request.Host))
 	return nil
 }
 
@@ -115,6 +125,297 @@ func NewDirectorDestMap(m map[string]string) DirectorDestMap {
 	return res
 }
 
+const (
+	hostRouteWildcardPrefix = "*."
+	hostRouteRegexpPrefix   = "~"
+)
+
+// hostPattern match request host by exact domain, wildcard ("*.example.com") or regexp ("~^www[0-9]*\\.").
+type hostPattern struct {
+	exact  string
+	suffix string
+	re     *regexp.Regexp
+}
+
+func parseHostPattern(pattern string) (hostPattern, error) {
+	pattern = strings.TrimSpace(pattern)
+	switch {
+	case strings.HasPrefix(pattern, hostRouteRegexpPrefix):
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, hostRouteRegexpPrefix))
+		if err != nil {
+			return hostPattern{}, fmt.Errorf("can't compile host regexp %q: %w", pattern, err)
+		}
+		return hostPattern{re: re}, nil
+	case strings.HasPrefix(pattern, hostRouteWildcardPrefix):
+		suffix := normalizeHost(strings.TrimPrefix(pattern, "*"))
+		if suffix == "" || suffix == "." {
+			return hostPattern{}, fmt.Errorf("empty host wildcard: %q", pattern)
+		}
+		return hostPattern{suffix: suffix}, nil
+	default:
+		host := normalizeHost(pattern)
+		if host == "" {
+			return hostPattern{}, fmt.Errorf("empty host pattern")
+		}
+		return hostPattern{exact: host}, nil
+	}
+}
+
+// match host, normalized by normalizeHost
+func (p hostPattern) match(host string) bool {
+	switch {
+	case host == "":
+		return false
+	case p.re != nil:
+		return p.re.MatchString(host)
+	case p.suffix != "":
+		return strings.HasSuffix(host, p.suffix)
+	default:
+		return host == p.exact
+	}
+}
+
+type hostRoute struct {
+	pattern hostPattern
+	target  string
+}
+
+// DirectorHostRoutes select target by request host (Host header or SNI if Host is empty).
+// Exact matches checked first, then wildcards from longest suffix, then regexps in sorted pattern order.
+type DirectorHostRoutes struct {
+	exact     map[string]string
+	wildcards []hostRoute
+	regexps   []hostRoute
+}
+
+// NewDirectorHostRoutes create director from map host pattern -> target address.
+// Pattern can be:
+// exact domain: "api.example.com"
+// wildcard: "*.static.example.com" - match all subdomains of static.example.com, but not static.example.com itself
+// regexp: "~^img[0-9]+\\.example\\.com$" - match host by regexp after "~" prefix
+func NewDirectorHostRoutes(m map[string]string) (DirectorHostRoutes, error) {
+	res := DirectorHostRoutes{exact: make(map[string]string)}
+
+	patterns := make([]string, 0, len(m))
+	for pattern := range m {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	for _, pattern := range patterns {
+		target := m[pattern]
+		parsed, err := parseHostPattern(pattern)
+		if err != nil {
+			return DirectorHostRoutes{}, err
+		}
+		switch {
+		case parsed.re != nil:
+			res.regexps = append(res.regexps, hostRoute{pattern: parsed, target: target})
+		case parsed.suffix != "":
+			res.wildcards = append(res.wildcards, hostRoute{pattern: parsed, target: target})
+		default:
+			res.exact[parsed.exact] = target
+		}
+	}
+
+	sort.SliceStable(res.wildcards, func(i, j int) bool {
+		return len(res.wildcards[i].pattern.suffix) > len(res.wildcards[j].pattern.suffix)
+	})
+	return res, nil
+}
+
+func (d DirectorHostRoutes) Director(request *http.Request) error {
+	ctx := request.Context()
+	host := requestHost(request)
+
+	target, ok := d.match(host)
+	if !ok {
+		zc.L(ctx).Debug("Host routes director no matches, skip.", zap.String("host", host))
+		return nil
+	}
+
+	if request.URL == nil {
+		request.URL = &url.URL{}
+	}
+	request.URL.Host = target
+	zc.L(ctx).Debug("Host routes director set dest", zap.String("host", host),
+		zap.String("target", target))
+	return nil
+}
+
+func (d DirectorHostRoutes) match(host string) (string, bool) {
+	if host == "" {
+		return "", false
+	}
+	if target, ok := d.exact[host]; ok {
+		return target, true
+	}
+	for _, route := range d.wildcards {
+		if route.pattern.match(host) {
+			return route.target, true
+		}
+	}
+	for _, route := range d.regexps {
+		if route.pattern.match(host) {
+			return route.target, true
+		}
+	}
+	return "", false
+}
+
+// PathRoute describe one rule of DirectorPathRoutes.
+type PathRoute struct {
+	// Host pattern in same format as for DirectorHostRoutes. Route match any host if empty.
+	Host string
+
+	// Prefix of request path, must start with "/".
+	Prefix string
+
+	// Target address IP:Port, unix socket "unix:/path.sock" or upstream pool. Keep target, selected by previous
+	// directors, if empty.
+	Target string
+
+	// StripPrefix remove Prefix from path before send request to backend.
+	StripPrefix bool
+
+	// RewritePrefix replace Prefix by the value before send request to backend.
+	RewritePrefix string
+
+	// Scheme for backend request: http, https or h2c. Keep scheme, selected by previous directors, if empty.
+	Scheme string
+
+	// ProxyProtocol is version of PROXY protocol header (v1 or v2) for send to backend. Disabled if empty.
+	ProxyProtocol string
+
+	// StaticDir - serve files from the directory instead of send request to backend.
+	// Request path (after StripPrefix or RewritePrefix) is path of file in the directory.
+	StaticDir string
+}
+
+type pathRoute struct {
+	PathRoute
+	hasHost bool
+	host    hostPattern
+}
+
+// DirectorPathRoutes select route by longest prefix of request path.
+// For same prefix length route with host pattern win over route without host.
+type DirectorPathRoutes []pathRoute
+
+func NewDirectorPathRoutes(routes []PathRoute) (DirectorPathRoutes, error) {
+	res := make(DirectorPathRoutes, 0, len(routes))
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return nil, fmt.Errorf("path route prefix must start with '/': %q", route.Prefix)
+		}
+		if route.RewritePrefix != "" && !strings.HasPrefix(route.RewritePrefix, "/") {
+			return nil, fmt.Errorf("path route rewrite prefix must start with '/': %q", route.RewritePrefix)
+		}
+		switch route.Scheme {
+		case "", ProtocolHTTP, ProtocolHTTPS, ProtocolH2C:
+			// pass
+		default:
+			return nil, fmt.Errorf("unknown path route scheme: %q", route.Scheme)
+		}
+		if _, err := parseProxyProtocolVersion(route.ProxyProtocol); err != nil {
+			return nil, err
+		}
+		if route.Scheme == ProtocolH2C && route.ProxyProtocol != "" {
+			return nil, fmt.Errorf("path route with h2c scheme can't have proxy protocol: %q", route.Prefix)
+		}
+		if route.StaticDir != "" && (route.Target != "" || route.Scheme != "" || route.ProxyProtocol != "") {
+			return nil, fmt.Errorf("path route with static dir can't have target, scheme or proxy protocol: %q", route.Prefix)
+		}
+
+		item := pathRoute{PathRoute: route}
+		if route.Host != "" {
+			host, err := parseHostPattern(route.Host)
+			if err != nil {
+				return nil, err
+			}
+			item.hasHost = true
+			item.host = host
+		}
+		res = append(res, item)
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if len(res[i].Prefix) != len(res[j].Prefix) {
+			return len(res[i].Prefix) > len(res[j].Prefix)
+		}
+		return res[i].hasHost && !res[j].hasHost
+	})
+	return res, nil
+}
+
+func (d DirectorPathRoutes) Director(request *http.Request) error {
+	ctx := request.Context()
+	if request.URL == nil {
+		request.URL = &url.URL{}
+	}
+
+	host := requestHost(request)
+	path := request.URL.Path
+
+	var route *pathRoute
+	for i := range d {
+		if d[i].hasHost && !d[i].host.match(host) {
+			continue
+		}
+		if strings.HasPrefix(path, d[i].Prefix) {
+			route = &d[i]
+			break
+		}
+	}
+	if route == nil {
+		zc.L(ctx).Debug("Path routes director no matches, skip.", zap.String("host", host), zap.String("path", path))
+		return nil
+	}
+
+	if route.Target != "" {
+		request.URL.Host = route.Target
+	}
+	if route.Scheme != "" {
+		request.URL.Scheme = route.Scheme
+	}
+	if route.StripPrefix || route.RewritePrefix != "" {
+		newPath := route.RewritePrefix + strings.TrimPrefix(path, route.Prefix)
+		if !strings.HasPrefix(newPath, "/") {
+			newPath = "/" + newPath
+		}
+		request.URL.Path = newPath
+		request.URL.RawPath = ""
+	}
+	if route.ProxyProtocol != "" {
+		*request = *request.WithContext(withProxyProtocol(ctx, route.ProxyProtocol))
+	}
+	if route.StaticDir != "" {
+		*request = *request.WithContext(withStaticDir(ctx, route.StaticDir))
+	}
+
+	zc.L(ctx).Debug("Path routes director match route", zap.String("host", host),
+		zap.String("path", path), zap.String("prefix", route.Prefix),
+		zap.String("new_path", request.URL.Path), zap.String("target", request.URL.Host),
+		zap.String("scheme", request.URL.Scheme), zap.String("static_dir", route.StaticDir))
+	return nil
+}
+
+// requestHost return lowercased host without port from Host header or from SNI if Host header is empty.
+func requestHost(request *http.Request) string {
+	host := request.Host
+	if host == "" && request.TLS != nil {
+		host = request.TLS.ServerName
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return normalizeHost(host)
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
 type DirectorHost string
 
 func (d DirectorHost) Director(request *http.Request) error {
@@ -129,56 +430,41 @@ func NewDirectorHost(host string) DirectorHost {
 	return DirectorHost(host)
 }
 
-type DirectorSetHeaders map[string]string
+// DirectorSetHeaders set headers by templates, see HeaderTemplate.
+type DirectorSetHeaders map[string]*HeaderTemplate
 
-func NewDirectorSetHeaders(m map[string]string) DirectorSetHeaders {
+func NewDirectorSetHeaders(m map[string]string) (DirectorSetHeaders, error) {
 	res := make(DirectorSetHeaders, len(m))
 	for k, v := range m {
-		res[k] = v
+		template, err := ParseHeaderTemplate(v)
+		if err != nil {
+			return nil, fmt.Errorf("parse header %q value %q: %w", k, v, err)
+		}
+		res[k] = template
 	}
-	return res
+	return res, nil
 }
 
 func (h DirectorSetHeaders) Director(request *http.Request) error {
-	ctx := request.Context()
-	host, port, errHostPort := net.SplitHostPort(request.RemoteAddr)
-	log.DebugDPanicCtx(ctx, errHostPort, "Parse remote addr for headers", zap.String("host", host), zap.String("port", port))
-
-	for name, headerVal := range h {
-		var value string
-
-		switch headerVal {
-		case ConnectionID:
-			value = request.Context().Value(contextlabel.ConnectionID).(string)
-		case HTTPProto:
-			if tls, ok := ctx.Value(contextlabel.TLSConnection).(bool); ok {
-				if tls {
-					value = ProtocolHTTPS
-				} else {
-					value = ProtocolHTTP
-				}
-			} else {
-				value = "error protocol detection"
-			}
-		case SourceIP:
-			value = host
-		case SourceIPPort:
-			value = host + ":" + port
-		case SourcePort:
-			value = port
-		default:
-			value = headerVal
-		}
-
-		if request.Header == nil {
-			request.Header = make(http.Header)
-		}
+	if request.Header == nil {
+		request.Header = make(http.Header)
+	}
 
-		request.Header.Set(name, value)
+	for name, template := range h {
+		request.Header.Set(name, template.Execute(request))
 	}
 	return nil
 }
 
+// verifiedClientCertificate return client certificate, verified by tls listener. Return nil if client doesn't send
+// certificate or it wasn't verified.
+func verifiedClientCertificate(request *http.Request) *x509.Certificate {
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 || len(request.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return request.TLS.VerifiedChains[0][0]
+}
+
 type HTTPHeader struct {
 	Name  string
 	Value string
@@ -193,11 +479,13 @@ func (n Net) Network() net.IPNet { return n.IPNet }
 
 type DirectorSetHeadersByIP struct {
 	allHeaders []string
+	templates  map[string]*HeaderTemplate // by header value
 	cidranger.Ranger[HTTPHeaders]
 }
 
 func NewDirectorSetHeadersByIP(m map[string]HTTPHeaders) (DirectorSetHeadersByIP, error) {
 	allHeadersSet := make(map[string]struct{})
+	templates := make(map[string]*HeaderTemplate)
 
 	ranger := cidranger.NewPCTrieRanger[HTTPHeaders]()
 	for k, v := range m {
@@ -213,6 +501,14 @@ func NewDirectorSetHeadersByIP(m map[string]HTTPHeaders) (DirectorSetHeadersByIP
 
 		for _, header := range v {
 			allHeadersSet[http.CanonicalHeaderKey(header.Name)] = struct{}{}
+			if _, ok := templates[header.Value]; ok {
+				continue
+			}
+			template, err := ParseHeaderTemplate(header.Value)
+			if err != nil {
+				return DirectorSetHeadersByIP{}, fmt.Errorf("parse header %q value %q: %w", header.Name, header.Value, err)
+			}
+			templates[header.Value] = template
 		}
 	}
 
@@ -222,7 +518,7 @@ func NewDirectorSetHeadersByIP(m map[string]HTTPHeaders) (DirectorSetHeadersByIP
 		allHeaders = append(allHeaders, k)
 	}
 
-	return DirectorSetHeadersByIP{Ranger: ranger, allHeaders: allHeaders}, nil
+	return DirectorSetHeadersByIP{Ranger: ranger, allHeaders: allHeaders, templates: templates}, nil
 }
 
 func (h DirectorSetHeadersByIP) Director(request *http.Request) error {
@@ -249,7 +545,7 @@ func (h DirectorSetHeadersByIP) Director(request *http.Request) error {
 		}
 
 		for _, header := range value {
-			request.Header[header.Name] = []string{header.Value}
+			request.Header[header.Name] = []string{h.templates[header.Value].Execute(request)}
 		}
 
 		return nil
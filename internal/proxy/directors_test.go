@@ -2,8 +2,12 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"testing"
 
@@ -94,6 +98,18 @@ func TestDirectorSameIP(t *testing.T) {
 		ctx, http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 881}))
 	d.Director(req)
 	td.CmpDeeply(req.URL.Host, "1.2.3.4:87")
+
+	req = &http.Request{}
+	req = req.WithContext(context.WithValue(
+		ctx, http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/lets-proxy.sock", Net: "unix"}))
+	td.CmpNoError(d.Director(req))
+	td.CmpDeeply(req.URL.Host, "127.0.0.1:87", "unix socket listener")
+
+	req = &http.Request{}
+	req = req.WithContext(context.WithValue(
+		ctx, http.LocalAddrContextKey, &net.UDPAddr{IP: net.IPv6unspecified, Port: 443}))
+	td.CmpNoError(d.Director(req))
+	td.CmpDeeply(req.URL.Host, "127.0.0.1:87", "http/3 listener on all interfaces")
 }
 
 func TestDirectorSetHeaders(t *testing.T) {
@@ -111,7 +127,7 @@ func TestDirectorSetHeaders(t *testing.T) {
 		"TestProtocol":     "{{HTTP_PROTO}}",
 	}
 
-	d := NewDirectorSetHeaders(m)
+	d := newTestDirectorSetHeaders(t, m)
 
 	ctx = context.WithValue(ctx, contextlabel.ConnectionID, "123")
 
@@ -138,6 +154,39 @@ func TestDirectorSetHeaders(t *testing.T) {
 	td.CmpDeeply(req.Header.Get("TestProtocol"), "http")
 }
 
+func TestDirectorSetHeaders_ClientCert(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	d := newTestDirectorSetHeaders(t, map[string]string{
+		"Subject":     "{{CLIENT_CERT_SUBJECT}}",
+		"Fingerprint": "{{CLIENT_CERT_FINGERPRINT}}",
+	})
+
+	cert := &x509.Certificate{Raw: []byte{1, 2, 3}, Subject: pkix.Name{CommonName: "admin", Organization: []string{"Org"}}}
+
+	req := (&http.Request{RemoteAddr: "1.2.3.4:881", Header: http.Header{"Subject": {"spoofed"}}}).WithContext(ctx)
+	td.CmpNoError(d.Director(req))
+	td.Cmp(req.Header.Get("Subject"), "", "without tls")
+	td.Cmp(req.Header.Get("Fingerprint"), "")
+
+	req = (&http.Request{RemoteAddr: "1.2.3.4:881", TLS: &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+	}}).WithContext(ctx)
+	td.CmpNoError(d.Director(req))
+	td.Cmp(req.Header.Get("Subject"), "", "not verified certificate")
+
+	req = (&http.Request{RemoteAddr: "1.2.3.4:881", TLS: &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}}).WithContext(ctx)
+	td.CmpNoError(d.Director(req))
+	td.Cmp(req.Header.Get("Subject"), "CN=admin,O=Org")
+	td.Cmp(req.Header.Get("Fingerprint"), "039058c6f2c0cb492c533b0a4d14ef77cc0f78abccced5287d84a1a2011cfb81")
+}
+
 func TestDirectorSetHeadersByIP(t *testing.T) {
 	ctx, flush := th.TestContext(t)
 	defer flush()
@@ -435,3 +484,130 @@ func TestNewDirectorSetHeadersByIP(t *testing.T) {
 		})
 	}
 }
+
+func TestDirectorHostRoutes(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	d, err := NewDirectorHostRoutes(map[string]string{
+		"api.example.com":              "10.0.0.5:8080",
+		"*.static.example.com":         "10.0.0.9:80",
+		"*.a.static.example.com":       "10.0.0.8:80",
+		`~^img[0-9]+\.example\.com$`:   "10.0.0.10:80",
+		`~^img[0-9]+\.example\.(com)$`: "10.0.0.11:80",
+	})
+	td.CmpNoError(err)
+
+	tests := []struct {
+		host string
+		sni  string
+		want string
+	}{
+		{host: "api.example.com", want: "10.0.0.5:8080"},
+		{host: "API.example.com.:443", want: "10.0.0.5:8080"},
+		{sni: "api.example.com", want: "10.0.0.5:8080"},
+		{host: "www.static.example.com", want: "10.0.0.9:80"},
+		{host: "x.www.static.example.com", want: "10.0.0.9:80"},
+		{host: "x.a.static.example.com", want: "10.0.0.8:80"},
+		{host: "static.example.com", want: "orig:80"},
+		{host: "img12.example.com", want: "10.0.0.11:80"}, // regexps checked in sorted order
+		{host: "img.example.com", want: "orig:80"},
+		{host: "other.com", sni: "api.example.com", want: "orig:80"},
+		{want: "orig:80"},
+	}
+
+	for _, test := range tests {
+		req := &http.Request{Host: test.host, URL: &url.URL{Host: "orig:80"}}
+		if test.sni != "" {
+			req.TLS = &tls.ConnectionState{ServerName: test.sni}
+		}
+		req = req.WithContext(ctx)
+		td.CmpNoError(d.Director(req))
+		td.Cmp(req.URL.Host, test.want, test.host+"|"+test.sni)
+	}
+
+	_, err = NewDirectorHostRoutes(map[string]string{"~[": "1.2.3.4:80"})
+	td.CmpError(err)
+
+	_, err = NewDirectorHostRoutes(map[string]string{"*.": "1.2.3.4:80"})
+	td.CmpError(err)
+
+	_, err = NewDirectorHostRoutes(map[string]string{"": "1.2.3.4:80"})
+	td.CmpError(err)
+}
+
+func TestDirectorPathRoutes(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	d, err := NewDirectorPathRoutes([]PathRoute{
+		{Prefix: "/", Target: "10.0.0.1:80"},
+		{Prefix: "/api/", Target: "10.0.0.2:80", StripPrefix: true},
+		{Prefix: "/api/v2/", Target: "10.0.0.3:443", RewritePrefix: "/v2/", Scheme: ProtocolHTTPS},
+		{Host: "*.example.com", Prefix: "/api/", Target: "10.0.0.4:80"},
+		{Prefix: "/static/", Scheme: ProtocolHTTPS},
+	})
+	td.CmpNoError(err)
+
+	tests := []struct {
+		host       string
+		path       string
+		wantHost   string
+		wantPath   string
+		wantScheme string
+	}{
+		{host: "example.com", path: "/index.html", wantHost: "10.0.0.1:80", wantPath: "/index.html", wantScheme: "http"},
+		{host: "example.com", path: "/api/users", wantHost: "10.0.0.2:80", wantPath: "/users", wantScheme: "http"},
+		{host: "example.com", path: "/api/", wantHost: "10.0.0.2:80", wantPath: "/", wantScheme: "http"},
+		{host: "example.com", path: "/api/v2/users", wantHost: "10.0.0.3:443", wantPath: "/v2/users", wantScheme: "https"},
+		{host: "www.example.com", path: "/api/users", wantHost: "10.0.0.4:80", wantPath: "/api/users", wantScheme: "http"},
+		{host: "www.example.com", path: "/api/v2/users", wantHost: "10.0.0.3:443", wantPath: "/v2/users", wantScheme: "https"},
+		{host: "example.com", path: "/static/a.css", wantHost: "orig:80", wantPath: "/static/a.css", wantScheme: "https"},
+	}
+
+	for _, test := range tests {
+		req := &http.Request{Host: test.host, URL: &url.URL{Scheme: "http", Host: "orig:80", Path: test.path}}
+		req = req.WithContext(ctx)
+		td.CmpNoError(d.Director(req))
+		td.Cmp(req.URL.Host, test.wantHost, test.host+test.path)
+		td.Cmp(req.URL.Path, test.wantPath, test.host+test.path)
+		td.Cmp(req.URL.Scheme, test.wantScheme, test.host+test.path)
+	}
+
+	d, err = NewDirectorPathRoutes([]PathRoute{{Prefix: "/api/", Target: "10.0.0.2:80"}})
+	td.CmpNoError(err)
+	req := &http.Request{URL: &url.URL{Host: "orig:80", Path: "/other"}}
+	req = req.WithContext(ctx)
+	td.CmpNoError(d.Director(req))
+	td.Cmp(req.URL.Host, "orig:80")
+	td.Cmp(getProxyProtocol(req.Context()), "")
+
+	d, err = NewDirectorPathRoutes([]PathRoute{{Prefix: "/smtp/", Target: "10.0.0.2:25", ProxyProtocol: ProxyProtocolV2}})
+	td.CmpNoError(err)
+	req = &http.Request{URL: &url.URL{Host: "orig:80", Path: "/smtp/"}}
+	req = req.WithContext(ctx)
+	td.CmpNoError(d.Director(req))
+	td.Cmp(getProxyProtocol(req.Context()), ProxyProtocolV2)
+
+	_, err = NewDirectorPathRoutes([]PathRoute{{Prefix: "/api/", ProxyProtocol: "v3"}})
+	td.CmpError(err)
+
+	_, err = NewDirectorPathRoutes([]PathRoute{{Prefix: "api"}})
+	td.CmpError(err)
+
+	_, err = NewDirectorPathRoutes([]PathRoute{{Prefix: "/api/", RewritePrefix: "v1"}})
+	td.CmpError(err)
+
+	_, err = NewDirectorPathRoutes([]PathRoute{{Prefix: "/api/", Scheme: "ftp"}})
+	td.CmpError(err)
+
+	_, err = NewDirectorPathRoutes([]PathRoute{{Prefix: "/grpc/", Scheme: ProtocolH2C, ProxyProtocol: ProxyProtocolV1}})
+	td.CmpError(err)
+
+	_, err = NewDirectorPathRoutes([]PathRoute{{Host: "~[", Prefix: "/api/"}})
+	td.CmpError(err)
+}
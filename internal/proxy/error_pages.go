@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ResponseModifierErrorPages replace body of responses with 5xx status codes by custom pages.
+type ResponseModifierErrorPages struct {
+	// Pages by status code.
+	Pages map[int][]byte
+
+	// Default page for 5xx status codes without own page. Keep response of backend if nil.
+	Default []byte
+}
+
+func (m ResponseModifierErrorPages) ModifyResponse(resp *http.Response) error {
+	if resp.StatusCode < 500 || resp.StatusCode > 599 {
+		return nil
+	}
+
+	page, ok := m.Pages[resp.StatusCode]
+	if !ok {
+		page = m.Default
+	}
+	if page == nil {
+		return nil
+	}
+
+	if resp.Body != nil {
+		_ = resp.Body.Close()
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	for _, name := range []string{"Content-Encoding", "Content-Range", "Etag", "Last-Modified", "Transfer-Encoding"} {
+		resp.Header.Del(name)
+	}
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(page)))
+	resp.ContentLength = int64(len(page))
+	resp.TransferEncoding = nil
+	resp.Body = io.NopCloser(bytes.NewReader(page))
+	return nil
+}
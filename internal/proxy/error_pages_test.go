@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestResponseModifierErrorPages(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := ResponseModifierErrorPages{Pages: map[int][]byte{http.StatusBadGateway: []byte("502 page")}}
+
+	check := func(m ResponseModifierErrorPages, statusCode int) (http.Header, string) {
+		resp := &http.Response{
+			StatusCode:    statusCode,
+			Header:        http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}, "Retry-After": {"1"}},
+			Body:          io.NopCloser(strings.NewReader("backend")),
+			ContentLength: 7,
+		}
+		td.CmpNoError(m.ModifyResponse(resp))
+		body, _ := io.ReadAll(resp.Body)
+		return resp.Header, string(body)
+	}
+
+	header, body := check(m, http.StatusBadGateway)
+	td.Cmp(body, "502 page")
+	td.Cmp(header, http.Header{
+		"Content-Type":   {"text/html; charset=utf-8"},
+		"Content-Length": {"8"},
+		"Retry-After":    {"1"},
+	})
+
+	_, body = check(m, http.StatusServiceUnavailable)
+	td.Cmp(body, "backend", "without default page")
+
+	_, body = check(m, http.StatusNotFound)
+	td.Cmp(body, "backend")
+
+	m.Default = []byte("default page")
+	_, body = check(m, http.StatusServiceUnavailable)
+	td.Cmp(body, "default page")
+
+	_, body = check(m, http.StatusOK)
+	td.Cmp(body, "backend")
+}
+
+func TestConfig_getErrorPages(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	dir := t.TempDir()
+	page := filepath.Join(dir, "page.html")
+	td.CmpNoError(os.WriteFile(page, []byte("page"), 0600))
+
+	c := Config{}
+	modifier, err := c.getErrorPages(ctx)
+	td.CmpNoError(err)
+	td.Nil(modifier)
+
+	c.ErrorPages = map[string]string{"502": page, "5XX": page}
+	modifier, err = c.getErrorPages(ctx)
+	td.CmpNoError(err)
+	td.Cmp(modifier, ResponseModifierErrorPages{Pages: map[int][]byte{502: []byte("page")}, Default: []byte("page")})
+
+	c.ErrorPages = map[string]string{"404": page}
+	_, err = c.getErrorPages(ctx)
+	td.CmpError(err)
+
+	c.ErrorPages = map[string]string{"502": filepath.Join(dir, "not-exist.html")}
+	_, err = c.getErrorPages(ctx)
+	td.CmpError(err)
+}
+
+func TestHTTPProxy_ErrorPages(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	// closed port
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	backendAddr := backendListener.Addr().String()
+	td.CmpNoError(backendListener.Close())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	proxy := NewHTTPProxy(ctx, listener)
+	defer th.Close(proxy)
+
+	proxy.Director = NewDirectorChain(NewDirectorHost(backendAddr), NewSetSchemeDirector(ProtocolHTTP))
+	proxy.ResponseModifier = ResponseModifierErrorPages{Pages: map[int][]byte{http.StatusBadGateway: []byte("502 page")}}
+	go func() { _ = proxy.Start() }()
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/")
+	td.CmpNoError(err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	td.Cmp(resp.StatusCode, http.StatusBadGateway)
+	td.Cmp(string(body), "502 page")
+}
@@ -0,0 +1,444 @@
+package proxy
+
+import (
+	"crypto/md5"  //nolint:gosec
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+// HeaderTemplate is parsed header value. Value is mix of literal text and expressions in {{...}}.
+//
+// Expression is pipeline of variable, "quoted literal" or function call, separated by '|'.
+// Result of previous step pass to function as last argument. Function arguments are variables or literals.
+// Examples:
+//
+//	{{SOURCE_IP}}:{{SOURCE_PORT}}
+//	{{CLIENT_CERT_SUBJECT | default "anonymous"}}
+//	{{printf "%s/%s" TLS_VERSION TLS_CIPHER}}
+//	{{SOURCE_IP | sha256 | truncate 16}}
+//
+// Text in {{...}}, which doesn't start with variable, function or literal, is not expression and kept as is:
+// it was allowed in header values before templates.
+type HeaderTemplate struct {
+	parts    []templatePart
+	warnings []error
+}
+
+type templatePart struct {
+	literal  string
+	pipeline []templateCall // nil for literal part
+}
+
+type templateCall struct {
+	variable string // for variable step
+	literal  string // for literal step
+	function string // for function call step
+	args     []templateArg
+}
+
+type templateArg struct {
+	variable string
+	literal  string
+}
+
+type templateFunction struct {
+	minArgs int
+	maxArgs int // -1 - unlimited
+	call    func(args []string) string
+	check   func(args []templateArg) error // check arguments (without piped value) at parse time, can be nil
+}
+
+var templateVariables = map[string]func(request *http.Request) string{
+	"CONNECTION_ID": func(request *http.Request) string {
+		connectionID, _ := request.Context().Value(contextlabel.ConnectionID).(string)
+		return connectionID
+	},
+	"REQUEST_ID": func(request *http.Request) string {
+		requestID, _ := request.Context().Value(contextlabel.RequestID).(string)
+		return requestID
+	},
+	"HTTP_PROTO": func(request *http.Request) string {
+		tls, ok := request.Context().Value(contextlabel.TLSConnection).(bool)
+		switch {
+		case !ok:
+			return "error protocol detection"
+		case tls:
+			return ProtocolHTTPS
+		default:
+			return ProtocolHTTP
+		}
+	},
+	"SOURCE_IP": func(request *http.Request) string {
+		host, _, _ := net.SplitHostPort(request.RemoteAddr)
+		return host
+	},
+	"SOURCE_PORT": func(request *http.Request) string {
+		_, port, _ := net.SplitHostPort(request.RemoteAddr)
+		return port
+	},
+	"SNI": func(request *http.Request) string {
+		if request.TLS == nil {
+			return ""
+		}
+		return request.TLS.ServerName
+	},
+	"TLS_VERSION": func(request *http.Request) string {
+		if request.TLS == nil {
+			return ""
+		}
+		return tlsVersionName(request.TLS.Version)
+	},
+	"TLS_CIPHER": func(request *http.Request) string {
+		if request.TLS == nil {
+			return ""
+		}
+		return tls.CipherSuiteName(request.TLS.CipherSuite)
+	},
+	"CLIENT_CERT_SUBJECT": func(request *http.Request) string {
+		if cert := verifiedClientCertificate(request); cert != nil {
+			return cert.Subject.String()
+		}
+		return ""
+	},
+	"CLIENT_CERT_FINGERPRINT": func(request *http.Request) string {
+		if cert := verifiedClientCertificate(request); cert != nil {
+			fingerprint := sha256.Sum256(cert.Raw)
+			return hex.EncodeToString(fingerprint[:])
+		}
+		return ""
+	},
+}
+
+var templateFunctions = map[string]templateFunction{
+	"sha256": {minArgs: 1, maxArgs: 1, call: func(args []string) string {
+		sum := sha256.Sum256([]byte(args[0]))
+		return hex.EncodeToString(sum[:])
+	}},
+	"sha1": {minArgs: 1, maxArgs: 1, call: func(args []string) string {
+		sum := sha1.Sum([]byte(args[0])) //nolint:gosec
+		return hex.EncodeToString(sum[:])
+	}},
+	"md5": {minArgs: 1, maxArgs: 1, call: func(args []string) string {
+		sum := md5.Sum([]byte(args[0])) //nolint:gosec
+		return hex.EncodeToString(sum[:])
+	}},
+	"base64": {minArgs: 1, maxArgs: 1, call: func(args []string) string {
+		return base64.StdEncoding.EncodeToString([]byte(args[0]))
+	}},
+	"upper": {minArgs: 1, maxArgs: 1, call: func(args []string) string {
+		return strings.ToUpper(args[0])
+	}},
+	"lower": {minArgs: 1, maxArgs: 1, call: func(args []string) string {
+		return strings.ToLower(args[0])
+	}},
+	"trim": {minArgs: 1, maxArgs: 1, call: func(args []string) string {
+		return strings.TrimSpace(args[0])
+	}},
+	// default FALLBACK VALUE - return FALLBACK if VALUE is empty
+	"default": {minArgs: 2, maxArgs: 2, call: func(args []string) string {
+		if args[1] == "" {
+			return args[0]
+		}
+		return args[1]
+	}},
+	// replace OLD NEW VALUE
+	"replace": {minArgs: 3, maxArgs: 3, call: func(args []string) string {
+		return strings.ReplaceAll(args[2], args[0], args[1])
+	}},
+	// truncate N VALUE - first N chars of VALUE
+	"truncate": {minArgs: 2, maxArgs: 2, call: func(args []string) string {
+		n, _ := strconv.Atoi(args[0])
+		runes := []rune(args[1])
+		if len(runes) <= n {
+			return args[1]
+		}
+		return string(runes[:n])
+	}, check: func(args []templateArg) error {
+		if args[0].variable != "" {
+			return fmt.Errorf("length must be literal number")
+		}
+		if n, err := strconv.Atoi(args[0].literal); err != nil || n < 0 {
+			return fmt.Errorf("bad length: %q", args[0].literal)
+		}
+		return nil
+	}},
+	// printf FORMAT ARGS... - format by fmt.Sprintf, all args are strings.
+	// FORMAT must be literal: piped value is last argument and can't be format.
+	"printf": {minArgs: 1, maxArgs: -1, call: func(args []string) string {
+		formatArgs := make([]interface{}, len(args)-1)
+		for i := range formatArgs {
+			formatArgs[i] = args[i+1]
+		}
+		return fmt.Sprintf(args[0], formatArgs...)
+	}, check: func(args []templateArg) error {
+		if len(args) == 0 {
+			return fmt.Errorf("literal format required")
+		}
+		if args[0].variable != "" {
+			return fmt.Errorf("format must be literal")
+		}
+		return nil
+	}},
+}
+
+// ParseHeaderTemplate parse header value and check all variables and functions.
+func ParseHeaderTemplate(s string) (*HeaderTemplate, error) {
+	res := &HeaderTemplate{}
+	for s != "" {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			res.appendLiteral(s)
+			break
+		}
+		if start > 0 {
+			res.appendLiteral(s[:start])
+		}
+		s = s[start+2:]
+
+		if !isTemplateExpression(s) {
+			text := "{{" + s
+			if end := strings.Index(s, "}}"); end >= 0 {
+				text = "{{" + s[:end+2]
+			}
+			res.appendLiteral(text)
+			res.warnings = append(res.warnings, fmt.Errorf("unknown expression in header template, kept as text: %q", text))
+			s = s[len(text)-2:]
+			continue
+		}
+
+		pipeline, rest, err := parseTemplatePipeline(s)
+		if err != nil {
+			return nil, err
+		}
+		res.parts = append(res.parts, templatePart{pipeline: pipeline})
+		s = rest
+	}
+	return res, nil
+}
+
+// Warnings return errors about text in {{...}}, which kept as is because it isn't template expression.
+func (t *HeaderTemplate) Warnings() []error {
+	return t.warnings
+}
+
+func (t *HeaderTemplate) appendLiteral(s string) {
+	if last := len(t.parts) - 1; last >= 0 && t.parts[last].pipeline == nil {
+		t.parts[last].literal += s
+		return
+	}
+	t.parts = append(t.parts, templatePart{literal: s})
+}
+
+// isTemplateExpression return true if text after {{ starts with variable, function or literal.
+func isTemplateExpression(s string) bool {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	if s == "" {
+		return false
+	}
+	token, _, err := nextTemplateToken(s)
+	if err != nil || token.pipe {
+		return false
+	}
+	if token.identifier == "" {
+		return true
+	}
+	_, isVariable := templateVariables[token.identifier]
+	_, isFunction := templateFunctions[token.identifier]
+	return isVariable || isFunction
+}
+
+// Execute return header value for the request.
+func (t *HeaderTemplate) Execute(request *http.Request) string {
+	if len(t.parts) == 1 && t.parts[0].pipeline == nil {
+		return t.parts[0].literal
+	}
+
+	var res strings.Builder
+	for _, part := range t.parts {
+		if part.pipeline == nil {
+			res.WriteString(part.literal)
+			continue
+		}
+		res.WriteString(executeTemplatePipeline(part.pipeline, request))
+	}
+	return res.String()
+}
+
+func executeTemplatePipeline(pipeline []templateCall, request *http.Request) string {
+	var value string
+	for i, step := range pipeline {
+		switch {
+		case step.variable != "":
+			value = templateVariables[step.variable](request)
+		case step.function != "":
+			args := make([]string, 0, len(step.args)+1)
+			for _, arg := range step.args {
+				args = append(args, arg.value(request))
+			}
+			if i > 0 {
+				args = append(args, value)
+			}
+			value = templateFunctions[step.function].call(args)
+		default:
+			value = step.literal
+		}
+	}
+	return value
+}
+
+func (a templateArg) value(request *http.Request) string {
+	if a.variable != "" {
+		return templateVariables[a.variable](request)
+	}
+	return a.literal
+}
+
+// parseTemplatePipeline parse expression until "}}" and return rest of string after it.
+func parseTemplatePipeline(s string) (pipeline []templateCall, rest string, err error) {
+	var tokens []templateToken
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if strings.HasPrefix(s, "}}") {
+			rest = s[2:]
+			break
+		}
+		if s == "" {
+			return nil, "", fmt.Errorf("unclosed {{ in header template")
+		}
+
+		var token templateToken
+		token, s, err = nextTemplateToken(s)
+		if err != nil {
+			return nil, "", err
+		}
+		tokens = append(tokens, token)
+	}
+
+	var steps [][]templateToken
+	var step []templateToken
+	for _, token := range tokens {
+		if token.pipe {
+			steps = append(steps, step)
+			step = nil
+			continue
+		}
+		step = append(step, token)
+	}
+	steps = append(steps, step)
+
+	for i, step := range steps {
+		call, err := parseTemplateCall(step, i > 0)
+		if err != nil {
+			return nil, "", err
+		}
+		pipeline = append(pipeline, call)
+	}
+	return pipeline, rest, nil
+}
+
+type templateToken struct {
+	identifier string
+	literal    string
+	pipe       bool
+}
+
+func nextTemplateToken(s string) (token templateToken, rest string, err error) {
+	switch {
+	case s[0] == '|':
+		return templateToken{pipe: true}, s[1:], nil
+	case s[0] == '"':
+		prefix, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return token, "", fmt.Errorf("bad literal in header template: %w", err)
+		}
+		token.literal, _ = strconv.Unquote(prefix)
+		return token, s[len(prefix):], nil
+	default:
+		end := strings.IndexFunc(s, func(r rune) bool {
+			return !(r == '_' || r == '-' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r))
+		})
+		if end == 0 {
+			return token, "", fmt.Errorf("unexpected symbol in header template: %q", s[:1])
+		}
+		if end < 0 {
+			end = len(s)
+		}
+		word := s[:end]
+		if _, err := strconv.ParseFloat(word, 64); err == nil {
+			// number is literal
+			token.literal = word
+		} else {
+			token.identifier = word
+		}
+		return token, s[end:], nil
+	}
+}
+
+func parseTemplateCall(tokens []templateToken, piped bool) (templateCall, error) {
+	if len(tokens) == 0 {
+		return templateCall{}, fmt.Errorf("empty expression in header template")
+	}
+
+	first := tokens[0]
+	if _, ok := templateVariables[first.identifier]; ok || first.identifier == "" {
+		if len(tokens) > 1 || piped {
+			return templateCall{}, fmt.Errorf("variable or literal can be only first step of header template expression")
+		}
+		return templateCall{variable: first.identifier, literal: first.literal}, nil
+	}
+
+	function, ok := templateFunctions[first.identifier]
+	if !ok {
+		return templateCall{}, fmt.Errorf("unknown variable or function in header template: %q", first.identifier)
+	}
+
+	call := templateCall{function: first.identifier}
+	for _, token := range tokens[1:] {
+		if token.identifier != "" {
+			if _, ok := templateVariables[token.identifier]; !ok {
+				return templateCall{}, fmt.Errorf("unknown variable in header template: %q", token.identifier)
+			}
+		}
+		call.args = append(call.args, templateArg{variable: token.identifier, literal: token.literal})
+	}
+
+	argsCount := len(call.args)
+	if piped {
+		argsCount++
+	}
+	if argsCount < function.minArgs || (function.maxArgs >= 0 && argsCount > function.maxArgs) {
+		return templateCall{}, fmt.Errorf("bad arguments count for function %q: %v", first.identifier, argsCount)
+	}
+	if function.check != nil {
+		if err := function.check(call.args); err != nil {
+			return templateCall{}, fmt.Errorf("function %q: %w", first.identifier, err)
+		}
+	}
+	return call, nil
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1.0"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
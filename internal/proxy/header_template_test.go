@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestHeaderTemplate(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	cert := &x509.Certificate{Raw: []byte{1, 2, 3}, Subject: pkix.Name{CommonName: "admin"}}
+
+	ctx = context.WithValue(ctx, contextlabel.ConnectionID, "conn-1")
+	ctx = context.WithValue(ctx, contextlabel.RequestID, "req-1")
+	ctx = context.WithValue(ctx, contextlabel.TLSConnection, true)
+	request := (&http.Request{RemoteAddr: "1.2.3.4:881", TLS: &tls.ConnectionState{
+		Version:        tls.VersionTLS13,
+		CipherSuite:    tls.TLS_AES_128_GCM_SHA256,
+		ServerName:     "example.com",
+		VerifiedChains: [][]*x509.Certificate{{cert}},
+	}}).WithContext(ctx)
+
+	table := []struct {
+		template string
+		result   string
+	}{
+		{template: "", result: ""},
+		{template: "plain text", result: "plain text"},
+		{template: "{{SOURCE_IP}}:{{SOURCE_PORT}}", result: "1.2.3.4:881"},
+		{template: "ip={{ SOURCE_IP }}, proto={{HTTP_PROTO}}", result: "ip=1.2.3.4, proto=https"},
+		{template: "{{CONNECTION_ID}}/{{REQUEST_ID}}", result: "conn-1/req-1"},
+		{template: "{{TLS_VERSION}} {{TLS_CIPHER}} {{SNI}}", result: "TLSv1.3 TLS_AES_128_GCM_SHA256 example.com"},
+		{template: "{{CLIENT_CERT_SUBJECT}}", result: "CN=admin"},
+		{template: "{{CLIENT_CERT_FINGERPRINT | truncate 8}}", result: "039058c6"},
+		{template: `{{"literal"}}`, result: "literal"},
+		{template: "{{sha256 SOURCE_IP}}", result: "6694f83c9f476da31f5df6bcc520034e7e57d421d247b9d34f49edbfc84a764c"},
+		{template: "{{SOURCE_IP | sha256 | truncate 6 | upper}}", result: "6694F8"},
+		{template: "{{SOURCE_IP | sha1}}", result: "09c35807ba47a82592ef88e5d6304ea699b8cbe2"},
+		{template: "{{SOURCE_IP | md5}}", result: "6465ec74397c9126916786bbcd6d7601"},
+		{template: "{{base64 SNI}}", result: "ZXhhbXBsZS5jb20="},
+		{template: `{{SNI | replace "." "_"}}`, result: "example_com"},
+		{template: `{{printf "%s-%s" SOURCE_IP SOURCE_PORT}}`, result: "1.2.3.4-881"},
+		{template: `{{SOURCE_IP | printf "ip=%s"}}`, result: "ip=1.2.3.4"},
+		{template: `{{"  A " | trim | lower}}`, result: "a"},
+		{template: `{{default "none" SNI}}`, result: "example.com"},
+		{template: `{{"" | default "none"}}`, result: "none"},
+	}
+
+	td := testdeep.NewT(t)
+	for _, test := range table {
+		template, err := ParseHeaderTemplate(test.template)
+		if !td.CmpNoError(err, test.template) {
+			continue
+		}
+		td.Cmp(template.Execute(request), test.result, test.template)
+	}
+
+	// without tls
+	request = (&http.Request{RemoteAddr: "1.2.3.4:881"}).WithContext(context.Background())
+	template, err := ParseHeaderTemplate("{{SNI}}|{{TLS_VERSION}}|{{CLIENT_CERT_SUBJECT}}|{{HTTP_PROTO}}")
+	td.CmpNoError(err)
+	td.Cmp(template.Execute(request), "|||error protocol detection")
+}
+
+func TestParseHeaderTemplate_Errors(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	for _, s := range []string{
+		"{{SOURCE_IP",
+		"{{sha256 UNKNOWN}}",
+		"{{sha256}}",
+		"{{sha256 SOURCE_IP SOURCE_PORT}}",
+		"{{SOURCE_IP | }}",
+		"{{SOURCE_IP SOURCE_PORT}}",
+		"{{SOURCE_IP | SOURCE_PORT}}",
+		"{{SOURCE_IP | truncate asd}}",
+		"{{SOURCE_IP | truncate -1}}",
+		"{{printf SOURCE_IP SOURCE_PORT}}",
+		"{{printf}}",
+		"{{SOURCE_IP | printf}}",
+		"{{SOURCE_IP # }}",
+	} {
+		_, err := ParseHeaderTemplate(s)
+		td.CmpError(err, s)
+	}
+}
+
+func TestParseHeaderTemplate_UnknownExpressions(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	request := (&http.Request{RemoteAddr: "1.2.3.4:881"}).WithContext(context.Background())
+	for _, test := range []struct {
+		template string
+		result   string
+		warnings int
+	}{
+		{template: "{{}}", result: "{{}}", warnings: 1},
+		{template: "a{{UNKNOWN}}b", result: "a{{UNKNOWN}}b", warnings: 1},
+		{template: "{{unknown SOURCE_IP}}-{{SOURCE_IP}}", result: "{{unknown SOURCE_IP}}-1.2.3.4", warnings: 1},
+		{template: `{{"unclosed}}`, result: `{{"unclosed}}`, warnings: 1},
+		{template: "{{ not closed", result: "{{ not closed", warnings: 1},
+		{template: "{{a}}{{b}}", result: "{{a}}{{b}}", warnings: 2},
+		{template: "{{SOURCE_IP}}", result: "1.2.3.4", warnings: 0},
+	} {
+		template, err := ParseHeaderTemplate(test.template)
+		if !td.CmpNoError(err, test.template) {
+			continue
+		}
+		td.Cmp(template.Execute(request), test.result, test.template)
+		td.Len(template.Warnings(), test.warnings, test.template)
+	}
+}
@@ -2,12 +2,19 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rekby/fastuuid"
+
 	"github.com/rekby/lets-proxy2/internal/contexthelper"
 
 	"github.com/rekby/lets-proxy2/internal/contextlabel"
@@ -26,15 +33,51 @@ type Director interface {
 type HTTPProxy struct {
 	GetContext           func(req *http.Request) (context.Context, error)
 	HandleHTTPValidation func(w http.ResponseWriter, r *http.Request) bool
-	Director             Director // modify requests to backend.
+	Director             Director         // modify requests to backend.
+	ResponseModifier     ResponseModifier // modify responses from backend, can be nil.
+	HTTPSRedirect        *HTTPSRedirect   // redirect to https for marked connections, default redirect if nil.
+	Maintenance          *Maintenance     // hosts in maintenance mode, can be nil.
+	MaintenancePage      MaintenancePage  // answer for hosts in maintenance mode.
 	HTTPTransport        http.RoundTripper
 	EnableAccessLog      bool
 
+	// HTTP3Listeners - QUIC listeners for serve HTTP/3 by same handler, advertised by Alt-Svc header
+	// on other requests.
+	HTTP3Listeners []http3.QUICEarlyListener
+
+	// HandleMisdirectedRequest answer requests, which can't be served by the connection, for example because of
+	// client certificate policy. Can be nil.
+	HandleMisdirectedRequest func(w http.ResponseWriter, r *http.Request) bool
+
 	logger           *zap.Logger
 	listener         net.Listener
 	httpReverseProxy httputil.ReverseProxy
 	IdleTimeout      time.Duration
 	httpServer       http.Server
+	http3Server      http3.Server
+
+	// state contains proxyState with director and transport, which can be replaced after start
+	state atomic.Value
+
+	// serveStopped closed when http server stop accept connections
+	serveStopped    chan struct{}
+	shutdownStarted int32
+
+	// newConnections - accepted connections, which doesn't start read request yet
+	newConnectionsMu sync.Mutex
+	newConnections   map[net.Conn]struct{}
+}
+
+// waitNewConnectionsTimeout limit wait on shutdown for accepted connections without read request.
+// http.Server.Shutdown close the connections without answer after read request.
+const waitNewConnectionsTimeout = time.Second
+
+type proxyState struct {
+	director         Director
+	responseModifier ResponseModifier
+	httpsRedirect    *HTTPSRedirect
+	maintenancePage  MaintenancePage
+	transport        http.RoundTripper
 }
 
 func NewHTTPProxy(ctx context.Context, listener net.Listener) *HTTPProxy {
@@ -43,43 +86,128 @@ func NewHTTPProxy(ctx context.Context, listener net.Listener) *HTTPProxy {
 		HandleHTTPValidation: func(_ http.ResponseWriter, _ *http.Request) bool {
 			return false
 		},
-		Director:   NewDirectorSameIP(defaultHTTPPort),
-		GetContext: getContext,
-		listener:   listener,
-		logger:     zc.L(ctx),
-		httpServer: http.Server{},
+		Director:       NewDirectorSameIP(defaultHTTPPort),
+		GetContext:     getContext,
+		listener:       listener,
+		logger:         zc.L(ctx),
+		httpServer:     http.Server{},
+		serveStopped:   make(chan struct{}),
+		newConnections: make(map[net.Conn]struct{}),
 	}
 	res.httpReverseProxy.Director = res.director
+	res.httpReverseProxy.ModifyResponse = res.modifyResponse
+	res.httpReverseProxy.ErrorHandler = res.errorHandler
 	return res
 }
 
 func (p *HTTPProxy) Close() error {
+	_ = p.http3Server.Close()
 	return p.httpServer.Close()
 }
 
+// Shutdown gracefully stop the proxy: close listener, wait until active requests finished, then close connections.
+// If ctx done before - return ctx error, remaining connections must be closed by Close.
+func (p *HTTPProxy) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&p.shutdownStarted, 1)
+	err := p.listener.Close()
+	log.DebugError(p.logger, err, "Close proxy listener")
+
+	p.waitNewConnections(ctx)
+
+	err = p.httpServer.Shutdown(ctx)
+	if errors.Is(err, net.ErrClosed) {
+		// listener was closed above
+		err = nil
+	}
+
+	// QUIC connections can't be drained without listener, they closed with it.
+	http3Err := p.http3Server.Close()
+	log.DebugError(p.logger, http3Err, "Close http/3 server")
+	return err
+}
+
+// waitNewConnections wait until server stop accept connections and accepted connections start read request.
+func (p *HTTPProxy) waitNewConnections(ctx context.Context) {
+	const checkInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(ctx, waitNewConnectionsTimeout)
+	defer cancel()
+
+	select {
+	case <-p.serveStopped:
+	case <-ctx.Done():
+		return
+	}
+
+	for {
+		p.newConnectionsMu.Lock()
+		newConnectionsCount := len(p.newConnections)
+		p.newConnectionsMu.Unlock()
+
+		if newConnectionsCount == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			p.logger.Debug("Stop wait new connections", zap.Int("new_connections", newConnectionsCount))
+			return
+		case <-time.After(checkInterval):
+		}
+	}
+}
+
+func (p *HTTPProxy) trackConnState(conn net.Conn, state http.ConnState) {
+	p.newConnectionsMu.Lock()
+	defer p.newConnectionsMu.Unlock()
+
+	if state == http.StateNew {
+		p.newConnections[conn] = struct{}{}
+	} else {
+		delete(p.newConnections, conn)
+	}
+}
+
 // Start - finish initialization of proxy and start handling request.
 // It is sync method, always return with non nil error: if handle stopped by context or if error on start handling.
-// Any public fields must not change after Start called
+// Any public fields must not change after Start called, use Update for change director and transport.
 func (p *HTTPProxy) Start() error {
-	if p.HTTPTransport != nil {
+	transport := p.HTTPTransport
+	if transport != nil {
 		p.logger.Info("Set transport to reverse proxy")
-		p.httpReverseProxy.Transport = p.HTTPTransport
+	} else {
+		transport = http.DefaultTransport
 	}
+	p.state.Store(proxyState{director: p.Director, responseModifier: p.ResponseModifier, httpsRedirect: p.HTTPSRedirect,
+		maintenancePage: p.MaintenancePage, transport: transport})
+	p.httpReverseProxy.Transport = stateTransport{p: p}
 
 	if p.EnableAccessLog {
 		p.httpReverseProxy.Transport = NewTransportLogger(p.httpReverseProxy.Transport)
 	}
 	p.logger.Info("Access log", zap.Bool("enabled", p.EnableAccessLog))
 
-	p.httpServer.Handler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		if !p.HandleHTTPValidation(writer, request) {
-			p.httpReverseProxy.ServeHTTP(writer, request)
+	var handler http.Handler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if p.HandleHTTPValidation(writer, request) || p.handleHTTPSRedirect(writer, request) ||
+			p.handleMisdirectedRequest(writer, request) || p.handleMaintenance(writer, request) {
+			return
 		}
+		p.httpReverseProxy.ServeHTTP(writer, request)
 	})
+	if len(p.HTTP3Listeners) > 0 {
+		handler = p.startHTTP3(handler)
+	}
+	p.httpServer.Handler = handler
 	p.httpServer.IdleTimeout = p.IdleTimeout
+	p.httpServer.ConnState = p.trackConnState
 
 	p.logger.Info("Http builtin reverse proxy start")
+	defer close(p.serveStopped)
 	err := p.httpServer.Serve(p.listener)
+	if atomic.LoadInt32(&p.shutdownStarted) == 1 {
+		// listener closed by Shutdown
+		err = http.ErrServerClosed
+	}
 	return err
 }
 
@@ -92,11 +220,124 @@ func (p *HTTPProxy) director(request *http.Request) {
 
 	logger := zc.L(ctx)
 	log.DebugDPanic(logger, err, "Get connection context for request")
-	*request = *request.WithContext(contexthelper.CombineContext(ctx, request.Context()))
-
 	if request.URL == nil {
 		request.URL = &url.URL{}
 	}
-	err = p.Director.Director(request)
+
+	var requestCtx context.Context = contexthelper.CombineContext(ctx, request.Context())
+	requestCtx = context.WithValue(requestCtx, contextlabel.RequestID, fastuuid.MustUUIDv4String())
+	requestCtx = context.WithValue(requestCtx, contextlabel.RequestPath, request.URL.Path)
+	*request = *request.WithContext(requestCtx)
+
+	err = p.getState().director.Director(request)
 	log.DebugPanic(logger, err, "Apply directors")
 }
+
+func (p *HTTPProxy) handleHTTPSRedirect(writer http.ResponseWriter, request *http.Request) bool {
+	ctx, err := p.GetContext(request)
+	if err != nil {
+		return false
+	}
+
+	redirect := p.getState().httpsRedirect
+	if redirect == nil {
+		redirect = defaultHTTPSRedirect
+	}
+	return redirect.Handle(ctx, writer, request)
+}
+
+func (p *HTTPProxy) handleMisdirectedRequest(writer http.ResponseWriter, request *http.Request) bool {
+	if p.HandleMisdirectedRequest == nil {
+		return false
+	}
+	return p.HandleMisdirectedRequest(writer, request)
+}
+
+func (p *HTTPProxy) handleMaintenance(writer http.ResponseWriter, request *http.Request) bool {
+	if p.Maintenance == nil {
+		return false
+	}
+
+	host := requestHost(request)
+	if !p.Maintenance.Enabled(host) {
+		return false
+	}
+
+	p.logger.Debug("Answer maintenance page", zap.String("host", host))
+	p.getState().maintenancePage.write(writer)
+	return true
+}
+
+func (p *HTTPProxy) modifyResponse(resp *http.Response) error {
+	modifier := p.getState().responseModifier
+	if modifier == nil {
+		return nil
+	}
+	err := modifier.ModifyResponse(resp)
+	if resp.Request != nil {
+		log.DebugError(zc.L(resp.Request.Context()), err, "Modify response")
+	}
+	return err
+}
+
+// errorHandler answer 502 if backend request failed. The answer modified by response modifier,
+// so it can be replaced by error page.
+func (p *HTTPProxy) errorHandler(writer http.ResponseWriter, request *http.Request, err error) {
+	logger := zc.L(request.Context())
+	logger.Info("Backend request failed", zap.Error(err))
+
+	resp := &http.Response{
+		StatusCode: http.StatusBadGateway,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    request,
+	}
+	_ = p.modifyResponse(resp)
+	defer func() { _ = resp.Body.Close() }()
+
+	for name, values := range resp.Header {
+		writer.Header()[name] = values
+	}
+	writer.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(writer, resp.Body)
+	log.DebugError(logger, err, "Write error answer")
+}
+
+// Update replace director, response modifier, https redirect, maintenance page and transport by values from newProxy
+// for new requests. It can be called after Start, requests in progress finish with old director and transport.
+// Health metrics of upstreams, removed from new transport, deleted.
+func (p *HTTPProxy) Update(newProxy *HTTPProxy) {
+	transport := newProxy.HTTPTransport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	oldTransport, _ := p.getState().transport.(Transport)
+	p.state.Store(proxyState{director: newProxy.Director, responseModifier: newProxy.ResponseModifier,
+		httpsRedirect: newProxy.HTTPSRedirect, maintenancePage: newProxy.MaintenancePage, transport: transport})
+	newTransport, _ := transport.(Transport)
+	oldTransport.Upstreams.deleteRemovedMetrics(newTransport.Upstreams)
+	p.logger.Info("Proxy director and transport updated")
+}
+
+// Upstreams return upstream pools of current transport, nil if transport has no pools.
+func (p *HTTPProxy) Upstreams() Upstreams {
+	transport, _ := p.getState().transport.(Transport)
+	return transport.Upstreams
+}
+
+func (p *HTTPProxy) getState() proxyState {
+	if state, ok := p.state.Load().(proxyState); ok {
+		return state
+	}
+	return proxyState{director: p.Director, responseModifier: p.ResponseModifier, httpsRedirect: p.HTTPSRedirect,
+		maintenancePage: p.MaintenancePage, transport: p.HTTPTransport}
+}
+
+// stateTransport send request by current transport of proxy
+type stateTransport struct {
+	p *HTTPProxy
+}
+
+func (t stateTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	return t.p.getState().transport.RoundTrip(request)
+}
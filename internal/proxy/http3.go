@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// altSvcMaxAge - seconds, while client can use advertised HTTP/3 endpoint.
+const altSvcMaxAge = 24 * 60 * 60
+
+// startHTTP3 serve HTTP/3 on HTTP3Listeners by the handler and return handler for tcp connections,
+// which advertise HTTP/3 by Alt-Svc header on tls connections.
+func (p *HTTPProxy) startHTTP3(handler http.Handler) http.Handler {
+	p.http3Server.Handler = handler
+
+	var altSvc []string
+	ports := make(map[int]bool, len(p.HTTP3Listeners))
+	for _, listener := range p.HTTP3Listeners {
+		if addr, ok := listener.Addr().(*net.UDPAddr); ok && !ports[addr.Port] {
+			ports[addr.Port] = true
+			altSvc = append(altSvc, fmt.Sprintf(`h3=":%d"; ma=%d`, addr.Port, altSvcMaxAge))
+		}
+
+		go func(listener http3.QUICEarlyListener) {
+			defer log.HandlePanic(p.logger)
+
+			err := p.http3Server.ServeListener(listener)
+			if errors.Is(err, http.ErrServerClosed) || errors.Is(err, quic.ErrServerClosed) {
+				err = nil
+			}
+			log.DebugError(p.logger, err, "Http/3 handle stopped", zap.Stringer("address", listener.Addr()))
+		}(listener)
+	}
+
+	altSvcHeader := strings.Join(altSvc, ", ")
+	p.logger.Info("Http/3 start", zap.String("alt_svc", altSvcHeader))
+	return altSvcHandler(handler, altSvcHeader)
+}
+
+// altSvcHandler add Alt-Svc header to responses for requests over tls only: HTTP/3 endpoint is alternative
+// for https origin and plain http responses must not advertise it.
+func altSvcHandler(handler http.Handler, altSvcHeader string) http.Handler {
+	if altSvcHeader == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.TLS != nil {
+			writer.Header().Add("Alt-Svc", altSvcHeader)
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestHTTPProxy_HTTP3(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	td.FailureIsFatal()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	td.CmpNoError(err)
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	defer udpConn.Close()
+	quicListener, err := quic.ListenEarly(udpConn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h3"},
+	}, nil)
+	td.CmpNoError(err)
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	tlsListener := tls.NewListener(tcpListener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	proxy := NewHTTPProxy(ctx, tlsListener)
+	defer th.Close(proxy)
+	proxy.Director = NewDirectorChain(
+		NewDirectorHost(strings.TrimPrefix(backend.URL, "http://")),
+		NewSetSchemeDirector(ProtocolHTTP),
+	)
+	proxy.HTTPTransport = Transport{RateLimiter: &RateLimiter{}, Cache: NewTransportCache(TransportParams{})}
+	proxy.HTTP3Listeners = []http3.QUICEarlyListener{quicListener}
+	go func() { _ = proxy.Start() }()
+
+	h3Transport := &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}} //nolint:gosec
+	defer h3Transport.Close()
+	h3Client := &http.Client{Transport: h3Transport, Timeout: 10 * time.Second}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+udpConn.LocalAddr().String()+"/h3", nil)
+	td.CmpNoError(err)
+	req.Host = "example.com"
+	resp, err := h3Client.Do(req)
+	td.CmpNoError(err)
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	td.CmpNoError(err)
+	td.Cmp(resp.ProtoMajor, 3)
+	td.Cmp(string(body), "example.com/h3", "same directors for HTTP/3")
+	td.Cmp(resp.Header.Get("Alt-Svc"), "")
+
+	tcpClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+	}}
+	var tcpResp *http.Response
+	for i := 0; i < 100; i++ {
+		// wait proxy start
+		tcpResp, err = tcpClient.Get("https://" + tcpListener.Addr().String() + "/tcp")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	td.CmpNoError(err)
+	_ = tcpResp.Body.Close()
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+	td.Cmp(tcpResp.Header.Get("Alt-Svc"), `h3=":`+strconv.Itoa(port)+`"; ma=86400`)
+}
+
+func TestAltSvcHandler(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	altSvc := altSvcHandler(handler, `h3=":443"; ma=86400`)
+
+	resp := httptest.NewRecorder()
+	altSvc.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	td.Cmp(resp.Header().Get("Alt-Svc"), "", "plain http")
+
+	resp = httptest.NewRecorder()
+	altSvc.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	td.Cmp(resp.Header().Get("Alt-Svc"), `h3=":443"; ma=86400`, "https")
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+const defaultHTTPSRedirectCode = http.StatusMovedPermanently
+
+// defaultHTTPSRedirect used if proxy has no configured redirect.
+var defaultHTTPSRedirect = &HTTPSRedirect{code: defaultHTTPSRedirectCode}
+
+// HTTPSRedirect answer redirect to https for requests from connections, marked by contextlabel.HTTPSRedirect.
+// Requests to except hosts and paths proxied as usual.
+type HTTPSRedirect struct {
+	code        int
+	exceptHosts []hostPattern
+	exceptPaths []string
+}
+
+// NewHTTPSRedirect create redirect with code 301 or 308 (301 if code is 0).
+// exceptHosts - host patterns in same format as for DirectorHostRoutes, exceptPaths - path prefixes.
+func NewHTTPSRedirect(code int, exceptHosts, exceptPaths []string) (*HTTPSRedirect, error) {
+	switch code {
+	case 0:
+		code = defaultHTTPSRedirectCode
+	case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+		// pass
+	default:
+		return nil, fmt.Errorf("https redirect code must be %v or %v: %v",
+			http.StatusMovedPermanently, http.StatusPermanentRedirect, code)
+	}
+
+	res := &HTTPSRedirect{code: code}
+	for _, host := range exceptHosts {
+		pattern, err := parseHostPattern(host)
+		if err != nil {
+			return nil, err
+		}
+		res.exceptHosts = append(res.exceptHosts, pattern)
+	}
+	for _, path := range exceptPaths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("https redirect except path must start with '/': %q", path)
+		}
+		res.exceptPaths = append(res.exceptPaths, path)
+	}
+	return res, nil
+}
+
+// Handle answer redirect if connection of request marked for redirect and request isn't in exceptions.
+// connectionCtx is context of client connection. Return true if request handled.
+func (r *HTTPSRedirect) Handle(connectionCtx context.Context, w http.ResponseWriter, request *http.Request) bool {
+	if redirect, _ := connectionCtx.Value(contextlabel.HTTPSRedirect).(bool); !redirect {
+		return false
+	}
+
+	host := requestHost(request)
+	for _, pattern := range r.exceptHosts {
+		if pattern.match(host) {
+			return false
+		}
+	}
+	for _, path := range r.exceptPaths {
+		if strings.HasPrefix(request.URL.Path, path) {
+			return false
+		}
+	}
+
+	logger := zc.L(connectionCtx)
+	if host == "" {
+		logger.Debug("Can't redirect to https request without host")
+		http.Error(w, "Host required", http.StatusBadRequest)
+		return true
+	}
+
+	if strings.Contains(host, ":") {
+		// ipv6
+		host = "[" + host + "]"
+	}
+	target := "https://" + host + request.URL.RequestURI()
+	logger.Debug("Redirect to https", zap.String("target", target), zap.Int("code", r.code))
+	http.Redirect(w, request, target, r.code)
+	return true
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestNewHTTPSRedirect(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	redirect, err := NewHTTPSRedirect(0, nil, nil)
+	td.CmpNoError(err)
+	td.Cmp(redirect.code, http.StatusMovedPermanently)
+
+	redirect, err = NewHTTPSRedirect(http.StatusPermanentRedirect, nil, nil)
+	td.CmpNoError(err)
+	td.Cmp(redirect.code, http.StatusPermanentRedirect)
+
+	_, err = NewHTTPSRedirect(http.StatusFound, nil, nil)
+	td.CmpError(err)
+
+	_, err = NewHTTPSRedirect(0, []string{"~("}, nil)
+	td.CmpError(err)
+
+	_, err = NewHTTPSRedirect(0, nil, []string{"asd"})
+	td.CmpError(err)
+}
+
+func TestHTTPSRedirect_Handle(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	redirect, err := NewHTTPSRedirect(http.StatusPermanentRedirect, []string{"*.local.example.com"}, []string{"/health"})
+	td.CmpNoError(err)
+
+	redirectCtx := context.WithValue(ctx, contextlabel.HTTPSRedirect, true)
+
+	check := func(connectionCtx context.Context, host, target string) (handled bool, code int, location string) {
+		request := httptest.NewRequest(http.MethodGet, target, nil)
+		request.Host = host
+		recorder := httptest.NewRecorder()
+		handled = redirect.Handle(connectionCtx, recorder, request)
+		return handled, recorder.Code, recorder.Header().Get("Location")
+	}
+
+	handled, _, _ := check(ctx, "example.com", "/")
+	td.False(handled, "connection without label")
+
+	handled, _, _ = check(context.WithValue(ctx, contextlabel.HTTPSRedirect, false), "example.com", "/")
+	td.False(handled)
+
+	handled, code, location := check(redirectCtx, "Example.com:80", "/path?a=b")
+	td.True(handled)
+	td.Cmp(code, http.StatusPermanentRedirect)
+	td.Cmp(location, "https://example.com/path?a=b")
+
+	_, _, location = check(redirectCtx, "[::1]:80", "/")
+	td.Cmp(location, "https://[::1]/")
+
+	handled, _, _ = check(redirectCtx, "www.local.example.com", "/")
+	td.False(handled, "except host")
+
+	handled, _, _ = check(redirectCtx, "example.com", "/health/check")
+	td.False(handled, "except path")
+
+	handled, code, _ = check(redirectCtx, "", "/")
+	td.True(handled)
+	td.Cmp(code, http.StatusBadRequest)
+}
+
+func TestHTTPProxy_HTTPSRedirect(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	proxy := NewHTTPProxy(ctx, listener)
+	defer th.Close(proxy)
+
+	proxy.GetContext = func(req *http.Request) (context.Context, error) {
+		return context.WithValue(ctx, contextlabel.HTTPSRedirect, true), nil
+	}
+	proxy.HandleHTTPValidation = func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			_, _ = w.Write([]byte("token"))
+			return true
+		}
+		return false
+	}
+	go func() { _ = proxy.Start() }()
+	time.Sleep(10 * time.Millisecond)
+
+	client := http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.Get("http://" + listener.Addr().String() + "/.well-known/acme-challenge/asd")
+	td.CmpNoError(err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	td.Cmp(resp.StatusCode, http.StatusOK)
+	td.Cmp(string(body), "token")
+
+	request, _ := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/test", nil)
+	request.Host = "example.com"
+	resp, err = client.Do(request)
+	td.CmpNoError(err)
+	_ = resp.Body.Close()
+	td.Cmp(resp.StatusCode, http.StatusMovedPermanently)
+	td.Cmp(resp.Header.Get("Location"), "https://example.com/test")
+}
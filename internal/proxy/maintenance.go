@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const defaultMaintenanceCheckInterval = time.Second
+
+var defaultMaintenancePageBody = []byte(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Maintenance</title></head>
+<body><h1>Service temporarily unavailable</h1><p>Maintenance in progress, please try again later.</p></body>
+</html>
+`)
+
+// MaintenancePage is answer with 503 status code for hosts in maintenance mode.
+type MaintenancePage struct {
+	// Body - html page, default page used if nil.
+	Body []byte
+
+	// RetryAfter - value of Retry-After header, header doesn't send if 0.
+	RetryAfter time.Duration
+}
+
+func (p MaintenancePage) write(w http.ResponseWriter) {
+	body := p.Body
+	if body == nil {
+		body = defaultMaintenancePageBody
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "no-store")
+	if p.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(p.RetryAfter/time.Second)))
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write(body)
+}
+
+// Maintenance store hosts in maintenance mode. Host switched by Set (from admin api)
+// or by flag file in FlagDir: name of file is host.
+type Maintenance struct {
+	FlagDir       string
+	CheckInterval time.Duration
+
+	mu        sync.RWMutex
+	hosts     map[string]bool
+	flagHosts map[string]bool
+}
+
+func NewMaintenance(flagDir string) *Maintenance {
+	return &Maintenance{
+		FlagDir:       flagDir,
+		CheckInterval: defaultMaintenanceCheckInterval,
+		hosts:         make(map[string]bool),
+		flagHosts:     make(map[string]bool),
+	}
+}
+
+// Start read flag files and re-read them every CheckInterval until ctx canceled.
+func (m *Maintenance) Start(ctx context.Context) {
+	logger := zc.L(ctx)
+	m.readFlagDir(ctx)
+
+	go func() {
+		defer log.HandlePanic(logger)
+
+		ticker := time.NewTicker(m.CheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.readFlagDir(ctx)
+			}
+		}
+	}()
+}
+
+func (m *Maintenance) readFlagDir(ctx context.Context) {
+	logger := zc.L(ctx)
+
+	entries, err := os.ReadDir(m.FlagDir)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warn("Can't read maintenance flag dir", zap.String("dir", m.FlagDir), zap.Error(err))
+		return
+	}
+
+	flagHosts := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			flagHosts[normalizeHost(entry.Name())] = true
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !reflect.DeepEqual(flagHosts, m.flagHosts) {
+		logger.Info("Maintenance flag files changed", zap.Int("hosts", len(flagHosts)))
+	}
+	m.flagHosts = flagHosts
+}
+
+// Set enable or disable maintenance mode for host. It doesn't change mode, enabled by flag file.
+func (m *Maintenance) Set(host string, enable bool) {
+	host = normalizeHost(host)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if enable {
+		m.hosts[host] = true
+	} else {
+		delete(m.hosts, host)
+	}
+}
+
+// Enabled return true if host in maintenance mode
+func (m *Maintenance) Enabled(host string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.hosts[host] || m.flagHosts[host]
+}
+
+// Hosts return sorted list of hosts in maintenance mode.
+func (m *Maintenance) Hosts() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	res := make([]string, 0, len(m.hosts)+len(m.flagHosts))
+	for host := range m.hosts {
+		res = append(res, host)
+	}
+	for host := range m.flagHosts {
+		if !m.hosts[host] {
+			res = append(res, host)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
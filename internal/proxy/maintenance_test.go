@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestMaintenance(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	dir := filepath.Join(t.TempDir(), "maintenance")
+	m := NewMaintenance(dir)
+	m.CheckInterval = 10 * time.Millisecond
+	m.Start(ctx)
+
+	td.False(m.Enabled("example.com"))
+	td.Cmp(m.Hosts(), []string{})
+
+	m.Set("Example.com", true)
+	td.True(m.Enabled("example.com"))
+	td.Cmp(m.Hosts(), []string{"example.com"})
+
+	td.CmpNoError(os.Mkdir(dir, 0700))
+	td.CmpNoError(os.WriteFile(filepath.Join(dir, "www.example.com"), nil, 0600))
+	time.Sleep(50 * time.Millisecond)
+	td.True(m.Enabled("www.example.com"))
+	td.Cmp(m.Hosts(), []string{"example.com", "www.example.com"})
+
+	m.Set("example.com", false)
+	m.Set("www.example.com", false)
+	td.False(m.Enabled("example.com"))
+	td.True(m.Enabled("www.example.com"), "flag file keep maintenance")
+
+	td.CmpNoError(os.Remove(filepath.Join(dir, "www.example.com")))
+	time.Sleep(50 * time.Millisecond)
+	td.False(m.Enabled("www.example.com"))
+}
+
+func TestMaintenancePage(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	recorder := httptest.NewRecorder()
+	MaintenancePage{}.write(recorder)
+	td.Cmp(recorder.Code, http.StatusServiceUnavailable)
+	td.Cmp(recorder.Header().Get("Retry-After"), "")
+	td.Cmp(recorder.Body.Bytes(), defaultMaintenancePageBody)
+
+	recorder = httptest.NewRecorder()
+	MaintenancePage{Body: []byte("page"), RetryAfter: time.Minute}.write(recorder)
+	td.Cmp(recorder.Code, http.StatusServiceUnavailable)
+	td.Cmp(recorder.Header().Get("Retry-After"), "60")
+	td.Cmp(recorder.Header().Get("Content-Type"), "text/html; charset=utf-8")
+	td.Cmp(recorder.Body.String(), "page")
+}
+
+func TestHTTPProxy_Maintenance(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	proxy := NewHTTPProxy(ctx, listener)
+	defer th.Close(proxy)
+
+	proxy.Director = NewDirectorChain(NewDirectorHost(backend.Listener.Addr().String()), NewSetSchemeDirector(ProtocolHTTP))
+	proxy.Maintenance = NewMaintenance(t.TempDir())
+	proxy.MaintenancePage = MaintenancePage{Body: []byte("maintenance"), RetryAfter: 10 * time.Second}
+	go func() { _ = proxy.Start() }()
+	time.Sleep(10 * time.Millisecond)
+
+	get := func(host string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/", nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		td.CmpNoError(err)
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp, string(body)
+	}
+
+	resp, body := get("example.com")
+	td.Cmp(resp.StatusCode, http.StatusOK)
+	td.Cmp(body, "backend")
+
+	proxy.Maintenance.Set("example.com", true)
+	resp, body = get("example.com")
+	td.Cmp(resp.StatusCode, http.StatusServiceUnavailable)
+	td.Cmp(resp.Header.Get("Retry-After"), "10")
+	td.Cmp(body, "maintenance")
+
+	_, body = get("other.com")
+	td.Cmp(body, "backend")
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+// Versions of PROXY protocol header, which can be sent to backend.
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyProtocolV2Local = 0x20 // version 2, command LOCAL
+	proxyProtocolV2Proxy = 0x21 // version 2, command PROXY
+
+	proxyProtocolV2FamilyTCP4 = 0x11
+	proxyProtocolV2FamilyTCP6 = 0x21
+)
+
+func parseProxyProtocolVersion(s string) (string, error) {
+	version := strings.ToLower(strings.TrimSpace(s))
+	switch version {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+		return version, nil
+	default:
+		return "", fmt.Errorf("unknown PROXY protocol version: %q", s)
+	}
+}
+
+// withProxyProtocol mark request context for send PROXY protocol header to backend.
+func withProxyProtocol(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, contextlabel.ProxyProtocol, version)
+}
+
+func getProxyProtocol(ctx context.Context) string {
+	version, _ := ctx.Value(contextlabel.ProxyProtocol).(string)
+	return version
+}
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyProtocolDialContext write PROXY protocol header to new connection if context marked by withProxyProtocol.
+// Client and listener addresses get from connection context.
+func proxyProtocolDialContext(dial dialContextFunc) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		version := getProxyProtocol(ctx)
+		if version == "" {
+			return conn, nil
+		}
+
+		src, _ := ctx.Value(contextlabel.RemoteAddr).(net.Addr)
+		dst, _ := ctx.Value(contextlabel.LocalAddr).(net.Addr)
+		header := proxyProtocolHeader(version, src, dst)
+		zc.L(ctx).Debug("Send PROXY protocol header to backend", zap.String("version", version),
+			zap.String("backend", addr), zap.Any("src", src), zap.Any("dst", dst))
+
+		if _, err = conn.Write(header); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("write PROXY protocol header: %w", err)
+		}
+		return conn, nil
+	}
+}
+
+// proxyProtocolHeader build header of the version. Header hasn't addresses if src or dst isn't tcp address
+// or addresses from different families.
+func proxyProtocolHeader(version string, src, dst net.Addr) []byte {
+	srcTCP, _ := src.(*net.TCPAddr)
+	dstTCP, _ := dst.(*net.TCPAddr)
+
+	var srcIP, dstIP net.IP
+	if srcTCP != nil && dstTCP != nil {
+		srcIP, dstIP = srcTCP.IP.To4(), dstTCP.IP.To4()
+		if srcIP == nil || dstIP == nil {
+			srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16()
+			if srcTCP.IP.To4() != nil || dstTCP.IP.To4() != nil {
+				// different families
+				srcIP, dstIP = nil, nil
+			}
+		}
+	}
+	hasAddresses := srcIP != nil && dstIP != nil
+	isIPv4 := len(srcIP) == net.IPv4len
+
+	if version == ProxyProtocolV1 {
+		if !hasAddresses {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if isIPv4 {
+			family = "TCP4"
+		}
+		return []byte("PROXY " + family + " " + srcIP.String() + " " + dstIP.String() + " " +
+			strconv.Itoa(srcTCP.Port) + " " + strconv.Itoa(dstTCP.Port) + "\r\n")
+	}
+
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	if !hasAddresses {
+		return append(header, proxyProtocolV2Local, 0, 0, 0)
+	}
+
+	family := byte(proxyProtocolV2FamilyTCP6)
+	if isIPv4 {
+		family = proxyProtocolV2FamilyTCP4
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], uint16(srcTCP.Port))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(dstTCP.Port))
+	addresses := append(append(append([]byte{}, srcIP...), dstIP...), ports...)
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addresses)))
+
+	header = append(header, proxyProtocolV2Proxy, family)
+	header = append(header, length...)
+	return append(header, addresses...)
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	src4 := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}
+	dst4 := &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	td.Cmp(string(proxyProtocolHeader(ProxyProtocolV1, src4, dst4)), "PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r\n")
+	td.Cmp(string(proxyProtocolHeader(ProxyProtocolV1, src6, dst6)), "PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n")
+	td.Cmp(string(proxyProtocolHeader(ProxyProtocolV1, src4, dst6)), "PROXY UNKNOWN\r\n")
+	td.Cmp(string(proxyProtocolHeader(ProxyProtocolV1, nil, dst4)), "PROXY UNKNOWN\r\n")
+	td.Cmp(string(proxyProtocolHeader(ProxyProtocolV1, &net.UnixAddr{}, dst4)), "PROXY UNKNOWN\r\n")
+
+	signature := string(proxyProtocolV2Signature)
+	td.Cmp(string(proxyProtocolHeader(ProxyProtocolV2, src4, dst4)),
+		signature+"\x21\x11\x00\x0c"+"\x01\x02\x03\x04"+"\x05\x06\x07\x08"+"\x04\xd2"+"\x01\xbb")
+	td.Cmp(string(proxyProtocolHeader(ProxyProtocolV2, src6, dst6)),
+		signature+"\x21\x21\x00\x24"+string(src6.IP.To16())+string(dst6.IP.To16())+"\x04\xd2"+"\x01\xbb")
+	td.Cmp(string(proxyProtocolHeader(ProxyProtocolV2, nil, nil)), signature+"\x20\x00\x00\x00")
+}
+
+func TestParseProxyProtocolVersion(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	for _, s := range []string{"", "v1", "V2", " v2 "} {
+		_, err := parseProxyProtocolVersion(s)
+		td.CmpNoError(err, s)
+	}
+	version, _ := parseProxyProtocolVersion(" V1 ")
+	td.Cmp(version, ProxyProtocolV1)
+
+	_, err := parseProxyProtocolVersion("v3")
+	td.CmpError(err)
+}
+
+func TestTransport_ProxyProtocol(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	// backend read PROXY protocol header line and http request, then answer with the header
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	defer func() { _ = listener.Close() }()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer func() { _ = conn.Close() }()
+
+				reader := bufio.NewReader(conn)
+				var header string
+				if b, _ := reader.Peek(1); len(b) == 1 && b[0] == 'P' {
+					header, _ = reader.ReadString('\n')
+				}
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				_, _ = io.Copy(io.Discard, req.Body)
+				resp := http.Response{
+					StatusCode: http.StatusOK,
+					ProtoMajor: 1,
+					ProtoMinor: 1,
+					Body:       io.NopCloser(strings.NewReader(header)),
+					Close:      true,
+				}
+				_ = resp.Write(conn)
+			}(conn)
+		}
+	}()
+	backendAddr := listener.Addr().String()
+
+	connCtx := context.WithValue(ctx, contextlabel.RemoteAddr, &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234})
+	connCtx = context.WithValue(connCtx, contextlabel.LocalAddr, &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 443})
+
+	send := func(transport Transport, ctx context.Context) string {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+backendAddr+"/", nil)
+		td.CmpNoError(err)
+		resp, err := transport.RoundTrip(req)
+		if !td.CmpNoError(err) {
+			return ""
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return string(body)
+	}
+
+	transport := Transport{
+		RateLimiter:          &RateLimiter{},
+		ProxyProtocolTargets: map[string]string{backendAddr: ProxyProtocolV1},
+	}
+	td.Cmp(send(transport, connCtx), "PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r\n")
+	td.Cmp(send(transport, ctx), "PROXY UNKNOWN\r\n", "without client address")
+
+	td.Cmp(send(Transport{RateLimiter: &RateLimiter{}}, connCtx), "", "without PROXY protocol")
+
+	// enabled by route
+	td.Cmp(send(Transport{RateLimiter: &RateLimiter{}}, withProxyProtocol(connCtx, ProxyProtocolV1)),
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r\n")
+}
+
+func TestConfig_getProxyProtocolTargets(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	c := Config{}
+	targets, err := c.getProxyProtocolTargets(ctx)
+	td.CmpNoError(err)
+	td.Nil(targets)
+
+	c = Config{
+		Upstreams: map[string]UpstreamConfig{"backend": {Targets: []string{"1.2.3.4"}}},
+		ProxyProtocolTargets: map[string]string{
+			"1.2.3.4":          "V1",
+			"1.2.3.5:25":       "v2",
+			"1.2.3.6":          "",
+			"upstream:backend": "v2",
+		},
+	}
+	targets, err = c.getProxyProtocolTargets(ctx)
+	td.CmpNoError(err)
+	td.Cmp(targets, map[string]string{
+		"1.2.3.4:80":       ProxyProtocolV1,
+		"1.2.3.5:25":       ProxyProtocolV2,
+		"upstream:backend": ProxyProtocolV2,
+	})
+
+	c.ProxyProtocolTargets = map[string]string{"1.2.3.4": "v3"}
+	_, err = c.getProxyProtocolTargets(ctx)
+	td.CmpError(err)
+
+	c.ProxyProtocolTargets = map[string]string{"upstream:unknown": "v1"}
+	_, err = c.getProxyProtocolTargets(ctx)
+	td.CmpError(err)
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+// ResponseModifier modify responses from backend before send it to client.
+type ResponseModifier interface {
+	ModifyResponse(resp *http.Response) error
+}
+
+type ResponseModifierChain []ResponseModifier
+
+// NewResponseModifierChain create chain from modifiers, nil modifiers skipped.
+func NewResponseModifierChain(modifiers ...ResponseModifier) ResponseModifierChain {
+	res := make(ResponseModifierChain, 0, len(modifiers))
+	for _, item := range modifiers {
+		if item != nil {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func (c ResponseModifierChain) ModifyResponse(resp *http.Response) error {
+	for _, m := range c {
+		if err := m.ModifyResponse(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResponseModifierHeaders remove and set response headers. Remove applied before set.
+type ResponseModifierHeaders struct {
+	Set    map[string]*HeaderTemplate
+	Remove []string
+}
+
+func (m ResponseModifierHeaders) ModifyResponse(resp *http.Response) error {
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	for _, name := range m.Remove {
+		resp.Header.Del(name)
+	}
+	for name, template := range m.Set {
+		resp.Header.Set(name, template.Execute(resp.Request))
+	}
+	return nil
+}
+
+// ResponseModifierHSTS set Strict-Transport-Security header with the value to responses for TLS connections only.
+type ResponseModifierHSTS string
+
+// NewResponseModifierHSTS create HSTS modifier with max-age in seconds.
+func NewResponseModifierHSTS(maxAge int, includeSubdomains, preload bool) ResponseModifierHSTS {
+	value := "max-age=" + strconv.Itoa(maxAge)
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if preload {
+		value += "; preload"
+	}
+	return ResponseModifierHSTS(value)
+}
+
+func (m ResponseModifierHSTS) ModifyResponse(resp *http.Response) error {
+	if resp.Request == nil {
+		return nil
+	}
+	if tls, _ := resp.Request.Context().Value(contextlabel.TLSConnection).(bool); !tls {
+		return nil
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	resp.Header.Set("Strict-Transport-Security", string(m))
+	return nil
+}
+
+// ResponseModifierRoute apply modifier to responses for requests, which match host pattern and path prefix.
+// Path is path of client request, before rewrite by directors.
+type ResponseModifierRoute struct {
+	hasHost  bool
+	host     hostPattern
+	prefix   string
+	modifier ResponseModifier
+}
+
+// NewResponseModifierRoute create modifier for host pattern (same format as for DirectorHostRoutes) and path prefix.
+// Empty host and prefix match all requests.
+func NewResponseModifierRoute(host, prefix string, modifier ResponseModifier) (ResponseModifierRoute, error) {
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return ResponseModifierRoute{}, fmt.Errorf("response headers prefix must start with '/': %q", prefix)
+	}
+
+	res := ResponseModifierRoute{prefix: prefix, modifier: modifier}
+	if host != "" {
+		pattern, err := parseHostPattern(host)
+		if err != nil {
+			return ResponseModifierRoute{}, err
+		}
+		res.hasHost = true
+		res.host = pattern
+	}
+	return res, nil
+}
+
+func (m ResponseModifierRoute) ModifyResponse(resp *http.Response) error {
+	if !m.match(resp) {
+		return nil
+	}
+	return m.modifier.ModifyResponse(resp)
+}
+
+func (m ResponseModifierRoute) match(resp *http.Response) bool {
+	if resp.Request == nil {
+		return false
+	}
+	if m.hasHost && !m.host.match(requestHost(resp.Request)) {
+		return false
+	}
+	if m.prefix != "" && !strings.HasPrefix(clientRequestPath(resp.Request), m.prefix) {
+		return false
+	}
+	return true
+}
+
+// ResponseModifierFirstRoute apply modifier of most specific matched route only.
+type ResponseModifierFirstRoute []ResponseModifierRoute
+
+// NewResponseModifierFirstRoute sort routes from specific to common.
+func NewResponseModifierFirstRoute(routes []ResponseModifierRoute) ResponseModifierFirstRoute {
+	res := make(ResponseModifierFirstRoute, len(routes))
+	copy(res, routes)
+	sortResponseModifierRoutes(res)
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+func (r ResponseModifierFirstRoute) ModifyResponse(resp *http.Response) error {
+	for _, route := range r {
+		if route.match(resp) {
+			return route.modifier.ModifyResponse(resp)
+		}
+	}
+	return nil
+}
+
+// sortResponseModifierRoutes sort routes from common to specific: global, then by path prefix length.
+// For same prefix length route with host is more specific. So specific routes override headers of common.
+func sortResponseModifierRoutes(routes []ResponseModifierRoute) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		if len(routes[i].prefix) != len(routes[j].prefix) {
+			return len(routes[i].prefix) < len(routes[j].prefix)
+		}
+		return !routes[i].hasHost && routes[j].hasHost
+	})
+}
+
+// clientRequestPath return path of client request, before rewrite by directors.
+func clientRequestPath(request *http.Request) string {
+	if path, ok := request.Context().Value(contextlabel.RequestPath).(string); ok {
+		return path
+	}
+	if request.URL == nil {
+		return ""
+	}
+	return request.URL.Path
+}
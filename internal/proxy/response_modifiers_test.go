@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestResponseModifierHSTS(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	m := NewResponseModifierHSTS(31536000, true, true)
+	td.Cmp(string(m), "max-age=31536000; includeSubDomains; preload")
+	td.Cmp(string(NewResponseModifierHSTS(100, false, false)), "max-age=100")
+
+	resp := &http.Response{Request: (&http.Request{}).WithContext(context.WithValue(ctx, contextlabel.TLSConnection, true))}
+	td.CmpNoError(m.ModifyResponse(resp))
+	td.Cmp(resp.Header.Get("Strict-Transport-Security"), "max-age=31536000; includeSubDomains; preload")
+
+	resp = &http.Response{Request: (&http.Request{}).WithContext(context.WithValue(ctx, contextlabel.TLSConnection, false))}
+	td.CmpNoError(m.ModifyResponse(resp))
+	td.Cmp(resp.Header.Get("Strict-Transport-Security"), "", "no hsts for http")
+}
+
+func TestResponseModifierHeaders(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	template, err := ParseHeaderTemplate("{{REQUEST_ID}}")
+	td.CmpNoError(err)
+	nosniff, err := ParseHeaderTemplate("nosniff")
+	td.CmpNoError(err)
+
+	m := ResponseModifierHeaders{
+		Set:    map[string]*HeaderTemplate{"X-Request-Id": template, "X-Content-Type-Options": nosniff},
+		Remove: []string{"Server", "x-powered-by"},
+	}
+	resp := &http.Response{
+		Header:  http.Header{"Server": {"nginx"}, "X-Powered-By": {"PHP"}, "Content-Type": {"text/html"}},
+		Request: (&http.Request{}).WithContext(context.WithValue(ctx, contextlabel.RequestID, "req-1")),
+	}
+	td.CmpNoError(m.ModifyResponse(resp))
+	td.Cmp(resp.Header, http.Header{
+		"Content-Type":           {"text/html"},
+		"X-Request-Id":           {"req-1"},
+		"X-Content-Type-Options": {"nosniff"},
+	})
+}
+
+func TestResponseModifierRoute(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	_, err := NewResponseModifierRoute("", "asd", ResponseModifierHSTS("max-age=1"))
+	td.CmpError(err)
+	_, err = NewResponseModifierRoute("~(", "", ResponseModifierHSTS("max-age=1"))
+	td.CmpError(err)
+
+	newHeaderRoute := func(host, prefix, value string) ResponseModifierRoute {
+		template, err := ParseHeaderTemplate(value)
+		td.CmpNoError(err)
+		route, err := NewResponseModifierRoute(host, prefix, ResponseModifierHeaders{Set: map[string]*HeaderTemplate{"X-Test": template}})
+		td.CmpNoError(err)
+		return route
+	}
+
+	routes := []ResponseModifierRoute{
+		newHeaderRoute("example.com", "/api", "host-api"),
+		newHeaderRoute("", "/api", "api"),
+		newHeaderRoute("example.com", "", "host"),
+		newHeaderRoute("", "", "global"),
+	}
+	sortResponseModifierRoutes(routes)
+	chain := make([]ResponseModifier, 0, len(routes))
+	for _, route := range routes {
+		chain = append(chain, route)
+	}
+	modifier := NewResponseModifierChain(chain...)
+
+	check := func(host, clientPath, backendPath string) string {
+		requestCtx := ctx
+		if clientPath != "" {
+			requestCtx = context.WithValue(ctx, contextlabel.RequestPath, clientPath)
+		}
+		resp := &http.Response{Request: (&http.Request{Host: host, URL: &url.URL{Path: backendPath}}).WithContext(requestCtx)}
+		td.CmpNoError(modifier.ModifyResponse(resp))
+		return resp.Header.Get("X-Test")
+	}
+
+	td.Cmp(check("other.com", "/", "/"), "global")
+	td.Cmp(check("example.com", "/", "/"), "host")
+	td.Cmp(check("other.com", "/api/v1", "/v1"), "api", "match client path")
+	td.Cmp(check("example.com:443", "/api/v1", "/v1"), "host-api")
+	td.Cmp(check("example.com", "", "/api"), "host-api", "backend path without client path")
+}
+
+func TestConfig_getResponseModifier(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	c := Config{}
+	modifier, err := c.getResponseModifier(ctx)
+	td.CmpNoError(err)
+	td.Nil(modifier)
+
+	c.ResponseHeaders = []ResponseHeadersConfig{{Set: []string{"asd"}}}
+	_, err = c.getResponseModifier(ctx)
+	td.CmpError(err)
+
+	c.ResponseHeaders = []ResponseHeadersConfig{{Set: []string{"X-Test:{{sha256 UNKNOWN}}"}}}
+	_, err = c.getResponseModifier(ctx)
+	td.CmpError(err)
+
+	c.ResponseHeaders = []ResponseHeadersConfig{{Prefix: "asd"}}
+	_, err = c.getResponseModifier(ctx)
+	td.CmpError(err)
+
+	c.ResponseHeaders = []ResponseHeadersConfig{
+		{Remove: []string{"Server"}, HSTSMaxAge: 100},
+		{Host: "*.example.com", Set: []string{"X-Frame-Options:DENY"}},
+	}
+	modifier, err = c.getResponseModifier(ctx)
+	td.CmpNoError(err)
+	td.Len(modifier, 2)
+}
+
+func TestHTTPProxy_ResponseModifier(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "backend")
+		w.Header().Set("X-Powered-By", "PHP")
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	proxy := NewHTTPProxy(ctx, listener)
+	defer th.Close(proxy)
+
+	pathRoutes, err := NewDirectorPathRoutes([]PathRoute{{Prefix: "/api", StripPrefix: true}})
+	td.CmpNoError(err)
+	proxy.Director = NewDirectorChain(
+		NewDirectorHost(backendURL.Host),
+		NewSetSchemeDirector(ProtocolHTTP),
+		pathRoutes,
+	)
+	c := Config{ResponseHeaders: []ResponseHeadersConfig{
+		{Remove: []string{"Server", "X-Powered-By"}},
+		{Prefix: "/api", Set: []string{"X-Content-Type-Options:nosniff"}},
+	}}
+	proxy.ResponseModifier, err = c.getResponseModifier(ctx)
+	td.CmpNoError(err)
+	go func() { _ = proxy.Start() }()
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/api/test")
+	td.CmpNoError(err)
+	_ = resp.Body.Close()
+	td.Cmp(resp.Header.Get("Server"), "")
+	td.Cmp(resp.Header.Get("X-Powered-By"), "")
+	td.Cmp(resp.Header.Get("X-Content-Type-Options"), "nosniff")
+	td.Cmp(resp.Header.Get("Strict-Transport-Security"), "")
+}
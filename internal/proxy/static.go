@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	zc "github.com/rekby/zapcontext"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const staticIndexFile = "index.html"
+
+// withStaticDir mark request context for serve files from the dir instead of send request to backend.
+func withStaticDir(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, contextlabel.StaticDir, dir)
+}
+
+func getStaticDir(ctx context.Context) string {
+	dir, _ := ctx.Value(contextlabel.StaticDir).(string)
+	return dir
+}
+
+// staticHandler serve files from dir with index.html for directories, range requests, Last-Modified and ETag.
+// Directories without index file answer 404 instead of list files.
+type staticHandler struct {
+	fs http.FileSystem
+}
+
+func newStaticHandler(dir string) staticHandler {
+	return staticHandler{fs: http.Dir(dir)}
+}
+
+func (h staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	stat, err := h.stat(name)
+	if err == nil && stat.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// http.FileServer redirect to path with trailing slash
+			http.FileServer(h.fs).ServeHTTP(w, r)
+			return
+		}
+		stat, err = h.stat(path.Join(name, staticIndexFile))
+	}
+	if err != nil || stat.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// http.FileServer check If-None-Match and If-Range by the header
+	w.Header().Set("Etag", staticETag(stat))
+	http.FileServer(h.fs).ServeHTTP(w, r)
+}
+
+func (h staticHandler) stat(name string) (os.FileInfo, error) {
+	f, err := h.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return f.Stat()
+}
+
+func staticETag(stat os.FileInfo) string {
+	return `"` + strconv.FormatInt(stat.ModTime().UnixNano(), 16) + "-" + strconv.FormatInt(stat.Size(), 16) + `"`
+}
+
+// roundTripStatic answer to request by files from dir as backend response.
+func roundTripStatic(req *http.Request, dir string) (*http.Response, error) {
+	return roundTripHandler(req, newStaticHandler(dir))
+}
+
+// roundTripHandler return response of handler for request. Handler write body in goroutine while
+// response body read.
+func roundTripHandler(req *http.Request, handler http.Handler) (*http.Response, error) {
+	logger := zc.L(req.Context())
+
+	pipeReader, pipeWriter := io.Pipe()
+	w := &handlerResponseWriter{
+		pipeWriter: pipeWriter,
+		ready:      make(chan struct{}),
+		resp: &http.Response{
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        make(http.Header),
+			Body:          pipeReader,
+			ContentLength: -1,
+			Request:       req,
+		},
+	}
+
+	go func() {
+		defer log.HandlePanic(logger)
+		defer w.finish()
+
+		handler.ServeHTTP(w, req)
+	}()
+
+	<-w.ready
+	return w.resp, nil
+}
+
+// handlerResponseWriter convert answer of http.Handler to http.Response.
+type handlerResponseWriter struct {
+	pipeWriter  *io.PipeWriter
+	resp        *http.Response
+	ready       chan struct{}
+	wroteHeader bool
+}
+
+func (w *handlerResponseWriter) Header() http.Header {
+	return w.resp.Header
+}
+
+func (w *handlerResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	w.resp.StatusCode = statusCode
+	w.resp.Status = fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode))
+	if contentLength, err := strconv.ParseInt(w.resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		w.resp.ContentLength = contentLength
+	}
+	close(w.ready)
+}
+
+func (w *handlerResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pipeWriter.Write(p)
+}
+
+func (w *handlerResponseWriter) finish() {
+	w.WriteHeader(http.StatusOK)
+	_ = w.pipeWriter.Close()
+}
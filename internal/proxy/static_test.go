@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestRoundTripStatic(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	dir := t.TempDir()
+	td.CmpNoError(os.WriteFile(filepath.Join(dir, "index.html"), []byte("index"), 0600))
+	td.CmpNoError(os.Mkdir(filepath.Join(dir, "sub"), 0700))
+	td.CmpNoError(os.WriteFile(filepath.Join(dir, "sub", "file.txt"), []byte("0123456789"), 0600))
+	td.CmpNoError(os.Mkdir(filepath.Join(dir, "empty"), 0700))
+
+	transport := Transport{RateLimiter: &RateLimiter{}}
+	request := func(path string, header http.Header) (*http.Response, string) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		req = req.WithContext(withStaticDir(ctx, dir))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := transport.RoundTrip(req)
+		td.CmpNoError(err)
+		body, err := io.ReadAll(resp.Body)
+		td.CmpNoError(err)
+		td.CmpNoError(resp.Body.Close())
+		return resp, string(body)
+	}
+
+	resp, body := request("/", nil)
+	td.Cmp(resp.StatusCode, http.StatusOK)
+	td.Cmp(body, "index")
+	td.NotEmpty(resp.Header.Get("Etag"))
+
+	resp, body = request("/sub/file.txt", nil)
+	td.Cmp(resp.StatusCode, http.StatusOK)
+	td.Cmp(body, "0123456789")
+	td.Cmp(resp.ContentLength, int64(10))
+	etag := resp.Header.Get("Etag")
+	td.NotEmpty(etag)
+
+	resp, _ = request("/sub/file.txt", http.Header{"If-None-Match": {etag}})
+	td.Cmp(resp.StatusCode, http.StatusNotModified)
+
+	resp, body = request("/sub/file.txt", http.Header{"Range": {"bytes=2-4"}})
+	td.Cmp(resp.StatusCode, http.StatusPartialContent)
+	td.Cmp(body, "234")
+	td.Cmp(resp.Header.Get("Content-Range"), "bytes 2-4/10")
+
+	resp, body = request("/sub/file.txt", http.Header{"Range": {"bytes=2-4"}, "If-Range": {`"other"`}})
+	td.Cmp(resp.StatusCode, http.StatusOK, "If-Range with other etag")
+	td.Cmp(body, "0123456789")
+
+	resp, _ = request("/sub", nil)
+	td.Cmp(resp.StatusCode, http.StatusMovedPermanently, "redirect to dir with slash")
+
+	resp, _ = request("/empty/", nil)
+	td.Cmp(resp.StatusCode, http.StatusNotFound, "dir without index")
+
+	resp, _ = request("/not-exist", nil)
+	td.Cmp(resp.StatusCode, http.StatusNotFound)
+
+	resp, _ = request("/../../etc/passwd", nil)
+	td.Cmp(resp.StatusCode, http.StatusNotFound)
+}
+
+func TestDirectorPathRoutes_StaticDir(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	_, err := NewDirectorPathRoutes([]PathRoute{{Prefix: "/static/", StaticDir: "/tmp", Target: "1.2.3.4:80"}})
+	td.CmpError(err)
+
+	d, err := NewDirectorPathRoutes([]PathRoute{{Prefix: "/static/", StaticDir: "/var/www", StripPrefix: true}})
+	td.CmpNoError(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/static/img/1.png", nil).WithContext(ctx)
+	td.CmpNoError(d.Director(req))
+	td.Cmp(getStaticDir(req.Context()), "/var/www")
+	td.Cmp(req.URL.Path, "/img/1.png")
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/api", nil).WithContext(ctx)
+	td.CmpNoError(d.Director(req))
+	td.Cmp(getStaticDir(req.Context()), "")
+}
@@ -1,22 +1,37 @@
 package proxy
 
 import (
-	"crypto/tls"
-	"net"
+	"context"
+	"errors"
+	"io"
 	"net/http"
 	"strings"
-	"time"
 
 	"go.uber.org/zap"
 
 	zc "github.com/rekby/zapcontext"
-)
 
-var defaultHTTPTransport = defaultTransport()
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
 
 type Transport struct {
 	IgnoreHTTPSCertificate bool
 	RateLimiter            *RateLimiter
+	Upstreams              Upstreams
+
+	// LogAttempts enable log of every attempt of send request to upstream pool with retries
+	LogAttempts bool
+
+	// ProxyProtocolTargets is map from target (IP:Port or upstream:<name>) to version of PROXY protocol header,
+	// which send to the target before request.
+	ProxyProtocolTargets map[string]string
+
+	// BackendTLS is map from target (IP:Port or upstream:<name>) to TLS options for connect to the target.
+	// Targets without options use IgnoreHTTPSCertificate.
+	BackendTLS map[string]*BackendTLS
+
+	// Cache of transports to backends, defaultTransportCache used if nil.
+	Cache *TransportCache
 }
 
 func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -32,15 +47,197 @@ func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		}, nil
 	}
 
-	return t.getTransport(req).RoundTrip(req)
+	if dir := getStaticDir(req.Context()); dir != "" {
+		zc.L(req.Context()).Debug("Serve static files", zap.String("dir", dir), zap.String("path", req.URL.Path))
+		return roundTripStatic(req, dir)
+	}
+
+	if getProxyProtocol(req.Context()) == "" {
+		if version := t.ProxyProtocolTargets[req.URL.Host]; version != "" {
+			req = req.WithContext(withProxyProtocol(req.Context(), version))
+		}
+	}
+
+	if getBackendTLS(req.Context()) == nil {
+		if backendTLS := t.BackendTLS[req.URL.Host]; backendTLS != nil {
+			req = req.WithContext(withBackendTLS(req.Context(), backendTLS))
+		}
+	}
+
+	if pool := t.Upstreams.pool(req.URL.Host); pool != nil {
+		return t.roundTripUpstream(req, pool)
+	}
+
+	transport, err := t.getTransport(req)
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
+}
+
+// roundTripUpstream send request to upstream, selected from pool.
+// Idempotent requests (and other requests if pool allow it) with replayable body retry on other upstreams
+// after transport errors and retryable status codes.
+func (t Transport) roundTripUpstream(req *http.Request, pool *UpstreamPool) (*http.Response, error) {
+	ctx := req.Context()
+	logger := zc.L(ctx).With(zap.String("pool", pool.params.Name))
+
+	maxAttempts := 1
+	if isRetryableRequest(req, pool.params.RetryReplayableBody) {
+		maxAttempts += pool.params.Retries
+	}
+
+	var tried map[string]bool
+	var lastResp *http.Response
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		u, err := pool.Select(clientIP(req), tried)
+		if err != nil {
+			logger.Warn("Can't select upstream", zap.Int("attempt", attempt), zap.Error(err))
+			switch {
+			case lastResp != nil:
+				return lastResp, nil
+			case lastErr != nil:
+				return nil, lastErr
+			default:
+				return nil, err
+			}
+		}
+
+		attemptReq := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			bodyReq := *req
+			bodyReq.Body = body
+			attemptReq = &bodyReq
+		}
+		if lastResp != nil {
+			_, _ = io.Copy(io.Discard, lastResp.Body)
+			_ = lastResp.Body.Close()
+			lastResp = nil
+		}
+
+		resp, err := t.roundTripUpstreamAttempt(attemptReq, pool, u, attempt, maxAttempts > 1)
+		if ctx.Err() != nil {
+			return resp, err
+		}
+		if err == nil && !pool.isRetryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+
+		if err == nil {
+			lastResp = resp
+			lastErr = nil
+		} else {
+			lastErr = err
+		}
+		logger.Debug("Upstream attempt failed", zap.String("upstream", u.addr), zap.Int("attempt", attempt),
+			zap.Int("max_attempts", maxAttempts), zap.Int("status_code", statusCode(resp)), zap.Error(err))
+
+		if tried == nil {
+			tried = make(map[string]bool)
+		}
+		tried[u.addr] = true
+	}
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	return nil, lastErr
+}
+
+func statusCode(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
 }
 
-func (t Transport) getTransport(req *http.Request) *http.Transport {
+func (t Transport) roundTripUpstreamAttempt(req *http.Request, pool *UpstreamPool, u *upstream, attempt int, logAttempt bool) (*http.Response, error) {
+	ctx := req.Context()
+
+	var cancel context.CancelFunc = func() {}
+	if pool.params.TryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, pool.params.TryTimeout)
+	}
+	ctx = context.WithValue(ctx, contextlabel.UpstreamAttempt, attempt)
+
+	// RoundTripper must not modify request
+	upstreamReq := req.WithContext(ctx)
+	upstreamURL := *req.URL
+	upstreamURL.Host = u.addr
+	upstreamReq.URL = &upstreamURL
+
+	transport, err := t.getTransport(upstreamReq)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if logAttempt && t.LogAttempts {
+		transport = NewTransportLogger(transport)
+	}
+
+	u.start()
+	resp, err := transport.RoundTrip(upstreamReq)
+	if err != nil {
+		u.finish()
+		cancel()
+		if req.Context().Err() == nil {
+			ejected := u.passiveResult(false, pool.params.MaxFails, pool.params.FailTimeout, pool.params.Clock)
+			zc.L(ctx).Debug("Upstream request failed", zap.String("pool", pool.params.Name),
+				zap.String("upstream", u.addr), zap.Bool("ejected", ejected), zap.Error(err))
+		}
+		return nil, err
+	}
+
+	u.passiveResult(true, pool.params.MaxFails, pool.params.FailTimeout, pool.params.Clock)
+	resp.Body = &upstreamBody{ReadCloser: resp.Body, finish: func() {
+		u.finish()
+		cancel()
+	}}
+	zc.L(ctx).Debug("Upstream selected", zap.String("pool", pool.params.Name), zap.String("upstream", u.addr),
+		zap.Int("attempt", attempt))
+	return resp, nil
+}
+
+// isRetryableRequest return true for requests, which body can be send again: idempotent requests
+// and, if retryReplayableBody, requests with other methods.
+func isRetryableRequest(req *http.Request, retryReplayableBody bool) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		// pass
+	default:
+		if !retryReplayableBody {
+			return false
+		}
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func (t Transport) getTransport(req *http.Request) (http.RoundTripper, error) {
 	logger := zc.L(req.Context())
 
-	if req.URL.Scheme == ProtocolHTTP {
-		logger.Debug("Use default http transport")
-		return defaultHTTPTransport
+	cache := t.Cache
+	if cache == nil {
+		cache = defaultTransportCache
+	}
+
+	proxyProtocol := getProxyProtocol(req.Context())
+	unixSocket, _ := unixSocketPath(req.URL.Host)
+	switch req.URL.Scheme {
+	case ProtocolHTTP:
+		logger.Debug("Use http transport", zap.String("proxy_protocol", proxyProtocol),
+			zap.String("unix_socket", unixSocket))
+		return cache.get(transportKey{scheme: ProtocolHTTP, unixSocket: unixSocket, proxyProtocol: proxyProtocol != ""}), nil
+	case ProtocolH2C:
+		if proxyProtocol != "" {
+			// one connection used for requests of many clients
+			return nil, errors.New("PROXY protocol isn't supported for h2c backends")
+		}
+		logger.Debug("Use h2c transport", zap.String("unix_socket", unixSocket))
+		return cache.get(transportKey{scheme: ProtocolH2C, unixSocket: unixSocket}), nil
 	}
 
 	host := req.Host
@@ -49,33 +246,31 @@ func (t Transport) getTransport(req *http.Request) *http.Transport {
 		host = parts[0]
 	}
 
-	transport := defaultTransport()
-	transport.TLSClientConfig = &tls.Config{ServerName: host}
-	transport.TLSClientConfig.InsecureSkipVerify = t.IgnoreHTTPSCertificate
+	backendTLS := getBackendTLS(req.Context())
+	if backendTLS == nil {
+		// options of upstream from pool
+		backendTLS = t.BackendTLS[req.URL.Host]
+	}
+	if backendTLS != nil && backendTLS.ServerName != "" {
+		host = backendTLS.ServerName
+	}
+	insecureSkipVerify := t.IgnoreHTTPSCertificate && backendTLS == nil
 
 	logger.Debug("Use https transport",
-		zap.Bool("ignore_cert", transport.TLSClientConfig.InsecureSkipVerify),
+		zap.Bool("ignore_cert", insecureSkipVerify),
+		zap.Bool("backend_tls", backendTLS != nil),
 		zap.String("tls_server_name", host),
 		zap.String("header_host", req.Header.Get("HOST")),
+		zap.String("proxy_protocol", proxyProtocol),
+		zap.String("unix_socket", unixSocket),
 	)
 
-	return transport
-}
-
-func defaultTransport() *http.Transport {
-	// copy from go 1.10, need for compile with go 1.10 compiler
-	// https://github.com/golang/go/blob/b0cb374daf646454998bac7b393f3236a2ab6aca/src/net/http/transport.go#L40
-	//noinspection GoDeprecation
-	return &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
+	return cache.get(transportKey{
+		scheme:             ProtocolHTTPS,
+		unixSocket:         unixSocket,
+		serverName:         host,
+		insecureSkipVerify: insecureSkipVerify,
+		backendTLS:         backendTLS,
+		proxyProtocol:      proxyProtocol != "",
+	}), nil
 }
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultTransportCacheSize    = 1000
+	defaultMaxIdleConns          = 100
+	defaultMaxIdleConnsPerHost   = 16
+	defaultIdleConnTimeout       = 90 * time.Second
+	defaultDialTimeout           = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultTCPKeepAlive          = 30 * time.Second
+	defaultExpectContinueTimeout = time.Second
+)
+
+// defaultTransportCache used by Transport without own cache.
+var defaultTransportCache = NewTransportCache(TransportParams{})
+
+// TransportParams - settings of connections to backends. Zero values replaced by defaults.
+type TransportParams struct {
+	// CacheSize - max count of cached transports, every transport has own idle connections pool.
+	CacheSize int
+
+	// MaxIdleConns - max idle connections of one transport.
+	MaxIdleConns int
+
+	// MaxIdleConnsPerHost - max idle connections of one transport to one backend.
+	MaxIdleConnsPerHost int
+
+	// IdleConnTimeout - idle connections closed after the timeout.
+	IdleConnTimeout time.Duration
+
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+
+	// ResponseHeaderTimeout - time to wait response headers after send request. 0 - without timeout.
+	ResponseHeaderTimeout time.Duration
+
+	// HTTP2 enable HTTP/2 for https backends, which support it.
+	HTTP2 bool
+}
+
+// transportKey - options of backend connections, requests with same key can reuse connections.
+type transportKey struct {
+	scheme             string
+	unixSocket         string
+	serverName         string
+	insecureSkipVerify bool
+	backendTLS         *BackendTLS
+	proxyProtocol      bool
+}
+
+// TransportCache keep transports by server name and TLS options for reuse connections to backends.
+// Least recently used transport evicted with close its idle connections when cache full.
+type TransportCache struct {
+	params     TransportParams
+	transports *lru.Cache[transportKey, http.RoundTripper]
+}
+
+func NewTransportCache(params TransportParams) *TransportCache {
+	if params.CacheSize <= 0 {
+		params.CacheSize = defaultTransportCacheSize
+	}
+	if params.MaxIdleConns <= 0 {
+		params.MaxIdleConns = defaultMaxIdleConns
+	}
+	if params.MaxIdleConnsPerHost <= 0 {
+		params.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if params.IdleConnTimeout <= 0 {
+		params.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if params.DialTimeout <= 0 {
+		params.DialTimeout = defaultDialTimeout
+	}
+	if params.TLSHandshakeTimeout <= 0 {
+		params.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+
+	// error only for non positive size
+	transports, _ := lru.NewWithEvict[transportKey, http.RoundTripper](params.CacheSize,
+		func(_ transportKey, transport http.RoundTripper) {
+			closeIdleConnections(transport)
+		})
+	return &TransportCache{params: params, transports: transports}
+}
+
+// get return cached transport for key or create new.
+func (c *TransportCache) get(key transportKey) http.RoundTripper {
+	if transport, ok := c.transports.Get(key); ok {
+		return transport
+	}
+
+	transport := c.newTransport(key)
+	if previous, ok, _ := c.transports.PeekOrAdd(key, transport); ok {
+		// created by other goroutine
+		return previous
+	}
+	return transport
+}
+
+func (c *TransportCache) newTransport(key transportKey) http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   c.params.DialTimeout,
+		KeepAlive: defaultTCPKeepAlive,
+	}
+	dial := dialer.DialContext
+	if key.unixSocket != "" {
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", key.unixSocket)
+		}
+	}
+	dial = proxyProtocolDialContext(dial)
+
+	rewrite := rewriteURLRoundTripper{}
+	if key.unixSocket != "" {
+		rewrite.host = unixSocketHost
+	}
+
+	if key.scheme == ProtocolH2C {
+		// h2c transport accept http scheme only
+		rewrite.scheme = ProtocolHTTP
+		rewrite.next = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		}
+		return rewrite
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		MaxIdleConns:          c.params.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.params.MaxIdleConnsPerHost,
+		IdleConnTimeout:       c.params.IdleConnTimeout,
+		TLSHandshakeTimeout:   c.params.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: c.params.ResponseHeaderTimeout,
+		ExpectContinueTimeout: defaultExpectContinueTimeout,
+
+		// connection with PROXY protocol header describe one client and can't be reused for other clients.
+		DisableKeepAlives: key.proxyProtocol,
+	}
+	if key.scheme == ProtocolHTTPS {
+		if key.backendTLS != nil {
+			transport.TLSClientConfig = key.backendTLS.tlsConfig(key.serverName)
+		} else {
+			transport.TLSClientConfig = &tls.Config{
+				ServerName:         key.serverName,
+				InsecureSkipVerify: key.insecureSkipVerify, //nolint:gosec
+			}
+		}
+		transport.ForceAttemptHTTP2 = c.params.HTTP2
+	}
+	if key.unixSocket == "" {
+		return transport
+	}
+
+	transport.Proxy = nil
+	rewrite.next = transport
+	return rewrite
+}
+
+// CloseIdleConnections of all cached transports.
+func (c *TransportCache) CloseIdleConnections() {
+	for _, key := range c.transports.Keys() {
+		if transport, ok := c.transports.Peek(key); ok {
+			closeIdleConnections(transport)
+		}
+	}
+}
+
+// Len return count of cached transports
+func (c *TransportCache) Len() int {
+	return c.transports.Len()
+}
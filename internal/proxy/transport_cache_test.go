@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestNewTransportCache(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	cache := NewTransportCache(TransportParams{})
+	td.Cmp(cache.params, TransportParams{
+		CacheSize:           defaultTransportCacheSize,
+		MaxIdleConns:        defaultMaxIdleConns,
+		MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		IdleConnTimeout:     defaultIdleConnTimeout,
+		DialTimeout:         defaultDialTimeout,
+		TLSHandshakeTimeout: defaultTLSHandshakeTimeout,
+	})
+
+	cache = NewTransportCache(TransportParams{
+		MaxIdleConnsPerHost:   3,
+		ResponseHeaderTimeout: time.Second,
+		HTTP2:                 true,
+	})
+	transport := cache.get(transportKey{scheme: ProtocolHTTPS, serverName: "example.com"}).(*http.Transport)
+	td.Cmp(transport.MaxIdleConnsPerHost, 3)
+	td.Cmp(transport.ResponseHeaderTimeout, time.Second)
+	td.True(transport.ForceAttemptHTTP2)
+	td.Cmp(transport.TLSClientConfig.ServerName, "example.com")
+
+	transport = cache.get(transportKey{scheme: ProtocolHTTP}).(*http.Transport)
+	td.False(transport.ForceAttemptHTTP2, "http/2 for tls backends only")
+	td.Nil(transport.TLSClientConfig)
+}
+
+func TestTransportCache_Evict(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	backend := newHandshakeCountServer()
+	defer backend.Close()
+
+	cache := NewTransportCache(TransportParams{CacheSize: 1})
+	tr := Transport{IgnoreHTTPSCertificate: true, RateLimiter: &RateLimiter{}, Cache: cache}
+	request := func(host string) {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+host+"/", nil)
+		req = req.WithContext(ctx)
+		req.URL.Host = backend.Listener.Addr().String()
+		resp, err := tr.RoundTrip(req)
+		td.CmpNoError(err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	request("first.example.com")
+	request("first.example.com")
+	td.Cmp(atomic.LoadInt64(&backend.connections), int64(1), "reuse connection")
+
+	request("second.example.com")
+	td.Cmp(atomic.LoadInt64(&backend.connections), int64(2), "other server name - other transport")
+	td.Cmp(cache.Len(), 1)
+
+	// first transport evicted, idle connection closed
+	time.Sleep(50 * time.Millisecond)
+	td.Cmp(atomic.LoadInt64(&backend.active), int64(1))
+
+	cache.CloseIdleConnections()
+	time.Sleep(50 * time.Millisecond)
+	td.Cmp(atomic.LoadInt64(&backend.active), int64(0))
+}
+
+// BenchmarkTransport_HTTPSBackend compare count of TLS handshakes with backend for transport per request
+// (as it was before transport cache) and for cached transports.
+func BenchmarkTransport_HTTPSBackend(b *testing.B) {
+	ctx, flush := th.TestContext(b)
+	defer flush()
+
+	backend := newHandshakeCountServer()
+	defer backend.Close()
+
+	bench := func(b *testing.B, getTransport func() Transport) {
+		atomic.StoreInt64(&backend.connections, 0)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			tr := getTransport()
+			req, _ := http.NewRequest(http.MethodGet, "https://"+backend.Listener.Addr().String()+"/", nil)
+			resp, err := tr.RoundTrip(req.WithContext(ctx))
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		b.StopTimer()
+		b.ReportMetric(float64(atomic.LoadInt64(&backend.connections))/float64(b.N), "handshakes/op")
+	}
+
+	b.Run("transport_per_request", func(b *testing.B) {
+		var previous *TransportCache
+		bench(b, func() Transport {
+			if previous != nil {
+				previous.CloseIdleConnections()
+			}
+			previous = NewTransportCache(TransportParams{})
+			return Transport{IgnoreHTTPSCertificate: true, RateLimiter: &RateLimiter{}, Cache: previous}
+		})
+		previous.CloseIdleConnections()
+	})
+
+	b.Run("cached_transport", func(b *testing.B) {
+		cache := NewTransportCache(TransportParams{})
+		tr := Transport{IgnoreHTTPSCertificate: true, RateLimiter: &RateLimiter{}, Cache: cache}
+		bench(b, func() Transport { return tr })
+		cache.CloseIdleConnections()
+	})
+}
+
+// handshakeCountServer - TLS server with counters of accepted and active connections.
+type handshakeCountServer struct {
+	connections int64 // first for 64-bit alignment of atomic operations
+	active      int64
+	*httptest.Server
+}
+
+func newHandshakeCountServer() *handshakeCountServer {
+	res := &handshakeCountServer{}
+	res.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	res.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt64(&res.connections, 1)
+			atomic.AddInt64(&res.active, 1)
+		case http.StateClosed, http.StateHijacked:
+			atomic.AddInt64(&res.active, -1)
+		}
+	}
+	res.StartTLS()
+	return res
+}
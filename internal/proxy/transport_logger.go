@@ -6,6 +6,7 @@ import (
 
 	"go.uber.org/zap"
 
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
 	"github.com/rekby/lets-proxy2/internal/log"
 )
 
@@ -23,7 +24,7 @@ func (t TransportLogger) RoundTrip(request *http.Request) (resp *http.Response,
 			respStatusCode = resp.StatusCode
 			respContentLength = resp.ContentLength
 		}
-		log.InfoErrorCtx(request.Context(), err, "Request",
+		fields := []zap.Field{
 			zap.Duration("duration_without_body", time.Since(start)),
 			zap.String("initiator_addr", request.RemoteAddr),
 			zap.String("metod", request.Method),
@@ -33,7 +34,11 @@ func (t TransportLogger) RoundTrip(request *http.Request) (resp *http.Response,
 			zap.Int("status_code", respStatusCode),
 			zap.Int64("request_content_length", request.ContentLength),
 			zap.Int64("resp_content_length", respContentLength),
-		)
+		}
+		if attempt, ok := request.Context().Value(contextlabel.UpstreamAttempt).(int); ok {
+			fields = append(fields, zap.Int("attempt", attempt), zap.String("upstream", request.URL.Host))
+		}
+		log.InfoErrorCtx(request.Context(), err, "Request", fields...)
 	}()
 
 	return t.Transport.RoundTrip(request)
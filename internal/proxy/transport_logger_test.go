@@ -12,6 +12,8 @@ import (
 
 	zc "github.com/rekby/zapcontext"
 
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+
 	"github.com/gojuno/minimock/v3"
 
 	"github.com/maxatome/go-testdeep"
@@ -73,4 +75,16 @@ func TestTransportLogger(t *testing.T) {
 	if !strings.Contains(res, "status_code") {
 		td.Error(res)
 	}
+	if strings.Contains(res, "attempt") {
+		td.Error(res)
+	}
+
+	buf.Reset()
+	req = &http.Request{URL: &url.URL{Host: "1.2.3.4:80"}}
+	req = req.WithContext(context.WithValue(ctx, contextlabel.UpstreamAttempt, 2))
+	_, _ = tl.RoundTrip(req)
+	res = buf.String()
+	if !strings.Contains(res, `"attempt": 2`) || !strings.Contains(res, `"upstream": "1.2.3.4:80"`) {
+		td.Error(res)
+	}
 }
@@ -16,27 +16,65 @@ func TestTransport_GetTransport(t *testing.T) {
 
 	td := testdeep.NewT(t)
 
-	tr := Transport{}
+	getHTTPTransport := func(tr Transport, r *http.Request) *http.Transport {
+		t.Helper()
+		transport, err := tr.getTransport(r)
+		td.CmpNoError(err)
+		return transport.(*http.Transport)
+	}
+
+	cache := NewTransportCache(TransportParams{})
+	tr := Transport{Cache: cache}
 	r, _ := http.NewRequest(http.MethodGet, "http://www.ru", nil)
 	r = r.WithContext(ctx)
-	httpTransport := tr.getTransport(r)
-	td.True(httpTransport == defaultHTTPTransport) // equal pointers
+	httpTransport := getHTTPTransport(tr, r)
+	td.Nil(httpTransport.TLSClientConfig)
+	td.False(httpTransport.DisableKeepAlives)
+	td.True(httpTransport == getHTTPTransport(tr, r)) // equal pointers
+
+	r = r.WithContext(withProxyProtocol(ctx, "v1"))
+	proxyProtocolTransport := getHTTPTransport(tr, r)
+	td.True(proxyProtocolTransport != httpTransport) // different pointers
+	td.True(proxyProtocolTransport.DisableKeepAlives)
 
-	tr = Transport{IgnoreHTTPSCertificate: false}
+	tr = Transport{IgnoreHTTPSCertificate: false, Cache: cache}
 	r, _ = http.NewRequest(http.MethodGet, "https://www.ru", nil)
 	r = r.WithContext(ctx)
-	httpTransport = tr.getTransport(r)
-	td.True(httpTransport != defaultTransport()) // different pointers
-	td.Cmp(httpTransport.TLSClientConfig.ServerName, "www.ru")
-	td.Cmp(httpTransport.TLSClientConfig.InsecureSkipVerify, false)
+	httpsTransport := getHTTPTransport(tr, r)
+	td.True(httpsTransport != httpTransport) // different pointers
+	td.True(httpsTransport == getHTTPTransport(tr, r))
+	td.Cmp(httpsTransport.TLSClientConfig.ServerName, "www.ru")
+	td.Cmp(httpsTransport.TLSClientConfig.InsecureSkipVerify, false)
 
-	tr = Transport{IgnoreHTTPSCertificate: true}
+	tr = Transport{IgnoreHTTPSCertificate: true, Cache: cache}
 	r, _ = http.NewRequest(http.MethodGet, "https://www.ru", nil)
 	r = r.WithContext(ctx)
-	httpTransport = tr.getTransport(r)
-	td.True(httpTransport != defaultTransport()) // different pointers
+	httpTransport = getHTTPTransport(tr, r)
+	td.True(httpTransport != httpsTransport) // different pointers
 	td.Cmp(httpTransport.TLSClientConfig.ServerName, "www.ru")
 	td.Cmp(httpTransport.TLSClientConfig.InsecureSkipVerify, true)
+
+	r, _ = http.NewRequest(http.MethodGet, "https://www.ru:8443", nil)
+	r = r.WithContext(ctx)
+	td.True(httpTransport == getHTTPTransport(tr, r), "same transport for other port")
+	td.Cmp(cache.Len(), 4)
+
+	r, _ = http.NewRequest(http.MethodGet, "http://localhost/", nil)
+	r.URL.Host = "unix:/run/app.sock"
+	r = r.WithContext(ctx)
+	unixTransport, err := tr.getTransport(r)
+	td.CmpNoError(err)
+	td.Cmp(unixTransport, testdeep.Isa(rewriteURLRoundTripper{}))
+	td.Cmp(unixTransport.(rewriteURLRoundTripper).host, unixSocketHost)
+
+	r.URL.Scheme = ProtocolH2C
+	h2cTransport, err := tr.getTransport(r)
+	td.CmpNoError(err)
+	td.Cmp(h2cTransport.(rewriteURLRoundTripper).scheme, ProtocolHTTP)
+
+	r = r.WithContext(withProxyProtocol(ctx, "v1"))
+	_, err = tr.getTransport(r)
+	td.CmpError(err, "PROXY protocol for h2c")
 }
 
 func TestTransport_RoundTrip(t *testing.T) {
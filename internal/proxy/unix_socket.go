@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// UnixTargetPrefix - prefix of target for send requests to unix socket, for example "unix:/run/app.sock".
+const UnixTargetPrefix = "unix:"
+
+// unixSocketHost used instead of socket path in request URL, because socket path isn't valid host.
+const unixSocketHost = "localhost"
+
+// parseUnixTarget check socket path of target and return normalized target.
+func parseUnixTarget(s string) (string, error) {
+	path := strings.TrimPrefix(strings.TrimSpace(s), UnixTargetPrefix)
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("unix socket path must be absolute: %q", s)
+	}
+	return UnixTargetPrefix + filepath.Clean(path), nil
+}
+
+// unixSocketPath return socket path if host is unix target
+func unixSocketPath(host string) (string, bool) {
+	if !strings.HasPrefix(host, UnixTargetPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(host, UnixTargetPrefix), true
+}
+
+// rewriteURLRoundTripper replace scheme and host of request URL before send it by next round tripper, if they
+// aren't empty. Host header, which point to unix socket, replaced by unixSocketHost.
+type rewriteURLRoundTripper struct {
+	next   http.RoundTripper
+	scheme string
+	host   string
+}
+
+func (t rewriteURLRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTripper must not modify request
+	newReq := req.WithContext(req.Context())
+	newURL := *req.URL
+	if t.scheme != "" {
+		newURL.Scheme = t.scheme
+	}
+	if t.host != "" {
+		newURL.Host = t.host
+	}
+	newReq.URL = &newURL
+	if _, ok := unixSocketPath(newReq.Host); ok {
+		newReq.Host = unixSocketHost
+	}
+	return t.next.RoundTrip(newReq)
+}
+
+func (t rewriteURLRoundTripper) CloseIdleConnections() {
+	closeIdleConnections(t.next)
+}
+
+func closeIdleConnections(rt http.RoundTripper) {
+	if closer, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
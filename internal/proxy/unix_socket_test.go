@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestParseUnixTarget(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	res, err := parseUnixTarget(" unix:/run/../run/app.sock ")
+	td.CmpNoError(err)
+	td.Cmp(res, "unix:/run/app.sock")
+
+	_, err = parseUnixTarget("unix:app.sock")
+	td.CmpError(err)
+
+	path, ok := unixSocketPath("unix:/run/app.sock")
+	td.True(ok)
+	td.Cmp(path, "/run/app.sock")
+
+	_, ok = unixSocketPath("127.0.0.1:80")
+	td.False(ok)
+}
+
+func TestTransport_UnixSocket(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", socket)
+	td.CmpNoError(err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host + r.URL.Path))
+	})}
+	go func() { _ = server.Serve(listener) }()
+	defer th.Close(server)
+
+	tr := Transport{RateLimiter: &RateLimiter{}, Cache: NewTransportCache(TransportParams{})}
+	defer tr.Cache.CloseIdleConnections()
+
+	request := func(host string) string {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost/path", nil)
+		req.URL.Host = UnixTargetPrefix + socket
+		req.Host = host
+		resp, err := tr.RoundTrip(req.WithContext(ctx))
+		td.CmpNoError(err)
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return string(body)
+	}
+	td.Cmp(request("example.com"), "example.com/path")
+	td.Cmp(request(""), unixSocketHost+"/path")
+}
+
+// TestHTTPProxy_GRPCStream check bidirectional streaming with trailers, as gRPC use it, from HTTP/2 client
+// through proxy to h2c backend on unix socket.
+func TestHTTPProxy_GRPCStream(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "grpc.sock")
+	backendListener, err := net.Listen("unix", socket)
+	td.CmpNoError(err)
+	backend := &http.Server{Handler: h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		// echo every line until client close request
+		count := 0
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			count++
+			_, _ = w.Write([]byte("echo " + scanner.Text() + "\n"))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "messages "+strconv.Itoa(count))
+	}), &http2.Server{})}
+	go func() { _ = backend.Serve(backendListener) }()
+	defer th.Close(backend)
+
+	certFile, keyFile := writeTestCert(t, dir)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	td.CmpNoError(err)
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	listener := tls.NewListener(tcpListener, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2"}})
+
+	proxy := NewHTTPProxy(ctx, listener)
+	defer th.Close(proxy)
+	proxy.Director = NewDirectorChain(NewDirectorHost(UnixTargetPrefix+socket), NewSetSchemeDirector(ProtocolH2C))
+	proxy.HTTPTransport = Transport{RateLimiter: &RateLimiter{}, Cache: NewTransportCache(TransportParams{})}
+	go func() { _ = proxy.Start() }()
+
+	client := &http.Client{Transport: &http2.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+	}}
+	requestBody, requestWriter := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+tcpListener.Addr().String()+"/echo.Echo/Stream", requestBody)
+	td.CmpNoError(err)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	resp, err := client.Do(req)
+	td.CmpNoError(err)
+	defer resp.Body.Close()
+	td.Cmp(resp.StatusCode, http.StatusOK)
+	td.Cmp(resp.Header.Get("Content-Type"), "application/grpc")
+
+	// every answer must come before next message send
+	reader := bufio.NewReader(resp.Body)
+	for _, message := range []string{"first", "second", "third"} {
+		_, err = requestWriter.Write([]byte(message + "\n"))
+		td.CmpNoError(err)
+
+		lineCh := make(chan string, 1)
+		go func() {
+			line, _ := reader.ReadString('\n')
+			lineCh <- line
+		}()
+		select {
+		case line := <-lineCh:
+			td.Cmp(line, "echo "+message+"\n")
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream answer timeout")
+		}
+	}
+	td.CmpNoError(requestWriter.Close())
+
+	rest, err := io.ReadAll(reader)
+	td.CmpNoError(err)
+	td.Cmp(string(rest), "")
+	td.Cmp(resp.Trailer.Get("Grpc-Status"), "0")
+	td.Cmp(resp.Trailer.Get("Grpc-Message"), "messages 3")
+}
@@ -0,0 +1,545 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/metrics"
+)
+
+// UpstreamTargetPrefix mark target as reference to upstream pool: "upstream:<name>".
+// Directors set the reference as request host, transport select real upstream address from the pool.
+const UpstreamTargetPrefix = "upstream:"
+
+const (
+	StrategyRoundRobin = "round-robin"
+	StrategyLeastConn  = "least-conn"
+	StrategyIPHash     = "ip-hash"
+)
+
+const (
+	defaultHealthCheckInterval    = 10 * time.Second
+	defaultHealthCheckTimeout     = 5 * time.Second
+	defaultHealthyThreshold       = 2
+	defaultUnhealthyThreshold     = 3
+	defaultPassiveFailTimeout     = 30 * time.Second
+	upstreamHashVirtualNodesCount = 100
+)
+
+var errNoAvailableUpstreams = errors.New("no available upstreams")
+
+//nolint:maligned
+type UpstreamConfig struct {
+	// Strategy of select upstream: round-robin (default), least-conn, ip-hash
+	Strategy string
+
+	// Targets - IP or IP:Port (default port 80) of upstreams
+	Targets []string
+
+	// HealthCheckPath enable active health checks if not empty.
+	HealthCheckPath            string
+	HealthCheckScheme          string
+	HealthCheckIntervalSeconds int
+	HealthCheckTimeoutSeconds  int
+	HealthyThreshold           int
+	UnhealthyThreshold         int
+
+	// MaxFails - count of consecutive transport errors before eject upstream for FailTimeoutSeconds.
+	// 0 disable passive ejection.
+	MaxFails           int
+	FailTimeoutSeconds int
+
+	// Retries - count of additional attempts on other upstreams for GET, HEAD and OPTIONS requests
+	// (other methods see in RetryReplayableBody) after connection errors or RetryStatusCodes. 0 disable retries.
+	Retries int
+
+	// RetryReplayableBody - retry requests with other methods (POST, PUT, ...) too, if body can be send again:
+	// request without body or with GetBody. Backends must tolerate repeat of such requests.
+	RetryReplayableBody bool
+
+	// TryTimeoutMs - timeout of one attempt, include read response body. 0 mean no timeout.
+	TryTimeoutMs     int
+	RetryStatusCodes []int
+}
+
+// UpstreamPoolParams is parsed and validated UpstreamConfig
+type UpstreamPoolParams struct {
+	Name     string
+	Strategy string
+	Targets  []string
+
+	HealthCheckPath     string
+	HealthCheckScheme   string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	HealthyThreshold    int
+	UnhealthyThreshold  int
+
+	MaxFails    int
+	FailTimeout time.Duration
+
+	Retries             int
+	RetryReplayableBody bool
+	TryTimeout          time.Duration
+	RetryStatusCodes    []int
+
+	// ProxyProtocol is version of PROXY protocol header for health checks, empty for disable.
+	ProxyProtocol string
+
+	// BackendTLS - TLS options for https health checks, nil for default.
+	BackendTLS *BackendTLS
+
+	Clock      clockwork.Clock
+	Registerer prometheus.Registerer
+
+	// Previous - pool with same name from previous config, can be nil.
+	// Upstreams with same address keep health and eject state from it.
+	Previous *UpstreamPool
+}
+
+type upstream struct {
+	addr string
+
+	activeRequests int64
+
+	mu               sync.Mutex
+	healthy          bool
+	checkSuccesses   int
+	checkFails       int
+	passiveFails     int
+	ejectedUntil     time.Time
+	healthGauge      prometheus.Gauge
+	ejectGaugeUpdate clockwork.Timer
+}
+
+type upstreamHashNode struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// UpstreamPool select upstream for request and track upstreams health
+type UpstreamPool struct {
+	params    UpstreamPoolParams
+	upstreams []*upstream
+	hashRing  []upstreamHashNode
+	counter   uint64
+	healthVec *prometheus.GaugeVec // can be nil
+}
+
+func NewUpstreamPool(params UpstreamPoolParams) (*UpstreamPool, error) {
+	switch params.Strategy {
+	case "":
+		params.Strategy = StrategyRoundRobin
+	case StrategyRoundRobin, StrategyLeastConn, StrategyIPHash:
+		// pass
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy %q for pool %q", params.Strategy, params.Name)
+	}
+	if len(params.Targets) == 0 {
+		return nil, fmt.Errorf("empty targets for upstream pool %q", params.Name)
+	}
+	if params.HealthCheckPath != "" && !strings.HasPrefix(params.HealthCheckPath, "/") {
+		return nil, fmt.Errorf("health check path must start with '/': %q", params.HealthCheckPath)
+	}
+	switch params.HealthCheckScheme {
+	case "":
+		params.HealthCheckScheme = ProtocolHTTP
+	case ProtocolHTTP, ProtocolHTTPS, ProtocolH2C:
+		// pass
+	default:
+		return nil, fmt.Errorf("unknown health check scheme %q for pool %q", params.HealthCheckScheme, params.Name)
+	}
+	if params.HealthCheckInterval <= 0 {
+		params.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if params.HealthCheckTimeout <= 0 {
+		params.HealthCheckTimeout = defaultHealthCheckTimeout
+	}
+	if params.HealthyThreshold <= 0 {
+		params.HealthyThreshold = defaultHealthyThreshold
+	}
+	if params.UnhealthyThreshold <= 0 {
+		params.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if params.FailTimeout <= 0 {
+		params.FailTimeout = defaultPassiveFailTimeout
+	}
+	if params.Retries < 0 {
+		return nil, fmt.Errorf("negative retries count for pool %q", params.Name)
+	}
+	for _, code := range params.RetryStatusCodes {
+		if code < 100 || code > 599 {
+			return nil, fmt.Errorf("bad retry status code %v for pool %q", code, params.Name)
+		}
+	}
+	if params.Clock == nil {
+		params.Clock = clockwork.NewRealClock()
+	}
+
+	healthVec := upstreamHealthGaugeVec(params.Registerer)
+
+	pool := &UpstreamPool{params: params, healthVec: healthVec}
+	for _, target := range params.Targets {
+		u := &upstream{addr: target, healthy: true}
+		if params.Previous != nil {
+			if previous := params.Previous.upstream(target); previous != nil {
+				u.inheritState(previous)
+			}
+		}
+		if healthVec != nil {
+			now := params.Clock.Now()
+			u.healthGauge = healthVec.WithLabelValues(params.Name, target)
+			u.updateGaugeLocked(now)
+			if now.Before(u.ejectedUntil) {
+				u.scheduleGaugeUpdateLocked(u.ejectedUntil.Sub(now), params.Clock)
+			}
+		}
+		pool.upstreams = append(pool.upstreams, u)
+
+		for i := 0; i < upstreamHashVirtualNodesCount; i++ {
+			pool.hashRing = append(pool.hashRing, upstreamHashNode{
+				hash:     crc32.ChecksumIEEE([]byte(target + "#" + strconv.Itoa(i))),
+				upstream: u,
+			})
+		}
+	}
+	sort.Slice(pool.hashRing, func(i, j int) bool {
+		return pool.hashRing[i].hash < pool.hashRing[j].hash
+	})
+	return pool, nil
+}
+
+// upstreamHealthGaugeVec register gauge vector or return registered early (for example by previous config).
+// can return nil
+func upstreamHealthGaugeVec(r prometheus.Registerer) *prometheus.GaugeVec {
+	if r == nil || reflect.ValueOf(r).IsNil() {
+		return nil
+	}
+
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "upstream_healthy",
+		Help: "Upstream available for requests: 1 - healthy, 0 - failed health check or ejected",
+	}, []string{"pool", "upstream"})
+	vec, ok := metrics.RegisterOrExisting(r, vec)
+	if !ok {
+		return nil
+	}
+	return vec
+}
+
+// Select return upstream for request from client ip.
+// Upstreams from exclude skipped, it need for retry request on other upstream.
+func (p *UpstreamPool) Select(clientIP string, exclude map[string]bool) (*upstream, error) {
+	now := p.params.Clock.Now()
+
+	isAvailable := func(u *upstream) bool {
+		return !exclude[u.addr] && u.available(now)
+	}
+
+	switch p.params.Strategy {
+	case StrategyIPHash:
+		if len(p.hashRing) == 0 {
+			return nil, errNoAvailableUpstreams
+		}
+		hash := crc32.ChecksumIEEE([]byte(clientIP))
+		start := sort.Search(len(p.hashRing), func(i int) bool {
+			return p.hashRing[i].hash >= hash
+		})
+		for i := 0; i < len(p.hashRing); i++ {
+			node := p.hashRing[(start+i)%len(p.hashRing)]
+			if isAvailable(node.upstream) {
+				return node.upstream, nil
+			}
+		}
+	case StrategyLeastConn:
+		start := int(atomic.AddUint64(&p.counter, 1) % uint64(len(p.upstreams)))
+		var best *upstream
+		var bestActive int64
+		for i := 0; i < len(p.upstreams); i++ {
+			u := p.upstreams[(start+i)%len(p.upstreams)]
+			if !isAvailable(u) {
+				continue
+			}
+			active := atomic.LoadInt64(&u.activeRequests)
+			if best == nil || active < bestActive {
+				best = u
+				bestActive = active
+			}
+		}
+		if best != nil {
+			return best, nil
+		}
+	default:
+		start := int(atomic.AddUint64(&p.counter, 1) % uint64(len(p.upstreams)))
+		for i := 0; i < len(p.upstreams); i++ {
+			u := p.upstreams[(start+i)%len(p.upstreams)]
+			if isAvailable(u) {
+				return u, nil
+			}
+		}
+	}
+	return nil, errNoAvailableUpstreams
+}
+
+func (p *UpstreamPool) isRetryableStatus(code int) bool {
+	for _, retryable := range p.params.RetryStatusCodes {
+		if code == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+// StartHealthCheck start background active health checks until ctx cancelled.
+// Do nothing if health check path is empty.
+func (p *UpstreamPool) StartHealthCheck(ctx context.Context, transport http.RoundTripper) {
+	if p.params.HealthCheckPath == "" {
+		return
+	}
+
+	logger := zc.L(ctx).With(zap.String("upstream_pool", p.params.Name))
+	ctx = zc.WithLogger(ctx, logger)
+	for _, u := range p.upstreams {
+		go func(u *upstream) {
+			defer log.HandlePanic(logger)
+
+			ticker := p.params.Clock.NewTicker(p.params.HealthCheckInterval)
+			defer ticker.Stop()
+
+			for {
+				p.checkUpstream(ctx, transport, u)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.Chan():
+				}
+			}
+		}(u)
+	}
+}
+
+func (p *UpstreamPool) checkUpstream(ctx context.Context, transport http.RoundTripper, u *upstream) {
+	ctx, cancel := context.WithTimeout(ctx, p.params.HealthCheckTimeout)
+	defer cancel()
+
+	if p.params.ProxyProtocol != "" {
+		ctx = withProxyProtocol(ctx, p.params.ProxyProtocol)
+	}
+	if p.params.BackendTLS != nil {
+		ctx = withBackendTLS(ctx, p.params.BackendTLS)
+	}
+
+	// upstream address can be unix socket, which can't be parsed as URL host
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.params.HealthCheckPath, nil)
+	if err == nil {
+		req.URL.Scheme = p.params.HealthCheckScheme
+		req.URL.Host = u.addr
+		var resp *http.Response
+		resp, err = transport.RoundTrip(req)
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+				err = fmt.Errorf("bad health check status code: %v", resp.StatusCode)
+			}
+		}
+	}
+	if ctx.Err() != nil && errors.Is(err, context.Canceled) {
+		return
+	}
+
+	changed, healthy := u.healthCheckResult(err == nil, p.params.HealthyThreshold, p.params.UnhealthyThreshold,
+		p.params.Clock.Now())
+	log.DebugInfoCtx(ctx, err, "Upstream health check", zap.String("upstream", u.addr),
+		zap.Bool("healthy", healthy), zap.Bool("changed", changed))
+}
+
+// Upstreams is map from name to upstream pool
+type Upstreams map[string]*UpstreamPool
+
+// pool return pool for target reference or nil if target is not reference to upstream pool
+func (u Upstreams) pool(target string) *UpstreamPool {
+	if !strings.HasPrefix(target, UpstreamTargetPrefix) {
+		return nil
+	}
+	return u[strings.TrimPrefix(target, UpstreamTargetPrefix)]
+}
+
+// StartHealthCheck start active health checks for all pools until ctx cancelled.
+func (u Upstreams) StartHealthCheck(ctx context.Context, transport http.RoundTripper) {
+	for _, pool := range u {
+		pool.StartHealthCheck(ctx, transport)
+	}
+}
+
+// deleteRemovedMetrics delete health metrics of pools and upstreams, which absent in newUpstreams,
+// else removed by config reload upstreams exported forever with last state.
+// Metrics of kept upstreams shared with new pools and must not be deleted.
+func (u Upstreams) deleteRemovedMetrics(newUpstreams Upstreams) {
+	for name, pool := range u {
+		if pool.healthVec == nil {
+			continue
+		}
+		newPool := newUpstreams[name]
+		for _, upstream := range pool.upstreams {
+			if newPool == nil || newPool.upstream(upstream.addr) == nil {
+				pool.healthVec.DeleteLabelValues(pool.params.Name, upstream.addr)
+			}
+		}
+	}
+}
+
+// upstream return upstream with the address or nil.
+func (p *UpstreamPool) upstream(addr string) *upstream {
+	for _, u := range p.upstreams {
+		if u.addr == addr {
+			return u
+		}
+	}
+	return nil
+}
+
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.healthy && !now.Before(u.ejectedUntil)
+}
+
+func (u *upstream) start() {
+	atomic.AddInt64(&u.activeRequests, 1)
+}
+
+func (u *upstream) finish() {
+	atomic.AddInt64(&u.activeRequests, -1)
+}
+
+// healthCheckResult apply result of active health check, return true if health state changed.
+func (u *upstream) healthCheckResult(ok bool, healthyThreshold, unhealthyThreshold int, now time.Time) (changed, healthy bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if ok {
+		u.checkFails = 0
+		u.checkSuccesses++
+		if !u.healthy && u.checkSuccesses >= healthyThreshold {
+			u.healthy = true
+			changed = true
+		}
+	} else {
+		u.checkSuccesses = 0
+		u.checkFails++
+		if u.healthy && u.checkFails >= unhealthyThreshold {
+			u.healthy = false
+			changed = true
+		}
+	}
+	u.updateGaugeLocked(now)
+	return changed, u.healthy
+}
+
+// passiveResult count consecutive transport errors and eject upstream after maxFails errors.
+// return true if upstream ejected by the call.
+func (u *upstream) passiveResult(ok bool, maxFails int, failTimeout time.Duration, clock clockwork.Clock) bool {
+	if maxFails <= 0 {
+		return false
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if ok {
+		u.passiveFails = 0
+		return false
+	}
+
+	u.passiveFails++
+	if u.passiveFails < maxFails {
+		return false
+	}
+
+	u.passiveFails = 0
+	now := clock.Now()
+	u.ejectedUntil = now.Add(failTimeout)
+	u.updateGaugeLocked(now)
+	u.scheduleGaugeUpdateLocked(failTimeout, clock)
+	return true
+}
+
+// scheduleGaugeUpdateLocked update gauge after eject timeout.
+func (u *upstream) scheduleGaugeUpdateLocked(timeout time.Duration, clock clockwork.Clock) {
+	if u.healthGauge == nil {
+		return
+	}
+	if u.ejectGaugeUpdate != nil {
+		u.ejectGaugeUpdate.Stop()
+	}
+	u.ejectGaugeUpdate = clock.AfterFunc(timeout, func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.updateGaugeLocked(clock.Now())
+	})
+}
+
+// inheritState copy health and eject state from upstream with same address from previous config,
+// else reload return failed upstreams to balancing.
+func (u *upstream) inheritState(previous *upstream) {
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+
+	u.healthy = previous.healthy
+	u.checkSuccesses = previous.checkSuccesses
+	u.checkFails = previous.checkFails
+	u.passiveFails = previous.passiveFails
+	u.ejectedUntil = previous.ejectedUntil
+}
+
+func (u *upstream) updateGaugeLocked(now time.Time) {
+	if u.healthGauge == nil {
+		return
+	}
+	if u.healthy && !now.Before(u.ejectedUntil) {
+		u.healthGauge.Set(1)
+	} else {
+		u.healthGauge.Set(0)
+	}
+}
+
+// upstreamBody finish upstream request when body closed, need for count active requests.
+type upstreamBody struct {
+	io.ReadCloser
+	once   sync.Once
+	finish func()
+}
+
+func (b *upstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.finish)
+	return err
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
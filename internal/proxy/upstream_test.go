@@ -0,0 +1,601 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/maxatome/go-testdeep"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestNewUpstreamPool(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	_, err := NewUpstreamPool(UpstreamPoolParams{Name: "test"})
+	td.CmpError(err)
+
+	_, err = NewUpstreamPool(UpstreamPoolParams{Name: "test", Targets: []string{"1.2.3.4:80"}, Strategy: "asd"})
+	td.CmpError(err)
+
+	_, err = NewUpstreamPool(UpstreamPoolParams{Name: "test", Targets: []string{"1.2.3.4:80"}, HealthCheckPath: "health"})
+	td.CmpError(err)
+
+	_, err = NewUpstreamPool(UpstreamPoolParams{Name: "test", Targets: []string{"1.2.3.4:80"}, HealthCheckScheme: "ftp"})
+	td.CmpError(err)
+
+	pool, err := NewUpstreamPool(UpstreamPoolParams{Name: "test", Targets: []string{"1.2.3.4:80", "1.2.3.5:80"}})
+	td.CmpNoError(err)
+	td.Cmp(pool.params.Strategy, StrategyRoundRobin)
+	td.Cmp(pool.params.HealthCheckScheme, ProtocolHTTP)
+	td.Cmp(pool.params.HealthyThreshold, defaultHealthyThreshold)
+	td.Cmp(pool.params.UnhealthyThreshold, defaultUnhealthyThreshold)
+	td.Len(pool.upstreams, 2)
+	td.Len(pool.hashRing, 2*upstreamHashVirtualNodesCount)
+}
+
+func TestUpstreamPool_Select(t *testing.T) {
+	targets := []string{"1.2.3.1:80", "1.2.3.2:80", "1.2.3.3:80"}
+
+	t.Run("RoundRobin", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		pool, err := NewUpstreamPool(UpstreamPoolParams{Name: "test", Targets: targets})
+		td.CmpNoError(err)
+
+		counts := map[string]int{}
+		for i := 0; i < 30; i++ {
+			u, err := pool.Select("1.1.1.1", nil)
+			td.CmpNoError(err)
+			counts[u.addr]++
+		}
+		td.Cmp(counts, map[string]int{"1.2.3.1:80": 10, "1.2.3.2:80": 10, "1.2.3.3:80": 10})
+
+		u, err := pool.Select("1.1.1.1", map[string]bool{"1.2.3.1:80": true, "1.2.3.2:80": true})
+		td.CmpNoError(err)
+		td.Cmp(u.addr, "1.2.3.3:80")
+
+		_, err = pool.Select("1.1.1.1", map[string]bool{"1.2.3.1:80": true, "1.2.3.2:80": true, "1.2.3.3:80": true})
+		td.CmpError(err)
+	})
+
+	t.Run("LeastConn", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		pool, err := NewUpstreamPool(UpstreamPoolParams{Name: "test", Targets: targets, Strategy: StrategyLeastConn})
+		td.CmpNoError(err)
+
+		pool.upstreams[0].start()
+		pool.upstreams[0].start()
+		pool.upstreams[2].start()
+
+		for i := 0; i < 5; i++ {
+			u, err := pool.Select("1.1.1.1", nil)
+			td.CmpNoError(err)
+			td.Cmp(u.addr, "1.2.3.2:80")
+		}
+
+		pool.upstreams[1].start()
+		pool.upstreams[1].start()
+		u, err := pool.Select("1.1.1.1", nil)
+		td.CmpNoError(err)
+		td.Cmp(u.addr, "1.2.3.3:80")
+	})
+
+	t.Run("IPHash", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		pool, err := NewUpstreamPool(UpstreamPoolParams{Name: "test", Targets: targets, Strategy: StrategyIPHash})
+		td.CmpNoError(err)
+
+		selected := map[string]string{}
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+			u, err := pool.Select(ip, nil)
+			td.CmpNoError(err)
+			selected[ip] = u.addr
+			for i := 0; i < 5; i++ {
+				u, err = pool.Select(ip, nil)
+				td.CmpNoError(err)
+				td.Cmp(u.addr, selected[ip], ip)
+			}
+		}
+
+		// clients of other upstreams keep own upstream while one upstream excluded
+		excluded := selected["10.0.0.1"]
+		for ip, addr := range selected {
+			u, err := pool.Select(ip, map[string]bool{excluded: true})
+			td.CmpNoError(err)
+			if addr == excluded {
+				td.Not(u.addr, excluded)
+			} else {
+				td.Cmp(u.addr, addr)
+			}
+		}
+	})
+}
+
+func TestUpstream_PassiveEjection(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	clock := clockwork.NewFakeClock()
+	registry := prometheus.NewRegistry()
+	pool, err := NewUpstreamPool(UpstreamPoolParams{
+		Name:        "test",
+		Targets:     []string{"1.2.3.1:80", "1.2.3.2:80"},
+		MaxFails:    2,
+		FailTimeout: time.Minute,
+		Clock:       clock,
+		Registerer:  registry,
+	})
+	td.CmpNoError(err)
+
+	u := pool.upstreams[0]
+	td.False(u.passiveResult(false, 2, time.Minute, clock))
+	td.False(u.passiveResult(true, 2, time.Minute, clock))
+	td.False(u.passiveResult(false, 2, time.Minute, clock))
+	td.True(u.passiveResult(false, 2, time.Minute, clock))
+	td.False(u.available(clock.Now()))
+	td.Cmp(upstreamHealthGauge(t, registry, "1.2.3.1:80"), 0.0)
+
+	for i := 0; i < 4; i++ {
+		selected, err := pool.Select("", nil)
+		td.CmpNoError(err)
+		td.Cmp(selected.addr, "1.2.3.2:80")
+	}
+
+	clock.Advance(time.Minute)
+	td.True(u.available(clock.Now()))
+	// gauge updated by timer of the clock in background
+	for i := 0; i < 100 && upstreamHealthGauge(t, registry, "1.2.3.1:80") != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	td.Cmp(upstreamHealthGauge(t, registry, "1.2.3.1:80"), 1.0)
+
+	td.False(u.passiveResult(false, 0, time.Minute, clock), "disabled")
+}
+
+func TestNewUpstreamPool_Previous(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	clock := clockwork.NewFakeClock()
+	registry := prometheus.NewRegistry()
+	params := UpstreamPoolParams{
+		Name:               "test",
+		Targets:            []string{"1.2.3.1:80", "1.2.3.2:80", "1.2.3.3:80"},
+		UnhealthyThreshold: 1,
+		Clock:              clock,
+		Registerer:         registry,
+	}
+	previous, err := NewUpstreamPool(params)
+	td.CmpNoError(err)
+	previous.upstreams[0].healthCheckResult(false, 1, 1, clock.Now())
+	previous.upstreams[1].passiveResult(false, 1, time.Minute, clock)
+
+	params.Targets = []string{"1.2.3.1:80", "1.2.3.2:80", "1.2.3.4:80"}
+	params.Previous = previous
+	pool, err := NewUpstreamPool(params)
+	td.CmpNoError(err)
+
+	td.False(pool.upstreams[0].available(clock.Now()), "unhealthy")
+	td.Cmp(upstreamHealthGauge(t, registry, "1.2.3.1:80"), 0.0)
+	td.False(pool.upstreams[1].available(clock.Now()), "ejected")
+	td.Cmp(upstreamHealthGauge(t, registry, "1.2.3.2:80"), 0.0)
+	td.True(pool.upstreams[2].available(clock.Now()), "new")
+	td.Cmp(upstreamHealthGauge(t, registry, "1.2.3.4:80"), 1.0)
+
+	clock.Advance(time.Minute)
+	td.True(pool.upstreams[1].available(clock.Now()))
+	for i := 0; i < 100 && upstreamHealthGauge(t, registry, "1.2.3.2:80") != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	td.Cmp(upstreamHealthGauge(t, registry, "1.2.3.2:80"), 1.0)
+}
+
+func TestUpstreamPool_HealthCheck(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	var healthy int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		td.Cmp(r.URL.Path, "/health")
+		if atomic.LoadInt32(&healthy) == 1 {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	registry := prometheus.NewRegistry()
+	serverAddr := strings.TrimPrefix(server.URL, "http://")
+	pool, err := NewUpstreamPool(UpstreamPoolParams{
+		Name:               "test",
+		Targets:            []string{serverAddr},
+		HealthCheckPath:    "/health",
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+		Registerer:         registry,
+	})
+	td.CmpNoError(err)
+
+	// register same metric for second pool, for example after config reload
+	_, err = NewUpstreamPool(UpstreamPoolParams{Name: "test2", Targets: []string{"1.2.3.4:80"}, Registerer: registry})
+	td.CmpNoError(err)
+
+	transport := Transport{RateLimiter: &RateLimiter{}}
+	u := pool.upstreams[0]
+	now := time.Now()
+
+	gauge := func() float64 {
+		return upstreamHealthGauge(t, registry, serverAddr)
+	}
+
+	pool.checkUpstream(ctx, transport, u)
+	td.True(u.available(now))
+	td.Cmp(gauge(), 1.0)
+
+	atomic.StoreInt32(&healthy, 0)
+	pool.checkUpstream(ctx, transport, u)
+	td.True(u.available(now))
+	pool.checkUpstream(ctx, transport, u)
+	td.False(u.available(now))
+	td.Cmp(gauge(), 0.0)
+
+	_, err = pool.Select("", nil)
+	td.CmpError(err)
+
+	atomic.StoreInt32(&healthy, 1)
+	pool.checkUpstream(ctx, transport, u)
+	td.False(u.available(now))
+	pool.checkUpstream(ctx, transport, u)
+	td.True(u.available(now))
+	td.Cmp(gauge(), 1.0)
+
+	server.Close()
+	pool.checkUpstream(ctx, transport, u)
+	pool.checkUpstream(ctx, transport, u)
+	td.False(u.available(now))
+}
+
+func TestHTTPProxy_UpdateDeleteRemovedUpstreamMetrics(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	td.FailureIsFatal()
+
+	registry := prometheus.NewRegistry()
+	upstreams := func(pools map[string][]string) Upstreams {
+		res := make(Upstreams, len(pools))
+		for name, targets := range pools {
+			pool, err := NewUpstreamPool(UpstreamPoolParams{Name: name, Targets: targets, Registerer: registry})
+			td.CmpNoError(err)
+			res[name] = pool
+		}
+		return res
+	}
+	series := func() []string {
+		families, err := registry.Gather()
+		td.CmpNoError(err)
+		var res []string
+		for _, family := range families {
+			if family.GetName() != "upstream_healthy" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				var pool, upstream string
+				for _, label := range metric.GetLabel() {
+					switch label.GetName() {
+					case "pool":
+						pool = label.GetValue()
+					case "upstream":
+						upstream = label.GetValue()
+					}
+				}
+				res = append(res, pool+"/"+upstream)
+			}
+		}
+		return res
+	}
+
+	proxy := NewHTTPProxy(ctx, nil)
+	proxy.Update(&HTTPProxy{HTTPTransport: Transport{Upstreams: upstreams(map[string][]string{
+		"a": {"1.1.1.1:80", "1.1.1.2:80"},
+		"b": {"2.2.2.2:80"},
+	})}})
+	td.Cmp(series(), testdeep.Bag("a/1.1.1.1:80", "a/1.1.1.2:80", "b/2.2.2.2:80"))
+
+	proxy.Update(&HTTPProxy{HTTPTransport: Transport{Upstreams: upstreams(map[string][]string{
+		"a": {"1.1.1.1:80", "1.1.1.3:80"},
+	})}})
+	td.Cmp(series(), testdeep.Bag("a/1.1.1.1:80", "a/1.1.1.3:80"))
+	td.Cmp(proxy.Upstreams(), testdeep.Len(1))
+
+	proxy.Update(&HTTPProxy{})
+	td.Len(series(), 0)
+	td.Nil(proxy.Upstreams())
+}
+
+func TestTransport_RoundTripUpstream(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	var requests1, requests2 int32
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests1, 1)
+	}))
+	defer server1.Close()
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests2, 1)
+	}))
+	server2Addr := strings.TrimPrefix(server2.URL, "http://")
+	server2.Close()
+
+	pool, err := NewUpstreamPool(UpstreamPoolParams{
+		Name:     "backend",
+		Targets:  []string{strings.TrimPrefix(server1.URL, "http://"), server2Addr},
+		Strategy: StrategyRoundRobin,
+		MaxFails: 1,
+	})
+	td.CmpNoError(err)
+
+	tr := Transport{RateLimiter: &RateLimiter{}, Upstreams: Upstreams{"backend": pool}}
+
+	var errorsCount int
+	for i := 0; i < 6; i++ {
+		req := &http.Request{
+			Method:     http.MethodGet,
+			URL:        &url.URL{Scheme: ProtocolHTTP, Host: UpstreamTargetPrefix + "backend", Path: "/"},
+			Header:     http.Header{},
+			RemoteAddr: "1.2.3.4:1234",
+		}
+		req = req.WithContext(ctx)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			errorsCount++
+			continue
+		}
+		td.Cmp(req.URL.Host, UpstreamTargetPrefix+"backend", "request must not be modified")
+		td.CmpNoError(resp.Body.Close())
+	}
+
+	// second server ejected after first error
+	td.Cmp(errorsCount, 1)
+	td.Cmp(atomic.LoadInt32(&requests1), int32(5))
+	td.Cmp(atomic.LoadInt64(&pool.upstreams[0].activeRequests), int64(0))
+	td.Cmp(atomic.LoadInt64(&pool.upstreams[1].activeRequests), int64(0))
+
+	req := &http.Request{URL: &url.URL{Scheme: ProtocolHTTP, Host: UpstreamTargetPrefix + "unknown"}}
+	req = req.WithContext(context.Background())
+	td.Nil(tr.Upstreams.pool(req.URL.Host))
+}
+
+func TestTransport_RoundTripUpstreamRetry(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	newServer := func(status int, delay time.Duration, counter *int32) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(counter, 1)
+			time.Sleep(delay)
+			w.WriteHeader(status)
+		}))
+		t.Cleanup(server.Close)
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+
+	closedServer := httptest.NewServer(http.NotFoundHandler())
+	closedAddr := strings.TrimPrefix(closedServer.URL, "http://")
+	closedServer.Close()
+
+	newRequest := func(method string) *http.Request {
+		req := &http.Request{
+			Method:     method,
+			URL:        &url.URL{Scheme: ProtocolHTTP, Host: UpstreamTargetPrefix + "backend", Path: "/"},
+			Header:     http.Header{},
+			RemoteAddr: "1.2.3.4:1234",
+		}
+		return req.WithContext(ctx)
+	}
+
+	newTransport := func(params UpstreamPoolParams) Transport {
+		params.Name = "backend"
+		pool, err := NewUpstreamPool(params)
+		testdeep.CmpNoError(t, err)
+		return Transport{RateLimiter: &RateLimiter{}, Upstreams: Upstreams{"backend": pool}, LogAttempts: true}
+	}
+
+	t.Run("ConnectionError", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		var okCount int32
+		tr := newTransport(UpstreamPoolParams{
+			Targets: []string{closedAddr, newServer(http.StatusOK, 0, &okCount)},
+			Retries: 1,
+		})
+		for i := 0; i < 4; i++ {
+			resp, err := tr.RoundTrip(newRequest(http.MethodGet))
+			td.CmpNoError(err)
+			td.Cmp(resp.StatusCode, http.StatusOK)
+			td.CmpNoError(resp.Body.Close())
+		}
+		td.Cmp(atomic.LoadInt32(&okCount), int32(4))
+
+		// non idempotent requests doesn't retry
+		var errCount int
+		for i := 0; i < 4; i++ {
+			resp, err := tr.RoundTrip(newRequest(http.MethodPost))
+			if err != nil {
+				errCount++
+				continue
+			}
+			td.CmpNoError(resp.Body.Close())
+		}
+		td.Cmp(errCount, 2)
+	})
+
+	t.Run("RetryStatusCode", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		var unavailableCount, okCount int32
+		tr := newTransport(UpstreamPoolParams{
+			Targets: []string{
+				newServer(http.StatusServiceUnavailable, 0, &unavailableCount),
+				newServer(http.StatusOK, 0, &okCount),
+			},
+			Retries:          2,
+			RetryStatusCodes: []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+		})
+		for i := 0; i < 4; i++ {
+			resp, err := tr.RoundTrip(newRequest(http.MethodHead))
+			td.CmpNoError(err)
+			td.Cmp(resp.StatusCode, http.StatusOK)
+			td.CmpNoError(resp.Body.Close())
+		}
+		td.Cmp(atomic.LoadInt32(&okCount), int32(4))
+		td.Gt(atomic.LoadInt32(&unavailableCount), int32(0))
+	})
+
+	t.Run("AllFailed", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		var count1, count2 int32
+		tr := newTransport(UpstreamPoolParams{
+			Targets: []string{
+				newServer(http.StatusServiceUnavailable, 0, &count1),
+				newServer(http.StatusServiceUnavailable, 0, &count2),
+			},
+			Retries:          5,
+			RetryStatusCodes: []int{http.StatusServiceUnavailable},
+		})
+		resp, err := tr.RoundTrip(newRequest(http.MethodGet))
+		td.CmpNoError(err)
+		td.Cmp(resp.StatusCode, http.StatusServiceUnavailable)
+		td.CmpNoError(resp.Body.Close())
+		td.Cmp(atomic.LoadInt32(&count1)+atomic.LoadInt32(&count2), int32(2))
+	})
+
+	t.Run("TryTimeout", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		var slowCount, okCount int32
+		tr := newTransport(UpstreamPoolParams{
+			Targets: []string{
+				newServer(http.StatusOK, time.Second, &slowCount),
+				newServer(http.StatusOK, 0, &okCount),
+			},
+			Strategy:   StrategyRoundRobin,
+			Retries:    1,
+			TryTimeout: 100 * time.Millisecond,
+		})
+		for i := 0; i < 2; i++ {
+			resp, err := tr.RoundTrip(newRequest(http.MethodGet))
+			td.CmpNoError(err)
+			td.Cmp(resp.StatusCode, http.StatusOK)
+			td.CmpNoError(resp.Body.Close())
+		}
+		td.Cmp(atomic.LoadInt32(&okCount), int32(2))
+	})
+
+	t.Run("ReplayBody", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		var bodies []string
+		var mu sync.Mutex
+		handler := func(status int) string {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				mu.Lock()
+				bodies = append(bodies, string(body))
+				mu.Unlock()
+				w.WriteHeader(status)
+			}))
+			t.Cleanup(server.Close)
+			return strings.TrimPrefix(server.URL, "http://")
+		}
+		tr := newTransport(UpstreamPoolParams{
+			Targets:          []string{handler(http.StatusBadGateway), handler(http.StatusBadGateway)},
+			Retries:          1,
+			RetryStatusCodes: []int{http.StatusBadGateway},
+		})
+
+		req := newRequest(http.MethodGet)
+		req.Body = io.NopCloser(strings.NewReader("body"))
+		req.ContentLength = 4
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("body")), nil
+		}
+		resp, err := tr.RoundTrip(req)
+		td.CmpNoError(err)
+		td.CmpNoError(resp.Body.Close())
+		td.Cmp(bodies, []string{"body", "body"})
+
+		newPost := func() *http.Request {
+			req := newRequest(http.MethodPost)
+			req.Body = io.NopCloser(strings.NewReader("post"))
+			req.ContentLength = 4
+			req.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader("post")), nil
+			}
+			return req
+		}
+
+		// non idempotent requests doesn't retry by default
+		bodies = nil
+		resp, err = tr.RoundTrip(newPost())
+		td.CmpNoError(err)
+		td.CmpNoError(resp.Body.Close())
+		td.Cmp(bodies, []string{"post"})
+
+		tr = newTransport(UpstreamPoolParams{
+			Targets:             []string{handler(http.StatusBadGateway), handler(http.StatusBadGateway)},
+			Retries:             1,
+			RetryReplayableBody: true,
+			RetryStatusCodes:    []int{http.StatusBadGateway},
+		})
+		bodies = nil
+		resp, err = tr.RoundTrip(newPost())
+		td.CmpNoError(err)
+		td.CmpNoError(resp.Body.Close())
+		td.Cmp(bodies, []string{"post", "post"})
+
+		// body can't be replayed
+		bodies = nil
+		req = newPost()
+		req.GetBody = nil
+		resp, err = tr.RoundTrip(req)
+		td.CmpNoError(err)
+		td.CmpNoError(resp.Body.Close())
+		td.Cmp(bodies, []string{"post"})
+	})
+}
+
+// upstreamHealthGauge return value of upstream_healthy metric for the upstream address.
+func upstreamHealthGauge(t *testing.T, registry *prometheus.Registry, addr string) float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "upstream_healthy" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "upstream" && label.GetValue() == addr {
+					return metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	t.Fatal("metric not found")
+	return 0
+}
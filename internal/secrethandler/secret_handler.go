@@ -20,11 +20,15 @@ type Config struct {
 	AllowedNetworks    []string
 	Password           string
 	AllowEmptyPassword bool
+
+	// AllowPost allow POST requests for handlers, which change state. Set from code, only GET and HEAD allowed else.
+	AllowPost bool `toml:"-"`
 }
 
 type SecretHandler struct {
 	allowedNetworks    []net.IPNet
 	allowEmptyPassword bool
+	allowPost          bool
 	password           string
 	logger             *zap.Logger
 	next               http.Handler
@@ -81,7 +85,7 @@ func (m SecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !(m.allowPost && r.Method == http.MethodPost) {
 		http.Error(w, "Bad method", http.StatusMethodNotAllowed)
 		return
 	}
@@ -105,6 +109,7 @@ func New(logger *zap.Logger, config Config, next http.Handler) SecretHandler {
 	secretHandler.allowedNetworks = allowedNetworksIP
 	secretHandler.password = config.Password
 	secretHandler.allowEmptyPassword = config.AllowEmptyPassword
+	secretHandler.allowPost = config.AllowPost
 	secretHandler.next = next
 	secretHandler.logger = logger
 	return secretHandler
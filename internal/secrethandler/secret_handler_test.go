@@ -135,3 +135,26 @@ func TestPassword(t *testing.T) {
 	nextCalled = false
 	_ = resp.Body.Close()
 }
+
+func TestSecretHandler_Methods(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func(h SecretHandler, method string) int {
+		respWriter := httptest.NewRecorder()
+		h.ServeHTTP(respWriter, httptest.NewRequest(method, "http://test?password=123", nil))
+		return respWriter.Code
+	}
+
+	h := New(th.Logger(td), Config{Password: "123"}, next)
+	td.Cmp(request(h, http.MethodGet), http.StatusOK)
+	td.Cmp(request(h, http.MethodHead), http.StatusOK)
+	td.Cmp(request(h, http.MethodPost), http.StatusMethodNotAllowed)
+
+	h = New(th.Logger(td), Config{Password: "123", AllowPost: true}, next)
+	td.Cmp(request(h, http.MethodGet), http.StatusOK)
+	td.Cmp(request(h, http.MethodPost), http.StatusOK)
+	td.Cmp(request(h, http.MethodDelete), http.StatusMethodNotAllowed)
+}
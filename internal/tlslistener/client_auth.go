@@ -0,0 +1,104 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+)
+
+// Client certificate policies for domains.
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+	ClientAuthVerify  = "verify"
+)
+
+func parseClientAuthPolicy(s string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthRequest:
+		return tls.RequestClientCert, nil
+	case ClientAuthRequire:
+		return tls.RequireAnyClientCert, nil
+	case ClientAuthVerify:
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, xerrors.Errorf("unknown client auth policy: %q", s)
+	}
+}
+
+// clientAuth return client certificate policy for SNI domain. Exact domain has priority over "*.domain" rules,
+// nearest parent wildcard has priority over far.
+func (p *ListenersHandler) clientAuth(serverName string) tls.ClientAuthType {
+	if len(p.ClientAuth) == 0 {
+		return tls.NoClientCert
+	}
+
+	domain := normalizeServerName(serverName)
+	if policy, ok := p.ClientAuth[domain]; ok {
+		return policy
+	}
+	for {
+		index := strings.Index(domain, ".")
+		if index < 0 {
+			return tls.NoClientCert
+		}
+		domain = domain[index+1:]
+		if policy, ok := p.ClientAuth["*."+domain]; ok {
+			return policy
+		}
+	}
+}
+
+// HandleClientAuthMismatch answer 421 Misdirected Request if client certificate policy of request host is stricter
+// than policy of the connection, which chosen by SNI. Else client can connect with other SNI (or without TLS),
+// skip certificate and send protected domain in Host header.
+// Policies compared by numeric value of tls.ClientAuthType, it grows from none to verify for used policies.
+func (p *ListenersHandler) HandleClientAuthMismatch(w http.ResponseWriter, r *http.Request) bool {
+	if len(p.ClientAuth) == 0 {
+		return false
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	connectionPolicy := tls.NoClientCert
+	if r.TLS != nil {
+		connectionPolicy = p.clientAuth(r.TLS.ServerName)
+		if host == "" {
+			host = r.TLS.ServerName
+		}
+	}
+	if p.clientAuth(host) <= connectionPolicy {
+		return false
+	}
+
+	http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+	return true
+}
+
+// isACMEValidation return true for tls-alpn-01 validation handshake, acme server doesn't send client certificate.
+func isACMEValidation(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+func loadClientCAs(fileName string) (*x509.CertPool, error) {
+	pemBytes, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, xerrors.Errorf("read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, xerrors.Errorf("no certificates in client CA file %q", fileName)
+	}
+	return pool, nil
+}
@@ -0,0 +1,210 @@
+package tlslistener
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"golang.org/x/crypto/acme"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func createTestClientCertificates(t *testing.T) (caPEM []byte, clientCert tls.Certificate) {
+	td := testdeep.NewT(t)
+	td.FailureIsFatal()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	td.CmpNoError(err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caBytes, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	td.CmpNoError(err)
+	caCert, err := x509.ParseCertificate(caBytes)
+	td.CmpNoError(err)
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	td.CmpNoError(err)
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "admin"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientBytes, err := x509.CreateCertificate(rand.Reader, clientTemplate, caCert, clientKey.Public(), caKey)
+	td.CmpNoError(err)
+
+	caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caBytes})
+	clientCert = tls.Certificate{Certificate: [][]byte{clientBytes}, PrivateKey: clientKey}
+	return caPEM, clientCert
+}
+
+func TestListenersHandler_ClientAuth(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	caPEM, clientCert := createTestClientCertificates(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	td.CmpNoError(os.WriteFile(caFile, caPEM, 0600))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+
+	handler := &ListenersHandler{
+		GetCertificate:        dummyGetCertificate,
+		ListenersForHandleTLS: []net.Listener{listener},
+	}
+	c := Config{
+		ClientAuth:       map[string]string{"*.admin.example.com": "verify"},
+		ClientAuthCAFile: caFile,
+	}
+	handler.ClientAuth, handler.ClientCAs, err = c.parseClientAuth()
+	td.CmpNoError(err)
+	td.CmpNoError(handler.Start(ctx, nil))
+	defer func() { _ = handler.Close() }()
+
+	handshake := func(serverName string, certificates []tls.Certificate) tls.ConnectionState {
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := handler.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+
+		//nolint:gosec
+		clientConn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			ServerName: serverName, Certificates: certificates, InsecureSkipVerify: true,
+		})
+		if err == nil {
+			defer func() { _ = clientConn.Close() }()
+		}
+
+		serverConn := (<-accepted).(*tls.Conn)
+		defer func() { _ = serverConn.Close() }()
+		return serverConn.ConnectionState()
+	}
+
+	state := handshake("www.example.com", nil)
+	td.True(state.HandshakeComplete, "domain without policy")
+
+	state = handshake("www.admin.example.com", nil)
+	td.False(state.HandshakeComplete, "without client certificate")
+
+	state = handshake("www.admin.example.com", []tls.Certificate{clientCert})
+	td.True(state.HandshakeComplete)
+	td.Len(state.VerifiedChains, 1)
+	td.Cmp(state.VerifiedChains[0][0].Subject.CommonName, "admin")
+}
+
+func TestListenersHandler_HandleClientAuthMismatch(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	p := ListenersHandler{ClientAuth: map[string]tls.ClientAuthType{
+		"*.admin.example.com": tls.RequireAndVerifyClientCert,
+		"api.example.com":     tls.RequestClientCert,
+	}}
+
+	handle := func(serverName string, tlsConnection bool, host string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		if tlsConnection {
+			req.TLS = &tls.ConnectionState{ServerName: serverName}
+		} else {
+			req.TLS = nil
+		}
+		resp := httptest.NewRecorder()
+		if p.HandleClientAuthMismatch(resp, req) {
+			return resp.Code
+		}
+		return 0
+	}
+
+	td.Cmp(handle("www.admin.example.com", true, "www.admin.example.com:443"), 0)
+	td.Cmp(handle("www.admin.example.com", true, "other.admin.example.com"), 0, "same policy")
+	td.Cmp(handle("www.admin.example.com", true, "www.example.com"), 0, "weaker policy")
+	td.Cmp(handle("www.admin.example.com", true, ""), 0, "host from SNI")
+	td.Cmp(handle("www.example.com", true, "www.example.com"), 0)
+	td.Cmp(handle("www.example.com", true, "www.admin.example.com"), http.StatusMisdirectedRequest,
+		"public SNI with protected host")
+	td.Cmp(handle("", true, "WWW.Admin.Example.com."), http.StatusMisdirectedRequest, "without SNI")
+	td.Cmp(handle("api.example.com", true, "www.admin.example.com"), http.StatusMisdirectedRequest,
+		"stricter policy")
+	td.Cmp(handle("", false, "www.admin.example.com"), http.StatusMisdirectedRequest, "without TLS")
+	td.Cmp(handle("", false, "www.example.com"), 0)
+
+	p.ClientAuth = nil
+	td.Cmp(handle("www.example.com", true, "www.admin.example.com"), 0, "without policies")
+}
+
+func TestListenersHandler_clientAuth(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	p := ListenersHandler{}
+	td.Cmp(p.clientAuth("example.com"), tls.NoClientCert)
+
+	p.ClientAuth = map[string]tls.ClientAuthType{
+		"example.com":            tls.RequestClientCert,
+		"*.example.com":          tls.RequireAnyClientCert,
+		"*.admin.example.com":    tls.RequireAndVerifyClientCert,
+		"open.admin.example.com": tls.NoClientCert,
+	}
+	td.Cmp(p.clientAuth("Example.com."), tls.RequestClientCert)
+	td.Cmp(p.clientAuth("www.example.com"), tls.RequireAnyClientCert)
+	td.Cmp(p.clientAuth("a.b.example.com"), tls.RequireAnyClientCert)
+	td.Cmp(p.clientAuth("a.admin.example.com"), tls.RequireAndVerifyClientCert)
+	td.Cmp(p.clientAuth("open.admin.example.com"), tls.NoClientCert)
+	td.Cmp(p.clientAuth("other.com"), tls.NoClientCert)
+
+	acmeHello := &tls.ClientHelloInfo{ServerName: "www.example.com", SupportedProtos: []string{acme.ALPNProto}}
+	td.Nil(p.configForClient(acmeHello, false), "tls-alpn-01 validation without client certificate")
+}
+
+func TestConfig_parseClientAuth(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	c := Config{ClientAuth: map[string]string{"Example.com": "Request", "www.example.com": "require"}}
+	policies, clientCAs, err := c.parseClientAuth()
+	td.CmpNoError(err)
+	td.Nil(clientCAs)
+	td.Cmp(policies, map[string]tls.ClientAuthType{
+		"example.com":     tls.RequestClientCert,
+		"www.example.com": tls.RequireAnyClientCert,
+	})
+
+	c.ClientAuth = map[string]string{"example.com": "asd"}
+	_, _, err = c.parseClientAuth()
+	td.CmpError(err)
+
+	c.ClientAuth = map[string]string{"example.com": "verify"}
+	_, _, err = c.parseClientAuth()
+	td.CmpError(err, "verify without CA")
+
+	c.ClientAuthCAFile = filepath.Join(t.TempDir(), "not-exist.pem")
+	_, _, err = c.parseClientAuth()
+	td.CmpError(err)
+}
@@ -2,9 +2,14 @@ package tlslistener
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"net"
 
+	"golang.org/x/xerrors"
+
 	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/upgrade"
 	zc "github.com/rekby/zapcontext"
 	"go.uber.org/zap"
 )
@@ -13,35 +18,135 @@ type Config struct {
 	TLSAddresses  []string
 	TCPAddresses  []string
 	MinTLSVersion string
+
+	// Udp addresses for serve HTTP/3 (QUIC). ACME tls-alpn-01 validation handled by TLSAddresses only.
+	QUICAddresses []string
+
+	// Addresses from TCPAddresses, which answer redirect to https instead of proxy requests.
+	// Redirect code and exceptions are in proxy config.
+	HTTPSRedirectAddresses []string
+
+	// Addresses from TLSAddresses and TCPAddresses, which receive PROXY protocol (v1 or v2) header before data.
+	ProxyProtocolAddresses []string
+
+	// Networks, which allowed to send PROXY protocol header. Connections from other sources handle as usual.
+	// Empty - allow from all.
+	ProxyProtocolTrustedNetworks []string
+
+	// Targets (host:port) of tcp mode by address from TLSAddresses. Connections terminate TLS with issued certificate
+	// and copy plain bytes to the target instead of handle as http.
+	TCPModeListeners map[string]string
+
+	// Targets (host:port) of tcp mode by SNI domain for all TLS addresses. It has priority over TCPModeListeners.
+	TCPModeDomains map[string]string
+
+	// Targets (host:port) by SNI domain for all TLS addresses, which receive raw TLS stream without termination.
+	// It has priority over tcp mode.
+	PassthroughDomains map[string]string
+
+	// Client certificate policy by domain: none, request, require or verify (against ClientAuthCAFile).
+	// Domain "*.example.com" match all subdomains of example.com.
+	ClientAuth map[string]string
+
+	// PEM file with CA certificates for verify policy.
+	ClientAuthCAFile string
 }
 
 func (c Config) Apply(ctx context.Context, l *ListenersHandler) error {
 	logger := zc.L(ctx)
 
+	proxyProtocolAddresses, trustedNetworks, err := c.parseProxyProtocol()
+	if err != nil {
+		return err
+	}
+
+	if err = c.checkTCPMode(); err != nil {
+		return err
+	}
+
+	httpsRedirectAddresses, err := c.parseHTTPSRedirectAddresses()
+	if err != nil {
+		return err
+	}
+
+	clientAuth, clientCAs, err := c.parseClientAuth()
+	if err != nil {
+		return err
+	}
+
+	var tcpModeListeners = make(map[net.Listener]string, len(c.TCPModeListeners))
 	var tlsListeners = make([]net.Listener, 0, len(c.TLSAddresses))
 	for _, addr := range c.TLSAddresses { //nolint:wsl
-		listener, err := net.Listen("tcp", addr)
+		listener, err := listen(addr)
 		log.DebugError(logger, err, "Start listen tls binding", zap.String("address", addr))
 		if err != nil {
 			return err
 		}
+		if proxyProtocolAddresses[addr] {
+			logger.Info("Enable PROXY protocol for listener", zap.String("address", addr))
+			listener = newProxyProtocolListener(listener, trustedNetworks)
+		}
+		if target, ok := c.TCPModeListeners[addr]; ok {
+			logger.Info("Tcp mode for listener", zap.String("address", addr), zap.String("target", target))
+			tcpModeListeners[listener] = target
+		}
 
 		tlsListeners = append(tlsListeners, listener)
 	}
 
+	var httpsRedirectListeners = make(map[net.Listener]bool, len(httpsRedirectAddresses))
 	var tcpListeners = make([]net.Listener, 0, len(c.TCPAddresses))
 
 	for _, addr := range c.TCPAddresses {
-		listener, err := net.Listen("tcp", addr)
+		listener, err := listen(addr)
 		log.DebugError(logger, err, "Start listen tcp binding", zap.String("address", addr))
 		if err != nil {
 			return err
 		}
+		if proxyProtocolAddresses[addr] {
+			logger.Info("Enable PROXY protocol for listener", zap.String("address", addr))
+			listener = newProxyProtocolListener(listener, trustedNetworks)
+		}
+		if httpsRedirectAddresses[addr] {
+			logger.Info("Redirect to https for listener", zap.String("address", addr))
+			httpsRedirectListeners[listener] = true
+		}
 
 		tcpListeners = append(tcpListeners, listener)
 	}
+	var quicConns = make([]net.PacketConn, 0, len(c.QUICAddresses))
+	for _, addr := range c.QUICAddresses {
+		conn, err := upgrade.ListenPacket("udp", addr)
+		log.DebugError(logger, err, "Start listen quic binding", zap.String("address", addr))
+		if err != nil {
+			return err
+		}
+		quicConns = append(quicConns, conn)
+	}
+
 	l.ListenersForHandleTLS = tlsListeners
 	l.Listeners = tcpListeners
+	l.HTTPSRedirectListeners = httpsRedirectListeners
+	l.TCPModeListeners = tcpModeListeners
+	l.QUICConns = quicConns
+
+	l.TCPModeDomains = make(map[string]string, len(c.TCPModeDomains))
+	for domain, target := range c.TCPModeDomains {
+		logger.Info("Tcp mode for domain", zap.String("domain", domain), zap.String("target", target))
+		l.TCPModeDomains[normalizeServerName(domain)] = target
+	}
+
+	if len(clientAuth) > 0 {
+		logger.Info("Client certificate policies", zap.Any("policies", c.ClientAuth))
+	}
+	l.ClientAuth = clientAuth
+	l.ClientCAs = clientCAs
+
+	l.PassthroughDomains = make(map[string]string, len(c.PassthroughDomains))
+	for domain, target := range c.PassthroughDomains {
+		logger.Info("Passthrough tls for domain", zap.String("domain", domain), zap.String("target", target))
+		l.PassthroughDomains[normalizeServerName(domain)] = target
+	}
 
 	if tlsVersion, err := ParseTLSVersion(c.MinTLSVersion); err == nil {
 		l.MinTLSVersion = tlsVersion
@@ -52,3 +157,100 @@ func (c Config) Apply(ctx context.Context, l *ListenersHandler) error {
 
 	return nil
 }
+
+func (c Config) parseProxyProtocol() (addresses map[string]bool, trustedNetworks []net.IPNet, err error) {
+	listenAddresses := make(map[string]bool, len(c.TLSAddresses)+len(c.TCPAddresses))
+	for _, addr := range c.TLSAddresses {
+		listenAddresses[addr] = true
+	}
+	for _, addr := range c.TCPAddresses {
+		listenAddresses[addr] = true
+	}
+
+	addresses = make(map[string]bool, len(c.ProxyProtocolAddresses))
+	for _, addr := range c.ProxyProtocolAddresses {
+		if !listenAddresses[addr] {
+			return nil, nil, xerrors.Errorf("PROXY protocol address %q isn't in listen addresses", addr)
+		}
+		addresses[addr] = true
+	}
+
+	for _, network := range c.ProxyProtocolTrustedNetworks {
+		_, parsedNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("parse PROXY protocol trusted network %q: %w", network, err)
+		}
+		trustedNetworks = append(trustedNetworks, *parsedNet)
+	}
+	return addresses, trustedNetworks, nil
+}
+
+func (c Config) parseHTTPSRedirectAddresses() (map[string]bool, error) {
+	tcpAddresses := make(map[string]bool, len(c.TCPAddresses))
+	for _, addr := range c.TCPAddresses {
+		tcpAddresses[addr] = true
+	}
+
+	addresses := make(map[string]bool, len(c.HTTPSRedirectAddresses))
+	for _, addr := range c.HTTPSRedirectAddresses {
+		if !tcpAddresses[addr] {
+			return nil, xerrors.Errorf("https redirect address %q isn't in tcp addresses", addr)
+		}
+		addresses[addr] = true
+	}
+	return addresses, nil
+}
+
+func (c Config) checkTCPMode() error {
+	tlsAddresses := make(map[string]bool, len(c.TLSAddresses))
+	for _, addr := range c.TLSAddresses {
+		tlsAddresses[addr] = true
+	}
+
+	for addr, target := range c.TCPModeListeners {
+		if !tlsAddresses[addr] {
+			return xerrors.Errorf("tcp mode address %q isn't in tls addresses", addr)
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return xerrors.Errorf("bad tcp mode target %q for address %q: %w", target, addr, err)
+		}
+	}
+
+	for domain, target := range c.TCPModeDomains {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return xerrors.Errorf("bad tcp mode target %q for domain %q: %w", target, domain, err)
+		}
+	}
+
+	for domain, target := range c.PassthroughDomains {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return xerrors.Errorf("bad passthrough target %q for domain %q: %w", target, domain, err)
+		}
+	}
+	return nil
+}
+
+func (c Config) parseClientAuth() (policies map[string]tls.ClientAuthType, clientCAs *x509.CertPool, err error) {
+	policies = make(map[string]tls.ClientAuthType, len(c.ClientAuth))
+	needCA := false
+	for domain, policyName := range c.ClientAuth {
+		policy, err := parseClientAuthPolicy(policyName)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("client auth for domain %q: %w", domain, err)
+		}
+		if policy == tls.RequireAndVerifyClientCert {
+			needCA = true
+		}
+		policies[normalizeServerName(domain)] = policy
+	}
+
+	if c.ClientAuthCAFile != "" {
+		clientCAs, err = loadClientCAs(c.ClientAuthCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if needCA {
+		return nil, nil, xerrors.New("client auth verify policy need ClientAuthCAFile")
+	}
+	return policies, clientCAs, nil
+}
@@ -44,6 +44,8 @@ func TestConfig_Apply(t *testing.T) {
 	c = &Config{
 		TCPAddresses: []string{addr + ":" + ports[0], addr + ":" + ports[1]},
 		TLSAddresses: []string{addr + ":" + ports[2], addr + ":" + ports[3], addr + ":" + ports[4]},
+
+		HTTPSRedirectAddresses: []string{addr + ":" + ports[1]},
 	}
 	err = c.Apply(ctx, l)
 
@@ -63,6 +65,27 @@ func TestConfig_Apply(t *testing.T) {
 
 	tlsListenerAddresses := []string{l.ListenersForHandleTLS[0].Addr().String(), l.ListenersForHandleTLS[1].Addr().String(), l.ListenersForHandleTLS[2].Addr().String()}
 	td.CmpDeeply(tlsListenerAddresses, []string{addr + ":" + ports[2], addr + ":" + ports[3], addr + ":" + ports[4]})
+
+	td.False(l.HTTPSRedirectListeners[l.Listeners[0]])
+	td.True(l.HTTPSRedirectListeners[l.Listeners[1]])
+}
+
+func TestConfig_parseHTTPSRedirectAddresses(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	c := Config{TCPAddresses: []string{":80", ":8080"}, TLSAddresses: []string{":443"}}
+	addresses, err := c.parseHTTPSRedirectAddresses()
+	td.CmpNoError(err)
+	td.Empty(addresses)
+
+	c.HTTPSRedirectAddresses = []string{":80"}
+	addresses, err = c.parseHTTPSRedirectAddresses()
+	td.CmpNoError(err)
+	td.Cmp(addresses, map[string]bool{":80": true})
+
+	c.HTTPSRedirectAddresses = []string{":443"}
+	_, err = c.parseHTTPSRedirectAddresses()
+	td.CmpError(err, "tls address")
 }
 
 func getFreePorts(ip string, cnt int) []string {
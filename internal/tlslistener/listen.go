@@ -0,0 +1,67 @@
+package tlslistener
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rekby/lets-proxy2/internal/upgrade"
+)
+
+const (
+	// unixAddressPrefix - prefix of listen address for unix socket, for example "unix:/run/lets-proxy.sock".
+	unixAddressPrefix = "unix:"
+
+	// systemdAddressPrefix - prefix of listen address for socket from systemd socket activation,
+	// by FileDescriptorName of socket unit or by index from 0, for example "systemd:https" or "systemd:0".
+	systemdAddressPrefix = "systemd:"
+)
+
+// listen start listen the address from config: tcp host:port, unix:path or systemd:name.
+func listen(address string) (net.Listener, error) {
+	var listener net.Listener
+	var err error
+	switch {
+	case strings.HasPrefix(address, unixAddressPrefix):
+		listener, err = upgrade.Listen("unix", strings.TrimPrefix(address, unixAddressPrefix))
+	case strings.HasPrefix(address, systemdAddressPrefix):
+		listener, err = upgrade.Listen(upgrade.NetworkSystemd, strings.TrimPrefix(address, systemdAddressPrefix))
+	default:
+		listener, err = upgrade.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// systemd socket can be unix socket too
+	if _, ok := listener.Addr().(*net.UnixAddr); ok {
+		listener = &unixListener{Listener: listener}
+	}
+	return listener, nil
+}
+
+// unixListener set unique remote address for accepted connections, because clients of unix socket usually
+// has no address, but connections registered by remote and local addresses.
+type unixListener struct {
+	net.Listener
+	counter uint64
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	id := atomic.AddUint64(&l.counter, 1)
+	return unixConn{Conn: conn, remoteAddr: &net.UnixAddr{Name: "unix-client-" + strconv.FormatUint(id, 10), Net: "unix"}}, nil
+}
+
+type unixConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c unixConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
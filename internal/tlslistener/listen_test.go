@@ -0,0 +1,66 @@
+package tlslistener
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestListen(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	_, err := listen(systemdAddressPrefix + "not-exist")
+	td.CmpError(err)
+
+	socket := filepath.Join(t.TempDir(), "test.sock")
+	listener, err := listen(unixAddressPrefix + socket)
+	td.CmpNoError(err)
+	defer th.Close(listener)
+	td.Cmp(listener.Addr().String(), socket)
+
+	accept := func() net.Conn {
+		client, err := net.Dial("unix", socket)
+		td.CmpNoError(err)
+		defer th.Close(client)
+
+		conn, err := listener.Accept()
+		td.CmpNoError(err)
+		_ = conn.Close()
+		return conn
+	}
+	first, second := accept(), accept()
+	td.Cmp(first.LocalAddr().String(), second.LocalAddr().String())
+	td.Not(first.RemoteAddr().String(), second.RemoteAddr().String(), "connections registered by remote address")
+}
+
+func TestConfig_ApplyUnix(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	dir := t.TempDir()
+	tlsAddress := unixAddressPrefix + filepath.Join(dir, "tls.sock")
+	tcpAddress := unixAddressPrefix + filepath.Join(dir, "tcp.sock")
+	c := Config{
+		TLSAddresses:           []string{tlsAddress},
+		TCPAddresses:           []string{tcpAddress},
+		HTTPSRedirectAddresses: []string{tcpAddress},
+		ProxyProtocolAddresses: []string{tlsAddress},
+	}
+	l := &ListenersHandler{}
+	td.CmpNoError(c.Apply(ctx, l))
+	defer func() {
+		for _, listener := range append(l.ListenersForHandleTLS, l.Listeners...) {
+			_ = listener.Close()
+		}
+	}()
+
+	td.Cmp(l.ListenersForHandleTLS[0].Addr().String(), filepath.Join(dir, "tls.sock"))
+	td.Cmp(l.Listeners[0].Addr().String(), filepath.Join(dir, "tcp.sock"))
+	td.True(l.HTTPSRedirectListeners[l.Listeners[0]])
+}
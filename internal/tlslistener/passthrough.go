@@ -0,0 +1,82 @@
+package tlslistener
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// clientHelloTimeout is time for receive ClientHello, when need SNI before TLS handshake.
+const clientHelloTimeout = 10 * time.Second
+
+var errClientHelloReceived = errors.New("client hello received")
+
+// peekServerName read ClientHello from conn and return SNI from it.
+// Returned connection read same bytes again, so it can be handled as new connection.
+func peekServerName(conn net.Conn) (serverName string, peeked *peekedConn, err error) {
+	var buf bytes.Buffer
+
+	_ = conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	err = tls.Server(readOnlyConn{Conn: conn, reader: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloReceived
+		},
+	}).Handshake()
+	_ = conn.SetReadDeadline(time.Time{})
+
+	peeked = &peekedConn{Conn: conn, reader: io.MultiReader(&buf, conn)}
+	if !errors.Is(err, errClientHelloReceived) {
+		return "", peeked, xerrors.Errorf("read client hello: %w", err)
+	}
+	return serverName, peeked, nil
+}
+
+// handlePassthroughConnection copy raw TLS stream between conn and target, without terminate TLS.
+// It close the connection after finish.
+func (p *ListenersHandler) handlePassthroughConnection(ctx context.Context, conn net.Conn, target string) {
+	defer func() {
+		err := conn.Close()
+		log.DebugError(zc.L(ctx), err, "Close passthrough connection", zap.String("target", target))
+	}()
+
+	p.copyToTarget(ctx, conn, target)
+}
+
+// readOnlyConn ignore writes, used for parse ClientHello without answer to client.
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (c readOnlyConn) Close() error {
+	return nil
+}
+
+// peekedConn return already read bytes before read from connection.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,112 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestPassthrough(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	// backend with own certificate
+	backendCert, err := dummyGetCertificate(&tls.ClientHelloInfo{ServerName: "pass.example.com"})
+	td.CmpNoError(err)
+	backend, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{*backendCert}})
+	td.CmpNoError(err)
+	defer func() { _ = backend.Close() }()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}(conn)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+
+	handler := &ListenersHandler{
+		GetCertificate:        dummyGetCertificate,
+		ListenersForHandleTLS: []net.Listener{listener},
+		PassthroughDomains:    map[string]string{"pass.example.com": backend.Addr().String()},
+	}
+	td.CmpNoError(handler.Start(ctx, nil))
+	defer func() { _ = handler.Close() }()
+
+	//nolint:gosec
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: "Pass.Example.com", InsecureSkipVerify: true})
+	td.CmpNoError(err)
+	td.Cmp(conn.ConnectionState().PeerCertificates[0].Raw, backendCert.Certificate[0], "certificate of backend")
+	_, err = conn.Write([]byte("hello"))
+	td.CmpNoError(err)
+	td.CmpNoError(conn.CloseWrite())
+	res, err := io.ReadAll(conn)
+	td.CmpNoError(err)
+	td.Cmp(string(res), "hello")
+	_ = conn.Close()
+
+	// other domains terminated as usual
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := handler.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	//nolint:gosec
+	conn, err = tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: "www.example.com", InsecureSkipVerify: true})
+	td.CmpNoError(err)
+	td.Cmp(conn.ConnectionState().PeerCertificates[0].DNSNames, []string{"www.example.com"})
+	serverConn := <-accepted
+	td.Isa(serverConn, &tls.Conn{})
+	_ = serverConn.Close()
+	_ = conn.Close()
+}
+
+func TestPeekServerName(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	client, server := net.Pipe()
+	go func() {
+		//nolint:gosec
+		_ = tls.Client(client, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true}).Handshake()
+	}()
+
+	serverName, peeked, err := peekServerName(server)
+	td.CmpNoError(err)
+	td.Cmp(serverName, "example.com")
+
+	// peeked connection return client hello again
+	header := make([]byte, 1)
+	_, err = peeked.Read(header)
+	td.CmpNoError(err)
+	td.Cmp(header, []byte{0x16}, "tls handshake record")
+
+	_ = client.Close()
+	_ = server.Close()
+
+	client, server = net.Pipe()
+	go func() {
+		_, _ = client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		_ = client.Close()
+	}()
+	_, peeked, err = peekServerName(server)
+	td.CmpError(err)
+	res, _ := io.ReadAll(peeked)
+	td.Cmp(string(res), "GET / HTTP/1.1\r\n\r\n", "peeked connection keep read bytes")
+	_ = server.Close()
+}
@@ -0,0 +1,225 @@
+package tlslistener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// proxyProtocolHeaderTimeout is time for receive PROXY protocol header after accept connection.
+const proxyProtocolHeaderTimeout = 10 * time.Second
+
+const (
+	proxyProtocolV1Prefix    = "PROXY "
+	proxyProtocolV1MaxLength = 107 // with CRLF
+
+	proxyProtocolV2HeaderLength = 16
+
+	proxyProtocolV2CommandLocal = 0x0
+	proxyProtocolV2CommandProxy = 0x1
+
+	proxyProtocolV2FamilyTCP4 = 0x11
+	proxyProtocolV2FamilyTCP6 = 0x21
+
+	proxyProtocolV2AddressesTCP4Length = 12
+	proxyProtocolV2AddressesTCP6Length = 36
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyProtocolBadHeader = errors.New("bad PROXY protocol header")
+
+// proxyProtocolListener wrap connections from trusted sources for read PROXY protocol header.
+// Connections from other sources return as is.
+type proxyProtocolListener struct {
+	net.Listener
+	trustedNetworks []net.IPNet
+}
+
+func newProxyProtocolListener(listener net.Listener, trustedNetworks []net.IPNet) *proxyProtocolListener {
+	return &proxyProtocolListener{Listener: listener, trustedNetworks: trustedNetworks}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return newProxyProtocolConn(conn), nil
+}
+
+func (l *proxyProtocolListener) isTrusted(addr net.Addr) bool {
+	if len(l.trustedNetworks) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for i := range l.trustedNetworks {
+		if l.trustedNetworks[i].Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConn read PROXY protocol header before first read and return client address from it as RemoteAddr.
+// If header has no client address (LOCAL command, UNKNOWN or unix family) - RemoteAddr return original address.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	headerOnce sync.Once
+	headerErr  error
+	remoteAddr net.Addr
+}
+
+func newProxyProtocolConn(conn net.Conn) *proxyProtocolConn {
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader read PROXY protocol header once, next calls return result of first read.
+func (c *proxyProtocolConn) readHeader() error {
+	c.headerOnce.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		c.remoteAddr, c.headerErr = readProxyProtocolHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+	})
+	return c.headerErr
+}
+
+// readProxyProtocolHeader read PROXY protocol header v1 or v2 and return source address from it.
+// Return nil address without error for valid header without source address.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	firstByte, err := r.Peek(1)
+	if err != nil {
+		return nil, xerrors.Errorf("read PROXY protocol header: %w", err)
+	}
+	switch firstByte[0] {
+	case proxyProtocolV1Prefix[0]:
+		return readProxyProtocolV1(r)
+	case proxyProtocolV2Signature[0]:
+		return readProxyProtocolV2(r)
+	default:
+		return nil, errProxyProtocolBadHeader
+	}
+}
+
+// readProxyProtocolV1 parse text header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, xerrors.Errorf("read PROXY protocol v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, xerrors.Errorf("too long PROXY protocol v1 header: %w", errProxyProtocolBadHeader)
+		}
+	}
+
+	lineString := string(line)
+	if !strings.HasPrefix(lineString, proxyProtocolV1Prefix) || !strings.HasSuffix(lineString, "\r\n") {
+		return nil, errProxyProtocolBadHeader
+	}
+
+	fields := strings.Split(strings.TrimSuffix(lineString, "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyProtocolBadHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, xerrors.Errorf("bad source ip %q: %w", fields[2], errProxyProtocolBadHeader)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, xerrors.Errorf("bad source port %q: %w", fields[4], errProxyProtocolBadHeader)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 parse binary header
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyProtocolV2HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, xerrors.Errorf("read PROXY protocol v2 header: %w", err)
+	}
+	if !bytes.Equal(header[:len(proxyProtocolV2Signature)], proxyProtocolV2Signature) {
+		return nil, errProxyProtocolBadHeader
+	}
+
+	versionCommand := header[12]
+	if versionCommand>>4 != 2 {
+		return nil, xerrors.Errorf("unsupported PROXY protocol version: %w", errProxyProtocolBadHeader)
+	}
+	command := versionCommand & 0x0F
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	// addresses and TLVs
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, xerrors.Errorf("read PROXY protocol v2 addresses: %w", err)
+	}
+
+	switch command {
+	case proxyProtocolV2CommandLocal:
+		return nil, nil
+	case proxyProtocolV2CommandProxy:
+		// pass
+	default:
+		return nil, xerrors.Errorf("unsupported PROXY protocol v2 command: %w", errProxyProtocolBadHeader)
+	}
+
+	switch family {
+	case proxyProtocolV2FamilyTCP4:
+		if len(data) < proxyProtocolV2AddressesTCP4Length {
+			return nil, errProxyProtocolBadHeader
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:10]))}, nil
+	case proxyProtocolV2FamilyTCP6:
+		if len(data) < proxyProtocolV2AddressesTCP6Length {
+			return nil, errProxyProtocolBadHeader
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:34]))}, nil
+	default:
+		// unspec, udp and unix families has no tcp client address
+		return nil, nil
+	}
+}
@@ -0,0 +1,179 @@
+package tlslistener
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func proxyProtocolV2Header(command, family byte, addresses []byte) []byte {
+	res := append([]byte{}, proxyProtocolV2Signature...)
+	res = append(res, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(res[14:16], uint16(len(addresses)))
+	return append(res, addresses...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	tcp4Addresses := []byte{
+		1, 2, 3, 4, // src
+		5, 6, 7, 8, // dst
+		0x04, 0xD2, // src port 1234
+		0x01, 0xBB, // dst port 443
+		1, 2, 3, // TLV
+	}
+	tcp6Addresses := append(append([]byte{}, net.ParseIP("2001:db8::1").To16()...), net.ParseIP("2001:db8::2").To16()...)
+	tcp6Addresses = append(tcp6Addresses, 0x04, 0xD2, 0x01, 0xBB)
+
+	table := []struct {
+		name   string
+		header string
+		addr   net.Addr
+		err    bool
+	}{
+		{name: "v1-tcp4", header: "PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r\n", addr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}},
+		{name: "v1-tcp6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n", addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}},
+		{name: "v1-unknown", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1-unknown-addresses", header: "PROXY UNKNOWN 1.2.3.4 5.6.7.8 1234 443\r\n"},
+		{name: "v1-ip-family-mismatch", header: "PROXY TCP4 2001:db8::1 5.6.7.8 1234 443\r\n", err: true},
+		{name: "v1-bad-port", header: "PROXY TCP4 1.2.3.4 5.6.7.8 123456 443\r\n", err: true},
+		{name: "v1-without-cr", header: "PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\n", err: true},
+		{name: "v1-too-long", header: "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", err: true},
+		{name: "v2-tcp4", header: string(proxyProtocolV2Header(proxyProtocolV2CommandProxy, proxyProtocolV2FamilyTCP4, tcp4Addresses)), addr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 1234}},
+		{name: "v2-tcp6", header: string(proxyProtocolV2Header(proxyProtocolV2CommandProxy, proxyProtocolV2FamilyTCP6, tcp6Addresses)), addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}},
+		{name: "v2-local", header: string(proxyProtocolV2Header(proxyProtocolV2CommandLocal, 0, nil))},
+		{name: "v2-short-addresses", header: string(proxyProtocolV2Header(proxyProtocolV2CommandProxy, proxyProtocolV2FamilyTCP4, []byte{1, 2, 3})), err: true},
+		{name: "v2-bad-command", header: string(proxyProtocolV2Header(0x5, proxyProtocolV2FamilyTCP4, tcp4Addresses)), err: true},
+		{name: "no-header", header: "GET / HTTP/1.1\r\n", err: true},
+		{name: "empty", header: "", err: true},
+	}
+
+	for _, test := range table {
+		t.Run(test.name, func(t *testing.T) {
+			td := td.RootName(test.name)
+			r := bufio.NewReader(strings.NewReader(test.header + "data"))
+			addr, err := readProxyProtocolHeader(r)
+			if test.err {
+				td.CmpError(err)
+				return
+			}
+			td.CmpNoError(err)
+			td.Cmp(addr, test.addr)
+
+			rest, _ := io.ReadAll(r)
+			td.Cmp(string(rest), "data")
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	const addr = "127.0.0.1"
+	ports := getFreePorts(addr, 2)
+	proxyAddr := addr + ":" + ports[0]
+	directAddr := addr + ":" + ports[1]
+
+	c := Config{
+		TCPAddresses:                 []string{proxyAddr, directAddr},
+		ProxyProtocolAddresses:       []string{proxyAddr},
+		ProxyProtocolTrustedNetworks: []string{"127.0.0.0/8"},
+	}
+	handler := &ListenersHandler{
+		connectionHandleStart:  func() {},
+		connectionHandleFinish: func(err error) {},
+	}
+	td.CmpNoError(c.Apply(ctx, handler))
+	td.CmpNoError(handler.Start(ctx, nil))
+	defer func() { _ = handler.Close() }()
+
+	go func() {
+		_ = http.Serve(handler, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.RemoteAddr))
+		}))
+	}()
+
+	request := func(addr, header string) (string, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = conn.Close() }()
+
+		_, err = conn.Write([]byte(header + "GET / HTTP/1.0\r\n\r\n"))
+		if err != nil {
+			return "", err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return string(body), err
+	}
+
+	remoteAddr, err := request(proxyAddr, "PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r\n")
+	td.CmpNoError(err)
+	td.Cmp(remoteAddr, "1.2.3.4:1234")
+
+	remoteAddr, err = request(proxyAddr, string(proxyProtocolV2Header(proxyProtocolV2CommandLocal, 0, nil)))
+	td.CmpNoError(err)
+	td.HasPrefix(remoteAddr, "127.0.0.1:", "LOCAL command keep connection address")
+
+	_, err = request(proxyAddr, "")
+	td.CmpError(err, "connection without header must be closed")
+
+	remoteAddr, err = request(directAddr, "")
+	td.CmpNoError(err)
+	td.HasPrefix(remoteAddr, "127.0.0.1:")
+}
+
+func TestProxyProtocolListener_isTrusted(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	l := proxyProtocolListener{}
+	td.True(l.isTrusted(&net.TCPAddr{IP: net.ParseIP("1.2.3.4")}), "empty list allow all")
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	l.trustedNetworks = []net.IPNet{*network}
+	td.True(l.isTrusted(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}))
+	td.False(l.isTrusted(&net.TCPAddr{IP: net.ParseIP("1.2.3.4")}))
+	td.False(l.isTrusted(&net.UnixAddr{Name: "/tmp/socket"}))
+}
+
+func TestConfig_parseProxyProtocol(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	c := Config{
+		TLSAddresses:                 []string{":443"},
+		TCPAddresses:                 []string{":80"},
+		ProxyProtocolAddresses:       []string{":443"},
+		ProxyProtocolTrustedNetworks: []string{"10.0.0.0/8"},
+	}
+	addresses, networks, err := c.parseProxyProtocol()
+	td.CmpNoError(err)
+	td.Cmp(addresses, map[string]bool{":443": true})
+	td.Len(networks, 1)
+
+	c.ProxyProtocolAddresses = []string{":444"}
+	_, _, err = c.parseProxyProtocol()
+	td.CmpError(err)
+
+	c.ProxyProtocolAddresses = nil
+	c.ProxyProtocolTrustedNetworks = []string{"asd"}
+	_, _, err = c.parseProxyProtocol()
+	td.CmpError(err)
+}
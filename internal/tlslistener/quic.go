@@ -0,0 +1,139 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/quic-go/quic-go"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// quicNextProto - ALPN protocol of HTTP/3
+const quicNextProto = "h3"
+
+var errQUICACMEValidation = xerrors.New("tls-alpn-01 validation handled by tcp listeners only")
+var errQUICNotHTTPDomain = xerrors.New("passthrough and tcp mode domains handled by tcp listeners only")
+
+// QUICListener accept QUIC connections with certificates from GetCertificate and register connection contexts,
+// same as for tcp connections, so GetConnectionContext work for HTTP/3 requests.
+type QUICListener struct {
+	*quic.EarlyListener
+	p *ListenersHandler
+}
+
+func (l QUICListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	conn, err := l.EarlyListener.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p := l.p
+	key := conn.RemoteAddr().String() + "-" + conn.LocalAddr().String()
+	ctxStruct := p.newConnectionContext(conn.RemoteAddr(), conn.LocalAddr(), true, false)
+
+	p.connectionsContextMu.Lock()
+	// tcp connection with same addresses has context with same values
+	_, exist := p.connectionsContext[key]
+	if !exist {
+		p.connectionsContext[key] = ctxStruct
+	}
+	p.connectionsContextMu.Unlock()
+
+	p.connectionHandleStart()
+	logger := zc.L(ctxStruct.ctx)
+	logger.Debug("Accept quic connection", zap.String("remote_addr", conn.RemoteAddr().String()),
+		zap.String("local_addr", conn.LocalAddr().String()))
+
+	go func() {
+		defer log.HandlePanic(logger)
+
+		<-conn.Context().Done()
+		if !exist {
+			p.connectionsContextMu.Lock()
+			delete(p.connectionsContext, key)
+			p.connectionsContextMu.Unlock()
+		}
+		ctxStruct.cancelFunc()
+		p.connectionHandleFinish(nil)
+		logger.Debug("Quic connection closed.")
+	}()
+	return conn, nil
+}
+
+// QUICListeners return listeners for serve HTTP/3 on QUICConns. It must be called after Start.
+func (p *ListenersHandler) QUICListeners() []QUICListener {
+	return p.quicListeners
+}
+
+func (p *ListenersHandler) startQUIC() error {
+	tlsConfig := p.quicTLSConfig()
+	for _, conn := range p.QUICConns {
+		listener, err := quic.ListenEarly(conn, tlsConfig, &quic.Config{})
+		if err != nil {
+			return xerrors.Errorf("start quic listener on %v: %w", conn.LocalAddr(), err)
+		}
+		p.quicListeners = append(p.quicListeners, QUICListener{EarlyListener: listener, p: p})
+	}
+	return nil
+}
+
+// quicTLSConfig use client certificate policies same as for tcp listeners. ACME validation by tls-alpn-01
+// work over tcp only.
+func (p *ListenersHandler) quicTLSConfig() *tls.Config {
+	config := &tls.Config{
+		GetCertificate: p.getQUICCertificate,
+		NextProtos:     []string{quicNextProto},
+		MinVersion:     tls.VersionTLS13, // QUIC require TLS 1.3
+	}
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if isACMEValidation(hello) {
+			return nil, errQUICACMEValidation
+		}
+		if p.isNotHTTPDomain(hello.ServerName) {
+			return nil, errQUICNotHTTPDomain
+		}
+		clientAuth := p.clientAuth(hello.ServerName)
+		if clientAuth == tls.NoClientCert {
+			return nil, nil
+		}
+		res := config.Clone()
+		res.GetConfigForClient = nil
+		res.ClientAuth = clientAuth
+		res.ClientCAs = p.ClientCAs
+		return res, nil
+	}
+	return config
+}
+
+// getQUICCertificate set connection with context to hello, because certificate manager get context from it,
+// but hello of QUIC handshake has no connection.
+func (p *ListenersHandler) getQUICCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	helloWithConn := *hello
+	helloWithConn.Conn = quicHelloConn{ctx: zc.WithLogger(p.ctx, p.logger.With(zap.String("protocol", "quic")))}
+	return p.GetCertificate(&helloWithConn)
+}
+
+type quicHelloConn struct {
+	net.Conn
+	ctx context.Context
+}
+
+func (c quicHelloConn) GetContext() context.Context {
+	return c.ctx
+}
+
+// isNotHTTPDomain return true for domains, which connections must not be terminated as http:
+// passthrough and tcp mode domains.
+func (p *ListenersHandler) isNotHTTPDomain(serverName string) bool {
+	serverName = normalizeServerName(serverName)
+	if _, ok := p.PassthroughDomains[serverName]; ok {
+		return true
+	}
+	_, ok := p.TCPModeDomains[serverName]
+	return ok
+}
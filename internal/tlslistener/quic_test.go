@@ -0,0 +1,93 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestListenersHandler_QUIC(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	td.FailureIsFatal()
+
+	handler := &ListenersHandler{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// certificate manager get context from connection
+			_ = hello.Conn.(interface{ GetContext() context.Context }).GetContext()
+			return dummyGetCertificate(hello)
+		},
+	}
+	c := Config{
+		QUICAddresses:      []string{"127.0.0.1:0"},
+		PassthroughDomains: map[string]string{"passthrough.example.com": "127.0.0.1:1"},
+		TCPModeDomains:     map[string]string{"tcp.example.com": "127.0.0.1:1"},
+	}
+	td.CmpNoError(c.Apply(ctx, handler))
+	td.Len(handler.QUICConns, 1)
+	td.CmpNoError(handler.Start(ctx, nil))
+	defer func() { _ = handler.Close() }()
+
+	td.Len(handler.QUICListeners(), 1)
+	listener := handler.QUICListeners()[0]
+	addr := listener.Addr().String()
+
+	server := &http3.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		localAddr := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		connCtx, err := handler.GetConnectionContext(r.RemoteAddr, localAddr.String())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if connCtx.Value(contextlabel.TLSConnection) != true || connCtx.Value(contextlabel.ConnectionID) == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})}
+	go func() { _ = server.ServeListener(listener) }()
+	defer func() { _ = server.Close() }()
+
+	client := &http.Client{
+		Transport: &http3.RoundTripper{TLSClientConfig: &tls.Config{ServerName: "example.com", InsecureSkipVerify: true}}, //nolint:gosec
+		Timeout:   10 * time.Second,
+	}
+	defer client.Transport.(*http3.RoundTripper).Close()
+
+	resp, err := client.Get("https://" + addr + "/")
+	td.CmpNoError(err)
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	td.CmpNoError(err)
+	td.Cmp(resp.StatusCode, http.StatusOK)
+	td.Cmp(string(body), "ok")
+
+	td.FailureIsFatal(false)
+	dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err = quic.DialAddr(dialCtx, addr, &tls.Config{
+		ServerName: "example.com", NextProtos: []string{acme.ALPNProto}, InsecureSkipVerify: true, //nolint:gosec
+	}, nil)
+	td.CmpError(err, "tls-alpn-01 over quic")
+
+	for _, serverName := range []string{"passthrough.example.com", "TCP.example.com."} {
+		_, err = quic.DialAddr(dialCtx, addr, &tls.Config{
+			ServerName: serverName, NextProtos: []string{quicNextProto}, InsecureSkipVerify: true, //nolint:gosec
+		}, nil)
+		td.CmpError(err, serverName)
+	}
+}
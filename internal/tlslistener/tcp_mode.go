@@ -0,0 +1,152 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// tcpModeDialTimeout is timeout for connect to target of tcp mode connection.
+const tcpModeDialTimeout = 10 * time.Second
+
+// Directions of copied bytes for tcp mode metrics.
+const (
+	tcpModeDirectionFromClient = "from_client"
+	tcpModeDirectionToClient   = "to_client"
+)
+
+func normalizeServerName(serverName string) string {
+	return strings.TrimSuffix(strings.ToLower(serverName), ".")
+}
+
+// tcpModeTarget return target for tls connection with the SNI. Domain target has priority over listener target.
+// Empty result mean connection must be handled by http server.
+func (p *ListenersHandler) tcpModeTarget(serverName, listenerTarget string) string {
+	if target, ok := p.TCPModeDomains[normalizeServerName(serverName)]; ok {
+		return target
+	}
+	return listenerTarget
+}
+
+// tcpModeConfigForClient return config, which accept application protocols of client as is:
+// connection will not be handled as http and backend know about own protocol.
+func (p *ListenersHandler) tcpModeConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	return p.configForClient(hello, true), nil
+}
+
+// handleTCPModeConnection copy bytes between established tls connection and target until both directions finish.
+// It close the connection after finish.
+func (p *ListenersHandler) handleTCPModeConnection(ctx context.Context, conn *tls.Conn, target string) {
+	logger := zc.L(ctx).With(zap.String("target", target))
+	defer func() {
+		err := conn.Close()
+		log.DebugError(logger, err, "Close tcp mode connection")
+	}()
+
+	if conn.ConnectionState().NegotiatedProtocol == acme.ALPNProto {
+		logger.Debug("Tls-alpn-01 validation connection, skip connect to target")
+		return
+	}
+
+	p.copyToTarget(ctx, conn, target)
+}
+
+// copyToTarget connect to target and copy bytes between conn and target until both directions finish.
+// Bytes count in tcp mode metrics.
+func (p *ListenersHandler) copyToTarget(ctx context.Context, conn net.Conn, target string) {
+	logger := zc.L(ctx).With(zap.String("target", target))
+
+	p.tcpModeStart()
+	dialer := net.Dialer{Timeout: tcpModeDialTimeout}
+	targetConn, err := dialer.DialContext(ctx, "tcp", target)
+	log.InfoError(logger, err, "Connect to tcp mode target")
+	if err != nil {
+		p.tcpModeFinish(err)
+		return
+	}
+	defer func() { _ = targetConn.Close() }()
+
+	var wg sync.WaitGroup
+	var fromClient int64
+	var fromClientErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer log.HandlePanic(logger)
+
+		fromClient, fromClientErr = copyTCPMode(targetConn, conn,
+			p.tcpModeBytes.WithLabelValues(target, tcpModeDirectionFromClient))
+	}()
+
+	toClient, toClientErr := copyTCPMode(conn, targetConn, p.tcpModeBytes.WithLabelValues(target, tcpModeDirectionToClient))
+	wg.Wait()
+
+	err = fromClientErr
+	if err == nil {
+		err = toClientErr
+	}
+	p.tcpModeFinish(err)
+	log.DebugError(logger, err, "Tcp mode connection finished",
+		zap.Int64("from_client_bytes", fromClient), zap.Int64("to_client_bytes", toClient))
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// copyTCPMode copy bytes from src to dst and add copied bytes count to counter.
+// After src EOF it close write side of dst, so other side receive EOF too.
+// On error it expire deadlines of both connections for interrupt copy in other direction.
+func copyTCPMode(dst, src net.Conn, counter prometheus.Counter) (int64, error) {
+	n, err := io.Copy(&countWriter{Writer: dst, counter: counter}, src)
+	if err != nil {
+		now := time.Now()
+		_ = dst.SetDeadline(now)
+		_ = src.SetDeadline(now)
+		return n, err
+	}
+
+	closeWrite(dst)
+	return n, nil
+}
+
+// closeWrite close write side of connection if it or connection wrapped by it support this.
+func closeWrite(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case closeWriter:
+			_ = c.CloseWrite()
+			return
+		case ContextConnextion:
+			conn = c.Conn
+		case *peekedConn:
+			conn = c.Conn
+		case *proxyProtocolConn:
+			conn = c.Conn
+		default:
+			return
+		}
+	}
+}
+
+type countWriter struct {
+	io.Writer
+	counter prometheus.Counter
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,124 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestTCPMode(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	// echo target
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	defer func() { _ = target.Close() }()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}(conn)
+		}
+	}()
+	targetAddr := target.Addr().String()
+
+	tcpModeListener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+
+	handler := &ListenersHandler{
+		GetCertificate:        dummyGetCertificate,
+		ListenersForHandleTLS: []net.Listener{tcpModeListener, httpListener},
+		TCPModeListeners:      map[net.Listener]string{tcpModeListener: targetAddr},
+		TCPModeDomains:        map[string]string{"tcp.example.com": targetAddr},
+	}
+	td.CmpNoError(handler.Start(ctx, nil))
+	defer func() { _ = handler.Close() }()
+
+	echo := func(addr, serverName string, nextProtos []string) (string, error) {
+		//nolint:gosec
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, NextProtos: nextProtos, InsecureSkipVerify: true})
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = conn.Close() }()
+
+		if _, err = conn.Write([]byte("hello")); err != nil {
+			return "", err
+		}
+		if err = conn.CloseWrite(); err != nil {
+			return "", err
+		}
+		res, err := io.ReadAll(conn)
+		return string(res), err
+	}
+
+	res, err := echo(tcpModeListener.Addr().String(), "any.example.com", []string{"mqtt"})
+	td.CmpNoError(err)
+	td.Cmp(res, "hello", "tcp mode listener")
+
+	res, err = echo(httpListener.Addr().String(), "TCP.example.com.", []string{"postgresql"})
+	td.CmpNoError(err)
+	td.Cmp(res, "hello", "tcp mode domain")
+
+	readCounter := func(direction string) float64 {
+		var metric dto.Metric
+		td.CmpNoError(handler.tcpModeBytes.WithLabelValues(targetAddr, direction).Write(&metric))
+		return metric.GetCounter().GetValue()
+	}
+	td.Cmp(readCounter(tcpModeDirectionFromClient), float64(10))
+	td.Cmp(readCounter(tcpModeDirectionToClient), float64(10))
+
+	// other domains handled by http server
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := handler.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	//nolint:gosec
+	conn, err := tls.Dial("tcp", httpListener.Addr().String(), &tls.Config{ServerName: "www.example.com", NextProtos: []string{"http/1.1"}, InsecureSkipVerify: true})
+	td.CmpNoError(err)
+	td.Cmp(conn.ConnectionState().NegotiatedProtocol, "http/1.1")
+	serverConn := <-accepted
+	td.Isa(serverConn, &tls.Conn{})
+	_ = serverConn.Close()
+	_ = conn.Close()
+}
+
+func TestConfig_checkTCPMode(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	c := Config{
+		TLSAddresses:     []string{":443", ":8883"},
+		TCPModeListeners: map[string]string{":8883": "127.0.0.1:1883"},
+		TCPModeDomains:   map[string]string{"db.example.com": "127.0.0.1:5432"},
+	}
+	td.CmpNoError(c.checkTCPMode())
+
+	c.TCPModeListeners = map[string]string{":8884": "127.0.0.1:1883"}
+	td.CmpError(c.checkTCPMode(), "address not in tls addresses")
+
+	c.TCPModeListeners = map[string]string{":8883": "127.0.0.1"}
+	td.CmpError(c.checkTCPMode(), "target without port")
+
+	c.TCPModeListeners = nil
+	c.TCPModeDomains = map[string]string{"db.example.com": "asd"}
+	td.CmpError(c.checkTCPMode())
+}
@@ -3,9 +3,11 @@ package tlslistener
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"github.com/rekby/fastuuid"
 	"net"
+	"reflect"
 	"runtime"
 	"sync"
 
@@ -35,9 +37,37 @@ type ListenersHandler struct {
 
 	NextProtos []string
 
+	// HTTPSRedirectListeners - listeners from Listeners, which connections marked for redirect to https
+	// by contextlabel.HTTPSRedirect.
+	HTTPSRedirectListeners map[net.Listener]bool
+
+	// TCPModeListeners - listeners from ListenersForHandleTLS in tcp mode and target (host:port) for them.
+	// Connections of the listeners terminate TLS and copy plain bytes to the target instead of http handle.
+	TCPModeListeners map[net.Listener]string
+
+	// TCPModeDomains - targets of tcp mode by SNI domain (lower case, without trailing dot) for all TLS listeners.
+	TCPModeDomains map[string]string
+
+	// PassthroughDomains - targets (host:port) by SNI domain (lower case, without trailing dot), which receive
+	// raw TLS stream without termination. It checked before tcp mode and http handle.
+	PassthroughDomains map[string]string
+
+	// ClientAuth - client certificate policy by SNI domain (lower case, without trailing dot).
+	// Key "*.domain" match all subdomains of the domain. Domains without policy doesn't request client certificate.
+	ClientAuth map[string]tls.ClientAuthType
+
+	// ClientCAs - CA certificates for verify client certificates with tls.RequireAndVerifyClientCert policy.
+	ClientCAs *x509.CertPool
+
+	// QUICConns - udp sockets for HTTP/3, use QUICListeners after Start for serve it.
+	QUICConns     []net.PacketConn
+	quicListeners []QUICListener
+
 	ctx           context.Context
 	ctxCancelFunc func()
+	closeOnce     sync.Once
 	tlsConfig     tls.Config
+	tcpModeConfig *tls.Config
 	logger        *zap.Logger
 
 	connListenProxy listenerType
@@ -47,6 +77,10 @@ type ListenersHandler struct {
 
 	connectionHandleStart  metrics.ProcessStartFunc
 	connectionHandleFinish metrics.ProcessFinishFunc
+
+	tcpModeStart  metrics.ProcessStartFunc
+	tcpModeFinish metrics.ProcessFinishFunc
+	tcpModeBytes  *prometheus.CounterVec
 }
 
 type contextInfo struct {
@@ -59,9 +93,28 @@ func (p *ListenersHandler) Accept() (net.Conn, error) {
 	return p.connListenProxy.Accept()
 }
 
+// Close stop accept new connections on all listeners.
+// Already accepted connections doesn't close. Second and next calls do nothing.
 func (p *ListenersHandler) Close() error {
-	p.ctxCancelFunc()
-	return p.connListenProxy.Close()
+	var err error
+	p.closeOnce.Do(func() {
+		p.ctxCancelFunc()
+		for _, listener := range p.ListenersForHandleTLS {
+			_ = listener.Close()
+		}
+		for _, listener := range p.Listeners {
+			_ = listener.Close()
+		}
+		// socket can be shared with new process after upgrade, so old process must stop read it immediately
+		for _, listener := range p.quicListeners {
+			_ = listener.Close()
+		}
+		for _, conn := range p.QUICConns {
+			_ = conn.Close()
+		}
+		err = p.connListenProxy.Close()
+	})
+	return err
 }
 
 func (p *ListenersHandler) Addr() net.Addr {
@@ -74,26 +127,36 @@ func (p *ListenersHandler) Start(ctx context.Context, r prometheus.Registerer) e
 	p.initMetrics(r)
 
 	p.ctx, p.ctxCancelFunc = context.WithCancel(ctx)
+	ctx = p.ctx
 
-	listenerClosed := make(chan struct{})
+	if err := p.startQUIC(); err != nil {
+		p.ctxCancelFunc()
+		return err
+	}
+
+	listenersCount := len(p.ListenersForHandleTLS) + len(p.Listeners)
+	listenerClosed := make(chan struct{}, listenersCount)
 
 	logger := zc.L(ctx)
 	logger.Info("StartAutoRenew handleListeners")
 
 	for _, listenerForTLS := range p.ListenersForHandleTLS {
 		// handlepanic: in handleConnections
-		go handleConnections(ctx, listenerForTLS, p.handleTCPTLSConnection, listenerClosed)
+		go handleConnections(ctx, listenerForTLS, p.tlsConnectionHandler(p.TCPModeListeners[listenerForTLS]), listenerClosed)
 	}
 
 	for _, listener := range p.Listeners {
 		// handlepanic: in handleConnections
-		go handleConnections(ctx, listener, p.handleTCPConnection, listenerClosed)
+		go handleConnections(ctx, listener, p.tcpConnectionHandler(p.HTTPSRedirectListeners[listener]), listenerClosed)
 	}
 
 	go func() {
 		defer log.HandlePanic(logger)
 
-		listenersCount := len(p.ListenersForHandleTLS) + len(p.Listeners)
+		if listenersCount == 0 {
+			// only quic listeners, they closed by Close
+			return
+		}
 		for i := 0; i < listenersCount; i++ {
 			select {
 			case <-ctx.Done():
@@ -144,14 +207,55 @@ func (p *ListenersHandler) init() {
 		NextProtos:     append(nextProtos, acme.ALPNProto),
 		MinVersion:     p.MinTLSVersion,
 	}
+	p.tlsConfig.GetConfigForClient = p.getConfigForClient
+	p.tcpModeConfig = p.tlsConfig.Clone()
+	p.tcpModeConfig.GetConfigForClient = p.tcpModeConfigForClient
 	p.connectionsContext = make(map[string]contextInfo)
 }
 
+// getConfigForClient return specific config for tcp mode domains and domains with client certificate policy.
+func (p *ListenersHandler) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	_, tcpMode := p.TCPModeDomains[normalizeServerName(hello.ServerName)]
+	return p.configForClient(hello, tcpMode), nil
+}
+
+// configForClient return nil if common config is good for the client.
+func (p *ListenersHandler) configForClient(hello *tls.ClientHelloInfo, tcpMode bool) *tls.Config {
+	clientAuth := tls.NoClientCert
+	if !isACMEValidation(hello) {
+		clientAuth = p.clientAuth(hello.ServerName)
+	}
+	if !tcpMode && clientAuth == tls.NoClientCert {
+		return nil
+	}
+
+	config := p.tlsConfig.Clone()
+	config.GetConfigForClient = nil
+	config.ClientAuth = clientAuth
+	config.ClientCAs = p.ClientCAs
+	if tcpMode {
+		config.NextProtos = hello.SupportedProtos
+	}
+	return config
+}
+
 func (p *ListenersHandler) initMetrics(r prometheus.Registerer) {
 	p.connectionHandleStart, p.connectionHandleFinish = metrics.ToefCounters(r, "registered_conn", "Registered tcp connections")
+	p.tcpModeStart, p.tcpModeFinish = metrics.ToefCounters(r, "tcp_mode_conn", "Tcp mode connections to targets")
+
+	p.tcpModeBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcp_mode_bytes",
+		Help: "Bytes, copied between clients and targets of tcp mode",
+	}, []string{"target", "direction"})
+	if r != nil && !reflect.ValueOf(r).IsNil() {
+		// reuse counter of previous handler with same registry
+		if existed, ok := metrics.RegisterOrExisting(r, p.tcpModeBytes); ok {
+			p.tcpModeBytes = existed
+		}
+	}
 }
 
-func (p *ListenersHandler) registerConnection(conn net.Conn, tls bool) ContextConnextion {
+func (p *ListenersHandler) registerConnection(conn net.Conn, tls bool, httpsRedirect bool) ContextConnextion {
 	key := conn.RemoteAddr().String() + "-" + conn.LocalAddr().String()
 
 	p.connectionsContextMu.Lock()
@@ -161,12 +265,7 @@ func (p *ListenersHandler) registerConnection(conn net.Conn, tls bool) ContextCo
 	if exist {
 		p.logger.DPanic("Connection already exist in map", zap.String("key", key))
 	} else {
-		ctxStruct.ctx, ctxStruct.cancelFunc = context.WithCancel(context.Background())
-		connectionUUID := fastuuid.MustUUIDv4String()
-		logger := p.logger.With(zap.String("connection_id", connectionUUID))
-		ctxStruct.ctx = context.WithValue(ctxStruct.ctx, contextlabel.TLSConnection, tls)
-		ctxStruct.ctx = context.WithValue(ctxStruct.ctx, contextlabel.ConnectionID, connectionUUID)
-		ctxStruct.ctx = zc.WithLogger(ctxStruct.ctx, logger)
+		ctxStruct = p.newConnectionContext(conn.RemoteAddr(), conn.LocalAddr(), tls, httpsRedirect)
 		p.connectionsContext[key] = ctxStruct
 	}
 
@@ -194,6 +293,20 @@ func (p *ListenersHandler) registerConnection(conn net.Conn, tls bool) ContextCo
 	return res
 }
 
+func (p *ListenersHandler) newConnectionContext(remoteAddr, localAddr net.Addr, tls bool, httpsRedirect bool) contextInfo {
+	var res contextInfo
+	res.ctx, res.cancelFunc = context.WithCancel(context.Background())
+	connectionUUID := fastuuid.MustUUIDv4String()
+	logger := p.logger.With(zap.String("connection_id", connectionUUID))
+	res.ctx = context.WithValue(res.ctx, contextlabel.TLSConnection, tls)
+	res.ctx = context.WithValue(res.ctx, contextlabel.HTTPSRedirect, httpsRedirect)
+	res.ctx = context.WithValue(res.ctx, contextlabel.ConnectionID, connectionUUID)
+	res.ctx = context.WithValue(res.ctx, contextlabel.RemoteAddr, remoteAddr)
+	res.ctx = context.WithValue(res.ctx, contextlabel.LocalAddr, localAddr)
+	res.ctx = zc.WithLogger(res.ctx, logger)
+	return res
+}
+
 func (p *ListenersHandler) GetConnectionContext(remoteAddr, localAddr string) (context.Context, error) {
 	key := remoteAddr + "-" + localAddr
 
@@ -206,14 +319,27 @@ func (p *ListenersHandler) GetConnectionContext(remoteAddr, localAddr string) (c
 	return nil, errors.New("not found registered connection")
 }
 
-func (p *ListenersHandler) handleTCPConnection(ctx context.Context, conn net.Conn) {
-	contextConn := p.registerConnection(conn, false)
+func (p *ListenersHandler) tcpConnectionHandler(httpsRedirect bool) func(ctx context.Context, conn net.Conn) {
+	return func(ctx context.Context, conn net.Conn) {
+		p.handleTCPConnection(ctx, conn, httpsRedirect)
+	}
+}
+
+// handleTCPConnection put plain connection to http server.
+// httpsRedirect mark the connection for answer redirect to https instead of proxy requests.
+func (p *ListenersHandler) handleTCPConnection(ctx context.Context, conn net.Conn, httpsRedirect bool) {
+	if !readProxyProtocolHeaderOrClose(ctx, conn) {
+		return
+	}
+
+	contextConn := p.registerConnection(conn, false, httpsRedirect)
 	logger := zc.L(contextConn.Context)
 
 	logger.Debug("Accept connection", zap.String("remote_addr", conn.RemoteAddr().String()),
 		zap.String("local_addr", conn.LocalAddr().String()))
 
-	err := p.connListenProxy.Put(contextConn)
+	// pointer, because http server use connection as map key and struct with func fields isn't comparable
+	err := p.connListenProxy.Put(&contextConn)
 	if err != nil {
 		if ctx.Err() != nil {
 			logger.Error("Can't put connection to proxy. Close it.", zap.Error(err))
@@ -222,17 +348,59 @@ func (p *ListenersHandler) handleTCPConnection(ctx context.Context, conn net.Con
 	}
 }
 
-func (p *ListenersHandler) handleTCPTLSConnection(ctx context.Context, conn net.Conn) {
-	contextConn := p.registerConnection(conn, true)
+func (p *ListenersHandler) tlsConnectionHandler(tcpModeTarget string) func(ctx context.Context, conn net.Conn) {
+	return func(ctx context.Context, conn net.Conn) {
+		p.handleTCPTLSConnection(ctx, conn, tcpModeTarget)
+	}
+}
+
+// handleTCPTLSConnection handshake tls and put connection to http server or copy it to tcp mode target.
+// tcpModeTarget is target of listener, empty if the listener isn't in tcp mode.
+func (p *ListenersHandler) handleTCPTLSConnection(ctx context.Context, conn net.Conn, tcpModeTarget string) {
+	if !readProxyProtocolHeaderOrClose(ctx, conn) {
+		return
+	}
+
+	contextConn := p.registerConnection(conn, true, false)
 	logger := zc.L(contextConn.Context)
 
 	logger.Debug("Accept tls connection", zap.String("remote_addr", conn.RemoteAddr().String()),
 		zap.String("local_addr", conn.LocalAddr().String()))
 
-	tlsConn := tls.Server(contextConn, &p.tlsConfig)
+	if len(p.PassthroughDomains) > 0 {
+		serverName, peekedConn, err := peekServerName(conn)
+		if err != nil {
+			log.DebugError(logger, err, "Read client hello")
+			_ = contextConn.Close()
+			return
+		}
+		contextConn.Conn = peekedConn
+
+		if target, ok := p.PassthroughDomains[normalizeServerName(serverName)]; ok {
+			logger.Debug("Passthrough tls connection", zap.String("server_name", serverName),
+				zap.String("target", target))
+			p.handlePassthroughConnection(contextConn.Context, contextConn, target)
+			return
+		}
+	}
+
+	tlsConfig := &p.tlsConfig
+	if tcpModeTarget != "" {
+		tlsConfig = p.tcpModeConfig
+	}
+	tlsConn := tls.Server(contextConn, tlsConfig)
 	err := tlsConn.Handshake()
 	log.DebugInfo(logger, err, "TLS Handshake")
 
+	if target := p.tcpModeTarget(tlsConn.ConnectionState().ServerName, tcpModeTarget); target != "" {
+		if err == nil {
+			p.handleTCPModeConnection(contextConn.Context, tlsConn, target)
+		} else {
+			_ = tlsConn.Close()
+		}
+		return
+	}
+
 	err = p.connListenProxy.Put(tlsConn)
 	if err != nil {
 		if ctx.Err() != nil {
@@ -242,6 +410,26 @@ func (p *ListenersHandler) handleTCPTLSConnection(ctx context.Context, conn net.
 	}
 }
 
+// readProxyProtocolHeaderOrClose read PROXY protocol header if connection has it, before use client address.
+// Close connection and return false if header bad.
+func readProxyProtocolHeaderOrClose(ctx context.Context, conn net.Conn) bool {
+	proxyProtocolConn, ok := conn.(*proxyProtocolConn)
+	if !ok {
+		return true
+	}
+
+	err := proxyProtocolConn.readHeader()
+	if err == nil {
+		return true
+	}
+
+	zc.L(ctx).Info("Can't read PROXY protocol header. Close connection.",
+		zap.String("remote_addr", conn.RemoteAddr().String()),
+		zap.String("local_addr", conn.LocalAddr().String()), zap.Error(err))
+	_ = conn.Close()
+	return false
+}
+
 // listenerType is proxy type - for use already handled connection and send it to http server
 // caller MUST NOT Put any connection after Close() call
 type listenerType struct {
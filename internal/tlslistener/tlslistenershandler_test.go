@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/maxatome/go-testdeep"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/rekby/lets-proxy2/internal/th"
 )
@@ -187,6 +188,54 @@ func TestProxyTLS(t *testing.T) {
 	_ = listenerForTCP2.Close()
 }
 
+func TestListenersHandler_Close(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	td.CmpNoError(err)
+
+	handler := ListenersHandler{
+		Listeners:              []net.Listener{listener},
+		connectionHandleStart:  func() {},
+		connectionHandleFinish: func(err error) {},
+	}
+	td.CmpNoError(handler.Start(ctx, nil))
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := handler.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	td.CmpNoError(err)
+	serverConn := <-accepted
+
+	td.CmpNoError(handler.Close())
+	td.CmpNoError(handler.Close(), "second close must do nothing")
+
+	_, err = handler.Accept()
+	td.CmpError(err)
+
+	_, err = net.Dial("tcp", listener.Addr().String())
+	td.CmpError(err, "listener must not accept connections after close")
+
+	// accepted connections must work after close
+	go func() { _, _ = clientConn.Write([]byte{1}) }()
+	buf := make([]byte, 1)
+	_, err = serverConn.Read(buf)
+	td.CmpNoError(err)
+	td.CmpDeeply(buf, []byte{1})
+
+	_ = clientConn.Close()
+	_ = serverConn.Close()
+}
+
 func dummyGetCertificate(info *tls.ClientHelloInfo) (certificate *tls.Certificate, e error) {
 	key, _ := rsa.GenerateKey(rand.Reader, 2048)
 
@@ -208,6 +257,22 @@ func dummyGetCertificate(info *tls.ClientHelloInfo) (certificate *tls.Certificat
 	return certificate, err
 }
 
+func TestListenersHandler_initMetricsRegisteredTCPModeBytes(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	// registered by previous handler
+	registry := prometheus.NewRegistry()
+	existed := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcp_mode_bytes",
+		Help: "Bytes, copied between clients and targets of tcp mode",
+	}, []string{"target", "direction"})
+	registry.MustRegister(existed)
+
+	p := &ListenersHandler{}
+	td.CmpNotPanic(func() { p.initMetrics(registry) })
+	td.Shallow(p.tcpModeBytes, existed)
+}
+
 func TestParseTLSVersion(t *testing.T) {
 	//goland:noinspection GoBoolExpressions
 	table := []struct {
@@ -0,0 +1,66 @@
+package upgrade
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Environment of systemd socket activation, see sd_listen_fds(3).
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+)
+
+// loadSystemd add sockets, passed by systemd socket activation, to inherited listeners.
+// Sockets go sequentially from fd 3, same as listeners from parent process, but process can't receive both:
+// systemd set LISTEN_PID to pid of started process only.
+func (s *listenersState) loadSystemd() error {
+	pid := os.Getenv(envListenPID)
+	if pid == "" {
+		return nil
+	}
+	fdsCount := os.Getenv(envListenFDs)
+	fdNames := os.Getenv(envListenFDNames)
+	_ = os.Unsetenv(envListenPID)
+	_ = os.Unsetenv(envListenFDs)
+	_ = os.Unsetenv(envListenFDNames)
+
+	if pid != strconv.Itoa(os.Getpid()) {
+		// sockets for other process
+		return nil
+	}
+
+	count, err := strconv.Atoi(fdsCount)
+	if err != nil {
+		return xerrors.Errorf("parse systemd sockets count %q: %w", fdsCount, err)
+	}
+	var names []string
+	if fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	for i := 0; i < count; i++ {
+		index := strconv.Itoa(i)
+		name := index
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(firstInheritedFD+i), NetworkSystemd+":"+name)
+		listener, err := fileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return xerrors.Errorf("restore systemd socket %v: %w", name, err)
+		}
+		s.inherited = append(s.inherited, listenerItem{
+			key:      listenerKey{Network: NetworkSystemd, Address: name},
+			alias:    listenerKey{Network: NetworkSystemd, Address: index},
+			listener: listener,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+// Package upgrade pass listening sockets from running process to new started binary for upgrade without downtime.
+//
+// Old process start new binary with listeners as inherited file descriptors and wait while new process
+// report about ready. After that old process can stop accept connections and drain active requests.
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// EnvListeners contains json list of inherited listeners. Listener file descriptors go sequentially from 3.
+	EnvListeners = "LETS_PROXY_UPGRADE_LISTENERS"
+
+	// EnvReadyFD contains file descriptor number, new process write byte to it after start serve.
+	EnvReadyFD = "LETS_PROXY_UPGRADE_READY_FD"
+
+	firstInheritedFD = 3 // after stdin, stdout, stderr
+
+	// NetworkSystemd - network for Listen sockets, passed by systemd socket activation. Address is name of socket
+	// (FileDescriptorName from socket unit) or its index from 0.
+	NetworkSystemd = "systemd"
+)
+
+var errNotReady = errors.New("new process exited or closed ready pipe before ready")
+
+type listenerKey struct {
+	Network string
+	Address string
+}
+
+type listenerItem struct {
+	key      listenerKey
+	alias    listenerKey // other key of same listener, can be empty
+	listener io.Closer   // net.Listener or net.PacketConn
+}
+
+type listenersState struct {
+	mu sync.Mutex
+
+	loaded    bool
+	inherited []listenerItem
+
+	// active listeners, created by Listen. They pass to new process on upgrade.
+	active []listenerItem
+}
+
+var state listenersState
+
+// Listen return inherited from parent process (or from systemd) listener for the network and address if exist.
+// Else start listen new socket. Address compare with address from parent process as is, without resolve.
+// Listener remember for pass to new process on upgrade.
+// Stale unix socket file removed before listen. Socket file doesn't remove on close, because it can be used
+// by new process after upgrade.
+func Listen(network, address string) (net.Listener, error) {
+	listener, err := listen(listenerKey{Network: network, Address: address}, func() (net.Listener, error) {
+		if network == "unix" {
+			return listenUnix(address)
+		}
+		return net.Listen(network, address)
+	})
+	if unixListener, ok := listener.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+	return listener, err
+}
+
+// ListenPacket same as Listen, but for packet networks, for example udp.
+func ListenPacket(network, address string) (net.PacketConn, error) {
+	return listen(listenerKey{Network: network, Address: address}, func() (net.PacketConn, error) {
+		return net.ListenPacket(network, address)
+	})
+}
+
+func listen[T io.Closer](key listenerKey, newListener func() (T, error)) (T, error) {
+	var res T
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	err := state.load()
+	if err != nil {
+		return res, err
+	}
+
+	if inherited := state.takeInherited(key); inherited != nil {
+		var ok bool
+		if res, ok = inherited.(T); !ok {
+			_ = inherited.Close()
+			return res, xerrors.Errorf("inherited listener %v:%v has unexpected type %T", key.Network, key.Address, inherited)
+		}
+	} else {
+		if key.Network == NetworkSystemd {
+			return res, xerrors.Errorf("systemd socket %q not found", key.Address)
+		}
+		res, err = newListener()
+		if err != nil {
+			return res, err
+		}
+	}
+	state.active = append(state.active, listenerItem{key: key, listener: res})
+	return res, nil
+}
+
+// CloseUnusedInherited close inherited listeners, which didn't take by Listen.
+// It need for not hold sockets, removed from config of new version.
+func CloseUnusedInherited() []string {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	var res []string
+	for _, item := range state.inherited {
+		_ = item.listener.Close()
+		res = append(res, item.key.Network+":"+item.key.Address)
+	}
+	state.inherited = nil
+	return res
+}
+
+// Ready report to parent process about new process ready for serve requests.
+// Do nothing if process started without upgrade.
+func Ready() error {
+	fdString := os.Getenv(EnvReadyFD)
+	if fdString == "" {
+		return nil
+	}
+	_ = os.Unsetenv(EnvReadyFD)
+
+	fd, err := strconv.Atoi(fdString)
+	if err != nil {
+		return xerrors.Errorf("parse ready fd %q: %w", fdString, err)
+	}
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	_, err = f.Write([]byte{1})
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return xerrors.Errorf("write ready byte: %w", err)
+	}
+	return nil
+}
+
+// StartProcess start new process of the binary with same arguments and pass active listeners to it.
+// Wait until new process ready or ctx done. If ctx done - kill new process.
+func StartProcess(ctx context.Context) (*os.Process, error) {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return nil, xerrors.Errorf("find binary path: %w", err)
+	}
+
+	state.mu.Lock()
+	files, keys, err := state.activeFiles()
+	state.mu.Unlock()
+	defer closeFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	keysBytes, err := json.Marshal(keys)
+	if err != nil {
+		return nil, xerrors.Errorf("marshal listeners: %w", err)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, xerrors.Errorf("create ready pipe: %w", err)
+	}
+	defer func() { _ = readyReader.Close() }()
+
+	cmd := exec.Command(path, os.Args[1:]...) //nolint:gosec
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(environWithout(EnvListeners, EnvReadyFD),
+		EnvListeners+"="+string(keysBytes),
+		EnvReadyFD+"="+strconv.Itoa(firstInheritedFD+len(files)),
+	)
+
+	err = cmd.Start()
+	_ = readyWriter.Close()
+	if err != nil {
+		return nil, xerrors.Errorf("start new process: %w", err)
+	}
+
+	readyErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyReader.Read(buf)
+		if err != nil {
+			err = errNotReady
+		}
+		readyErr <- err
+	}()
+
+	select {
+	case err = <-readyErr:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, xerrors.Errorf("wait new process ready: %w", err)
+	}
+
+	// release process resources in background, new process continue work after old exit
+	go func() { _ = cmd.Wait() }()
+	return cmd.Process, nil
+}
+
+func (s *listenersState) load() error {
+	if s.loaded {
+		return nil
+	}
+	s.loaded = true
+
+	err := s.loadSystemd()
+	if err != nil {
+		return err
+	}
+
+	listenersString := os.Getenv(EnvListeners)
+	if listenersString == "" {
+		return nil
+	}
+	_ = os.Unsetenv(EnvListeners)
+
+	var keys []listenerKey
+	err = json.Unmarshal([]byte(listenersString), &keys)
+	if err != nil {
+		return xerrors.Errorf("parse inherited listeners: %w", err)
+	}
+
+	for i, key := range keys {
+		f := os.NewFile(uintptr(firstInheritedFD+i), fmt.Sprintf("%v:%v", key.Network, key.Address))
+		listener, err := fileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return xerrors.Errorf("restore inherited listener %v:%v: %w", key.Network, key.Address, err)
+		}
+		s.inherited = append(s.inherited, listenerItem{key: key, listener: listener})
+	}
+	return nil
+}
+
+// fileListener restore listener or packet connection from file.
+func fileListener(f *os.File) (io.Closer, error) {
+	listener, err := net.FileListener(f)
+	if err == nil {
+		return listener, nil
+	}
+	if packetConn, packetErr := net.FilePacketConn(f); packetErr == nil {
+		return packetConn, nil
+	}
+	return nil, err
+}
+
+// listenUnix remove socket file, if nobody listen it, and start listen.
+func listenUnix(path string) (net.Listener, error) {
+	if stat, err := os.Lstat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			_ = conn.Close()
+			return nil, xerrors.Errorf("unix socket %q already in use", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, xerrors.Errorf("remove stale unix socket %q: %w", path, err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func (s *listenersState) takeInherited(key listenerKey) io.Closer {
+	for i, item := range s.inherited {
+		if item.key == key || item.alias == key {
+			s.inherited = append(s.inherited[:i], s.inherited[i+1:]...)
+			return item.listener
+		}
+	}
+	return nil
+}
+
+func (s *listenersState) activeFiles() (files []*os.File, keys []listenerKey, _ error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+
+	active := make([]listenerItem, 0, len(s.active))
+	for _, item := range s.active {
+		listener, ok := item.listener.(filer)
+		if !ok {
+			return files, nil, xerrors.Errorf("listener %v:%v can't be passed to new process", item.key.Network, item.key.Address)
+		}
+		f, err := listener.File()
+		if errors.Is(err, net.ErrClosed) {
+			// forget closed listener
+			continue
+		}
+		if err != nil {
+			return files, nil, xerrors.Errorf("get file of listener %v:%v: %w", item.key.Network, item.key.Address, err)
+		}
+		active = append(active, item)
+		files = append(files, f)
+		keys = append(keys, item.key)
+	}
+	s.active = active
+	return files, keys, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		_ = f.Close()
+	}
+}
+
+func environWithout(names ...string) []string {
+	env := os.Environ()
+	res := make([]string, 0, len(env))
+
+envLoop:
+	for _, item := range env {
+		for _, name := range names {
+			if len(item) > len(name) && item[:len(name)+1] == name+"=" {
+				continue envLoop
+			}
+		}
+		res = append(res, item)
+	}
+	return res
+}
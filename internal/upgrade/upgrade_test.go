@@ -0,0 +1,280 @@
+package upgrade
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/proxy"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+const (
+	envTestChild     = "LETS_PROXY_UPGRADE_TEST_CHILD"
+	testListenAddres = "127.0.0.1:0"
+
+	testChildExitWithoutReady = "exit-without-ready"
+	testChildSystemd          = "systemd"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envTestChild) != "" {
+		runTestChild()
+		return
+	}
+	th.InitMain(m)
+	os.Exit(m.Run())
+}
+
+// runTestChild is new version of server, started by StartProcess from test.
+func runTestChild() {
+	child := os.Getenv(envTestChild)
+	if child == testChildExitWithoutReady {
+		os.Exit(0)
+	}
+
+	network, address, answer := "tcp", testListenAddres, "new"
+	if child == testChildSystemd {
+		network, address, answer = NetworkSystemd, "web", "systemd"
+	}
+	listener, err := Listen(network, address)
+	if err != nil {
+		panic(err)
+	}
+	server := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(answer))
+	})}
+	go func() { _ = server.Serve(listener) }()
+
+	if child != testChildSystemd {
+		if err = Ready(); err != nil {
+			panic(err)
+		}
+	}
+
+	// parent test kill the process after finish
+	time.Sleep(time.Minute)
+	os.Exit(1)
+}
+
+func TestUpgrade(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	td.FailureIsFatal()
+
+	listener, err := Listen("tcp", testListenAddres)
+	td.CmpNoError(err)
+	addr := listener.Addr().String()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond) // long request for drain
+		_, _ = w.Write([]byte("old"))
+	}))
+	defer backend.Close()
+
+	p := proxy.NewHTTPProxy(ctx, listener)
+	p.Director = proxy.NewDirectorChain(
+		proxy.NewDirectorHost(strings.TrimPrefix(backend.URL, "http://")),
+		proxy.NewSetSchemeDirector(proxy.ProtocolHTTP),
+	)
+	go func() { _ = p.Start() }()
+
+	// client works all time while upgrade
+	var oldAnswers, newAnswers, clientErrors int64
+	clientStop := make(chan struct{})
+	clientStopped := make(chan struct{})
+	go func() {
+		defer close(clientStopped)
+
+		client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		for {
+			select {
+			case <-clientStop:
+				return
+			default:
+			}
+
+			resp, err := client.Get("http://" + addr)
+			if err != nil {
+				t.Log(err)
+				atomic.AddInt64(&clientErrors, 1)
+				continue
+			}
+			body, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			switch {
+			case err != nil:
+				t.Log(err)
+				atomic.AddInt64(&clientErrors, 1)
+			case string(body) == "old":
+				atomic.AddInt64(&oldAnswers, 1)
+			case string(body) == "new":
+				atomic.AddInt64(&newAnswers, 1)
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	t.Setenv(envTestChild, "1")
+	startCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	process, err := StartProcess(startCtx)
+	td.CmpNoError(err)
+	defer func() {
+		_ = process.Kill()
+	}()
+
+	// stop accept connections and drain active requests
+	td.CmpNoError(p.Shutdown(ctx))
+
+	time.Sleep(50 * time.Millisecond)
+	close(clientStop)
+	<-clientStopped
+
+	td.FailureIsFatal(false)
+	td.Cmp(atomic.LoadInt64(&clientErrors), int64(0))
+	td.Gt(atomic.LoadInt64(&oldAnswers), int64(0))
+	td.Gt(atomic.LoadInt64(&newAnswers), int64(0))
+}
+
+func TestStartProcessNotReady(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	t.Setenv(envTestChild, testChildExitWithoutReady)
+	_, err := StartProcess(ctx)
+	td.CmpError(err)
+}
+
+func TestListenInherited(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	s := listenersState{loaded: true}
+	listener, err := net.Listen("tcp", testListenAddres)
+	td.CmpNoError(err)
+	key := listenerKey{Network: "tcp", Address: "inherited"}
+	s.inherited = []listenerItem{{key: key, listener: listener}}
+
+	td.Nil(s.takeInherited(listenerKey{Network: "tcp", Address: "other"}))
+	td.Cmp(s.takeInherited(key), listener)
+	td.Nil(s.takeInherited(key), "listener can be taken once")
+	_ = listener.Close()
+}
+
+func TestListenSystemd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("systemd socket activation work on linux only")
+	}
+
+	td := testdeep.NewT(t)
+	td.FailureIsFatal()
+
+	listener, err := net.Listen("tcp", testListenAddres)
+	td.CmpNoError(err)
+	defer listener.Close()
+	f, err := listener.(*net.TCPListener).File()
+	td.CmpNoError(err)
+	defer f.Close()
+
+	// systemd set LISTEN_PID to pid of started process, shell keep its pid by exec
+	cmd := exec.Command("/bin/sh", "-c", `export `+envListenPID+`=$$; exec "$0" -test.run=^$`, os.Args[0]) //nolint:gosec
+	cmd.Env = append(os.Environ(), envTestChild+"="+testChildSystemd, envListenFDs+"=1", envListenFDNames+"=web")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stderr = os.Stderr
+	td.CmpNoError(cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + listener.Addr().String())
+	td.CmpNoError(err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	td.CmpNoError(err)
+	td.Cmp(string(body), "systemd")
+}
+
+func TestListenSystemdAlias(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	s := listenersState{loaded: true}
+	listener, err := net.Listen("tcp", testListenAddres)
+	td.CmpNoError(err)
+	s.inherited = []listenerItem{{
+		key:      listenerKey{Network: NetworkSystemd, Address: "web"},
+		alias:    listenerKey{Network: NetworkSystemd, Address: "0"},
+		listener: listener,
+	}}
+
+	td.Cmp(s.takeInherited(listenerKey{Network: NetworkSystemd, Address: "0"}), listener)
+	td.Nil(s.takeInherited(listenerKey{Network: NetworkSystemd, Address: "web"}), "listener can be taken once")
+	_ = listener.Close()
+}
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	td := testdeep.NewT(t)
+
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "test.sock")
+	listener, err := Listen("unix", socket)
+	td.CmpNoError(err)
+
+	_, err = Listen("unix", socket)
+	td.CmpError(err, "socket in use")
+
+	_ = listener.Close()
+	_, err = os.Stat(socket)
+	td.CmpNoError(err, "socket file stay for new process after upgrade")
+
+	listener, err = Listen("unix", socket)
+	td.CmpNoError(err, "stale socket removed")
+	_ = listener.Close()
+
+	regularFile := filepath.Join(dir, "file")
+	td.CmpNoError(os.WriteFile(regularFile, nil, 0600))
+	_, err = Listen("unix", regularFile)
+	td.CmpError(err, "regular file doesn't removed")
+
+	_, err = Listen(NetworkSystemd, "not-exist")
+	td.CmpError(err)
+}
+
+func TestListenPacket(t *testing.T) {
+	td := testdeep.NewT(t)
+	td.FailureIsFatal()
+
+	conn, err := ListenPacket("udp", testListenAddres)
+	td.CmpNoError(err)
+	defer conn.Close()
+
+	f, err := conn.(*net.UDPConn).File()
+	td.CmpNoError(err)
+	restored, err := fileListener(f)
+	_ = f.Close()
+	td.CmpNoError(err)
+	defer restored.Close()
+	td.Cmp(restored.(net.PacketConn).LocalAddr().String(), conn.LocalAddr().String(), "packet connection restored from file")
+}